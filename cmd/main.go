@@ -1,11 +1,13 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
 	"tiff2pdf/contracts"
@@ -78,6 +80,223 @@ func validateFlags(args InputFlags) []error {
 		errs = append(errs, fmt.Errorf("CCITT mode must be either 'on', 'off' or 'auto'"))
 	}
 
+	bilevel := strings.ToLower(args.Bilevel)
+	if bilevel != "ccitt" && bilevel != "jbig2" {
+		errs = append(errs, fmt.Errorf("bilevel encoding must be either 'ccitt' or 'jbig2'"))
+	}
+	if bilevel == "jbig2" && fileType == "tiff" {
+		errs = append(errs, fmt.Errorf("bilevel encoding 'jbig2' is supported for PDF output only"))
+	}
+
+	mrcMode := strings.ToLower(args.MRC)
+	if mrcMode != "off" && mrcMode != "on" && mrcMode != "auto" {
+		errs = append(errs, fmt.Errorf("MRC mode must be either 'on', 'off' or 'auto'"))
+	}
+	if mrcMode != "off" && fileType == "tiff" {
+		errs = append(errs, fmt.Errorf("MRC is supported for PDF output only"))
+	}
+
+	compressions := []struct{ name, value string }{
+		{"compression", args.Compression},
+		{"RGB compression", args.RGBCompression},
+		{"gray compression", args.GrayCompression},
+	}
+	for i, c := range compressions {
+		value := strings.ToLower(c.value)
+		if value == "" && i > 0 {
+			continue // per class override not set
+		}
+		if value != "jpeg" && value != "flate" && value != "jpx" {
+			errs = append(errs, fmt.Errorf("%s must be either 'jpeg', 'flate' or 'jpx'", c.name))
+			continue
+		}
+		if value == "jpx" && !converter.JPXAvailable {
+			errs = append(errs, fmt.Errorf("%s 'jpx' requires a build with JPEG 2000 support (-tags jpx)", c.name))
+		}
+		if value == "jpx" && fileType == "tiff" {
+			errs = append(errs, fmt.Errorf("%s 'jpx' is supported for PDF output only", c.name))
+		}
+	}
+	if args.RGBJpxRatio < 0 {
+		errs = append(errs, fmt.Errorf("RGB JPEG 2000 ratio must be 0 (lossless) or positive"))
+	}
+	if args.GrayJpxRatio < 0 {
+		errs = append(errs, fmt.Errorf("gray JPEG 2000 ratio must be 0 (lossless) or positive"))
+	}
+
+	if args.Rotate != 0 && args.Rotate != 90 && args.Rotate != 180 && args.Rotate != 270 {
+		errs = append(errs, fmt.Errorf("rotation must be 0, 90, 180 or 270"))
+	}
+
+	if args.Deskew {
+		if args.DeskewMaxAngle <= 0 || args.DeskewMaxAngle > 45 {
+			errs = append(errs, fmt.Errorf("deskew max angle must be greater than 0 and at most 45 degrees"))
+		}
+		if args.DeskewMinAngle < 0 || args.DeskewMinAngle >= args.DeskewMaxAngle {
+			errs = append(errs, fmt.Errorf("deskew min angle must be between 0 and the max angle"))
+		}
+	}
+
+	autoCrop := strings.ToLower(args.AutoCrop)
+	if autoCrop != "off" && autoCrop != "edges" && autoCrop != "content" {
+		errs = append(errs, fmt.Errorf("auto crop must be either 'off', 'edges' or 'content'"))
+	}
+	cropAction := strings.ToLower(args.CropAction)
+	if cropAction != "crop" && cropAction != "whiten" {
+		errs = append(errs, fmt.Errorf("crop action must be either 'crop' or 'whiten'"))
+	}
+	if args.CropPaddingMM < 0 {
+		errs = append(errs, fmt.Errorf("crop padding must not be negative"))
+	}
+
+	blankMode := strings.ToLower(args.BlankMode)
+	if blankMode != "off" && blankMode != "drop" && blankMode != "flag" && blankMode != "split" {
+		errs = append(errs, fmt.Errorf("blank mode must be either 'off', 'drop', 'flag' or 'split'"))
+	}
+	if (blankMode == "drop" || blankMode == "split") && fileType == "tiff" {
+		errs = append(errs, fmt.Errorf("blank mode '%s' is supported for PDF output only", blankMode))
+	}
+	if args.BlankInkPercent <= 0 || args.BlankInkPercent >= 100 {
+		errs = append(errs, fmt.Errorf("blank ink coverage must be between 0 and 100 percent"))
+	}
+	if args.BlankMarginMM < 0 {
+		errs = append(errs, fmt.Errorf("blank margin must not be negative"))
+	}
+
+	barcodes := false
+	for _, separator := range args.Separators {
+		switch separator {
+		case "patch":
+		case "code39", "code128":
+			barcodes = true
+		default:
+			errs = append(errs, fmt.Errorf("separator must be 'patch', 'code39' or 'code128', got '%s'", separator))
+		}
+	}
+	if len(args.Separators) > 0 && fileType == "tiff" {
+		errs = append(errs, fmt.Errorf("separator sheets are supported for PDF output only"))
+	}
+	if args.SeparatorNames && !barcodes {
+		errs = append(errs, fmt.Errorf("naming PDFs after separators requires -separator code39 or code128"))
+	}
+
+	switch args.Binarization {
+	case "fixed":
+		if args.BinarizeThreshold < 1 || args.BinarizeThreshold > 255 {
+			errs = append(errs, fmt.Errorf("binarization threshold must be between 1 and 255"))
+		}
+	case "sauvola", "niblack":
+		if args.BinarizeWindowMM <= 0 {
+			errs = append(errs, fmt.Errorf("binarization window must be positive"))
+		}
+	case "otsu", "dither":
+	default:
+		errs = append(errs, fmt.Errorf("binarization must be either 'fixed', 'otsu', 'sauvola', 'niblack' or 'dither'"))
+	}
+	if args.BinarizePreFilter != "none" && args.BinarizePreFilter != "median" {
+		errs = append(errs, fmt.Errorf("binarization pre-filter must be either 'none' or 'median'"))
+	}
+	for _, filter := range args.BinarizePostFilters {
+		if filter != "despeckle" && filter != "close" {
+			errs = append(errs, fmt.Errorf("binarization post-filter must be 'despeckle', 'close' or 'none', got '%s'", filter))
+		}
+	}
+
+	class := args.Classification
+	if class.GrayThreshold < 1 || class.GrayThreshold > 255 {
+		errs = append(errs, fmt.Errorf("gray channel difference must be between 1 and 255"))
+	}
+	if class.GrayRatio < 0 || class.GrayRatio > 1 {
+		errs = append(errs, fmt.Errorf("gray ratio must be between 0 and 1"))
+	}
+	if class.LowerThreshold < 0 || class.UpperThreshold > 255 || class.LowerThreshold >= class.UpperThreshold {
+		errs = append(errs, fmt.Errorf("black and white levels must satisfy 0 <= low < high <= 255"))
+	}
+	if class.CCITTThreshold < 0 || class.CCITTThreshold > 100 {
+		errs = append(errs, fmt.Errorf("bilevel ratio must be between 0 and 100 percent"))
+	}
+	if class.ColorThreshold < 1 || class.ColorThreshold > 255 {
+		errs = append(errs, fmt.Errorf("color channel difference must be between 1 and 255"))
+	}
+	if class.ColorAreaMM2 < 0 {
+		errs = append(errs, fmt.Errorf("color area must not be negative"))
+	}
+
+	alpha := strings.ToLower(args.Alpha)
+	if alpha != "flatten" && alpha != "smask" {
+		errs = append(errs, fmt.Errorf("alpha handling must be either 'flatten' or 'smask'"))
+	}
+	if alpha == "smask" && fileType == "tiff" {
+		errs = append(errs, fmt.Errorf("alpha handling 'smask' is supported for PDF output only"))
+	}
+	cmyk := strings.ToLower(args.CMYK)
+	if cmyk != "keep" && cmyk != "rgb" && cmyk != "icc" {
+		errs = append(errs, fmt.Errorf("CMYK handling must be either 'keep', 'rgb' or 'icc'"))
+	}
+	if cmyk == "icc" && !converter.ICCAvailable {
+		errs = append(errs, fmt.Errorf("CMYK handling 'icc' requires a build with LittleCMS (-tags lcms)"))
+	}
+	if args.CMYKProfile != "" {
+		if cmyk != "icc" {
+			errs = append(errs, fmt.Errorf("a CMYK profile requires -cmyk icc"))
+		}
+		if stat, err := os.Stat(args.CMYKProfile); err != nil || stat.IsDir() {
+			errs = append(errs, fmt.Errorf("CMYK profile %s does not exist", args.CMYKProfile))
+		}
+	}
+
+	switch strings.ToLower(args.ResampleFilter) {
+	case "area", "bilinear", "bicubic", "lanczos3", "nearest":
+	default:
+		errs = append(errs, fmt.Errorf("resampling filter must be 'area', 'bilinear', 'bicubic', 'lanczos3' or 'nearest'"))
+	}
+	policy := strings.ToLower(args.ResamplePolicy)
+	if policy != "any" && policy != "downonly" {
+		errs = append(errs, fmt.Errorf("resampling policy must be either 'any' or 'downonly'"))
+	}
+
+	if err := converter.ValidateNameTemplate(args.OutputName, args.NamePattern, true); err != nil {
+		errs = append(errs, err)
+	}
+	if args.TIFFName != "" {
+		if err := converter.ValidateNameTemplate(args.TIFFName, args.NamePattern, false); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	switch strings.ToLower(args.Overwrite) {
+	case converter.OverwriteAlways, converter.OverwriteNever, converter.OverwriteIfNewer:
+	default:
+		errs = append(errs, fmt.Errorf("overwrite policy must be 'always', 'never' or 'if-newer'"))
+	}
+	if args.BackupDir != "" {
+		if args.OutputFileType != "tiff" || args.TIFFMode != "replace" {
+			errs = append(errs, fmt.Errorf("backup directory is used by TIFF replace mode only"))
+		}
+		if stat, err := os.Stat(args.BackupDir); err != nil || !stat.IsDir() {
+			errs = append(errs, fmt.Errorf("backup directory %s does not exist or is not a directory", args.BackupDir))
+		} else if input, err := os.Stat(args.InputRootDir); err == nil && os.SameFile(stat, input) {
+			errs = append(errs, fmt.Errorf("backup directory must not be the input directory"))
+		}
+	}
+	switch strings.ToLower(args.Collision) {
+	case converter.CollisionSkip, converter.CollisionSuffix, converter.CollisionFail, converter.CollisionOverwrite:
+	default:
+		errs = append(errs, fmt.Errorf("collision policy must be 'skip', 'suffix' or 'fail' ('overwrite' is deprecated and means -overwrite always)"))
+	}
+
+	if args.ReportPath != "" {
+		if stat, err := os.Stat(filepath.Dir(args.ReportPath)); err != nil || !stat.IsDir() {
+			errs = append(errs, fmt.Errorf("report directory %s does not exist", filepath.Dir(args.ReportPath)))
+		}
+	}
+
+	for _, mm := range args.FixedCropMM {
+		if mm < 0 {
+			errs = append(errs, fmt.Errorf("fixed crop margins must not be negative"))
+			break
+		}
+	}
+
 	if args.RGBdpi <= 0 {
 		errs = append(errs, fmt.Errorf("RGB DPI must be positive"))
 	}
@@ -98,6 +317,195 @@ func validateFlags(args InputFlags) []error {
 	return errs
 }
 
+// parseCropMM reads "top,right,bottom,left" margins in mm, a single value is used for all edges
+func parseCropMM(value string) ([4]float64, error) {
+	var margins [4]float64
+	parts := strings.Split(value, ",")
+	if len(parts) != 1 && len(parts) != 4 {
+		return margins, fmt.Errorf("expected one value or four values: top,right,bottom,left")
+	}
+	for i, part := range parts {
+		mm, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil || mm < 0 {
+			return margins, fmt.Errorf("invalid margin %q", part)
+		}
+		margins[i] = mm
+	}
+	if len(parts) == 1 {
+		margins = [4]float64{margins[0], margins[0], margins[0], margins[0]}
+	}
+	return margins, nil
+}
+
+// parsePostFilters reads a comma separated list of binarization post-filters;
+// empty keeps the method default and "none" turns them off
+func parsePostFilters(value string) []string {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if value == "" {
+		return nil
+	}
+	filters := []string{}
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part != "" && part != "none" {
+			filters = append(filters, part)
+		}
+	}
+	return filters
+}
+
+// parseSeparators reads a comma separated list of separator codes, "off" for none
+func parseSeparators(value string) []string {
+	var separators []string
+	for _, part := range strings.Split(strings.ToLower(value), ",") {
+		part = strings.TrimSpace(part)
+		if part != "" && part != "off" {
+			separators = append(separators, part)
+		}
+	}
+	return separators
+}
+
+// commandLineSettings describes the flags given on the command line as
+// settings, so they can be applied over config files
+func commandLineSettings(outputs []string, cropMM [4]float64) (*files_manager.Settings, error) {
+	values := make(map[string]any)
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "config", "preset", "print-config", "dry-run", "rollback":
+		case "output":
+			values[f.Name] = outputs
+		case "cropmm":
+			values[f.Name] = cropMM[:]
+		default:
+			if getter, ok := f.Value.(flag.Getter); ok {
+				values[f.Name] = getter.Get()
+			}
+		}
+	})
+	data, err := json.Marshal(values)
+	if err != nil {
+		return nil, err
+	}
+	return files_manager.ParseSettings(data)
+}
+
+// applyConfig layers the config file and the preset over the defaults and
+// the command line flags over both
+func applyConfig(params InputFlags, cli *files_manager.Settings, configPath, preset string) (InputFlags, error) {
+	var cfg *files_manager.Config
+	if configPath != "" {
+		var err error
+		if cfg, err = files_manager.ReadConfig(configPath); err != nil {
+			return params, fmt.Errorf("error reading config: %v", err)
+		}
+		if params, err = cfg.Apply(params); err != nil {
+			return params, fmt.Errorf("config %s: %v", filepath.Base(configPath), err)
+		}
+	}
+	if preset != "" {
+		settings, err := files_manager.Preset(cfg, strings.ToLower(preset))
+		if err != nil {
+			return params, err
+		}
+		if params, err = settings.Apply(params); err != nil {
+			return params, fmt.Errorf("preset %s: %v", preset, err)
+		}
+	}
+	return cli.Apply(params)
+}
+
+// printSettings prints the effective settings as a config file, followed
+// by those of the folders with a folder config
+func printSettings(params InputFlags, cli *files_manager.Settings) {
+	show := func(flags InputFlags) {
+		data, _ := json.MarshalIndent(files_manager.FlagSettings(flags), "", "  ")
+		fmt.Println(string(data))
+	}
+	show(params)
+
+	var folders []TIFFfolder
+	if params.InputRootDir == "" {
+		return
+	}
+	if params.OutputFileType == "tiff" {
+		folderFlags, configPath, err := files_manager.ReadFolderConfig(params.InputRootDir, params, cli)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "- folder config: %v\n", err)
+			return
+		}
+		folders = append(folders, TIFFfolder{Name: filepath.Base(params.InputRootDir), Flags: folderFlags, ConfigPath: configPath})
+	} else {
+		var err error
+		if folders, err = files_manager.GetTIFFFolders(params.InputRootDir, params, cli); err != nil {
+			fmt.Fprintf(os.Stderr, "- %v\n", err)
+			return
+		}
+	}
+	for _, folder := range folders {
+		if folder.Flags != nil {
+			fmt.Printf("\n# folder %s (%s)\n", folder.Name, filepath.Base(folder.ConfigPath))
+			show(*folder.Flags)
+		}
+	}
+}
+
+// validateFolderConfigs checks the flags of folders with a config file by
+// the rules of the command line flags and exits on errors
+func validateFolderConfigs(folders []TIFFfolder) {
+	failed := false
+	for _, folder := range folders {
+		if folder.Flags == nil {
+			continue
+		}
+		fmt.Printf("FOLDER CONFIG: %s (%s)\n", folder.Name, filepath.Base(folder.ConfigPath))
+		for _, err := range validateFlags(*folder.Flags) {
+			fmt.Fprintf(os.Stderr, "- folder %s: %v\n", folder.Name, err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// printPlanErrors prints the output plan errors that stopped a run
+func printPlanErrors(errs []error) {
+	fmt.Fprintln(os.Stderr, "Output plan errors:")
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "- %v\n", err)
+	}
+}
+
+func postFiltersText(filters []string) string {
+	switch {
+	case filters == nil:
+		return "default"
+	case len(filters) == 0:
+		return "none"
+	}
+	return strings.Join(filters, ", ")
+}
+
+func printClassCompression(class, override, common string, jpegQuality, jpxRatio int) {
+	compression := override
+	if compression == "" {
+		compression = common
+	}
+	switch compression {
+	case "flate":
+		fmt.Printf("TARGET %s COMPRESSION: Flate (lossless)\n", class)
+	case "jpx":
+		if jpxRatio == 0 {
+			fmt.Printf("TARGET %s COMPRESSION: JPEG 2000 (lossless)\n", class)
+		} else {
+			fmt.Printf("TARGET %s COMPRESSION: JPEG 2000 (ratio %d:1)\n", class, jpxRatio)
+		}
+	default:
+		fmt.Printf("TARGET %s JPEG Quality:  %d\n", class, jpegQuality)
+	}
+}
+
 func main() {
 
 	inputRootDir := flag.String("input", "", "Input directory containing folders with TIFF files or TIFF files")
@@ -111,28 +519,159 @@ func main() {
 	tiffMode := flag.String("tiffmode", "replace", "TIFF mode: replace, convert, append")
 
 	ccitt_compression := flag.String("ccitt", "off", "CCITT compression: on, off, auto")
+	bilevel := flag.String("bilevel", "ccitt", "Encoding for bilevel pages: ccitt (G4), jbig2 (falls back to G4 on failure)")
+	mrc := flag.String("mrc", "off", "Mixed raster content for color pages with text: on, off, auto")
+	compression := flag.String("compression", "jpeg", "Compression for gray and RGB images: jpeg, flate (lossless), jpx (JPEG 2000)")
+	compressionRGB := flag.String("rgbcomp", "", "Compression for RGB images, overrides -compression: jpeg, flate, jpx")
+	compressionGray := flag.String("grcomp", "", "Compression for grayscale images, overrides -compression: jpeg, flate, jpx")
 
 	dpiRGB := flag.Int("rgbdpi", 300, "DPI fo RGB images")
 	dpiGray := flag.Int("grdpi", 300, "DPI for grayscale images")
 	jpegRGBQuality := flag.Int("rgbq", 100, "JPEG quality (1-100) for RGB images")
 	jpegGrayQuality := flag.Int("grq", 100, "JPEG quality (1-100) for grayscale images")
+	jpxRGBRatio := flag.Int("rgbjpxr", 0, "JPEG 2000 compression ratio for RGB images (0 = lossless)")
+	jpxGrayRatio := flag.Int("grjpxr", 0, "JPEG 2000 compression ratio for grayscale images (0 = lossless)")
+	rotate := flag.Int("rotate", 0, "Rotate all pages clockwise: 0, 90, 180, 270 (per page: "+files_manager.RotationListName+" in the folder)")
+	deskew := flag.Bool("deskew", false, "Straighten skewed scans")
+	deskewMax := flag.Float64("deskewmax", 5, "Largest skew angle (degrees) searched by -deskew")
+	deskewMin := flag.Float64("deskewmin", 0.1, "Skew angle (degrees) below which -deskew leaves the page as is")
+	autoCrop := flag.String("autocrop", "off", "Automatic crop: off, edges (dark scanner borders), content (borders and empty margins)")
+	cropAction := flag.String("cropaction", "crop", "What to do with cropped areas: crop, whiten (keep the page size)")
+	cropPadding := flag.Float64("croppad", 2, "Padding in mm kept around content, or trimmed past dark borders")
+	var cropMM [4]float64
+	flag.Func("cropmm", "Fixed crop in mm from each edge: top,right,bottom,left or one value for all", func(value string) error {
+		margins, err := parseCropMM(value)
+		if err != nil {
+			return err
+		}
+		cropMM = margins
+		return nil
+	})
+	blankMode := flag.String("blank", "off", "Blank pages: off, drop (leave out of the PDF), flag (mark in the report), split (start a new PDF after each)")
+	blankInk := flag.Float64("blankink", 0.02, "Ink coverage in percent below which a page is blank")
+	blankMargin := flag.Float64("blankmargin", 10, "Margin in mm ignored by blank page detection")
+	separators := flag.String("separator", "off", "Separator sheets that split a folder into several PDFs, comma separated: patch (Patch T and II), code39, code128")
+	separatorNames := flag.Bool("separatorname", false, "Name each PDF after the barcode on its separator sheet")
+	binarize := flag.String("binarize", "otsu", "Gray to bilevel conversion for CCITT pages: fixed, otsu, sauvola, niblack (adaptive, for uneven lighting), dither (photos)")
+	binThreshold := flag.Int("binthreshold", 128, "Threshold (1-255) of -binarize fixed")
+	binK := flag.Float64("bink", 0, "Sensitivity k of sauvola/niblack, 0 = default (0.34 sauvola, -0.2 niblack)")
+	binWindow := flag.Float64("binwindow", 4, "Window size in mm of sauvola/niblack")
+	binPre := flag.String("binpre", "none", "Filter before binarization: none, median")
+	binPost := flag.String("binpost", "", "Filters after binarization, comma separated: despeckle, close, none (default close, none for dither)")
+	grayDiff := flag.Int("graydiff", converter.DefaultGrayThreshold, "Max channel difference of a gray pixel")
+	grayRatio := flag.Float64("grayratio", converter.DefaultGrayRatio, "Share (0-1) of gray pixels above which a page is gray")
+	bwLow := flag.Int("bwlow", converter.DefaultLowerThreshold, "Gray levels up to this count as black for CCITT")
+	bwHigh := flag.Int("bwhigh", converter.DefaultUpperThreshold, "Gray levels from this count as white for CCITT")
+	bwRatio := flag.Int("bwratio", converter.DefaultCCITTThreshold, "Percent of black and white pixels that makes a gray page bilevel with -ccitt auto")
+	colorDiff := flag.Int("colordiff", converter.DefaultColorThreshold, "Channel difference of a colored pixel for -colorarea")
+	colorArea := flag.Float64("colorarea", converter.DefaultColorAreaMM2, "Keep pages with a colored region of at least this many mm² RGB (stamps, logos), 0 = off")
+	jpegPass := flag.Bool("jpegpass", true, "Keep the data of JPEG TIFF pages that need no resampling instead of re-encoding them (PDF output)")
+	alpha := flag.String("alpha", "flatten", "Alpha channels: flatten (onto white), smask (keep as PDF soft mask)")
+	cmyk := flag.String("cmyk", "keep", "CMYK pages: keep (CMYK JPEG in PDF), rgb (simple conversion), icc (convert with the ICC profile)")
+	cmykProfile := flag.String("cmykprofile", "", "ICC profile for CMYK pages without an embedded one, with -cmyk icc")
+	resample := flag.String("resample", "area", "Resampling filter: area (box average), bilinear, bicubic, lanczos3 (sharpest), nearest (fastest)")
+	resamplePolicy := flag.String("resamplepolicy", "any", "Resampling policy: any (always the target DPI), downonly (never upsample pages below the target DPI)")
+	reportPath := flag.String("report", "", "Write a JSON report of the processed pages to this file")
+	nameTemplate := flag.String("name", converter.DefaultNameTemplate, "PDF file name template: {folder}, {parent}, {date}, {pages}, {index}, {barcode} and groups of -namepattern like {1}")
+	tiffName := flag.String("tiffname", "", "TIFF file name template: {file}, {folder}, {parent}, {date}, {index} and groups of -namepattern (default {file}, _{file} in append mode)")
+	namePattern := flag.String("namepattern", converter.DefaultNamePattern, "Regular expression matched against the folder name, its groups are name placeholders")
+	overwrite := flag.String("overwrite", converter.OverwriteAlways, "Existing output files: always (replace), never (keep), if-newer (replace when a source TIFF is newer)")
+	collision := flag.String("collision", converter.CollisionSkip, "Existing output files that are not overwritten: skip, suffix (add _2, _3, ...), fail; overwrite is deprecated, use -overwrite always")
+	configPath := flag.String("config", "", "Config file (JSON, or TOML with a .toml extension) with flag values and presets")
+	preset := flag.String("preset", "", "Named settings: archive, email, fax or a preset of the -config file")
+	printConfig := flag.Bool("print-config", false, "Print the effective settings as a config file and exit")
+	backupDir := flag.String("backup", "", "Save the originals of TIFF replace mode to this directory, with a rollback log")
+	rollback := flag.String("rollback", "", "Restore the originals listed in a rollback log of -backup and exit")
+	dryRun := flag.Bool("dry-run", false, "Read the TIFF headers and print the predicted treatment of every page, the output files and size and memory estimates without converting or writing anything")
 	flag.Parse()
 
+	if *rollback != "" {
+		restored, err := converter.Rollback(*rollback)
+		fmt.Printf("Restored %d files from %s\n", restored, *rollback)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "- %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	// for testing
 	// flag.Visit(func(f *flag.Flag) {
 	// 	fmt.Printf("Пойман флаг: %s = %s\n", f.Name, f.Value)
 	// })
 
 	params := InputFlags{
-		InputRootDir:    *inputRootDir,
-		OutputDir:       outputs,
-		OutputFileType:  *fileType,
-		CCITT:           *ccitt_compression,
-		TIFFMode:        *tiffMode,
-		RGBdpi:          *dpiRGB,
-		GrayDpi:         *dpiGray,
-		GrayJpegQuality: *jpegGrayQuality,
-		RGBJpegQuality:  *jpegRGBQuality,
+		InputRootDir:        *inputRootDir,
+		OutputDir:           outputs,
+		OutputFileType:      *fileType,
+		CCITT:               *ccitt_compression,
+		Bilevel:             strings.ToLower(*bilevel),
+		MRC:                 strings.ToLower(*mrc),
+		Compression:         strings.ToLower(*compression),
+		RGBCompression:      strings.ToLower(*compressionRGB),
+		GrayCompression:     strings.ToLower(*compressionGray),
+		TIFFMode:            *tiffMode,
+		RGBdpi:              *dpiRGB,
+		GrayDpi:             *dpiGray,
+		GrayJpegQuality:     *jpegGrayQuality,
+		RGBJpegQuality:      *jpegRGBQuality,
+		RGBJpxRatio:         *jpxRGBRatio,
+		GrayJpxRatio:        *jpxGrayRatio,
+		Rotate:              *rotate,
+		Deskew:              *deskew,
+		DeskewMaxAngle:      *deskewMax,
+		DeskewMinAngle:      *deskewMin,
+		AutoCrop:            strings.ToLower(*autoCrop),
+		CropAction:          strings.ToLower(*cropAction),
+		CropPaddingMM:       *cropPadding,
+		FixedCropMM:         cropMM,
+		BlankMode:           strings.ToLower(*blankMode),
+		BlankInkPercent:     *blankInk,
+		BlankMarginMM:       *blankMargin,
+		Separators:          parseSeparators(*separators),
+		SeparatorNames:      *separatorNames,
+		Binarization:        strings.ToLower(*binarize),
+		BinarizeThreshold:   *binThreshold,
+		BinarizeK:           *binK,
+		BinarizeWindowMM:    *binWindow,
+		BinarizePreFilter:   strings.ToLower(*binPre),
+		BinarizePostFilters: parsePostFilters(*binPost),
+		JPEGPassthrough:     *jpegPass,
+		Alpha:               strings.ToLower(*alpha),
+		CMYK:                strings.ToLower(*cmyk),
+		CMYKProfile:         *cmykProfile,
+		ResampleFilter:      strings.ToLower(*resample),
+		ResamplePolicy:      strings.ToLower(*resamplePolicy),
+		Classification: contracts.ClassifyParameters{
+			GrayThreshold:  *grayDiff,
+			GrayRatio:      *grayRatio,
+			LowerThreshold: *bwLow,
+			UpperThreshold: *bwHigh,
+			CCITTThreshold: *bwRatio,
+			ColorThreshold: *colorDiff,
+			ColorAreaMM2:   *colorArea,
+		},
+		ReportPath:  *reportPath,
+		OutputName:  *nameTemplate,
+		TIFFName:    *tiffName,
+		NamePattern: *namePattern,
+		Overwrite:   strings.ToLower(*overwrite),
+		Collision:   strings.ToLower(*collision),
+		BackupDir:   *backupDir,
+	}
+
+	// command line flags win over the preset and the config file, and over folder configs
+	cli, err := commandLineSettings(outputs, cropMM)
+	if err == nil {
+		params, err = applyConfig(params, cli, *configPath, *preset)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "- %v\n", err)
+		os.Exit(1)
+	}
+	if *printConfig {
+		printSettings(params, cli)
+		os.Exit(0)
 	}
 
 	if errs := validateFlags(params); errs != nil {
@@ -144,14 +683,24 @@ func main() {
 	}
 
 	fmt.Println(string(Yellow), "-------------------", string(Reset))
+	if *configPath != "" {
+		fmt.Println("CONFIG: ", *configPath)
+	}
+	if *preset != "" {
+		fmt.Println("PRESET: ", *preset)
+	}
 	if params.OutputFileType == "pdf" {
+		bilevelName := "CCITTFAXG4"
+		if params.Bilevel == "jbig2" {
+			bilevelName = "JBIG2"
+		}
 		switch params.CCITT {
 		case "on":
-			fmt.Println("TIFFS -> PDF (resampled if needed) with CCITTFAXG4 compression")
+			fmt.Printf("TIFFS -> PDF (resampled if needed) with %s compression\n", bilevelName)
 		case "off":
 			fmt.Println("TIFFS -> PDF (resampled if needed)")
 		case "auto":
-			fmt.Println("TIFFS -> PDF (resampled if needed) with CCITTFAXG4 compression (if possible)")
+			fmt.Printf("TIFFS -> PDF (resampled if needed) with %s compression (if possible)\n", bilevelName)
 		}
 	} else {
 		switch params.CCITT {
@@ -165,6 +714,9 @@ func main() {
 		switch params.TIFFMode {
 		case "replace":
 			fmt.Println("TIFF mode: replace - replace original TIFF files")
+			if params.BackupDir != "" {
+				fmt.Printf("BACKUP: %s (%s)\n", params.BackupDir, converter.RollbackLogName)
+			}
 		case "convert":
 			fmt.Println("TIFF mode: convert - convert original TIFF files to new TIFF files")
 		case "append":
@@ -185,9 +737,72 @@ func main() {
 	} else {
 		fmt.Println("TARGET GRAY DPI: Image original")
 	}
+	if params.ResampleFilter != "area" || params.ResamplePolicy != "any" {
+		fmt.Printf("RESAMPLING: %s, %s\n", params.ResampleFilter, params.ResamplePolicy)
+	}
+	if params.OutputName != converter.DefaultNameTemplate || params.NamePattern != converter.DefaultNamePattern {
+		fmt.Printf("PDF NAMES: %s (folder pattern %s)\n", params.OutputName, params.NamePattern)
+	}
+	if params.TIFFName != "" {
+		fmt.Printf("TIFF NAMES: %s\n", params.TIFFName)
+	}
+	if params.Overwrite != converter.OverwriteAlways && params.Collision != converter.CollisionOverwrite {
+		fmt.Printf("EXISTING FILES: overwrite %s, otherwise %s\n", params.Overwrite, params.Collision)
+	}
+	if params.Rotate != 0 {
+		fmt.Printf("ROTATE: %d degrees clockwise\n", params.Rotate)
+	}
+	if params.Deskew {
+		fmt.Printf("DESKEW: up to %.1f degrees, ignoring less than %.2f\n", params.DeskewMaxAngle, params.DeskewMinAngle)
+	}
+	if params.FixedCropMM != [4]float64{} {
+		fmt.Printf("FIXED CROP (mm): top %.1f, right %.1f, bottom %.1f, left %.1f\n",
+			params.FixedCropMM[0], params.FixedCropMM[1], params.FixedCropMM[2], params.FixedCropMM[3])
+	}
+	if params.AutoCrop != "off" {
+		fmt.Printf("AUTO CROP: %s (%s, padding %.1f mm)\n", params.AutoCrop, params.CropAction, params.CropPaddingMM)
+	}
+	if params.BlankMode != "off" {
+		fmt.Printf("BLANK PAGES: %s (below %.3f%% ink, margin %.1f mm)\n", params.BlankMode, params.BlankInkPercent, params.BlankMarginMM)
+	}
+	if params.CCITT != "off" {
+		fmt.Printf("BINARIZATION: %s (pre-filter %s, post-filters %s)\n", params.Binarization, params.BinarizePreFilter, postFiltersText(params.BinarizePostFilters))
+	}
+	if params.Classification != converter.DefaultClassifyParameters() {
+		c := params.Classification
+		fmt.Printf("CLASSIFICATION: gray diff %d, gray ratio %.2f, black <= %d, white >= %d, bilevel %d%%, color diff %d, color area %.1f mm²\n",
+			c.GrayThreshold, c.GrayRatio, c.LowerThreshold, c.UpperThreshold, c.CCITTThreshold, c.ColorThreshold, c.ColorAreaMM2)
+	}
+	if len(params.Separators) > 0 {
+		fmt.Printf("SEPARATORS: %s\n", strings.Join(params.Separators, ", "))
+		if params.SeparatorNames {
+			fmt.Println("SEPARATOR NAMES: PDFs named after barcodes")
+		}
+	}
+	if params.Alpha == "smask" {
+		fmt.Println("ALPHA: kept as soft mask")
+	}
+	switch params.CMYK {
+	case "keep":
+		if params.OutputFileType == "pdf" {
+			fmt.Println("CMYK: kept as CMYK JPEG")
+		}
+	case "icc":
+		if params.CMYKProfile != "" {
+			fmt.Printf("CMYK: converted with ICC profile (default %s)\n", filepath.Base(params.CMYKProfile))
+		} else {
+			fmt.Println("CMYK: converted with embedded ICC profile")
+		}
+	}
+	switch params.MRC {
+	case "on":
+		fmt.Println("MRC: text mask + background/foreground layers for all RGB pages")
+	case "auto":
+		fmt.Println("MRC: text mask + background/foreground layers for RGB text pages")
+	}
 	if params.CCITT == "off" || params.CCITT == "auto" {
-		fmt.Println("TARGET RGB JPEG Quality: ", params.RGBJpegQuality)
-		fmt.Println("TARGET GRAY JPEG Quality: ", params.GrayJpegQuality)
+		printClassCompression("RGB", params.RGBCompression, params.Compression, params.RGBJpegQuality, params.RGBJpxRatio)
+		printClassCompression("GRAY", params.GrayCompression, params.Compression, params.GrayJpegQuality, params.GrayJpxRatio)
 	}
 	fmt.Println(string(Yellow), "-------------------", string(Reset))
 
@@ -196,11 +811,12 @@ func main() {
 	var request ConversionRequest
 
 	if params.OutputFileType == "pdf" {
-		tifFldrs, err := files_manager.GetTIFFFolders(params.InputRootDir)
+		tifFldrs, err := files_manager.GetTIFFFolders(params.InputRootDir, params, cli)
 		if err != nil {
 			fmt.Printf("Error getting TIFF folders: %v\n", err)
 			os.Exit(1)
 		}
+		validateFolderConfigs(tifFldrs)
 		if len(tifFldrs) == 0 {
 			fmt.Println("No TIFF folders found in the input directory.")
 			os.Exit(0)
@@ -213,22 +829,16 @@ func main() {
 	}
 
 	if params.OutputFileType == "tiff" {
-		tiffs, size, err := files_manager.GetTIFFPaths(params.InputRootDir)
+		tiffFolder, err := files_manager.GetTIFFFolder(params.InputRootDir, params, cli)
 		if err != nil {
 			fmt.Printf("Error getting TIFF files: %v\n", err)
 			os.Exit(1)
 		}
-		if len(tiffs) == 0 {
+		if len(tiffFolder.TiffFilesPaths) == 0 {
 			fmt.Println("No TIFF files found in the input directory.")
 			os.Exit(0)
 		}
-
-		tiffFolder := TIFFfolder{
-			TiffFilesPaths: tiffs,
-			Name:           filepath.Base(params.InputRootDir),
-			Path:           params.InputRootDir,
-			TiffFilesSize:  size,
-		}
+		validateFolderConfigs([]TIFFfolder{tiffFolder})
 
 		request = ConversionRequest{
 			Parameters: params,
@@ -236,6 +846,13 @@ func main() {
 		}
 	}
 
+	if *dryRun {
+		if err := converter.DryRun(request); err != nil {
+			fmt.Fprintf(os.Stderr, "Dry run: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
 
@@ -246,6 +863,10 @@ func main() {
 	}()
 
 	if err := converter.Convert(request); err != nil {
+		if planErr, ok := err.(*converter.PlanError); ok {
+			printPlanErrors(planErr.Errors)
+			os.Exit(1)
+		}
 		fmt.Printf("Error during conversion: %v\n", err)
 		os.Exit(1)
 	}
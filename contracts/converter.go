@@ -13,13 +13,46 @@ type ConvertResult struct {
 	ImgBuffer []byte
 	ImageId   string
 	ImgFormat string
+	Palette   []byte // color table of an indexed image, gray or RGB entries
 	//imgBuffer   io.Reader
-	PixelWidth  int
-	PixelHeight int
+	PixelWidth       int
+	PixelHeight      int
+	BitsPerComponent int
+	DPI              int // resolution of the image pixels
 	// drawWidth   float64
 	// drawHeight  float64
 	//x, y      float64
 	PageIndex int
 	Gray      bool
 	CCITT     bool
+	MRC       *MRCLayers // set when ImgBuffer is the background of a layered page
+	// CCITT decode parameters of passed through data, nil means plain G4
+	CCITTParams *CCITTParams
+	Rotate      int    // clockwise page /Rotate for data kept in stored order
+	Mirror      bool   // image is drawn mirrored left-right (applied before Rotate)
+	CMYK        bool   // ImgBuffer is a CMYK JPEG with Adobe inverted samples
+	SMask       []byte // Flate alpha plane with PNG predictors, drawn as /SMask; nil if opaque
+	ICCProfile  []byte // source ICC profile of the image colors, written as a shared /ICCBased space
+	Report      PageReport
+}
+
+// CCITTParams describes CCITT data as the PDF CCITTFaxDecode filter expects it
+type CCITTParams struct {
+	K                int // -1 G4, 0 G3 1D, > 0 G3 2D
+	EncodedByteAlign bool
+	EndOfLine        bool
+	BlackIs1         bool // set for MinIsBlack sources
+}
+
+// MRCLayers holds the mixed raster content layers of a color page.
+// The page size is the mask size; background and foreground are JPEGs
+// at a lower resolution that get scaled to the page.
+type MRCLayers struct {
+	Mask       []byte // text mask, 1 = text, CCITT G4 or JBIG2
+	MaskFormat string
+	Foreground []byte // text colors, painted through the mask
+	FgWidth    int
+	FgHeight   int
+	BgWidth    int
+	BgHeight   int
 }
@@ -12,6 +12,9 @@ type TIFFfolder struct {
 	Name           string
 	Path           string
 	TiffFilesSize  int64
+	Rotations      map[string]int // extra clockwise rotation by file name, from the folder rotation list
+	Flags          *InputFlags    // run flags with the folder config applied, nil without a config
+	ConfigPath     string         // folder config file, empty without one
 }
 
 type ConvertedFolder struct {
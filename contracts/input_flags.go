@@ -1,13 +1,74 @@
 package contracts
 
+// ClassifyParameters are the thresholds that decide whether a page is RGB, gray or bilevel
+type ClassifyParameters struct {
+	GrayThreshold  int     // max channel difference of a gray pixel
+	GrayRatio      float64 // share of gray pixels that makes a page gray
+	LowerThreshold int     // darker gray levels count as black
+	UpperThreshold int     // lighter gray levels count as white
+	CCITTThreshold int     // percent of black and white pixels that makes a gray page bilevel
+	ColorThreshold int     // channel difference of a colored pixel
+	ColorAreaMM2   float64 // a colored region this large keeps the page RGB, 0 = off
+}
+
+// PDFMetadata is written to the document information dictionary, empty
+// entries are left out
+type PDFMetadata struct {
+	Title    string `json:"title"`
+	Author   string `json:"author"`
+	Subject  string `json:"subject"`
+	Keywords string `json:"keywords"`
+}
+
 type InputFlags struct {
-	OutputDir       []string
-	InputRootDir    string
-	OutputFileType  string
-	CCITT           string
-	TIFFMode        string
-	RGBdpi          int
-	GrayDpi         int
-	GrayJpegQuality int
-	RGBJpegQuality  int
+	OutputDir           []string
+	InputRootDir        string
+	OutputFileType      string
+	CCITT               string
+	Bilevel             string
+	MRC                 string
+	Compression         string
+	RGBCompression      string
+	GrayCompression     string
+	TIFFMode            string
+	RGBdpi              int
+	GrayDpi             int
+	GrayJpegQuality     int
+	RGBJpegQuality      int
+	RGBJpxRatio         int
+	GrayJpxRatio        int
+	Rotate              int
+	Deskew              bool
+	DeskewMaxAngle      float64
+	DeskewMinAngle      float64
+	AutoCrop            string
+	CropAction          string
+	CropPaddingMM       float64
+	FixedCropMM         [4]float64 // top, right, bottom, left
+	BlankMode           string     // off, drop, flag or split
+	BlankInkPercent     float64
+	BlankMarginMM       float64
+	Separators          []string // patch, code39, code128; PDF output only
+	SeparatorNames      bool
+	Binarization        string
+	BinarizeThreshold   int
+	BinarizeK           float64
+	BinarizeWindowMM    float64
+	BinarizePreFilter   string
+	BinarizePostFilters []string // nil = method default
+	Classification      ClassifyParameters
+	JPEGPassthrough     bool
+	Alpha               string // flatten or smask
+	CMYK                string // keep, rgb or icc
+	CMYKProfile         string // ICC profile file for CMYK pages without one
+	ResampleFilter      string // area, bilinear, bicubic, lanczos3 or nearest
+	ResamplePolicy      string // any or downonly
+	OutputName          string // PDF file name template
+	TIFFName            string // TIFF file name template, empty for the TIFF mode default
+	NamePattern         string // regular expression for the folder name, its groups are placeholders
+	Overwrite           string // existing output files: always, never or if-newer
+	BackupDir           string // originals of TIFF replace mode are saved here, with a rollback log
+	Collision           string // existing files that are not overwritten: skip, suffix or fail
+	Metadata            PDFMetadata
+	ReportPath          string // JSON report of the run, not written if empty
 }
@@ -0,0 +1,44 @@
+package contracts
+
+// PageReport records what the converter did with a single page
+type PageReport struct {
+	File      string  `json:"file"`
+	Page      int     `json:"page"`
+	Width     int     `json:"width"`
+	Height    int     `json:"height"`
+	Format    string  `json:"format"`
+	SkewAngle float64 `json:"skew_angle"` // detected skew in degrees, positive is clockwise
+	Deskewed  bool    `json:"deskewed"`
+	CropBox   []int   `json:"crop_box,omitempty"` // kept area x0, y0, x1, y1 in pixels of the uncropped page
+	// ink coverage in percent inside the margins, set when blank detection is on
+	InkCoverage    float64    `json:"ink_coverage"`
+	Blank          bool       `json:"blank"`
+	Passthrough    bool       `json:"passthrough,omitempty"`    // original CCITT or JPEG data kept
+	Classification *PageClass `json:"classification,omitempty"` // set for pages decoded to pixels
+	// gray to bilevel steps, e.g. median+sauvola(0.34)+close, and the global threshold
+	Binarization string `json:"binarization,omitempty"`
+	Threshold    int    `json:"threshold,omitempty"`
+	// separator sheet code (patch-t, patch-2, code39, code128) and barcode value
+	Separator      string `json:"separator,omitempty"`
+	SeparatorValue string `json:"separator_value,omitempty"`
+	// sample conversions of 16-bit, Lab, CMYK and alpha pages, e.g. 16bit+cmyk:icc
+	ColorConversion string `json:"color_conversion,omitempty"`
+}
+
+// PageClass is the RGB/gray/bilevel decision of a decoded page and the statistics behind it
+type PageClass struct {
+	Class          string  `json:"class"`           // rgb, gray, bilevel, cmyk or palette
+	GrayPercent    float64 `json:"gray_percent"`    // pixels with nearly equal channels
+	BilevelPercent float64 `json:"bilevel_percent"` // near black or white pixels, measured on gray pages
+	ColorAreaMM2   float64 `json:"color_area_mm2"`  // largest colored region, measured when the area rule decides
+}
+
+type FolderReport struct {
+	Folder string       `json:"folder"`
+	Pages  []PageReport `json:"pages"`
+	Error  string       `json:"error,omitempty"` // why the folder failed
+}
+
+type RunReport struct {
+	Folders []FolderReport `json:"folders"`
+}
@@ -0,0 +1,231 @@
+package converter
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RollbackLogName is the log of replaced files in the backup directory, one
+// JSON object per line
+const RollbackLogName = "tiff2pdf-rollback.jsonl"
+
+// RollbackEntry is a replaced file: Original was saved as Backup and the
+// converted page written as Output. A file that was at Output before, under
+// another name than Original, was saved as OutputBackup.
+type RollbackEntry struct {
+	Time         time.Time `json:"time"`
+	Original     string    `json:"original"`
+	Backup       string    `json:"backup"`
+	Output       string    `json:"output"`
+	OutputBackup string    `json:"output_backup,omitempty"`
+}
+
+// backupDir keeps the originals of replace mode and logs every replaced file
+type backupDir struct {
+	mu  sync.Mutex
+	dir string
+	log *os.File
+}
+
+func openBackupDir(dir string) (*backupDir, error) {
+	log, err := os.OpenFile(filepath.Join(dir, RollbackLogName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening rollback log: %v", err)
+	}
+	return &backupDir{dir: dir, log: log}, nil
+}
+
+func (b *backupDir) close() error {
+	return b.log.Close()
+}
+
+// save links or copies original into the backup directory, numbering the
+// name if an earlier run left a file with it
+func (b *backupDir) save(original string) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	base := filepath.Base(original)
+	ext := filepath.Ext(base)
+	path := filepath.Join(b.dir, base)
+	for n := 2; ; n++ {
+		if _, err := os.Lstat(path); os.IsNotExist(err) {
+			break
+		}
+		path = filepath.Join(b.dir, fmt.Sprintf("%s_%d%s", strings.TrimSuffix(base, ext), n, ext))
+	}
+	if err := os.Link(original, path); err == nil {
+		return path, nil
+	}
+	// another file system
+	if err := copyFile(original, path); err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	return path, nil
+}
+
+// record appends an entry to the rollback log and syncs it
+func (b *backupDir) record(entry RollbackEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, err := b.log.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("error writing rollback log: %v", err)
+	}
+	return b.log.Sync()
+}
+
+// copyFile copies src to a new file dst with its modification time and
+// syncs it
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+// syncDir makes renames and removals in dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// replaceOriginal puts the verified TMP file in place of original. The
+// original, and an existing file at an output with another name, are saved
+// to the backup directory first, then tmp is renamed over output, which is
+// atomic, and an original with another name is removed last. Until the
+// rename the original is untouched.
+func replaceOriginal(original, tmp, output string, backup *backupDir) error {
+	var backupPath, outputBackup string
+	if backup != nil {
+		path, err := backup.save(original)
+		if err != nil {
+			os.Remove(tmp)
+			return fmt.Errorf("error saving backup of %s, the original is kept: %v", filepath.Base(original), err)
+		}
+		backupPath = path
+		if _, err := os.Lstat(output); err == nil && output != original {
+			path, err := backup.save(output)
+			if err != nil {
+				os.Remove(tmp)
+				return fmt.Errorf("error saving backup of %s, the original is kept: %v", filepath.Base(output), err)
+			}
+			outputBackup = path
+		}
+	}
+	if err := os.Rename(tmp, output); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to rename file, the original is kept: %v", err)
+	}
+	if output != original {
+		if err := os.Remove(original); err != nil {
+			return fmt.Errorf("error removing original %s: %v", filepath.Base(original), err)
+		}
+	}
+	if err := syncDir(filepath.Dir(output)); err != nil {
+		return fmt.Errorf("error syncing directory %s: %v", filepath.Dir(output), err)
+	}
+	if backup == nil {
+		return nil
+	}
+	return backup.record(RollbackEntry{Time: time.Now(), Original: original, Backup: backupPath, Output: output, OutputBackup: outputBackup})
+}
+
+// Rollback restores the originals of a rollback log, newest entry first, so
+// files replaced by several runs get their first version back. Outputs with
+// another name than their original are removed, or restored when a file was
+// there before. It returns the number of restored files.
+func Rollback(logPath string) (int, error) {
+	f, err := os.Open(logPath)
+	if err != nil {
+		return 0, fmt.Errorf("error opening rollback log: %v", err)
+	}
+	var entries []RollbackEntry
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var entry RollbackEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			f.Close()
+			return 0, fmt.Errorf("rollback log line %d: %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	f.Close()
+	if err := scanner.Err(); err != nil {
+		return 0, fmt.Errorf("error reading rollback log: %v", err)
+	}
+
+	restored := 0
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		if err := restoreFile(entry.Backup, entry.Original); err != nil {
+			return restored, err
+		}
+		switch {
+		case entry.Output == entry.Original:
+		case entry.OutputBackup != "":
+			if err := restoreFile(entry.OutputBackup, entry.Output); err != nil {
+				return restored, err
+			}
+		default:
+			if err := os.Remove(entry.Output); err != nil && !os.IsNotExist(err) {
+				return restored, fmt.Errorf("error removing %s: %v", entry.Output, err)
+			}
+		}
+		restored++
+	}
+	return restored, nil
+}
+
+// restoreFile copies backup over path through a TMP file
+func restoreFile(backup, path string) error {
+	tmp := path + ".restore"
+	if err := copyFile(backup, tmp); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("error restoring %s: %v", path, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("error restoring %s: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package converter
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkFiles compares the files of dir with want, name to content
+func checkFiles(t *testing.T, dir string, want map[string]string) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]string)
+	for _, e := range entries {
+		data, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[e.Name()] = string(data)
+	}
+	if len(got) != len(want) {
+		t.Errorf("%s holds %v, want %v", dir, got, want)
+		return
+	}
+	for name, content := range want {
+		if got[name] != content {
+			t.Errorf("%s holds %v, want %v", dir, got, want)
+			return
+		}
+	}
+}
+
+func openTestBackup(t *testing.T) (*backupDir, string) {
+	t.Helper()
+	dir := t.TempDir()
+	b, err := openBackupDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.close() })
+	return b, dir
+}
+
+func TestReplaceOriginalSameName(t *testing.T) {
+	dir := t.TempDir()
+	b, backups := openTestBackup(t)
+	original := filepath.Join(dir, "a.tif")
+	writeTestFile(t, original, "scan")
+	writeTestFile(t, filepath.Join(dir, "a.tmp"), "converted")
+
+	if err := replaceOriginal(original, filepath.Join(dir, "a.tmp"), original, b); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, dir, map[string]string{"a.tif": "converted"})
+
+	if n, err := Rollback(filepath.Join(backups, RollbackLogName)); err != nil || n != 1 {
+		t.Fatalf("Rollback = %d, %v, want 1 file restored", n, err)
+	}
+	checkFiles(t, dir, map[string]string{"a.tif": "scan"})
+}
+
+func TestReplaceOriginalRenamedOverExistingFile(t *testing.T) {
+	dir := t.TempDir()
+	b, backups := openTestBackup(t)
+	original, output := filepath.Join(dir, "a.tif"), filepath.Join(dir, "._a.tif")
+	writeTestFile(t, original, "scan")
+	writeTestFile(t, output, "resource fork")
+	writeTestFile(t, filepath.Join(dir, "a.tmp"), "converted")
+
+	if err := replaceOriginal(original, filepath.Join(dir, "a.tmp"), output, b); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, dir, map[string]string{"._a.tif": "converted"})
+	checkFiles(t, backups, map[string]string{"a.tif": "scan", "._a.tif": "resource fork", RollbackLogName: readTestFile(t, filepath.Join(backups, RollbackLogName))})
+
+	if n, err := Rollback(filepath.Join(backups, RollbackLogName)); err != nil || n != 1 {
+		t.Fatalf("Rollback = %d, %v, want 1 file restored", n, err)
+	}
+	checkFiles(t, dir, map[string]string{"a.tif": "scan", "._a.tif": "resource fork"})
+}
+
+func TestReplaceOriginalRenamedToNewFile(t *testing.T) {
+	dir := t.TempDir()
+	b, backups := openTestBackup(t)
+	original, output := filepath.Join(dir, "a.tif"), filepath.Join(dir, "a_new.tif")
+	writeTestFile(t, original, "scan")
+	writeTestFile(t, filepath.Join(dir, "a.tmp"), "converted")
+
+	if err := replaceOriginal(original, filepath.Join(dir, "a.tmp"), output, b); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, dir, map[string]string{"a_new.tif": "converted"})
+
+	if _, err := Rollback(filepath.Join(backups, RollbackLogName)); err != nil {
+		t.Fatal(err)
+	}
+	// the output had no file before, so it is removed
+	checkFiles(t, dir, map[string]string{"a.tif": "scan"})
+}
+
+func TestRollbackRestoresTheFirstVersion(t *testing.T) {
+	dir := t.TempDir()
+	b, backups := openTestBackup(t)
+	original := filepath.Join(dir, "a.tif")
+	writeTestFile(t, original, "scan")
+	for _, content := range []string{"first run", "second run"} {
+		writeTestFile(t, filepath.Join(dir, "a.tmp"), content)
+		if err := replaceOriginal(original, filepath.Join(dir, "a.tmp"), original, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkFiles(t, dir, map[string]string{"a.tif": "second run"})
+	// the second backup is numbered
+	if got := readTestFile(t, filepath.Join(backups, "a_2.tif")); got != "first run" {
+		t.Errorf("a_2.tif holds %q, want the first run", got)
+	}
+
+	if n, err := Rollback(filepath.Join(backups, RollbackLogName)); err != nil || n != 2 {
+		t.Fatalf("Rollback = %d, %v, want 2 files restored", n, err)
+	}
+	checkFiles(t, dir, map[string]string{"a.tif": "scan"})
+}
+
+func TestReplaceOriginalWithoutBackup(t *testing.T) {
+	dir := t.TempDir()
+	original := filepath.Join(dir, "a.tif")
+	writeTestFile(t, original, "scan")
+	writeTestFile(t, filepath.Join(dir, "a.tmp"), "converted")
+
+	if err := replaceOriginal(original, filepath.Join(dir, "a.tmp"), filepath.Join(dir, "b.tif"), nil); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, dir, map[string]string{"b.tif": "converted"})
+}
+
+func TestReplaceOriginalKeepsOriginalOnFailure(t *testing.T) {
+	dir := t.TempDir()
+	b, _ := openTestBackup(t)
+	original := filepath.Join(dir, "a.tif")
+	writeTestFile(t, original, "scan")
+	writeTestFile(t, filepath.Join(dir, "a.tmp"), "converted")
+	// a directory at the output cannot be replaced by the rename
+	output := filepath.Join(dir, "out")
+	if err := os.Mkdir(output, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(output, "x"), "")
+
+	if err := replaceOriginal(original, filepath.Join(dir, "a.tmp"), output, b); err == nil {
+		t.Fatal("replaceOriginal over a directory succeeded")
+	}
+	if got := readTestFile(t, original); got != "scan" {
+		t.Errorf("original holds %q after a failed replace", got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a.tmp")); !os.IsNotExist(err) {
+		t.Errorf("TMP file is left after a failed replace: %v", err)
+	}
+}
+
+func TestRollbackBadLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), RollbackLogName)
+	writeTestFile(t, path, "{\"original\": \"a.tif\"}\nnot json\n")
+	if _, err := Rollback(path); err == nil {
+		t.Error("Rollback of a broken log succeeded")
+	}
+}
+
+func readTestFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
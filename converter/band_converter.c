@@ -0,0 +1,384 @@
+#include <stdlib.h>
+#include <string.h>
+#include <math.h>
+#include <tiffio.h>
+
+#include "settings.h"
+#include "converter.h"
+#include "sample_reader.h"
+
+
+// Rows of a TIFF decoded a band at a time in stored order, so a large page
+// never has to fit in memory as a whole raster. Strips and tiles are decoded
+// by libtiff, which also reads tiled and BigTIFF files, or by the sample
+// reader for 16-bit, CMYK, Lab and alpha pages. Strips taller than a band
+// are read row by row in one pass.
+typedef struct {
+    TIFF*         tif;
+    TIFFRGBAImage img;
+    sample_reader sr;
+    bool          samples; // rows come from sr
+    bool          scanlines; // rows of large strips come from TIFFReadScanline
+    uint8_t*      scan;   // undecoded rows of a band with scanlines
+    uint16_t      orientation;
+    uint32_t      width;
+    uint32_t      height;
+    uint32_t      step;   // rows of a strip or a tile
+    uint32_t      band;   // rows decoded at once, whole strips or tiles
+    uint32_t*     rows;   // band plus the rows kept from the band before
+    uint32_t      keep;   // rows that can be kept
+    uint32_t      first;  // stored row in rows[0]
+    uint32_t      count;  // decoded rows in rows
+} band_reader;
+
+static void band_close(band_reader* r)
+{
+    free(r->rows);
+    free(r->scan);
+    if (r->samples) {
+        sample_reader_close(&r->sr);
+    } else {
+        TIFFRGBAImageEnd(&r->img);
+    }
+    TIFFClose(r->tif);
+}
+
+static int band_open(band_reader* r, const tiff_convert_options* options)
+{
+    memset(r, 0, sizeof(*r));
+    r->tif = TIFFOpen(options->path, "r");
+    if (!r->tif) return -1;
+
+    TIFFSetWarningHandler(NULL);
+
+    // there is no soft mask for banded pages
+    tiff_convert_options flat = *options;
+    flat.alpha = ALPHA_FLATTEN;
+    int rc = sample_reader_open(&r->sr, r->tif, &flat);
+    if (rc < 0) {
+        TIFFClose(r->tif);
+        return rc;
+    }
+    if (rc == 1) {
+        r->samples = true;
+        r->orientation = ORIENTATION_TOPLEFT;
+        TIFFGetFieldDefaulted(r->tif, TIFFTAG_ORIENTATION, &r->orientation);
+        r->width = r->sr.width;
+        r->height = r->sr.height;
+    } else {
+        char emsg[1024];
+        if (!TIFFRGBAImageOK(r->tif, emsg) || !TIFFRGBAImageBegin(&r->img, r->tif, 0, emsg)) {
+            TIFFClose(r->tif);
+            return -5;
+        }
+        // stored order like read_raster, the PDF page is turned instead
+        r->img.req_orientation = r->img.orientation;
+        r->orientation = r->img.orientation;
+        r->width = r->img.width;
+        r->height = r->img.height;
+    }
+
+    uint32_t step = 0;
+    if (TIFFIsTiled(r->tif)) {
+        TIFFGetField(r->tif, TIFFTAG_TILELENGTH, &step);
+    } else {
+        TIFFGetFieldDefaulted(r->tif, TIFFTAG_ROWSPERSTRIP, &step);
+    }
+    // libtiff's RGBA reader decodes a strip from its start for every band,
+    // the scanlines of a large strip are decoded once in order instead
+    if (!r->samples && !TIFFIsTiled(r->tif) && step > BAND_ROWS &&
+        r->img.isContig && r->img.photometric != PHOTOMETRIC_YCBCR) {
+        r->scanlines = true;
+        step = BAND_ROWS;
+        r->scan = malloc((size_t)BAND_ROWS * TIFFScanlineSize(r->tif));
+        if (!r->scan) {
+            band_close(r);
+            return -4;
+        }
+    }
+    if (step == 0 || step > r->height) step = BAND_ROWS;
+    r->step = step;
+    r->band = (BAND_ROWS + step - 1) / step * step;
+
+    r->keep = 1;
+    r->rows = malloc(((size_t)r->band + r->keep) * r->width * sizeof(uint32_t));
+    if (!r->rows) {
+        band_close(r);
+        return -4;
+    }
+    return 0;
+}
+
+// Make room for n rows asked for at once
+static int band_reserve(band_reader* r, uint32_t n)
+{
+    if (n <= r->keep + 1) return 0;
+    uint32_t* rows = realloc(r->rows, ((size_t)r->band + n - 1) * r->width * sizeof(uint32_t));
+    if (!rows) return -4;
+    r->rows = rows;
+    r->keep = n - 1;
+    return 0;
+}
+
+// Stored rows y to y+n-1 of a large strip: libtiff goes on decoding from
+// the last row read and starts over only for an earlier one
+static bool band_scanlines(band_reader* r, uint32_t y, uint32_t n, uint32_t* dst)
+{
+    tmsize_t size = TIFFScanlineSize(r->tif);
+    for (uint32_t i = 0; i < n; i++) {
+        if (TIFFReadScanline(r->tif, r->scan + (size_t)i * size, y + i, 0) < 0) return false;
+    }
+    r->img.put.contig(&r->img, dst, 0, y, r->width, n, 0, 0, r->scan);
+    return true;
+}
+
+// Stored rows y to y+n-1, next to each other; n is at most keep + 1. Rows
+// are asked for in ascending order; the rows asked for last are kept when
+// the next band is decoded.
+static const uint32_t* band_rows(band_reader* r, uint32_t y, uint32_t n)
+{
+    if (y >= r->first && y + n <= r->first + r->count) {
+        return r->rows + (size_t)(y - r->first) * r->width;
+    }
+
+    uint32_t keep = 0, next = y - y % r->step;
+    if (r->count > 0 && y >= r->first && y < r->first + r->count) {
+        keep = r->first + r->count - y;
+        memmove(r->rows, r->rows + (size_t)(y - r->first) * r->width, (size_t)keep * r->width * sizeof(uint32_t));
+        next = r->first + r->count;
+    }
+    uint32_t rows = r->height - next < r->band ? r->height - next : r->band;
+
+    uint32_t* dst = r->rows + (size_t)keep * r->width;
+    bool ok;
+    if (r->samples) {
+        ok = sample_reader_rows(&r->sr, next, rows, dst) == 0;
+    } else if (r->scanlines) {
+        ok = band_scanlines(r, next, rows, dst);
+    } else {
+        r->img.row_offset = (int)next;
+        r->img.col_offset = 0;
+        ok = TIFFRGBAImageGet(&r->img, dst, r->width, rows);
+    }
+    if (!ok) {
+        r->count = 0;
+        return NULL;
+    }
+    r->first = next - keep;
+    r->count = rows + keep;
+
+    if (y + n > r->first + r->count && r->first + r->count < r->height) {
+        // y was the last row of an aligned band
+        return band_rows(r, y, n);
+    }
+    return r->rows + (size_t)(y - r->first) * r->width;
+}
+
+// Classify the page from its stored rows like read_pxls_from_raster: gray
+// pixel share, colored region and the black and white share for the report
+static int classify_bands(band_reader* r, const classify_params* params, int dpi,
+                          bool* gray, classify_stats* stats)
+{
+    size_t width = r->width, height = r->height;
+    size_t cw = (width + COLOR_CELL - 1) / COLOR_CELL;
+    size_t ch = (height + COLOR_CELL - 1) / COLOR_CELL;
+    uint8_t* cells = NULL;
+    if (params->color_area_mm2 > 0 && dpi > 0) {
+        cells = calloc(cw * ch, 1);
+    }
+    uint8_t* rgb = malloc(width * 3);
+    if (!rgb) {
+        free(cells);
+        return -6;
+    }
+
+    size_t gr_count = 0, bw_count = 0;
+    for (uint32_t y = 0; y < height; y++) {
+        const uint32_t* row = band_rows(r, y, 1);
+        if (!row) {
+            free(cells);
+            free(rgb);
+            return -5;
+        }
+        for (size_t x = 0; x < width; x++) {
+            uint8_t red = TIFFGetR(row[x]), green = TIFFGetG(row[x]), blue = TIFFGetB(row[x]);
+            rgb[x * 3 + 0] = red;
+            rgb[x * 3 + 1] = green;
+            rgb[x * 3 + 2] = blue;
+            if (abs(red-green) < params->gray_threshold && abs(red-blue) < params->gray_threshold && abs(green-blue) < params->gray_threshold) {
+                gr_count++;
+            }
+            int lum = (red * 77 + green * 150 + blue * 29) >> 8;
+            if (lum <= params->lower_threshold || lum >= params->upper_threshold) {
+                bw_count++;
+            }
+        }
+        if (cells) {
+            count_color_cells(rgb, width, y, 1, params->color_threshold, cells);
+        }
+    }
+    free(rgb);
+
+    size_t npixels = width * height;
+    stats->gray_ratio = (double)gr_count / (double)npixels;
+    stats->bw_ratio = 0;
+    stats->color_area_mm2 = 0;
+    bool is_gray = stats->gray_ratio > params->gray_ratio;
+    if (is_gray && cells) {
+        double mm = 25.4 / dpi;
+        stats->color_area_mm2 = largest_color_cell_region(cells, cw, ch) * mm * mm;
+        if (stats->color_area_mm2 >= params->color_area_mm2) {
+            is_gray = false;
+        }
+    }
+    free(cells);
+
+    *gray = is_gray;
+    if (*gray) {
+        stats->bw_ratio = (double)bw_count / (double)npixels;
+    }
+    return 0;
+}
+
+// Output row y from the stored rows its taps reach, NULL axes copy the
+// stored row y. components is 3 for RGB and 4 for packed CMYK.
+static int resampled_row(band_reader* r, size_t y, const resample_axis* ax, const resample_axis* ay,
+                         float* tmp, int components, uint8_t* rgb)
+{
+    if (!ax) {
+        const uint32_t* row = band_rows(r, (uint32_t)y, 1);
+        if (!row) return -5;
+        for (size_t x = 0; x < r->width; x++) {
+            for (int c = 0; c < components; c++) {
+                rgb[x * components + c] = (row[x] >> (c * 8)) & 0xFF;
+            }
+        }
+        return 0;
+    }
+
+    const uint32_t* rows = band_rows(r, (uint32_t)ay->first[y], (uint32_t)ay->count[y]);
+    if (!rows) return -5;
+    resample_row(ax, ay, y, rows, r->width, components, tmp, rgb);
+    return 0;
+}
+
+// Pages above BANDED_MIN_PIXELS are converted in bands
+bool page_needs_bands(const char* path)
+{
+    TIFF* tif = TIFFOpen(path, "r");
+    if (!tif) return false;
+    uint32_t width = 0, height = 0;
+    TIFFGetField(tif, TIFFTAG_IMAGEWIDTH, &width);
+    TIFFGetField(tif, TIFFTAG_IMAGELENGTH, &height);
+    TIFFClose(tif);
+    return width >= 2 && height >= 2 && (uint64_t)width * height > BANDED_MIN_PIXELS;
+}
+
+// convert_tiff_to_data for large pages without raw output: one pass over the
+// bands classifies the page, a second one resamples the rows and feeds them
+// to the JPEG encoder. Bilevel output would need the whole page, so large
+// pages are never CCITT. Kept CMYK is not classified and goes to a CMYK
+// JPEG. The page stays in stored order.
+int convert_tiff_banded(const tiff_convert_options* options,
+                        unsigned char** outBuf, unsigned long* outSize,
+                        int* ccitt_filter, bool* gray_filter,
+                        size_t* outWidth, size_t* outHeight, int* outDpi,
+                        classify_stats* stats, int* outMirror, int* outRotate,
+                        sample_result* samples)
+{
+    band_reader r;
+    int rc = band_open(&r, options);
+    if (rc != 0) return rc;
+
+    int orig_dpi = get_resolution_dpi(options->path);
+    bool gray = false;
+    bool cmyk = r.samples && (sample_reader_conversions(&r.sr) & SAMPLES_CMYK_KEPT);
+    if (!cmyk) {
+        rc = classify_bands(&r, &options->classify, orig_dpi ? orig_dpi : options->rgb_target_dpi,
+                            &gray, stats);
+    }
+    if (rc != 0) {
+        band_close(&r);
+        return rc;
+    }
+
+    if (orig_dpi == 0) {
+        orig_dpi = gray ? options->gray_target_dpi : options->rgb_target_dpi;
+    }
+    int target_dpi = output_dpi(options, gray ? options->gray_target_dpi : options->rgb_target_dpi, orig_dpi);
+    bool resample = target_dpi != orig_dpi;
+    size_t width = r.width, height = r.height;
+    if (resample) {
+        resampled_size(r.width, r.height, target_dpi, orig_dpi, &width, &height);
+    }
+
+    resample_axis ax = {0}, ay = {0};
+    if (resample) {
+        if (resample_axis_init(&ax, r.width, width, options->filter) != 0 ||
+            resample_axis_init(&ay, r.height, height, options->filter) != 0 ||
+            band_reserve(&r, (uint32_t)ay.taps) != 0) {
+            rc = -4;
+        }
+    }
+    int components = cmyk ? 4 : 3;
+    float* tmp = malloc(r.width * components * sizeof(float));
+    uint8_t* rgb = malloc(width * components);
+    uint8_t* gray_row = malloc(width);
+    if (rc != 0 || !tmp || !rgb || !gray_row) {
+        resample_axis_free(&ax);
+        resample_axis_free(&ay);
+        free(tmp);
+        free(rgb);
+        free(gray_row);
+        band_close(&r);
+        return -4;
+    }
+
+    jpeg_stream* jpeg = jpeg_stream_begin((uint32_t)width, (uint32_t)height,
+                                          gray ? options->gray_quality : options->rgb_quality,
+                                          target_dpi, gray ? 1 : components, outBuf, outSize);
+    if (!jpeg) rc = -6;
+
+    for (size_t y = 0; rc == 0 && y < height; y++) {
+        rc = resampled_row(&r, y, resample ? &ax : NULL, resample ? &ay : NULL, tmp, components, rgb);
+        if (rc != 0) break;
+        if (gray) {
+            for (size_t x = 0; x < width; x++) {
+                gray_row[x] = (rgb[x * 3] * 77 + rgb[x * 3 + 1] * 150 + rgb[x * 3 + 2] * 29) >> 8;
+            }
+        }
+        jpeg_stream_write(jpeg, gray ? gray_row : rgb);
+    }
+    if (jpeg) {
+        jpeg_stream_end(jpeg);
+    }
+
+    uint16_t orientation = r.orientation;
+    if (r.samples) {
+        samples->conversions = sample_reader_conversions(&r.sr);
+        samples->cmyk = cmyk;
+    }
+    resample_axis_free(&ax);
+    resample_axis_free(&ay);
+    free(tmp);
+    free(rgb);
+    free(gray_row);
+    band_close(&r);
+
+    if (rc != 0) {
+        if (jpeg) {
+            free(*outBuf);
+            *outBuf = NULL;
+        }
+        return rc;
+    }
+
+    *outDpi = target_dpi;
+    *ccitt_filter = 0;
+    *gray_filter = gray;
+    *outWidth = width;
+    *outHeight = height;
+
+    orientation_transform(orientation, options->rotate, outMirror, outRotate);
+    return 0;
+}
@@ -0,0 +1,75 @@
+#include <stdlib.h>
+#include <string.h>
+#include <tiffio.h>
+
+#include "converter.h"
+
+
+// Decode a 1-bit TIFF into a packed MSB2LSB buffer with 1 = black
+int read_bilevel_packed(const char*     path,
+                        unsigned char** outBuf,
+                        unsigned long*  outSize,
+                        size_t*         width,
+                        size_t*         height,
+                        int*            orientation)
+{
+    TIFF* tif = TIFFOpen(path, "r");
+    if (!tif) return -1;
+
+    TIFFSetWarningHandler(NULL);
+
+    uint32_t w = 0, h = 0;
+    uint16_t bps = 1, spp = 1, photometric = PHOTOMETRIC_MINISWHITE;
+    TIFFGetField(tif, TIFFTAG_IMAGEWIDTH,  &w);
+    TIFFGetField(tif, TIFFTAG_IMAGELENGTH, &h);
+    TIFFGetFieldDefaulted(tif, TIFFTAG_BITSPERSAMPLE,   &bps);
+    TIFFGetFieldDefaulted(tif, TIFFTAG_SAMPLESPERPIXEL, &spp);
+    TIFFGetField(tif, TIFFTAG_PHOTOMETRIC, &photometric);
+    uint16_t orient = ORIENTATION_TOPLEFT;
+    TIFFGetFieldDefaulted(tif, TIFFTAG_ORIENTATION, &orient);
+    if (w == 0 || h == 0 || bps != 1 || spp != 1) {
+        TIFFClose(tif);
+        return -2;
+    }
+
+    size_t rowBytes = (w + 7) / 8;
+    if ((size_t)TIFFScanlineSize(tif) != rowBytes) {
+        TIFFClose(tif);
+        return -3;
+    }
+    unsigned char* buf = malloc(rowBytes * h);
+    if (!buf) {
+        TIFFClose(tif);
+        return -4;
+    }
+
+    // libtiff undoes FillOrder while decoding
+    for (uint32_t y = 0; y < h; y++) {
+        if (TIFFReadScanline(tif, buf + y * rowBytes, y, 0) < 0) {
+            free(buf);
+            TIFFClose(tif);
+            return -5;
+        }
+    }
+    TIFFClose(tif);
+
+    if (photometric == PHOTOMETRIC_MINISBLACK) {
+        for (size_t i = 0; i < rowBytes * h; i++) {
+            buf[i] = ~buf[i];
+        }
+    }
+    // clear padding bits so they do not show up as black
+    if (w % 8 != 0) {
+        unsigned char mask = (unsigned char)(0xFF << (8 - w % 8));
+        for (uint32_t y = 0; y < h; y++) {
+            buf[y * rowBytes + rowBytes - 1] &= mask;
+        }
+    }
+
+    *outBuf  = buf;
+    *outSize = (unsigned long)(rowBytes * h);
+    *width   = w;
+    *height  = h;
+    *orientation = orient;
+    return 0;
+}
@@ -0,0 +1,161 @@
+package converter
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Gray to bilevel conversion of CCITT-ready pages: optional median pre-filter,
+// a threshold or dither method and optional despeckle/close post-filters.
+
+const (
+	sauvolaDefaultK = 0.34
+	niblackDefaultK = -0.2
+	sauvolaRange    = 128 // dynamic range of the standard deviation
+)
+
+// binarizeGray turns gray pixels into a packed MSB2LSB bilevel page (1 = black)
+// with the configured method and records the steps in the report
+func binarizeGray(gray []byte, width, height, dpi int, convParams ConversionParameters, report *PageReport) []byte {
+	var steps []string
+	if convParams.BinarizePreFilter == "median" {
+		gray = medianFilterLight(gray, width, height)
+		steps = append(steps, "median")
+	}
+
+	method := convParams.Binarization
+	if method == "" {
+		method = "otsu"
+	}
+	var bin []uint8
+	switch method {
+	case "fixed":
+		bin = thresholdGray(gray, uint8(convParams.BinarizeThreshold))
+		report.Threshold = convParams.BinarizeThreshold
+	case "sauvola", "niblack":
+		k := convParams.BinarizeK
+		if k == 0 {
+			k = sauvolaDefaultK
+			if method == "niblack" {
+				k = niblackDefaultK
+			}
+		}
+		radius := max(1, mmToPixels(convParams.BinarizeWindowMM, dpi)/2)
+		bin = adaptiveThreshold(gray, width, height, radius, k, method == "sauvola")
+		method += "(" + strconv.FormatFloat(k, 'g', -1, 64) + ")"
+	case "dither":
+		bin = ditherFloydSteinberg(gray, width, height)
+	default: // otsu
+		thresh := OtsuThreshold(gray)
+		bin = thresholdGray(gray, thresh)
+		report.Threshold = int(thresh)
+	}
+	steps = append(steps, method)
+
+	post := convParams.BinarizePostFilters
+	if post == nil && method != "dither" {
+		post = []string{"close"} // closing was always applied before the option existed
+	}
+	for _, filter := range post {
+		switch filter {
+		case "despeckle":
+			bin = despeckle(bin, width, height)
+			steps = append(steps, filter)
+		case "close":
+			bin = MorphologyClose(bin, width, height)
+			steps = append(steps, filter)
+		}
+	}
+
+	report.Binarization = strings.Join(steps, "+")
+	return packBits(bin, width, height)
+}
+
+// thresholdGray marks pixels darker than thresh as black
+func thresholdGray(gray []byte, thresh uint8) []uint8 {
+	bin := make([]uint8, len(gray))
+	for i, v := range gray {
+		if v < thresh {
+			bin[i] = 1
+		}
+	}
+	return bin
+}
+
+// adaptiveThreshold compares every pixel with a threshold from the mean m and
+// standard deviation s of the window around it: Sauvola m*(1+k*(s/R-1)),
+// Niblack m+k*s. Window sums slide over column sums, so memory stays at one row.
+func adaptiveThreshold(gray []byte, width, height, radius int, k float64, sauvola bool) []uint8 {
+	bin := make([]uint8, width*height)
+	colSum := make([]int, width)
+	colSq := make([]int, width)
+	addRow := func(y, sign int) {
+		for x, v := range gray[y*width : (y+1)*width] {
+			colSum[x] += sign * int(v)
+			colSq[x] += sign * int(v) * int(v)
+		}
+	}
+
+	for y := 0; y <= min(radius, height-1); y++ {
+		addRow(y, 1)
+	}
+	for y := 0; y < height; y++ {
+		if y > 0 {
+			if y+radius < height {
+				addRow(y+radius, 1)
+			}
+			if y-radius-1 >= 0 {
+				addRow(y-radius-1, -1)
+			}
+		}
+		rows := min(y+radius, height-1) - max(y-radius, 0) + 1
+
+		sum, sq := 0, 0
+		for x := 0; x <= min(radius, width-1); x++ {
+			sum += colSum[x]
+			sq += colSq[x]
+		}
+		for x := 0; x < width; x++ {
+			if x > 0 {
+				if x+radius < width {
+					sum += colSum[x+radius]
+					sq += colSq[x+radius]
+				}
+				if x-radius-1 >= 0 {
+					sum -= colSum[x-radius-1]
+					sq -= colSq[x-radius-1]
+				}
+			}
+			n := float64(rows * (min(x+radius, width-1) - max(x-radius, 0) + 1))
+			mean := float64(sum) / n
+			std := math.Sqrt(max(0, float64(sq)/n-mean*mean))
+			var t float64
+			if sauvola {
+				t = mean * (1 + k*(std/sauvolaRange-1))
+			} else {
+				t = mean + k*std
+			}
+			if float64(gray[y*width+x]) < t {
+				bin[y*width+x] = 1
+			}
+		}
+	}
+	return bin
+}
+
+// packBits packs a 0/1 page (1 = black) into MSB2LSB rows
+func packBits(bin []uint8, width, height int) []byte {
+	rowBytes := (width + 7) / 8
+	out := make([]byte, rowBytes*height)
+	for y := 0; y < height; y++ {
+		row := bin[y*width : (y+1)*width]
+		dst := out[y*rowBytes : (y+1)*rowBytes]
+		for x, v := range row {
+			if v == 1 {
+				dst[x>>3] |= 0x80 >> uint(x&7)
+			}
+		}
+	}
+	return out
+}
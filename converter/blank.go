@@ -0,0 +1,66 @@
+package converter
+
+const (
+	// darker than this counts as ink even when Otsu finds a higher threshold,
+	// so paper texture of an empty page is not taken for content
+	blankInkLevel = 160
+	// a dark pixel with fewer dark neighbours is a speck of dust
+	blankMinNeighbours = 2
+)
+
+// blankDetectionEnabled reports whether pages are checked for being blank
+func blankDetectionEnabled(convParams ConversionParameters) bool {
+	return convParams.BlankMode != "" && convParams.BlankMode != "off"
+}
+
+// detectBlank measures the ink coverage (percent) of a gray page at dpi
+// inside the margins and compares it with the blank threshold.
+// The page is binarized like packGrayTo1BitOtsuClose and despeckled first.
+func detectBlank(gray []byte, width, height, dpi int, convParams ConversionParameters) (float64, bool) {
+	thresh := min(OtsuThreshold(gray), blankInkLevel)
+	bin := make([]uint8, width*height)
+	for i, v := range gray {
+		if v <= thresh {
+			bin[i] = 1
+		}
+	}
+	bin = despeckle(MorphologyClose(bin, width, height), width, height)
+
+	margin := mmToPixels(convParams.BlankMarginMM, dpi)
+	x0, y0 := margin, margin
+	x1, y1 := width-margin, height-margin
+	if x1 <= x0 || y1 <= y0 {
+		// margins cover the whole page
+		x0, y0, x1, y1 = 0, 0, width, height
+	}
+
+	ink := 0
+	for y := y0; y < y1; y++ {
+		for _, v := range bin[y*width+x0 : y*width+x1] {
+			ink += int(v)
+		}
+	}
+	coverage := float64(ink) * 100 / float64((x1-x0)*(y1-y0))
+	return coverage, coverage < convParams.BlankInkPercent
+}
+
+// despeckle clears dark pixels with fewer than blankMinNeighbours dark
+// pixels around them
+func despeckle(bin []uint8, w, h int) []uint8 {
+	out := make([]uint8, len(bin))
+	for y := 1; y < h-1; y++ {
+		for x := 1; x < w-1; x++ {
+			idx := y*w + x
+			if bin[idx] == 0 {
+				continue
+			}
+			n := bin[idx-w-1] + bin[idx-w] + bin[idx-w+1] +
+				bin[idx-1] + bin[idx+1] +
+				bin[idx+w-1] + bin[idx+w] + bin[idx+w+1]
+			if n >= blankMinNeighbours {
+				out[idx] = 1
+			}
+		}
+	}
+	return out
+}
@@ -11,24 +11,75 @@ int extract_ccitt_raw(const char*     path,
                     unsigned char** outBuf,
                     unsigned long*  outSize,
                     size_t*         width,
-                    size_t*         height)
+                    size_t*         height,
+                    ccitt_params*   params)
 {
     TIFF* tif = TIFFOpen(path, "r");
     if (!tif) return -1;
 
     // Get width and height
-    size_t w=0, h=0;
+    uint32_t w=0, h=0;
     TIFFGetField(tif, TIFFTAG_IMAGEWIDTH,  &w);
     TIFFGetField(tif, TIFFTAG_IMAGELENGTH, &h);
 
-    // Ensure that it's CCITT-G4
+    // Only G3 and G4 are passed through, modified Huffman is transcoded to G4
     uint16_t comp=0;
     TIFFGetField(tif, TIFFTAG_COMPRESSION, &comp);
-    if (comp != COMPRESSION_CCITTFAX4) {
+    if (comp != COMPRESSION_CCITTFAX4 && comp != COMPRESSION_CCITTFAX3) {
         TIFFClose(tif);
         return -2;
     }
 
+    uint16_t bps = 1, spp = 1, photometric = PHOTOMETRIC_MINISWHITE;
+    TIFFGetFieldDefaulted(tif, TIFFTAG_BITSPERSAMPLE,   &bps);
+    TIFFGetFieldDefaulted(tif, TIFFTAG_SAMPLESPERPIXEL, &spp);
+    TIFFGetField(tif, TIFFTAG_PHOTOMETRIC, &photometric);
+    if (bps != 1 || spp != 1 ||
+        (photometric != PHOTOMETRIC_MINISWHITE && photometric != PHOTOMETRIC_MINISBLACK)) {
+        TIFFClose(tif);
+        return -2;
+    }
+
+    // G4 coding restarts in every strip/tile, so the pieces cannot simply be
+    // concatenated; such files are decoded and re-encoded instead
+    if (TIFFIsTiled(tif) || (comp == COMPRESSION_CCITTFAX4 && TIFFNumberOfStrips(tif) > 1)) {
+        TIFFClose(tif);
+        return -2;
+    }
+
+    params->k = -1;
+    params->encoded_byte_align = 0;
+    params->end_of_line = 0;
+    // CCITT codes "white" runs for sample value 0, which is black for MinIsBlack
+    params->black_is_1 = (photometric == PHOTOMETRIC_MINISBLACK) ? 1 : 0;
+    // the data keeps its stored order, the page turns it upright
+    uint16_t orientation = ORIENTATION_TOPLEFT;
+    TIFFGetFieldDefaulted(tif, TIFFTAG_ORIENTATION, &orientation);
+    params->orientation = orientation;
+    if (comp == COMPRESSION_CCITTFAX3) {
+        uint32_t t4 = 0;
+        TIFFGetField(tif, TIFFTAG_T4OPTIONS, &t4);
+        if (t4 & GROUP3OPT_UNCOMPRESSED) {
+            TIFFClose(tif);
+            return -2;
+        }
+        // any K > 0 works for decoding, every 2D line carries its own tag bit
+        params->k = (t4 & GROUP3OPT_2DENCODING) ? 4 : 0;
+        params->encoded_byte_align = (t4 & GROUP3OPT_FILLBITS) ? 1 : 0;
+        // TIFF G3 data always starts lines with EOL codes
+        params->end_of_line = 1;
+    } else {
+        uint32_t t6 = 0;
+        TIFFGetField(tif, TIFFTAG_T6OPTIONS, &t6);
+        if (t6 & GROUP4OPT_UNCOMPRESSED) {
+            TIFFClose(tif);
+            return -2;
+        }
+    }
+
+    uint16_t fillOrder = FILLORDER_MSB2LSB;
+    TIFFGetField(tif, TIFFTAG_FILLORDER, &fillOrder);
+
     // counting strips
     int nstrips = TIFFNumberOfStrips(tif);
 
@@ -46,16 +97,26 @@ int extract_ccitt_raw(const char*     path,
     }
     toff_t offset = 0;
     for (int i = 0; i < nstrips; i++) {
-        int sz = TIFFRawStripSize(tif, i);
-        TIFFReadRawStrip(tif, i, buf + offset, sz);
+        tmsize_t sz = TIFFReadRawStrip(tif, i, buf + offset, TIFFRawStripSize(tif, i));
+        if (sz < 0) {
+            free(buf);
+            TIFFClose(tif);
+            return -4;
+        }
         offset += sz;
     }
+    total = offset;
 
     TIFFClose(tif);
 
+    // PDF CCITTFaxDecode expects the first pixel in the high-order bit
+    if (fillOrder == FILLORDER_LSB2MSB) {
+        TIFFReverseBits(buf, (tmsize_t)total);
+    }
+
     *outBuf  = buf;
     *outSize = total;
     *width   = w;
     *height  = h;
     return 0;
-}
\ No newline at end of file
+}
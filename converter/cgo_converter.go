@@ -22,6 +22,7 @@ import "C"
 import (
 	"errors"
 	"fmt"
+	"math"
 	"os"
 	"path/filepath"
 	"strings"
@@ -35,15 +36,42 @@ const (
 	CompressionCCITTG4 = C.COMPRESSION_CCITTFAX4
 	CompressionJPEG    = C.COMPRESSION_JPEG
 	CompressionLZW     = C.COMPRESSION_LZW
+	CompressionDeflate = C.COMPRESSION_ADOBE_DEFLATE
+)
+
+// the Go copies of settings.h values must match
+var _ = [1]struct{}{}[bandedMinPixels-C.BANDED_MIN_PIXELS]
+var _ = [1]struct{}{}[bandRows-C.BAND_ROWS]
+
+const (
+	// page classification defaults from settings.h
+	DefaultGrayThreshold  = C.GRAY_THRESHOLD
+	DefaultGrayRatio      = C.GRAY_RATIO
+	DefaultLowerThreshold = C.LOWER_THRESHOLD
+	DefaultUpperThreshold = C.UPPER_THRESHOLD
+	DefaultCCITTThreshold = C.CCITT_THRESHOLD
+	DefaultColorThreshold = C.COLOR_THRESHOLD
+	DefaultColorAreaMM2   = C.COLOR_AREA_MM2
 )
 
 type ImageData struct {
-	Data      []byte
-	CCITT     int
-	Width     int
-	Height    int
-	ActualDpi int
-	Gray      bool
+	Data             []byte
+	Palette          []byte
+	CCITT            int
+	Width            int
+	Height           int
+	ActualDpi        int
+	BitsPerComponent int
+	Gray             bool
+	Format           OutputFormat
+	MRC              *MRCLayers
+	CCITTParams      *CCITTParams // nil for G4 produced by encodeRawCCITTG4
+	Rotate           int          // clockwise page rotation for data kept in stored order
+	Mirror           bool         // data is mirrored left-right before Rotate
+	CMYK             bool         // Data is a CMYK JPEG with Adobe inverted samples
+	SMask            []byte       // Flate compressed alpha plane with PNG predictors, nil if opaque
+	ICCProfile       []byte       // embedded ICC profile of the source that applies to Data, nil if none
+	Report           PageReport   // processing details, file and page are set by the caller
 }
 
 func ConvertTIFF(path string, convParams ConversionParameters) (ImageData, error) {
@@ -55,6 +83,14 @@ func ConvertTIFF(path string, convParams ConversionParameters) (ImageData, error
 		}
 	}()
 
+	// bilevel pages are decoded once for all the checks that need the bits
+	page := &bilevelPage{cPath: cPath}
+	if separatorsEnabled(convParams) {
+		if img, found := readSeparator(page, convParams); found {
+			return img, nil
+		}
+	}
+
 	var outBuf *C.uchar
 	var outSize C.ulong
 	var w, h C.size_t
@@ -73,33 +109,27 @@ func ConvertTIFF(path string, convParams ConversionParameters) (ImageData, error
 
 	comp := C.get_compression_type(cPath)
 	if comp == 2 || comp == 3 || comp == 4 {
-		// CCITT
-		ccitt := 1
-		rc := C.extract_ccitt_raw(
-			cPath,
-			&outBuf, &outSize,
-			&w, &h)
-		if rc != 0 {
-			C.free(unsafe.Pointer(outBuf))
-			return ImageData{}, fmt.Errorf("ExtractCCITTRaw failed with code %d", int(rc))
+		img, err := convertCCITT(page, convParams)
+		if err == nil && blankDetectionEnabled(convParams) && !pageEditsEnabled(convParams) {
+			// passed through data is decoded for the check only
+			err = checkBlankBilevel(page, convParams, &img.Report)
 		}
-		dataSize := int(outSize)
-		data := C.GoBytes(unsafe.Pointer(outBuf), C.int(dataSize))
-		if outBuf != nil {
-			C.free(unsafe.Pointer(outBuf))
+		return img, err
+	}
+	if comp == CompressionJPEG && jpegPassthroughAllowed(convParams) {
+		if img, ok := passJPEG(cPath, convParams); ok {
+			return img, nil
 		}
-		return ImageData{
-			Data:   data,
-			CCITT:  ccitt,
-			Gray:   false,
-			Width:  int(w),
-			Height: int(h),
-		}, nil
 	}
 
-	rawFlag := 0
+	if palettePageAllowed(convParams) {
+		if img, ok := convertPalette(cPath, convParams); ok {
+			return img, nil
+		}
+	}
 
-	if convParams.Raw {
+	rawFlag := 0
+	if decodesRaw(convParams) {
 		rawFlag = 1
 	}
 
@@ -110,15 +140,41 @@ func ConvertTIFF(path string, convParams ConversionParameters) (ImageData, error
 		gray_quality:    C.int(convParams.TargetGrayjpegQuality),
 		rgb_target_dpi:  C.int(convParams.TargetRGBdpi),
 		gray_target_dpi: C.int(convParams.TargetGraydpi),
+		rotate:          C.int(convParams.Rotate),
+		classify:        classifyParams(convParams),
+		alpha:           alphaMode(convParams),
+		cmyk:            cmykMode(convParams, rawFlag),
+		filter:          resampleFilter(convParams.ResampleFilter),
+		downsample_only: C.bool(convParams.DownsampleOnly),
+	}
+	if len(convParams.CMYKProfile) > 0 {
+		profile := C.CBytes(convParams.CMYKProfile)
+		defer C.free(profile)
+		options.cmyk_profile = (*C.uchar)(profile)
+		options.cmyk_profile_size = C.size_t(len(convParams.CMYKProfile))
 	}
 
+	var stats C.classify_stats
+	var mirror, rotate C.int // large pages stay in stored order
+	var samples C.sample_result
 	rc := C.convert_tiff_to_data(
 		&options,
 		&outBuf, &outSize,
 		&use_ccitt,
 		&use_gray,
 		&w, &h, &d,
+		&stats,
+		&mirror, &rotate,
+		&samples,
 	)
+	var alpha []byte
+	if samples.alpha != nil {
+		if rc == 0 {
+			alpha = goBytes(unsafe.Pointer(samples.alpha), int(w*h))
+		}
+		C.free(unsafe.Pointer(samples.alpha))
+	}
+	conversions := sampleConversions(samples.conversions)
 	if rc != 0 {
 		if outBuf != nil {
 			C.free(unsafe.Pointer(outBuf))
@@ -126,17 +182,41 @@ func ConvertTIFF(path string, convParams ConversionParameters) (ImageData, error
 		return ImageData{}, fmt.Errorf("convert_tiff_to_data failed with code %d", int(rc))
 	}
 
+	dpi := int(d) // target resolution, or the page's own below it with DownsampleOnly
 	if use_ccitt == 1 && convParams.CCITT != "off" {
 		dataSize := int(outSize)
-		goGray := C.GoBytes(unsafe.Pointer(outBuf), C.int(dataSize))
+		goGray := goBytes(unsafe.Pointer(outBuf), dataSize)
+		report := PageReport{Classification: pageClass(stats, true, true), ColorConversion: conversions}
+		if rawPixelsNeeded(convParams) {
+			var ew, eh int
+			goGray, ew, eh = editPage(goGray, int(w), int(h), 1, dpi, convParams, &report)
+			w, h = C.size_t(ew), C.size_t(eh)
+		}
 
-		// filtered := medianFilterLight(goGray, int(w), int(h))
-		// filtered := medianFilterLight(goGray, int(w), int(h))
-		//packed := packGrayTo1BitDither(goGray, int(w), int(h))
-		packed := packGrayTo1BitOtsuClose(goGray, int(w), int(h))
+		packed := binarizeGray(goGray, int(w), int(h), dpi, convParams, &report)
 
 		C.free(unsafe.Pointer(outBuf)) // Освобождаем оригинальный буфер
 
+		if convParams.Bilevel == "jbig2" && !convParams.Raw {
+			jbig2Data, jbig2Err := encodeJBIG2Generic(packed, int(w), int(h), dpi)
+			if jbig2Err == nil {
+				return ImageData{
+					Data:             jbig2Data,
+					CCITT:            int(use_ccitt),
+					Gray:             bool(use_gray),
+					Width:            int(w),
+					Height:           int(h),
+					ActualDpi:        dpi,
+					BitsPerComponent: 1,
+					Format:           jbig2Format,
+					Rotate:           int(rotate),
+					Mirror:           mirror != 0,
+					Report:           report,
+				}, nil
+			}
+			fmt.Printf("JBIG2 encode failed for %s, falling back to CCITT G4: %v\n", filepath.Base(path), jbig2Err)
+		}
+
 		ccittData, encodeErr := encodeRawCCITTG4(packed, int(w), int(h))
 		if encodeErr != nil {
 			return ImageData{}, fmt.Errorf("ccittg4 encode failed: %v", encodeErr)
@@ -148,34 +228,660 @@ func ConvertTIFF(path string, convParams ConversionParameters) (ImageData, error
 			Gray:      bool(use_gray),
 			Width:     int(w),
 			Height:    int(h),
-			ActualDpi: convParams.TargetGraydpi,
+			ActualDpi: dpi,
+			Format:    ccittFormat,
+			Rotate:    int(rotate),
+			Mirror:    mirror != 0,
+			Report:    report,
 		}, nil
 	}
 	dataSize := int(outSize)
-	data := C.GoBytes(unsafe.Pointer(outBuf), C.int(dataSize))
+	data := goBytes(unsafe.Pointer(outBuf), dataSize)
 
 	if outBuf != nil {
 		C.free(unsafe.Pointer(outBuf))
 	}
 
-	var actDPI int = 0
+	if samples.cmyk {
+		return ImageData{
+			Data:             data,
+			Width:            int(w),
+			Height:           int(h),
+			ActualDpi:        dpi,
+			BitsPerComponent: 8,
+			Format:           jpgFormat,
+			Rotate:           int(rotate),
+			Mirror:           mirror != 0,
+			CMYK:             true,
+			Report:           PageReport{Classification: &PageClass{Class: "cmyk"}, ColorConversion: conversions},
+		}, nil
+	}
+
+	actDPI := dpi
+
+	img := ImageData{
+		Data:             data,
+		CCITT:            int(use_ccitt),
+		Gray:             bool(use_gray),
+		Width:            int(w),
+		Height:           int(h),
+		ActualDpi:        actDPI,
+		BitsPerComponent: 8,
+		Format:           jpgFormat,
+		Rotate:           int(rotate),
+		Mirror:           mirror != 0,
+		Report:           PageReport{Classification: pageClass(stats, false, bool(use_gray)), ColorConversion: conversions},
+	}
+	if alpha != nil {
+		smask, encodeErr := encodeSMask(alpha, int(w), int(h))
+		if encodeErr != nil {
+			return ImageData{}, fmt.Errorf("soft mask encode failed: %v", encodeErr)
+		}
+		img.SMask = smask
+	}
+	if rawPixelsNeeded(convParams) {
+		components := 3
+		if use_gray {
+			components = 1
+		}
+		data, img.Width, img.Height = editPage(data, int(w), int(h), components, actDPI, convParams, &img.Report)
+		w, h = C.size_t(img.Width), C.size_t(img.Height)
+		img.Data = data
+	}
+	if convParams.Raw || rawFlag == 0 {
+		return img, nil
+	}
+
+	if !use_gray && convParams.MRC != "" && convParams.MRC != "off" {
+		layers, background, ok, mrcErr := buildMRCLayers(data, int(w), int(h), actDPI, convParams)
+		if mrcErr != nil {
+			return ImageData{}, fmt.Errorf("mrc failed: %v", mrcErr)
+		}
+		if ok {
+			img.Data = background
+			img.MRC = layers
+			return img, nil
+		}
+	}
+
+	compression := convParams.RGBCompression
+	jpegQuality := convParams.TargetRGBjpegQuality
+	jpxRatio := convParams.TargetRGBjpxRatio
 	if use_gray {
-		actDPI = convParams.TargetGraydpi
-	} else {
-		actDPI = convParams.TargetRGBdpi
+		compression = convParams.GrayCompression
+		jpegQuality = convParams.TargetGrayjpegQuality
+		jpxRatio = convParams.TargetGrayjpxRatio
+	}
+
+	switch compression {
+	case "flate":
+		components := 3
+		if use_gray {
+			components = 1
+		}
+		flateImg, encodeErr := encodeFlate(data, int(w), int(h), components)
+		if encodeErr != nil {
+			return ImageData{}, fmt.Errorf("flate encode failed: %v", encodeErr)
+		}
+		img.Data = flateImg.Data
+		img.Palette = flateImg.Palette
+		img.BitsPerComponent = flateImg.BitsPerComponent
+		img.Format = pngFormat
+	case "jpx":
+		jpxData, encodeErr := encodeJPX(data, int(w), int(h), bool(use_gray), jpxRatio)
+		if encodeErr != nil {
+			return ImageData{}, fmt.Errorf("jpx encode failed: %v", encodeErr)
+		}
+		img.Data = jpxData
+		img.Format = jpxFormat
+	default:
+		// raw pixels were requested for the other image class
+		jpegData, encodeErr := encodeJPEG(data, int(w), int(h), bool(use_gray), jpegQuality, actDPI)
+		if encodeErr != nil {
+			return ImageData{}, fmt.Errorf("jpeg encode failed: %v", encodeErr)
+		}
+		img.Data = jpegData
 	}
 
+	return img, nil
+}
+
+// alphaMode keeps alpha channels for a soft mask when nothing else works on
+// the page pixels, otherwise they are flattened onto white
+func alphaMode(convParams ConversionParameters) C.int {
+	if convParams.Alpha == "smask" && !convParams.Raw &&
+		(convParams.MRC == "" || convParams.MRC == "off") && !rawPixelsNeeded(convParams) {
+		return C.ALPHA_KEEP
+	}
+	return C.ALPHA_FLATTEN
+}
+
+// cmykMode keeps CMYK pages as CMYK JPEGs only when the C side writes the
+// JPEG, pages decoded for the Go side are converted to RGB
+func cmykMode(convParams ConversionParameters, rawFlag int) C.int {
+	switch {
+	case convParams.CMYK == "icc":
+		return C.CMYK_ICC
+	case convParams.CMYK == "keep" && rawFlag == 0:
+		return C.CMYK_KEEP
+	}
+	return C.CMYK_SIMPLE
+}
+
+// resampleFilter maps a -resample option to a RESAMPLE_* filter
+func resampleFilter(filter string) C.int {
+	switch filter {
+	case "bilinear":
+		return C.RESAMPLE_BILINEAR
+	case "bicubic":
+		return C.RESAMPLE_BICUBIC
+	case "lanczos3":
+		return C.RESAMPLE_LANCZOS3
+	case "nearest":
+		return C.RESAMPLE_NEAREST
+	}
+	return C.RESAMPLE_AREA
+}
+
+// sampleConversions names the SAMPLES_* flags of a page, e.g. 16bit+lab+alpha:smask
+// goBytes copies n bytes of a C buffer into Go memory. C.GoBytes takes a
+// C.int, which overflows for buffers of large pages past 2 GB
+func goBytes(p unsafe.Pointer, n int) []byte {
+	out := make([]byte, n)
+	if n > 0 {
+		copy(out, unsafe.Slice((*byte)(p), n))
+	}
+	return out
+}
+
+func sampleConversions(flags C.int) string {
+	names := []struct {
+		flag C.int
+		name string
+	}{
+		{C.SAMPLES_16BIT, "16bit"},
+		{C.SAMPLES_LAB, "lab"},
+		{C.SAMPLES_CMYK_KEPT, "cmyk:keep"},
+		{C.SAMPLES_CMYK_ICC, "cmyk:icc"},
+		{C.SAMPLES_CMYK_SIMPLE, "cmyk:rgb"},
+		{C.SAMPLES_ALPHA_FLAT, "alpha:flatten"},
+		{C.SAMPLES_ALPHA_KEPT, "alpha:smask"},
+	}
+	var parts []string
+	for _, n := range names {
+		if flags&n.flag != 0 {
+			parts = append(parts, n.name)
+		}
+	}
+	return strings.Join(parts, "+")
+}
+
+// classifyParams fills the C classification thresholds, unset values take the settings.h defaults
+func classifyParams(convParams ConversionParameters) C.classify_params {
+	c := convParams.Classification
+	if c == (ClassifyParameters{}) {
+		c = DefaultClassifyParameters()
+	}
+	return C.classify_params{
+		gray_threshold:  C.int(c.GrayThreshold),
+		gray_ratio:      C.double(c.GrayRatio),
+		lower_threshold: C.int(c.LowerThreshold),
+		upper_threshold: C.int(c.UpperThreshold),
+		ccitt_threshold: C.int(c.CCITTThreshold),
+		color_threshold: C.int(c.ColorThreshold),
+		color_area_mm2:  C.double(c.ColorAreaMM2),
+	}
+}
+
+// DefaultClassifyParameters returns the settings.h classification thresholds
+func DefaultClassifyParameters() ClassifyParameters {
+	return ClassifyParameters{
+		GrayThreshold:  DefaultGrayThreshold,
+		GrayRatio:      DefaultGrayRatio,
+		LowerThreshold: DefaultLowerThreshold,
+		UpperThreshold: DefaultUpperThreshold,
+		CCITTThreshold: DefaultCCITTThreshold,
+		ColorThreshold: DefaultColorThreshold,
+		ColorAreaMM2:   DefaultColorAreaMM2,
+	}
+}
+
+// pageClass reports the classification decision of a page and its statistics
+func pageClass(stats C.classify_stats, bilevel, gray bool) *PageClass {
+	class := "rgb"
+	switch {
+	case bilevel:
+		class = "bilevel"
+	case gray:
+		class = "gray"
+	}
+	return &PageClass{
+		Class:          class,
+		GrayPercent:    math.Round(float64(stats.gray_ratio)*10000) / 100,
+		BilevelPercent: math.Round(float64(stats.bw_ratio)*10000) / 100,
+		ColorAreaMM2:   math.Round(float64(stats.color_area_mm2)*10) / 10,
+	}
+}
+
+// convertCCITT passes CCITT G3/G4 data through or transcodes it when the
+// output cannot carry it as is
+func convertCCITT(page *bilevelPage, convParams ConversionParameters) (ImageData, error) {
+	var outBuf *C.uchar
+	var outSize C.ulong
+	var w, h C.size_t
+
+	// CCITT
+	ccitt := 1
+	if pageEditsEnabled(convParams) {
+		return transcodeBilevelEdited(page, convParams)
+	}
+	if convParams.Bilevel == "jbig2" && !convParams.Raw {
+		if img, err := transcodeBilevelToJBIG2(page, convParams); err == nil {
+			return img, nil
+		}
+		// keep the original CCITT data if JBIG2 transcoding fails
+	}
+	var params C.ccitt_params
+	rc := C.extract_ccitt_raw(
+		page.cPath,
+		&outBuf, &outSize,
+		&w, &h,
+		&params)
+	mirror, rotate := pageOrientation(params.orientation, convParams.Rotate)
+	// TIFF output is always written upright as MinIsWhite G4, so other sources are transcoded too
+	if rc == -2 || (rc == 0 && convParams.Raw &&
+		(params.k != -1 || params.black_is_1 != 0 || mirror || rotate != 0)) {
+		if outBuf != nil {
+			C.free(unsafe.Pointer(outBuf))
+		}
+		return transcodeBilevelToG4(page, convParams)
+	}
+	if rc != 0 {
+		C.free(unsafe.Pointer(outBuf))
+		return ImageData{}, fmt.Errorf("ExtractCCITTRaw failed with code %d", int(rc))
+	}
+	dataSize := int(outSize)
+	data := goBytes(unsafe.Pointer(outBuf), dataSize)
+	if outBuf != nil {
+		C.free(unsafe.Pointer(outBuf))
+	}
 	return ImageData{
 		Data:      data,
-		CCITT:     int(use_ccitt),
-		Gray:      bool(use_gray),
+		CCITT:     ccitt,
+		Gray:      false,
 		Width:     int(w),
 		Height:    int(h),
-		ActualDpi: actDPI,
+		ActualDpi: readResolution(page.cPath), // passed through pages keep theirs
+		Format:    ccittFormat,
+		CCITTParams: &CCITTParams{
+			K:                int(params.k),
+			EncodedByteAlign: params.encoded_byte_align != 0,
+			EndOfLine:        params.end_of_line != 0,
+			BlackIs1:         params.black_is_1 != 0,
+		},
+		Rotate: rotate,
+		Mirror: mirror,
+		Report: PageReport{Passthrough: true},
 	}, nil
 }
 
-func saveDataToTIFFFile(tiffMode string, origFilePath string, outputs []string, width, height int, data []byte, dpi int, compression int, gray bool) error {
+// readSeparator checks a bilevel page for a separator code. Separator sheets
+// are left out of the output, so the page is not converted further.
+func readSeparator(page *bilevelPage, convParams ConversionParameters) (ImageData, bool) {
+	packed, w, h, orientation, err := page.bits()
+	if err != nil {
+		return ImageData{}, false // not a bilevel page
+	}
+	mirror, rotate := pageOrientation(orientation, convParams.Rotate)
+	packed, w, h = orientPacked(packed, w, h, mirror, rotate)
+	dpi := readResolution(page.cPath)
+	if dpi == 0 {
+		dpi = convParams.TargetGraydpi
+	}
+	kind, value := detectSeparator(packed, w, h, dpi, convParams.Separators)
+	if kind == "" {
+		return ImageData{}, false
+	}
+	return ImageData{
+		Width:  w,
+		Height: h,
+		Report: PageReport{Separator: kind, SeparatorValue: value},
+	}, true
+}
+
+// passJPEG hands the JPEG data of a single strip or tile TIFF to the PDF as
+// is when the page would not be resampled. The page keeps its color space,
+// it is not classified.
+func passJPEG(cPath *C.char, convParams ConversionParameters) (ImageData, bool) {
+	var outBuf *C.uchar
+	var outSize C.ulong
+	var w, h C.size_t
+	var params C.jpeg_params
+	if rc := C.extract_jpeg_raw(cPath, &outBuf, &outSize, &w, &h, &params); rc != 0 {
+		return ImageData{}, false
+	}
+	data := goBytes(unsafe.Pointer(outBuf), int(outSize))
+	C.free(unsafe.Pointer(outBuf))
+
+	gray := params.gray != 0
+	compression, targetDPI := convParams.RGBCompression, convParams.TargetRGBdpi
+	if gray {
+		compression, targetDPI = convParams.GrayCompression, convParams.TargetGraydpi
+	}
+	dpi := readResolution(cPath)
+	if compression != "jpeg" || (dpi != 0 && dpi != outputDPI(convParams, targetDPI, dpi)) {
+		return ImageData{}, false
+	}
+	if dpi == 0 {
+		dpi = targetDPI
+	}
+
+	mirror, rotate := pageOrientation(params.orientation, convParams.Rotate)
+	return ImageData{
+		Data:             data,
+		Gray:             gray,
+		Width:            int(w),
+		Height:           int(h),
+		ActualDpi:        dpi,
+		BitsPerComponent: 8,
+		Format:           jpgFormat,
+		Rotate:           rotate,
+		Mirror:           mirror,
+		Report:           PageReport{Passthrough: true},
+	}, true
+}
+
+// convertPalette keeps the colormap of a palette TIFF. The indices are
+// resampled nearest neighbour and written as an /Indexed Flate image, or
+// left uncompressed for a palette TIFF. The page is not classified.
+func convertPalette(cPath *C.char, convParams ConversionParameters) (ImageData, bool) {
+	var outBuf *C.uchar
+	var outSize C.ulong
+	var w, h C.size_t
+	var colors, orientation C.int
+	var colormap [maxPaletteColors * 3]C.uchar
+	rc := C.read_palette_indices(cPath, &outBuf, &outSize, &w, &h, &colormap[0], &colors, &orientation)
+	if rc != 0 {
+		return ImageData{}, false
+	}
+	indices := goBytes(unsafe.Pointer(outBuf), int(outSize))
+	C.free(unsafe.Pointer(outBuf))
+
+	// only the entries in use are written
+	used := 0
+	for _, v := range indices {
+		if int(v) >= used {
+			used = int(v) + 1
+		}
+	}
+	palette := C.GoBytes(unsafe.Pointer(&colormap[0]), C.int(used*3))
+
+	width, height := int(w), int(h)
+	targetDPI := convParams.TargetRGBdpi
+	dpi := readResolution(cPath)
+	if dpi != 0 {
+		targetDPI = outputDPI(convParams, targetDPI, dpi)
+	}
+	if dpi != 0 && dpi != targetDPI {
+		nw := max(1, width*targetDPI/dpi)
+		nh := max(1, height*targetDPI/dpi)
+		indices = downsampleGray(indices, width, height, nw, nh)
+		width, height = nw, nh
+	}
+
+	// TIFF output is written upright, PDF pages are turned instead
+	mirror, rotate := pageOrientation(orientation, convParams.Rotate)
+	if convParams.Raw && (mirror || rotate != 0) {
+		indices, width, height = orientPlane(indices, width, height, mirror, rotate)
+		mirror, rotate = false, 0
+	}
+
+	bits := paletteBits(used)
+	rows, rowBytes := packIndices(indices, width, height, bits)
+	img := ImageData{
+		Data:             rows,
+		Palette:          palette,
+		Width:            width,
+		Height:           height,
+		ActualDpi:        targetDPI,
+		BitsPerComponent: bits,
+		Format:           pngFormat,
+		Rotate:           rotate,
+		Mirror:           mirror,
+		Report:           PageReport{Classification: &PageClass{Class: "palette"}},
+	}
+	if convParams.Raw {
+		return img, true
+	}
+	data, err := deflateRows(rows, rowBytes, height, 1)
+	if err != nil {
+		return ImageData{}, false
+	}
+	img.Data = data
+	return img, true
+}
+
+// checkBlankBilevel decodes a 1-bit TIFF and runs the blank page check on it
+func checkBlankBilevel(page *bilevelPage, convParams ConversionParameters, report *PageReport) error {
+	packed, w, h, _, err := page.bits()
+	if err != nil {
+		return err
+	}
+	dpi := readResolution(page.cPath)
+	if dpi == 0 {
+		dpi = convParams.TargetGraydpi
+	}
+	report.InkCoverage, report.Blank = detectBlank(unpackBits(packed, w, h), w, h, dpi, convParams)
+	return nil
+}
+
+// bilevelPage is the 1-bit page of a TIFF, decoded on first use. The bits
+// are shared, so they are only read.
+type bilevelPage struct {
+	cPath       *C.char
+	read        bool
+	packed      []byte
+	w, h        int
+	orientation C.int
+	err         error
+}
+
+// bits returns the page as readBilevelPacked does, decoding it only once
+func (p *bilevelPage) bits() ([]byte, int, int, C.int, error) {
+	if !p.read {
+		p.packed, p.w, p.h, p.orientation, p.err = readBilevelPacked(p.cPath)
+		p.read = true
+	}
+	return p.packed, p.w, p.h, p.orientation, p.err
+}
+
+// readBilevelPacked decodes a 1-bit TIFF into packed MSB2LSB bits, 1 = black.
+// The bits keep their stored order, the Orientation tag is returned with them.
+func readBilevelPacked(cPath *C.char) ([]byte, int, int, C.int, error) {
+	var outBuf *C.uchar
+	var outSize C.ulong
+	var w, h C.size_t
+	var orientation C.int
+	rc := C.read_bilevel_packed(cPath, &outBuf, &outSize, &w, &h, &orientation)
+	if rc != 0 {
+		return nil, 0, 0, 0, fmt.Errorf("read_bilevel_packed failed with code %d", int(rc))
+	}
+	packed := goBytes(unsafe.Pointer(outBuf), int(outSize))
+	C.free(unsafe.Pointer(outBuf))
+	return packed, int(w), int(h), orientation, nil
+}
+
+// pageOrientation combines the TIFF Orientation tag with the requested rotation
+func pageOrientation(orientation C.int, rotate int) (bool, int) {
+	var mirror, rot C.int
+	C.orientation_transform(orientation, C.int(rotate), &mirror, &rot)
+	return mirror != 0, int(rot)
+}
+
+// readBilevelOriented reads a 1-bit TIFF and turns it upright for TIFF output,
+// PDF output keeps the stored order and returns the page rotation instead
+func readBilevelOriented(page *bilevelPage, convParams ConversionParameters) ([]byte, int, int, bool, int, error) {
+	packed, w, h, orientation, err := page.bits()
+	if err != nil {
+		return nil, 0, 0, false, 0, err
+	}
+	mirror, rotate := pageOrientation(orientation, convParams.Rotate)
+	if convParams.Raw && (mirror || rotate != 0) {
+		packed, w, h = orientPacked(packed, w, h, mirror, rotate)
+		mirror, rotate = false, 0
+	}
+	return packed, w, h, mirror, rotate, nil
+}
+
+// transcodeBilevelToJBIG2 decodes a 1-bit TIFF and re-encodes it as JBIG2
+func transcodeBilevelToJBIG2(page *bilevelPage, convParams ConversionParameters) (ImageData, error) {
+	packed, w, h, mirror, rotate, err := readBilevelOriented(page, convParams)
+	if err != nil {
+		return ImageData{}, err
+	}
+	data, err := encodeJBIG2Generic(packed, w, h, 0)
+	if err != nil {
+		return ImageData{}, err
+	}
+	return ImageData{
+		Data:             data,
+		CCITT:            1,
+		Width:            w,
+		Height:           h,
+		ActualDpi:        readResolution(page.cPath),
+		BitsPerComponent: 1,
+		Format:           jbig2Format,
+		Rotate:           rotate,
+		Mirror:           mirror,
+	}, nil
+}
+
+// transcodeBilevelToG4 decodes a 1-bit TIFF (modified Huffman, G3, ...) and re-encodes it as G4
+func transcodeBilevelToG4(page *bilevelPage, convParams ConversionParameters) (ImageData, error) {
+	packed, w, h, mirror, rotate, err := readBilevelOriented(page, convParams)
+	if err != nil {
+		return ImageData{}, err
+	}
+	data, err := encodeRawCCITTG4(packed, w, h)
+	if err != nil {
+		return ImageData{}, fmt.Errorf("ccittg4 encode failed: %v", err)
+	}
+	return ImageData{
+		Data:             data,
+		CCITT:            1,
+		Width:            w,
+		Height:           h,
+		ActualDpi:        readResolution(page.cPath),
+		BitsPerComponent: 1,
+		Format:           ccittFormat,
+		Rotate:           rotate,
+		Mirror:           mirror,
+	}, nil
+}
+
+// transcodeBilevelEdited decodes a 1-bit TIFF upright, runs the page edits
+// and re-encodes it as JBIG2 or G4
+func transcodeBilevelEdited(page *bilevelPage, convParams ConversionParameters) (ImageData, error) {
+	packed, w, h, orientation, err := page.bits()
+	if err != nil {
+		return ImageData{}, err
+	}
+	// skew is measured on text lines, so the page must be upright first
+	if mirror, rotate := pageOrientation(orientation, convParams.Rotate); mirror || rotate != 0 {
+		packed, w, h = orientPacked(packed, w, h, mirror, rotate)
+	}
+	dpi := readResolution(page.cPath)
+	if dpi == 0 {
+		dpi = convParams.TargetGraydpi
+	}
+	var report PageReport
+	packed, w, h = editPacked(packed, w, h, dpi, convParams, &report)
+
+	img := ImageData{
+		CCITT:            1,
+		Width:            w,
+		Height:           h,
+		ActualDpi:        dpi,
+		BitsPerComponent: 1,
+		Report:           report,
+	}
+	if convParams.Bilevel == "jbig2" && !convParams.Raw {
+		if data, err := encodeJBIG2Generic(packed, w, h, 0); err == nil {
+			img.Data = data
+			img.Format = jbig2Format
+			return img, nil
+		}
+	}
+	data, err := encodeRawCCITTG4(packed, w, h)
+	if err != nil {
+		return ImageData{}, fmt.Errorf("ccittg4 encode failed: %v", err)
+	}
+	img.Data = data
+	img.Format = ccittFormat
+	return img, nil
+}
+
+// pageICCProfile returns the ICC profile embedded in a TIFF when it
+// describes the color space of the converted page: a gray page made from an
+// RGB scan or a CMYK page converted to RGB does not get it
+func pageICCProfile(path string, img ImageData) []byte {
+	space := "RGB "
+	switch {
+	case img.CCITT != 0 || img.Format == ccittFormat || img.Format == jbig2Format || img.Data == nil:
+		return nil
+	case img.CMYK:
+		space = "CMYK"
+	case img.Gray:
+		space = "GRAY"
+	}
+
+	cPath := C.CString(path)
+	defer C.free(unsafe.Pointer(cPath))
+	var outBuf *C.uchar
+	var outSize C.ulong
+	if rc := C.get_icc_profile(cPath, &outBuf, &outSize); rc != 0 || outBuf == nil {
+		return nil
+	}
+	profile := goBytes(unsafe.Pointer(outBuf), int(outSize))
+	C.free(unsafe.Pointer(outBuf))
+
+	// data color space signature of the 128 byte profile header
+	if len(profile) < 128 || string(profile[16:20]) != space {
+		return nil
+	}
+	return profile
+}
+
+// readResolution returns the horizontal resolution of a TIFF in dpi, 0 if unknown
+func readResolution(cPath *C.char) int {
+	return int(C.get_resolution_dpi(cPath))
+}
+
+// ReadTIFFHeader reads the header of the first page of a TIFF
+func ReadTIFFHeader(path string) (TIFFHeader, error) {
+	cPath := C.CString(path)
+	defer C.free(unsafe.Pointer(cPath))
+	var h C.tiff_header
+	if rc := C.read_tiff_header(cPath, &h); rc != 0 {
+		return TIFFHeader{}, fmt.Errorf("cannot open TIFF file %s", filepath.Base(path))
+	}
+	return TIFFHeader{
+		Width:         int(h.width),
+		Height:        int(h.height),
+		DPI:           int(h.dpi),
+		Compression:   int(h.compression),
+		Photometric:   int(h.photometric),
+		BitsPerSample: int(h.bits),
+		Samples:       int(h.samples),
+		Pages:         int(h.pages),
+		Tiled:         h.tiled != 0,
+	}, nil
+}
+
+// saveDataToTIFFFile writes a page as name, in the output folders or next
+// to the source depending on tiffMode; the output policy decides about
+// existing files. Replace mode saves the original to backup when it is set.
+func saveDataToTIFFFile(tiffMode string, origFilePath string, name string, policy outputPolicy, backup *backupDir, outputs []string, width, height int, data []byte, dpi int, compression int, gray bool, palette []byte, bits int) error {
 
 	//fmt.Println("saveDataToTIFFFile: filePath:", filePath, "width:", width, "height:", height, "dpi:", dpi)
 
@@ -187,11 +893,25 @@ func saveDataToTIFFFile(tiffMode string, origFilePath string, outputs []string,
 	// 	return fmt.Errorf("unsupported tiffMode: %s", tiffMode)
 	// }
 
+	var cPalette *C.uchar // palette indices are written with their colormap
+	if len(palette) > 0 {
+		p := C.CBytes(palette)
+		defer C.free(p)
+		cPalette = (*C.uchar)(p)
+	}
+
 	if tiffMode == "convert" {
 		base := filepath.Base(origFilePath)
 		fileName := strings.TrimSuffix(base, filepath.Ext(base))
 		tmpProcessedFileName := fileName + ".tmp"
-		processedFileName := fileName + ".tif"
+		processedFileName, err := policy.outputName(outputs, name, "")
+		if err != nil {
+			return err
+		}
+		if processedFileName == "" {
+			fmt.Printf("Skipped %s, the existing file is kept\n", name)
+			return nil
+		}
 
 		cBuf := C.CBytes(data)
 		defer C.free(cBuf)
@@ -212,7 +932,7 @@ func saveDataToTIFFFile(tiffMode string, origFilePath string, outputs []string,
 				cTmp := C.CString(tmpProcessedFilePath)
 				defer C.free(unsafe.Pointer(cTmp))
 
-				C.write_tiff(
+				rc := C.write_tiff(
 					cTmp,
 					C.uint32_t(width),
 					C.uint32_t(height),
@@ -221,7 +941,15 @@ func saveDataToTIFFFile(tiffMode string, origFilePath string, outputs []string,
 					C.int(dpi),
 					C.int(compression),
 					C.int(grayInt),
+					cPalette,
+					C.int(len(palette)/3),
+					C.int(bits),
 				)
+				if rc != 0 {
+					os.Remove(tmpProcessedFilePath)
+					errs <- fmt.Errorf("failed to write file %s (code %d)", tmpProcessedFilePath, int(rc))
+					return
+				}
 				info, err := os.Stat(tmpProcessedFilePath)
 				if err != nil {
 					errs <- fmt.Errorf("failed to get file info: %v", err)
@@ -246,12 +974,18 @@ func saveDataToTIFFFile(tiffMode string, origFilePath string, outputs []string,
 			}
 		}
 	} else if tiffMode == "replace" {
-		base := filepath.Base(origFilePath)
-		fileName := strings.TrimSuffix(base, filepath.Ext(base))
-		tmpProcessedFileName := fileName + ".tmp"
-		processedFileName := fileName + ".tif"
-		tmpProcessedFilePath := filepath.Join(filepath.Dir(origFilePath), tmpProcessedFileName)
-		processedFilePath := filepath.Join(filepath.Dir(origFilePath), processedFileName)
+		dir := filepath.Dir(origFilePath)
+		processedFileName, err := policy.outputName([]string{dir}, name, origFilePath)
+		if err != nil {
+			return err
+		}
+		if processedFileName == "" {
+			fmt.Printf("Skipped %s, the existing file is kept\n", name)
+			return nil
+		}
+		// b.tif and b.tiff in one folder need their own TMP files
+		tmpProcessedFilePath := filepath.Join(dir, filepath.Base(origFilePath)+".tmp")
+		processedFilePath := filepath.Join(dir, processedFileName)
 		cBuf := C.CBytes(data)
 		defer C.free(cBuf)
 		grayInt := 0
@@ -260,7 +994,7 @@ func saveDataToTIFFFile(tiffMode string, origFilePath string, outputs []string,
 		}
 		cTmp := C.CString(tmpProcessedFilePath)
 		defer C.free(unsafe.Pointer(cTmp))
-		C.write_tiff(
+		rc := C.write_tiff(
 			cTmp,
 			C.uint32_t(width),
 			C.uint32_t(height),
@@ -269,23 +1003,40 @@ func saveDataToTIFFFile(tiffMode string, origFilePath string, outputs []string,
 			C.int(dpi),
 			C.int(compression),
 			C.int(grayInt),
+			cPalette,
+			C.int(len(palette)/3),
+			C.int(bits),
 		)
-		info, err := os.Stat(tmpProcessedFilePath)
-		if err != nil {
-			return fmt.Errorf("failed to get file info: %v", err)
+		if rc == 0 {
+			// the new file must read back before it replaces the original
+			rc = C.check_tiff(cTmp, C.uint32_t(width), C.uint32_t(height))
 		}
-		if info.Size() == 0 {
-			return fmt.Errorf("file is empty: %s", tmpProcessedFilePath)
+		if rc != 0 {
+			os.Remove(tmpProcessedFilePath)
+			return fmt.Errorf("failed to write TIFF file %s (code %d), the original is kept", filepath.Base(tmpProcessedFilePath), int(rc))
 		}
-		_ = os.Remove(origFilePath)
-		if err := os.Rename(tmpProcessedFilePath, processedFilePath); err != nil {
-			return fmt.Errorf("failed to rename file: %v", err)
+		tmp, err := os.Open(tmpProcessedFilePath)
+		if err == nil {
+			err = tmp.Sync()
+			tmp.Close()
+		}
+		if err != nil {
+			os.Remove(tmpProcessedFilePath)
+			return fmt.Errorf("failed to sync file, the original is kept: %v", err)
 		}
+		return replaceOriginal(origFilePath, tmpProcessedFilePath, processedFilePath, backup)
 	} else if tiffMode == "append" {
 		base := filepath.Base(origFilePath)
 		fileName := strings.TrimSuffix(base, filepath.Ext(base))
 		tmpProcessedFileName := fileName + ".tmp"
-		processedFileName := "_" + fileName + ".tif"
+		processedFileName, err := policy.outputName([]string{filepath.Dir(origFilePath)}, name, "")
+		if err != nil {
+			return err
+		}
+		if processedFileName == "" {
+			fmt.Printf("Skipped %s, the existing file is kept\n", name)
+			return nil
+		}
 		tmpProcessedFilePath := filepath.Join(filepath.Dir(origFilePath), tmpProcessedFileName)
 		processedFilePath := filepath.Join(filepath.Dir(origFilePath), processedFileName)
 		cBuf := C.CBytes(data)
@@ -296,7 +1047,7 @@ func saveDataToTIFFFile(tiffMode string, origFilePath string, outputs []string,
 		}
 		cTmp := C.CString(tmpProcessedFilePath)
 		defer C.free(unsafe.Pointer(cTmp))
-		C.write_tiff(
+		rc := C.write_tiff(
 			cTmp,
 			C.uint32_t(width),
 			C.uint32_t(height),
@@ -305,7 +1056,14 @@ func saveDataToTIFFFile(tiffMode string, origFilePath string, outputs []string,
 			C.int(dpi),
 			C.int(compression),
 			C.int(grayInt),
+			cPalette,
+			C.int(len(palette)/3),
+			C.int(bits),
 		)
+		if rc != 0 {
+			os.Remove(tmpProcessedFilePath)
+			return fmt.Errorf("failed to write file %s (code %d)", tmpProcessedFilePath, int(rc))
+		}
 		info, err := os.Stat(tmpProcessedFilePath)
 		if err != nil {
 			return fmt.Errorf("failed to get file info: %v", err)
@@ -339,7 +1097,32 @@ func encodeRawCCITTG4(bits []byte, width, height int) ([]byte, error) {
 	}
 	defer C.free(unsafe.Pointer(outPtr))
 	size := int(outSize)
-	return C.GoBytes(unsafe.Pointer(outPtr), C.int(size)), nil
+	return goBytes(unsafe.Pointer(outPtr), size), nil
+}
+
+func encodeJPEG(pxls []byte, width, height int, gray bool, quality, dpi int) ([]byte, error) {
+	components := 3
+	grayInt := 0
+	if gray {
+		components = 1
+		grayInt = 1
+	}
+	if len(pxls) != width*height*components {
+		return nil, errors.New("invalid pixel buffer length")
+	}
+	var outPtr *C.uchar
+	var outSize C.ulong
+	ret := C.write_jpeg_to_mem(
+		C.uint32_t(width), C.uint32_t(height),
+		(*C.uint8_t)(unsafe.Pointer(&pxls[0])),
+		C.int(quality), C.int(dpi), C.int(grayInt),
+		&outPtr, &outSize,
+	)
+	if ret != 0 || outPtr == nil {
+		return nil, errors.New("libjpeg encode failed")
+	}
+	defer C.free(unsafe.Pointer(outPtr))
+	return goBytes(unsafe.Pointer(outPtr), int(outSize)), nil
 }
 
 // // #cgo LDFLAGS: -ltiff -ljpeg -lwebp -lzstd -llzma -ldeflate -ljbig -lLerc -lz
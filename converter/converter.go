@@ -13,6 +13,7 @@ import (
 	"tiff2pdf/contracts"
 	"tiff2pdf/pdf_writer"
 	"time"
+	"unicode"
 )
 
 const (
@@ -28,14 +29,58 @@ type TIFFfolder = contracts.TIFFfolder
 type ConversionRequest = contracts.ConversionRequest
 type Converter = contracts.Converter
 type ConvertResult = contracts.ConvertResult
+type CCITTParams = contracts.CCITTParams
+type PageReport = contracts.PageReport
+type FolderReport = contracts.FolderReport
+type RunReport = contracts.RunReport
+type PageClass = contracts.PageClass
+type ClassifyParameters = contracts.ClassifyParameters
 
 type ConversionParameters struct {
 	CCITT                 string
+	Bilevel               string
+	MRC                   string
+	RGBCompression        string
+	GrayCompression       string
 	TIFFMode              string
 	TargetRGBdpi          int
 	TargetGraydpi         int
 	TargetRGBjpegQuality  int
 	TargetGrayjpegQuality int
+	TargetRGBjpxRatio     int
+	TargetGrayjpxRatio    int
+	Rotate                int // clockwise, applied on top of the TIFF Orientation tag
+	Deskew                bool
+	DeskewMaxAngle        float64 // degrees searched on both sides
+	DeskewMinAngle        float64 // smaller skew is left as is
+	AutoCrop              string  // off, edges (dark scanner borders), content (also crops to content)
+	CropAction            string  // crop or whiten
+	CropPaddingMM         float64
+	FixedCropMM           [4]float64         // top, right, bottom, left
+	BlankMode             string             // off, drop (leave out of the PDF), flag (report only) or split (start a new PDF)
+	BlankInkPercent       float64            // pages with less ink coverage are blank
+	BlankMarginMM         float64            // ignored page margins when measuring ink
+	Separators            []string           // separator codes that split a folder: patch, code39, code128
+	SeparatorNames        bool               // name the PDFs after the barcode of their separator sheet
+	Binarization          string             // gray to bilevel: fixed, otsu, sauvola, niblack or dither
+	BinarizeThreshold     int                // threshold of the fixed method
+	BinarizeK             float64            // Sauvola/Niblack k, 0 = method default
+	BinarizeWindowMM      float64            // Sauvola/Niblack window size
+	BinarizePreFilter     string             // none or median
+	BinarizePostFilters   []string           // despeckle, close; nil = close, none for dither
+	Classification        ClassifyParameters // zero value uses the settings.h defaults
+	JPEGPassthrough       bool               // keep the data of JPEG pages that need no resampling
+	Alpha                 string             // flatten (onto white) or smask
+	CMYK                  string             // keep, rgb or icc
+	CMYKProfile           []byte             // ICC profile for CMYK pages without one of their own
+	ResampleFilter        string             // area, bilinear, bicubic, lanczos3 or nearest
+	DownsampleOnly        bool               // pages below the target resolution keep their own
+	NameTemplate          string             // PDF file name template
+	TIFFNameTemplate      string             // TIFF file name template
+	NamePattern           string             // regular expression for the folder name, its groups are placeholders
+	Overwrite             string             // existing output files: always, never or if-newer
+	Collision             string             // existing files that are not overwritten: skip, suffix or fail
+	Metadata              contracts.PDFMetadata
 	Raw                   bool
 }
 
@@ -43,16 +88,28 @@ type convertFolderParam struct {
 	convParams ConversionParameters
 	tiffFolder TIFFfolder
 	outputDirs []string
+	report     *FolderReport
+	started    time.Time // run start, the {date} of output names
+	outputs    *runOutputs
+	backup     *backupDir // originals of replace mode, nil without a backup directory
+}
+
+// outputPolicy is the overwrite policy of the outputs of owner, made from
+// the given sources
+func (cfg convertFolderParam) outputPolicy(owner string, sources ...string) outputPolicy {
+	p := newOutputPolicy(cfg.convParams.Overwrite, cfg.convParams.Collision, sources...)
+	p.owner, p.run = owner, cfg.outputs
+	return p
 }
 
 type decodeTiffTask struct {
 	filePath   string
 	pageNumber int
+	rotate     int
 	resultCh   chan ConvertResult
 }
 
 type ConvertedDestination struct {
-	pdfFilePath string
 	tmpFilePath string
 	tmpFile     *os.File
 }
@@ -60,12 +117,13 @@ type ConvertedDestination struct {
 type OutputFormat string
 
 const (
-	pngFormat OutputFormat = "PNG"
-	jpgFormat OutputFormat = "JPG"
+	pngFormat   OutputFormat = "PNG" // FlateDecode with PNG predictors
+	jpgFormat   OutputFormat = "JPG"
+	jpxFormat   OutputFormat = "JPX" // JPEG 2000
+	ccittFormat OutputFormat = "G4"
+	jbig2Format OutputFormat = "JBIG2"
 )
 
-var imgFormat OutputFormat = jpgFormat
-
 //var jpegQualityC = 100
 
 func convertWorker(taskChan <-chan decodeTiffTask, convCfg ConversionParameters, wg *sync.WaitGroup) {
@@ -73,26 +131,49 @@ func convertWorker(taskChan <-chan decodeTiffTask, convCfg ConversionParameters,
 
 	for task := range taskChan {
 
-		img, err := ConvertTIFF(task.filePath, convCfg)
+		pageParams := convCfg
+		pageParams.Rotate = task.rotate
+		img, err := ConvertTIFF(task.filePath, pageParams)
 		if err != nil {
 			fmt.Printf("Error encoding JPEG: %v\n", err)
 			continue
 		}
 		//buf := bytes.NewBuffer(data)
 		buf := img.Data
+		if !pageParams.Raw {
+			img.ICCProfile = pageICCProfile(task.filePath, img)
+		}
+
+		report := img.Report
+		report.File = filepath.Base(task.filePath)
+		report.Page = task.pageNumber
+		report.Width = img.Width
+		report.Height = img.Height
+		report.Format = string(img.Format)
 
 		// mmImgWidth := float64(img.Width) * 25.4 / float64(img.ActualDpi)
 		// mmImgHeight := float64(img.Height) * 25.4 / float64(img.ActualDpi)
 		//x := 0.0
 		//y := 0.0
 		task.resultCh <- ConvertResult{
-			ImageId:     fmt.Sprintf("img_%d", task.pageNumber),
-			ImgBuffer:   buf,
-			PixelWidth:  img.Width,
-			PixelHeight: img.Height,
-			CCITT:       img.CCITT != 0,
-			Gray:        img.Gray,
-			ImgFormat:   string(imgFormat),
+			ImageId:          fmt.Sprintf("img_%d", task.pageNumber),
+			ImgBuffer:        buf,
+			Palette:          img.Palette,
+			PixelWidth:       img.Width,
+			PixelHeight:      img.Height,
+			BitsPerComponent: img.BitsPerComponent,
+			DPI:              img.ActualDpi,
+			CCITT:            img.CCITT != 0,
+			Gray:             img.Gray,
+			MRC:              img.MRC,
+			CCITTParams:      img.CCITTParams,
+			Rotate:           img.Rotate,
+			Mirror:           img.Mirror,
+			CMYK:             img.CMYK,
+			SMask:            img.SMask,
+			ICCProfile:       img.ICCProfile,
+			ImgFormat:        string(img.Format),
+			Report:           report,
 			// drawWidth:   mmImgWidth,
 			// drawHeight:  mmImgHeight,
 			//x:         x,
@@ -103,6 +184,23 @@ func convertWorker(taskChan <-chan decodeTiffTask, convCfg ConversionParameters,
 
 }
 
+// tiffCompression maps an image class compression option to a TIFF compression tag
+func tiffCompression(compression string) int {
+	if compression == "flate" {
+		return CompressionDeflate
+	}
+	return CompressionJPEG
+}
+
+// pageRotation adds the folder rotation list entry of a file to the common rotation
+func pageRotation(cfg convertFolderParam, filePath string) int {
+	rel, err := filepath.Rel(cfg.tiffFolder.Path, filePath)
+	if err != nil {
+		rel = filepath.Base(filePath)
+	}
+	return (cfg.convParams.Rotate + cfg.tiffFolder.Rotations[filepath.ToSlash(rel)]) % 360
+}
+
 func processTIFFFolder(cfg convertFolderParam) error {
 
 	tiffMode := cfg.convParams.TIFFMode
@@ -110,6 +208,7 @@ func processTIFFFolder(cfg convertFolderParam) error {
 	numWorkers := min(runtime.NumCPU(), filesCount)
 
 	var processedFilesCount int = 0
+	var saveErrors []string // files converted but not saved
 
 	decodeTiffTaskChan := make(chan decodeTiffTask)
 	resultChan := make(chan ConvertResult, numWorkers)
@@ -122,10 +221,14 @@ func processTIFFFolder(cfg convertFolderParam) error {
 	}
 
 	done := make(chan struct{})
+	fields := folderFields(cfg.tiffFolder, cfg.convParams.NamePattern, cfg.started)
 
 	go func() {
 		for result := range resultChan {
 			origFilePath := cfg.tiffFolder.TiffFilesPaths[result.PageIndex]
+			base := filepath.Base(origFilePath)
+			fields.file, fields.index = strings.TrimSuffix(base, filepath.Ext(base)), result.PageIndex+1
+			name := tiffOutputName(cfg.convParams.TIFFNameTemplate, fields, origFilePath, tiffMode)
 			//tiffFileName := filepath.Base(cfg.tiffFolder.TiffFilesPaths[result.pageIndex])
 			//fmt.Printf("Processing file %s", tiffFileName)
 			fmt.Printf("Processed %d%% \r", processedFilesCount*100/filesCount)
@@ -134,24 +237,35 @@ func processTIFFFolder(cfg convertFolderParam) error {
 			var targetDPI int
 			var grayImage bool
 
-			if result.CCITT {
+			if len(result.Palette) > 0 {
+				// palette pages keep their colormap, JPEG cannot carry indices
+				compression = CompressionLZW
+				targetDPI = cfg.convParams.TargetRGBdpi
+			} else if result.CCITT {
 				compression = CompressionCCITTG4
 				targetDPI = cfg.convParams.TargetGraydpi
 				grayImage = true
 			} else {
 				if result.Gray {
-					compression = CompressionJPEG
+					compression = tiffCompression(cfg.convParams.GrayCompression)
 					targetDPI = cfg.convParams.TargetGraydpi
 					grayImage = true
 				} else {
-					compression = CompressionJPEG
+					compression = tiffCompression(cfg.convParams.RGBCompression)
 					targetDPI = cfg.convParams.TargetRGBdpi
 					grayImage = false
 				}
 			}
+			if result.DPI != 0 {
+				// pages below the target keep their own resolution with -resamplepolicy downonly
+				targetDPI = result.DPI
+			}
 			err := saveDataToTIFFFile(
 				tiffMode,
 				origFilePath,
+				name,
+				cfg.outputPolicy("file "+base, origFilePath),
+				cfg.backup,
 				cfg.outputDirs,
 				result.PixelWidth,
 				result.PixelHeight,
@@ -159,11 +273,15 @@ func processTIFFFolder(cfg convertFolderParam) error {
 				targetDPI,
 				compression,
 				grayImage,
+				result.Palette,
+				result.BitsPerComponent,
 			)
 			if err != nil {
 				fmt.Printf("%sError saving processed TIFF file %s: %v%s\n", Red, filepath.Base(origFilePath), err, Reset)
+				saveErrors = append(saveErrors, fmt.Sprintf("%s: %v", base, err))
 				continue
 			}
+			cfg.report.Pages = append(cfg.report.Pages, result.Report)
 			processedFilesCount++
 		}
 		if processedFilesCount == filesCount {
@@ -179,6 +297,7 @@ func processTIFFFolder(cfg convertFolderParam) error {
 
 			filePath:   file,
 			pageNumber: i,
+			rotate:     pageRotation(cfg, file),
 			resultCh:   resultChan,
 		}
 		decodeTiffTaskChan <- task
@@ -189,11 +308,83 @@ func processTIFFFolder(cfg convertFolderParam) error {
 	close(resultChan)
 	<-done
 
+	if processedFilesCount < filesCount {
+		// files that failed to convert are reported by the workers
+		if len(saveErrors) > 0 {
+			return fmt.Errorf("%d of %d file(s) not written: %s", filesCount-processedFilesCount, filesCount, strings.Join(saveErrors, "; "))
+		}
+		return fmt.Errorf("%d of %d file(s) not written", filesCount-processedFilesCount, filesCount)
+	}
 	return nil
 }
 
+// pdfDocument is a PDF being written to a TMP file in every output folder
+type pdfDocument struct {
+	destinations []ConvertedDestination
+	writer       *pdf_writer.PDFWriter
+	pageCount    int
+	name         string // file name from a separator barcode, without extension
+}
+
+func openPDFDocument(outputDirs []string, tmpName string) (*pdfDocument, error) {
+	doc := &pdfDocument{destinations: make([]ConvertedDestination, len(outputDirs))}
+	writers := make([]io.Writer, len(outputDirs))
+	for i, outputDir := range outputDirs {
+		doc.destinations[i] = ConvertedDestination{
+			tmpFilePath: filepath.Join(outputDir, tmpName+".tmp"),
+		}
+		f, err := os.Create(doc.destinations[i].tmpFilePath)
+		if err != nil {
+			doc.discard()
+			return nil, fmt.Errorf("error creating TMP file at output folder %s: %v", filepath.Base(outputDir), err)
+		}
+		doc.destinations[i].tmpFile = f
+		writers[i] = f
+	}
+
+	pdfWriter, err := pdf_writer.NewPDFWriter(io.MultiWriter(writers...))
+	if err != nil {
+		doc.discard()
+		return nil, fmt.Errorf("error creating PDF writer: %v", err)
+	}
+	doc.writer = pdfWriter
+	return doc, nil
+}
+
+// finish completes the PDF and syncs and closes its TMP files
+func (doc *pdfDocument) finish() error {
+	if err := doc.writer.Finish(); err != nil {
+		return fmt.Errorf("error writing PDF file to output folder: %v", err)
+	}
+	for _, destination := range doc.destinations {
+		if err := destination.tmpFile.Sync(); err != nil {
+			return fmt.Errorf("error syncing TMP file to output folder %s: %v", filepath.Base(destination.tmpFilePath), err)
+		}
+		if err := destination.tmpFile.Close(); err != nil {
+			return fmt.Errorf("error closing TMP file to output folder %s: %v", filepath.Base(destination.tmpFilePath), err)
+		}
+	}
+	return nil
+}
+
+// discard closes and removes the TMP files
+func (doc *pdfDocument) discard() {
+	for _, destination := range doc.destinations {
+		if destination.tmpFile == nil {
+			continue
+		}
+		destination.tmpFile.Close()
+		if removeErr := os.Remove(destination.tmpFilePath); removeErr != nil && !os.IsNotExist(removeErr) {
+			fmt.Printf("Error removing TMP file %s: %v\n", destination.tmpFilePath, removeErr)
+		}
+	}
+}
+
 func convertFolderToPDF(cfg convertFolderParam) (err error) {
 	var pdfPageCount int = 0
+	var blankCount int = 0
+	var separatorCount int = 0
+	var droppedCount int = 0 // blank and separator pages left out of the PDF
 	startTime := time.Now()
 
 	if len(cfg.tiffFolder.TiffFilesPaths) == 0 {
@@ -212,46 +403,39 @@ func convertFolderToPDF(cfg convertFolderParam) (err error) {
 		go convertWorker(decodeTiffTaskChan, cfg.convParams, wg)
 	}
 
-	dirName := strings.TrimSuffix(cfg.tiffFolder.Name, "-2") // pdf file name = tiff files folder name
+	dirName := cfg.tiffFolder.Name // names the TMP files, the PDFs are named once the folder is done
 
-	destinations := make([]ConvertedDestination, len(cfg.outputDirs))
-	writers := make([]io.Writer, len(cfg.outputDirs))
-	for i, outputDir := range cfg.outputDirs {
-		destinations[i] = ConvertedDestination{
-			tmpFilePath: filepath.Join(outputDir, dirName+".tmp"),
-			pdfFilePath: filepath.Join(outputDir, dirName+".pdf"),
-		}
-		f, err := os.Create(destinations[i].tmpFilePath)
+	// split mode may produce several documents, they are named once the folder is done
+	var docs []*pdfDocument
+	newDocument := func() (*pdfDocument, error) {
+		doc, err := openPDFDocument(cfg.outputDirs, fmt.Sprintf("%s_%03d", dirName, len(docs)+1))
 		if err != nil {
-			return fmt.Errorf("error creating TMP file at output folder %s: %v", filepath.Base(outputDir), err)
+			return nil, err
 		}
-		destinations[i].tmpFile = f
-		writers[i] = f
+		doc.writer.SetMetadata(cfg.convParams.Metadata)
+		docs = append(docs, doc)
+		return doc, nil
 	}
 
 	defer func() {
 		if err == nil {
 			return
 		}
-		for _, destination := range destinations {
-			if destination.tmpFile != nil {
-				destination.tmpFile.Close()
-			}
-			if removeErr := os.Remove(destination.tmpFilePath); removeErr != nil {
-				fmt.Printf("Error removing TMP file %s: %v\n", destination.tmpFilePath, removeErr)
-			}
+		for _, doc := range docs {
+			doc.discard()
 		}
 	}()
 
-	multipleWriter := io.MultiWriter(writers...)
-
-	pdfWriter, errNewPDFWriter := pdf_writer.NewPDFWriter(multipleWriter)
-	if errNewPDFWriter != nil {
-		return fmt.Errorf("error creating PDF writer: %v", errNewPDFWriter)
+	doc, err := newDocument()
+	if err != nil {
+		return err
 	}
 
 	results := make([]*ConvertResult, filesCount)
 	nextIndex := 0
+	splitPending := false // the next page starts a new document
+	nextName := ""        // barcode of the last separator sheet
+	var writeErr error
 
 	done := make(chan struct{})
 
@@ -261,16 +445,58 @@ func convertFolderToPDF(cfg convertFolderParam) (err error) {
 			results[result.PageIndex] = &result
 
 			for nextIndex < len(results) && results[nextIndex] != nil {
+				page := results[nextIndex]
+				results[nextIndex] = nil
+				nextIndex++
+
+				if page.Report.Separator != "" {
+					separatorCount++
+					droppedCount++
+					cfg.report.Pages = append(cfg.report.Pages, page.Report)
+					splitPending = doc.pageCount > 0
+					if cfg.convParams.SeparatorNames {
+						nextName = page.Report.SeparatorValue
+					}
+					continue
+				}
+				if page.Report.Blank {
+					blankCount++
+					switch cfg.convParams.BlankMode {
+					case "drop":
+						droppedCount++
+						cfg.report.Pages = append(cfg.report.Pages, page.Report)
+						continue
+					case "split":
+						// the separator sheet itself is left out
+						splitPending = doc.pageCount > 0
+						droppedCount++
+						cfg.report.Pages = append(cfg.report.Pages, page.Report)
+						continue
+					}
+				}
+				if splitPending && writeErr == nil {
+					splitPending = false
+					if writeErr = doc.finish(); writeErr == nil {
+						doc, writeErr = newDocument()
+					}
+				}
+				if writeErr != nil {
+					continue
+				}
+				if doc.pageCount == 0 && nextName != "" {
+					doc.name = nextName
+					nextName = ""
+				}
 
-				err := pdfWriter.WriteImage(results[nextIndex])
+				err := doc.writer.WriteImage(page)
 				if err != nil {
 					fmt.Printf("Failed writing image to PDF: %v\n", err)
 					//os.Exit(1)
 				} else {
+					doc.pageCount++
 					pdfPageCount++
+					cfg.report.Pages = append(cfg.report.Pages, page.Report)
 				}
-				results[nextIndex] = nil
-				nextIndex++
 			}
 
 		}
@@ -281,6 +507,7 @@ func convertFolderToPDF(cfg convertFolderParam) (err error) {
 		task := decodeTiffTask{
 			filePath:   file,
 			pageNumber: i,
+			rotate:     pageRotation(cfg, file),
 			resultCh:   resultChan,
 		}
 		decodeTiffTaskChan <- task
@@ -291,17 +518,11 @@ func convertFolderToPDF(cfg convertFolderParam) (err error) {
 	close(resultChan)
 	<-done
 
-	if err := pdfWriter.Finish(); err != nil {
-		return fmt.Errorf("error writing PDF file to output folder: %v", err)
+	if writeErr != nil {
+		return writeErr
 	}
-
-	for _, destination := range destinations {
-		if err := destination.tmpFile.Sync(); err != nil {
-			return fmt.Errorf("error syncing TMP file to output folder %s: %v", filepath.Base(destination.tmpFilePath), err)
-		}
-		if err := destination.tmpFile.Close(); err != nil {
-			return fmt.Errorf("error closing TMP file to output folder %s: %v", filepath.Base(destination.tmpFilePath), err)
-		}
+	if err := doc.finish(); err != nil {
+		return err
 	}
 
 	for _, outputDir := range cfg.outputDirs {
@@ -315,24 +536,207 @@ func convertFolderToPDF(cfg convertFolderParam) (err error) {
 		d.Close()
 	}
 
-	for _, destination := range destinations {
-		if err := os.Rename(destination.tmpFilePath, destination.pdfFilePath); err != nil {
-			return fmt.Errorf("error renaming TMP file to PDF at output folder %s: %v", filepath.Base(destination.tmpFilePath), err)
+	// a folder of blank pages and separator sheets leaves an empty document
+	written := docs[:0]
+	for _, doc := range docs {
+		if doc.pageCount == 0 {
+			doc.discard()
+			continue
+		}
+		written = append(written, doc)
+	}
+	docs = written
+	if len(docs) == 0 {
+		fmt.Printf("Warning: folder %s has no pages left after dropping blank pages and separator sheets, no PDF file is written\n", dirName)
+	}
+
+	fields := folderFields(cfg.tiffFolder, cfg.convParams.NamePattern, cfg.started)
+	template := cfg.convParams.NameTemplate
+	used := make(map[string]bool)
+	policy := cfg.outputPolicy("folder "+cfg.tiffFolder.Name, cfg.tiffFolder.TiffFilesPaths...)
+	for n, doc := range docs {
+		fields.index, fields.pages, fields.barcode = n+1, doc.pageCount, doc.name
+		docTemplate := template
+		if safeFileName(doc.name) != "" && template == DefaultNameTemplate {
+			// a template of the user's own places {barcode} itself, or leaves it out
+			docTemplate = "{barcode}"
+		} else if len(docs) > 1 && !usesPlaceholder(template, "index") && !usesPlaceholder(template, "barcode") {
+			// split documents are numbered
+			ext := filepath.Ext(template)
+			if !strings.EqualFold(ext, ".pdf") {
+				ext = ""
+			}
+			docTemplate = strings.TrimSuffix(template, ext) + "_{index}" + ext
+		}
+		pdfName := expandName(docTemplate, fields, ".pdf")
+		if used[pdfName] {
+			ext := filepath.Ext(pdfName)
+			pdfName = fmt.Sprintf("%s_%03d%s", strings.TrimSuffix(pdfName, ext), n+1, ext)
+		}
+		used[pdfName] = true
+		finalName, err := policy.outputName(cfg.outputDirs, pdfName, "")
+		if err != nil {
+			return err
+		}
+		if finalName == "" {
+			fmt.Printf("Folder %s - skipped %s, the existing file is kept\n", cfg.tiffFolder.Name, pdfName)
+			doc.discard()
+			continue
+		}
+		pdfName = finalName
+		for _, destination := range doc.destinations {
+			pdfFilePath := filepath.Join(filepath.Dir(destination.tmpFilePath), pdfName)
+			if err := os.Rename(destination.tmpFilePath, pdfFilePath); err != nil {
+				return fmt.Errorf("error renaming TMP file to PDF at output folder %s: %v", filepath.Base(destination.tmpFilePath), err)
+			}
 		}
 	}
 
 	endTime := time.Since(startTime)
-	if pdfPageCount != len(cfg.tiffFolder.TiffFilesPaths) {
+	if separatorCount > 0 {
+		fmt.Printf("Folder %s - %d separator sheets found\n", dirName, separatorCount)
+	}
+	if blankCount > 0 {
+		fmt.Printf("Folder %s - %d blank pages found (%s)\n", dirName, blankCount, cfg.convParams.BlankMode)
+	}
+	if pdfPageCount+droppedCount != len(cfg.tiffFolder.TiffFilesPaths) {
 		fmt.Printf("Warning: %d pages written to PDF file, but %d TIFF files were processed\n", pdfPageCount, len(cfg.tiffFolder.TiffFilesPaths))
 	} else {
 		fmt.Println("Folder " + dirName + " - " + fmt.Sprint(len(cfg.tiffFolder.TiffFilesPaths)) +
-			" files converted to PDF with " + fmt.Sprint(pdfPageCount) + " pages. With time: " + endTime.String())
+			" files converted to PDF with " + fmt.Sprint(pdfPageCount) + " pages in " + fmt.Sprint(len(docs)) +
+			" file(s). With time: " + endTime.String())
 	}
 
 	return nil
 }
 
+// safeFileName keeps letters, digits, dots, dashes and underscores of a
+// barcode value, anything else becomes an underscore
+func safeFileName(value string) string {
+	name := strings.Map(func(r rune) rune {
+		if r < 128 && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '.' || r == '-' || r == '_') {
+			return r
+		}
+		return '_'
+	}, value)
+	return strings.Trim(name, ".")
+}
+
+// classCompression returns the per-class compression override or the common default
+func classCompression(override, common string) string {
+	if override != "" {
+		return override
+	}
+	if common != "" {
+		return common
+	}
+	return "jpeg"
+}
+
+// tiffNameTemplate is the TIFF name template of the flags or the default
+// of the TIFF mode
+func tiffNameTemplate(params contracts.InputFlags) string {
+	switch {
+	case params.TIFFName != "":
+		return params.TIFFName
+	case params.TIFFMode == "append":
+		return AppendTIFFNameTemplate
+	}
+	return DefaultTIFFNameTemplate
+}
+
+// pdfConversionParameters are the page conversion settings of a folder
+// converted to PDF
+func pdfConversionParameters(params contracts.InputFlags, cmykProfile []byte) ConversionParameters {
+	return ConversionParameters{
+		Raw:                   false,
+		CCITT:                 params.CCITT,
+		Bilevel:               params.Bilevel,
+		MRC:                   params.MRC,
+		RGBCompression:        classCompression(params.RGBCompression, params.Compression),
+		GrayCompression:       classCompression(params.GrayCompression, params.Compression),
+		TargetRGBdpi:          params.RGBdpi,
+		TargetGraydpi:         params.GrayDpi,
+		TargetRGBjpegQuality:  params.RGBJpegQuality,
+		TargetGrayjpegQuality: params.GrayJpegQuality,
+		TargetRGBjpxRatio:     params.RGBJpxRatio,
+		TargetGrayjpxRatio:    params.GrayJpxRatio,
+		Rotate:                params.Rotate,
+		Deskew:                params.Deskew,
+		DeskewMaxAngle:        params.DeskewMaxAngle,
+		DeskewMinAngle:        params.DeskewMinAngle,
+		AutoCrop:              params.AutoCrop,
+		CropAction:            params.CropAction,
+		CropPaddingMM:         params.CropPaddingMM,
+		FixedCropMM:           params.FixedCropMM,
+		BlankMode:             params.BlankMode,
+		BlankInkPercent:       params.BlankInkPercent,
+		BlankMarginMM:         params.BlankMarginMM,
+		Separators:            params.Separators,
+		SeparatorNames:        params.SeparatorNames,
+		Binarization:          params.Binarization,
+		BinarizeThreshold:     params.BinarizeThreshold,
+		BinarizeK:             params.BinarizeK,
+		BinarizeWindowMM:      params.BinarizeWindowMM,
+		BinarizePreFilter:     params.BinarizePreFilter,
+		BinarizePostFilters:   params.BinarizePostFilters,
+		Classification:        params.Classification,
+		JPEGPassthrough:       params.JPEGPassthrough,
+		Alpha:                 params.Alpha,
+		CMYK:                  params.CMYK,
+		CMYKProfile:           cmykProfile,
+		ResampleFilter:        params.ResampleFilter,
+		DownsampleOnly:        params.ResamplePolicy == "downonly",
+		NameTemplate:          params.OutputName,
+		NamePattern:           params.NamePattern,
+		Overwrite:             params.Overwrite,
+		Collision:             params.Collision,
+		Metadata:              params.Metadata,
+	}
+}
+
+// tiffConversionParameters are the page conversion settings of a folder
+// converted to TIFF files
+func tiffConversionParameters(params contracts.InputFlags, cmykProfile []byte) ConversionParameters {
+	return ConversionParameters{
+		Raw:                 true,
+		TargetRGBdpi:        params.RGBdpi,
+		TargetGraydpi:       params.GrayDpi,
+		CCITT:               params.CCITT,
+		RGBCompression:      classCompression(params.RGBCompression, params.Compression),
+		GrayCompression:     classCompression(params.GrayCompression, params.Compression),
+		TIFFMode:            params.TIFFMode,
+		Rotate:              params.Rotate,
+		Deskew:              params.Deskew,
+		DeskewMaxAngle:      params.DeskewMaxAngle,
+		DeskewMinAngle:      params.DeskewMinAngle,
+		AutoCrop:            params.AutoCrop,
+		CropAction:          params.CropAction,
+		CropPaddingMM:       params.CropPaddingMM,
+		FixedCropMM:         params.FixedCropMM,
+		BlankMode:           params.BlankMode,
+		BlankInkPercent:     params.BlankInkPercent,
+		BlankMarginMM:       params.BlankMarginMM,
+		Binarization:        params.Binarization,
+		BinarizeThreshold:   params.BinarizeThreshold,
+		BinarizeK:           params.BinarizeK,
+		BinarizeWindowMM:    params.BinarizeWindowMM,
+		BinarizePreFilter:   params.BinarizePreFilter,
+		BinarizePostFilters: params.BinarizePostFilters,
+		Classification:      params.Classification,
+		CMYK:                params.CMYK,
+		CMYKProfile:         cmykProfile,
+		ResampleFilter:      params.ResampleFilter,
+		DownsampleOnly:      params.ResamplePolicy == "downonly",
+		TIFFNameTemplate:    tiffNameTemplate(params),
+		NamePattern:         params.NamePattern,
+		Overwrite:           params.Overwrite,
+		Collision:           params.Collision,
+	}
+}
+
 func Convert(request ConversionRequest) error {
+	started := time.Now()
 
 	foldersCount := len(request.Folders)
 
@@ -344,7 +748,34 @@ func Convert(request ConversionRequest) error {
 		})
 	}
 
+	var cmykProfile []byte
+	if request.Parameters.CMYKProfile != "" {
+		profile, err := os.ReadFile(request.Parameters.CMYKProfile)
+		if err != nil {
+			return fmt.Errorf("error reading CMYK profile: %v", err)
+		}
+		cmykProfile = profile
+	}
+
+	if _, errs := PlanOutputs(request); len(errs) > 0 {
+		return &PlanError{Errors: errs}
+	}
+	outputs := newRunOutputs()
+
+	var backup *backupDir
+	if request.Parameters.BackupDir != "" {
+		b, err := openBackupDir(request.Parameters.BackupDir)
+		if err != nil {
+			return err
+		}
+		defer b.close()
+		backup = b
+	}
+
 	var wg sync.WaitGroup
+	var reportMu sync.Mutex
+	var runReport RunReport
+	var failed []string // folders that stopped with an error
 
 	sem := make(chan struct{}, maxConversions)
 
@@ -358,50 +789,72 @@ func Convert(request ConversionRequest) error {
 			sem <- struct{}{}
 			defer func() { <-sem }()
 
-			if request.Parameters.OutputFileType == "pdf" {
-				folderParams := convertFolderParam{
-					tiffFolder: tiffFolder,
-					outputDirs: request.Parameters.OutputDir,
-
-					convParams: ConversionParameters{
-						Raw:                   false,
-						CCITT:                 request.Parameters.CCITT,
-						TargetRGBdpi:          request.Parameters.RGBdpi,
-						TargetGraydpi:         request.Parameters.GrayDpi,
-						TargetRGBjpegQuality:  request.Parameters.RGBJpegQuality,
-						TargetGrayjpegQuality: request.Parameters.GrayJpegQuality,
-					},
-				}
-				err := convertFolderToPDF(folderParams)
+			report := &FolderReport{Folder: tiffFolder.Name}
+			var err error
+			defer func() {
 				if err != nil {
 					fmt.Printf("Error during conversion in subdirectory %s: %v\n", tiffFolder.Name, err)
+					report.Error = err.Error()
+				}
+				reportMu.Lock()
+				runReport.Folders = append(runReport.Folders, *report)
+				if err != nil {
+					failed = append(failed, tiffFolder.Name)
+				}
+				reportMu.Unlock()
+			}()
+
+			params := folderParams(request, tiffFolder)
+			folderProfile := cmykProfile
+			if params.CMYKProfile != request.Parameters.CMYKProfile {
+				profile, readErr := os.ReadFile(params.CMYKProfile)
+				if readErr != nil {
+					err = fmt.Errorf("error reading CMYK profile: %v", readErr)
 					return
 				}
+				folderProfile = profile
+			}
+
+			if params.OutputFileType == "pdf" {
+				folderParams := convertFolderParam{
+					tiffFolder: tiffFolder,
+					outputDirs: params.OutputDir,
+					report:     report,
+					started:    started,
+					outputs:    outputs,
+
+					convParams: pdfConversionParameters(params, folderProfile),
+				}
+				err = convertFolderToPDF(folderParams)
 			} else {
 				fmt.Printf("Processing TIFF files in folder %s...\n", tiffFolder.Name)
 				fmt.Println("TIFF files count: ", len(tiffFolder.TiffFilesPaths))
 				fmt.Println("TIFF files size: ", tiffFolder.TiffFilesSize)
 				folderParams := convertFolderParam{
 					tiffFolder: tiffFolder,
-					outputDirs: request.Parameters.OutputDir,
-					convParams: ConversionParameters{
-						Raw:           true,
-						TargetRGBdpi:  request.Parameters.RGBdpi,
-						TargetGraydpi: request.Parameters.GrayDpi,
-						CCITT:         request.Parameters.CCITT,
-						TIFFMode:      request.Parameters.TIFFMode,
-					},
+					outputDirs: params.OutputDir,
+					report:     report,
+					started:    started,
+					outputs:    outputs,
+					backup:     backup,
+					convParams: tiffConversionParameters(params, folderProfile),
 				}
 				//fmt.Println(folderParams)
-				err := processTIFFFolder(folderParams)
-				if err != nil {
-					fmt.Printf("Error during conversion in subdirectory %s: %v\n", tiffFolder.Name, err)
-				}
-				return
+				err = processTIFFFolder(folderParams)
 			}
 
 		}(tiffFolder)
 	}
 	wg.Wait()
+
+	if request.Parameters.ReportPath != "" {
+		if err := writeReport(request.Parameters.ReportPath, runReport); err != nil {
+			return fmt.Errorf("error writing report: %v", err)
+		}
+	}
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return fmt.Errorf("%d of %d folder(s) failed: %s", len(failed), len(request.Folders), strings.Join(failed, ", "))
+	}
 	return nil
 }
@@ -5,20 +5,48 @@
 #include <stddef.h>
 #include <stdbool.h>
 
-void rgb_to_gray_sse2(const uint8_t* rgb, uint8_t* gray, size_t npixels, int* ccitt_ready);
+// page classification thresholds, defaults are in settings.h
+typedef struct {
+    int gray_threshold;     // max channel difference of a gray pixel
+    double gray_ratio;      // pages with a larger share of gray pixels are gray
+    int lower_threshold;    // darker gray levels count as black for CCITT
+    int upper_threshold;    // lighter gray levels count as white for CCITT
+    int ccitt_threshold;    // percent of black and white pixels of a CCITT-ready page
+    int color_threshold;    // channel difference of a colored pixel
+    double color_area_mm2;  // a colored region this large keeps the page RGB, 0 = off
+} classify_params;
 
-int read_raster(const char* path,
-                uint32_t** raster,
-                 uint16_t* orig_dpi, 
-                 size_t* orig_width, 
-                 size_t* orig_height);
+// classification statistics of a page
+typedef struct {
+    double gray_ratio;      // share of gray pixels
+    double bw_ratio;        // share of black and white pixels, gray pages only
+    double color_area_mm2;  // largest colored region, measured when the area rule decides
+} classify_stats;
 
-int read_pxls_from_raster(uint32_t* raster, size_t* width, size_t* height,
-                        uint8_t** pxls_buff, bool* gray, int* ccitt_ready);
+#define COLOR_CELL 4 // colored regions are traced on cells of 4x4 pixels
 
-int read_pxls_resampled_from_raster(uint32_t* raster, size_t* width, size_t* height,
-                                    uint8_t** pxls_buff, bool* gray, int* ccitt_ready,
-                                    int target_dpi, int orig_dpi);
+void count_color_cells(const uint8_t* rgb, size_t width, size_t y0, size_t rows,
+                       int threshold, uint8_t* cells);
+
+size_t largest_color_cell_region(uint8_t* cells, size_t cw, size_t ch);
+
+void rgb_to_gray_sse2(const uint8_t* rgb, uint8_t* gray, size_t npixels,
+                      const classify_params* params, int* ccitt_ready, double* bw_ratio);
+
+
+// handling of alpha channels and CMYK pages
+#define ALPHA_FLATTEN 0     // composite onto white
+#define ALPHA_KEEP    1     // keep as a plane for a PDF soft mask
+#define CMYK_SIMPLE   0     // plain conversion to RGB
+#define CMYK_KEEP     1     // CMYK JPEG
+#define CMYK_ICC      2     // to sRGB with the embedded or the given ICC profile
+
+// resampling filters
+#define RESAMPLE_AREA      0    // average of the covered source pixels
+#define RESAMPLE_BILINEAR  1
+#define RESAMPLE_BICUBIC   2    // Catmull-Rom
+#define RESAMPLE_LANCZOS3  3
+#define RESAMPLE_NEAREST   4
 
 typedef struct {
     const char* path;
@@ -27,17 +55,130 @@ typedef struct {
     int gray_quality;
     int rgb_target_dpi;
     int gray_target_dpi;
+    int rotate;             // extra clockwise rotation on top of Orientation
+    classify_params classify;
+    int alpha;              // ALPHA_FLATTEN or ALPHA_KEEP
+    int cmyk;               // CMYK_SIMPLE, CMYK_KEEP or CMYK_ICC
+    const unsigned char* cmyk_profile; // for CMYK files without a profile of their own
+    size_t cmyk_profile_size;
+    int filter;             // RESAMPLE_*
+    bool downsample_only;   // pages below the target resolution are not upsampled
 } tiff_convert_options;
 
+// sample conversions applied to a page
+#define SAMPLES_16BIT        0x01 // 16 bits per sample scaled to 8
+#define SAMPLES_LAB          0x02 // CIELab converted to sRGB
+#define SAMPLES_CMYK_KEPT    0x04
+#define SAMPLES_CMYK_ICC     0x08
+#define SAMPLES_CMYK_SIMPLE  0x10
+#define SAMPLES_ALPHA_FLAT   0x20
+#define SAMPLES_ALPHA_KEPT   0x40 // set only when some pixels are not opaque
+
+// how the samples of a page were decoded
+typedef struct {
+    int conversions;        // SAMPLES_* flags
+    bool cmyk;              // outBuf is a CMYK JPEG with inverted (Adobe) samples
+    unsigned char* alpha;   // alpha plane at the output size with ALPHA_KEEP, NULL if opaque
+} sample_result;
+
+int read_raster(const tiff_convert_options* options,
+                uint32_t** raster,
+                uint16_t* orig_dpi,
+                size_t* orig_width,
+                size_t* orig_height,
+                sample_result* samples);
+
+void orientation_transform(int orientation, int extra_rotate, int* mirror, int* rotate);
+
+int orient_raster(uint32_t** raster, size_t* width, size_t* height,
+                  int orientation, int extra_rotate);
+
+int read_pxls_from_raster(uint32_t* raster, size_t* width, size_t* height,
+                        uint8_t** pxls_buff, bool* gray, int* ccitt_ready,
+                        const classify_params* params, int dpi, classify_stats* stats);
+
+int read_pxls_resampled_from_raster(uint32_t* raster, size_t* width, size_t* height,
+                                    uint8_t** pxls_buff, bool* gray, int* ccitt_ready,
+                                    int target_dpi, int orig_dpi, int filter,
+                                    const classify_params* params, classify_stats* stats);
+
+
+// pages converted in bands are returned in stored order, mirror and rotate
+// turn them upright
 int convert_tiff_to_data(const tiff_convert_options* options,
                          unsigned char** outBuf, unsigned long* outSize,
                          int* ccitt_filter, bool* gray_filter,
-                         size_t* outWidth, size_t* outHeight, int* outDpi);
+                         size_t* outWidth, size_t* outHeight, int* outDpi,
+                         classify_stats* stats, int* outMirror, int* outRotate,
+                         sample_result* samples);
+
+bool page_needs_bands(const char* path);
+
+int convert_tiff_banded(const tiff_convert_options* options,
+                        unsigned char** outBuf, unsigned long* outSize,
+                        int* ccitt_filter, bool* gray_filter,
+                        size_t* outWidth, size_t* outHeight, int* outDpi,
+                        classify_stats* stats, int* outMirror, int* outRotate,
+                        sample_result* samples);
+
+int resample_raster(uint32_t** raster, size_t* width, size_t* height, int target_dpi, int orig_dpi, int filter);
+
+int resample_plane(uint8_t** plane, size_t width, size_t height,
+                   size_t new_width, size_t new_height, int filter);
+
+// source taps of every output position along one axis
+typedef struct {
+    size_t  out;
+    int     taps;           // weights per output position
+    size_t* first;          // first source position
+    int*    count;          // source positions used
+    float*  weights;
+} resample_axis;
+
+int resample_axis_init(resample_axis* a, size_t in, size_t out, int filter);
+
+void resample_axis_free(resample_axis* a);
+
+void resample_row(const resample_axis* ax, const resample_axis* ay, size_t y,
+                  const uint32_t* rows, size_t width, int components,
+                  float* tmp, uint8_t* out);
+
+void resampled_size(size_t width, size_t height, int target_dpi, int orig_dpi,
+                    size_t* new_width, size_t* new_height);
+
+int output_dpi(const tiff_convert_options* options, int target_dpi, int orig_dpi);
+
+typedef struct jpeg_stream jpeg_stream;
+
+jpeg_stream* jpeg_stream_begin(uint32_t width, uint32_t height, int quality, int dpi, int components,
+                               unsigned char** out, unsigned long* outSize);
+
+void jpeg_stream_write(jpeg_stream* s, const uint8_t* row);
+
+void jpeg_stream_end(jpeg_stream* s);
 
 int write_jpeg_to_mem(uint32_t width, uint32_t height, uint8_t* buffer,
                       int quality, int dpi, int gray,
                       unsigned char** out, unsigned long* outSize);
 
+int write_cmyk_jpeg_to_mem(uint32_t width, uint32_t height, const uint32_t* cmyk,
+                           int quality, int dpi,
+                           unsigned char** out, unsigned long* outSize);
+
+// CMYK to sRGB transform of an ICC profile; NULL in builds without the lcms tag
+// (LittleCMS) or if the profile is not a CMYK profile
+void* cmyk_icc_open(const unsigned char* profile, size_t size);
+
+// convert packed CMYK pixels to RGBA in place
+void cmyk_icc_apply(void* transform, uint32_t* pixels, size_t npixels);
+
+void cmyk_icc_close(void* transform);
+
+// available only in builds with the jpx tag (OpenJPEG)
+int write_jpx_to_mem(uint32_t width, uint32_t height, const uint8_t* buffer,
+                     int gray, int ratio,
+                     unsigned char** out, unsigned long* outSize);
+
 
 int encode_raw_g4(
     unsigned char *bits1,
@@ -47,18 +188,78 @@ int encode_raw_g4(
     unsigned long   *outSize
 );
 
+typedef struct {
+    int k;                  // PDF /K: -1 G4, 0 G3 1D, > 0 G3 2D
+    int encoded_byte_align; // G3 fill bits before EOL
+    int end_of_line;
+    int black_is_1;         // source is MinIsBlack
+    int orientation;        // TIFF Orientation tag
+} ccitt_params;
+
 int extract_ccitt_raw(const char*     path,
                     unsigned char** outBuf,
                     unsigned long*  outSize,
                     size_t*         width,
-                    size_t*         height);
+                    size_t*         height,
+                    ccitt_params*   params);
+
+typedef struct {
+    int gray;               // one component, otherwise YCbCr
+    int orientation;        // TIFF Orientation tag
+} jpeg_params;
+
+int extract_jpeg_raw(const char*     path,
+                     unsigned char** outBuf,
+                     unsigned long*  outSize,
+                     size_t*         width,
+                     size_t*         height,
+                     jpeg_params*    params);
+
+int read_bilevel_packed(const char*     path,
+                        unsigned char** outBuf,
+                        unsigned long*  outSize,
+                        size_t*         width,
+                        size_t*         height,
+                        int*            orientation);
+
+// palette pages keep their colormap, colormap holds up to 256 RGB entries
+int read_palette_indices(const char*     path,
+                         unsigned char** outBuf,
+                         unsigned long*  outSize,
+                         size_t*         width,
+                         size_t*         height,
+                         unsigned char*  colormap,
+                         int*            colors,
+                         int*            orientation);
 
 int get_compression_type(const char* path);
 
-void write_tiff(const char* filename,
+int get_resolution_dpi(const char* path);
+
+// first page fields of a TIFF, read without decoding the image
+typedef struct {
+    uint32_t width, height;
+    int dpi;
+    int compression;
+    int photometric;
+    int bits;     // bits per sample
+    int samples;  // samples per pixel
+    int pages;    // number of directories
+    int tiled;
+} tiff_header;
+
+int read_tiff_header(const char* path, tiff_header* h);
+
+int get_icc_profile(const char* path, unsigned char** out, unsigned long* size);
+
+// palette is NULL or holds colors RGB entries for bits-wide indices in buf
+int write_tiff(const char* filename,
                     uint32_t width, uint32_t height,
                     unsigned char* buf, size_t buf_size,
-                    int dpi, int compression, int gray);
+                    int dpi, int compression, int gray,
+                    const unsigned char* palette, int colors, int bits);
+
+int check_tiff(const char* filename, uint32_t width, uint32_t height);
        
                     
 #endif // CONVERTER_H
\ No newline at end of file
@@ -0,0 +1,149 @@
+package converter
+
+import (
+	"math"
+)
+
+const (
+	deskewSampleWidth = 1000 // skew is estimated on a page subsampled to about this width
+	deskewCoarseStep  = 0.2  // degrees
+	deskewFineStep    = 0.02 // degrees
+)
+
+// estimateSkew finds the angle (degrees, positive is clockwise) within
+// ±maxAngle that makes the row projection of black pixels the sharpest.
+// bin is 1 for black pixels.
+func estimateSkew(bin []uint8, width, height int, maxAngle float64) float64 {
+	step := max(1, width/deskewSampleWidth)
+	var xs, ys []int
+	for y := 0; y < height; y += step {
+		row := bin[y*width : (y+1)*width]
+		for x := 0; x < width; x += step {
+			if row[x] == 1 {
+				xs = append(xs, x/step)
+				ys = append(ys, y/step)
+			}
+		}
+	}
+	if len(xs) == 0 {
+		return 0
+	}
+
+	sw, sh := (width+step-1)/step, (height+step-1)/step
+	shift := int(float64(sw)*math.Tan(maxAngle*math.Pi/180)) + 1
+	profile := make([]float64, sh+2*shift+2)
+
+	score := func(angle float64) float64 {
+		clear(profile)
+		t := math.Tan(angle * math.Pi / 180)
+		for i := range xs {
+			// split every pixel between the two nearest rows, plain rounding
+			// aliases and hides angles of a few tenths of a degree
+			r := float64(ys[i]) - float64(xs[i])*t + float64(shift)
+			r0 := math.Floor(r)
+			if r0 < 0 || int(r0)+1 >= len(profile) {
+				continue
+			}
+			f := r - r0
+			profile[int(r0)] += 1 - f
+			profile[int(r0)+1] += f
+		}
+		// differential square sum: sharp line edges score higher than
+		// a large count, which keeps small angles apart
+		var sum float64
+		for i := 1; i < len(profile); i++ {
+			d := profile[i] - profile[i-1]
+			sum += d * d
+		}
+		return sum
+	}
+
+	search := func(from, to, step float64) float64 {
+		best, bestScore := 0.0, -1.0
+		for a := from; a <= to+step/2; a += step {
+			if s := score(a); s > bestScore {
+				best, bestScore = a, s
+			}
+		}
+		return best
+	}
+
+	coarse := search(-maxAngle, maxAngle, deskewCoarseStep)
+	fine := search(max(-maxAngle, coarse-deskewCoarseStep), min(maxAngle, coarse+deskewCoarseStep), deskewFineStep)
+	return math.Round(fine*100) / 100
+}
+
+// rotateBilinear turns gray (components=1) or RGB (components=3) pixels
+// counterclockwise by angle degrees around the page center, keeping the
+// page size; uncovered corners are filled with white
+func rotateBilinear(pxls []byte, width, height, components int, angle float64) []byte {
+	out := make([]byte, len(pxls))
+	sin, cos := math.Sincos(angle * math.Pi / 180)
+	cx, cy := float64(width-1)/2, float64(height-1)/2
+
+	for y := 0; y < height; y++ {
+		dy := float64(y) - cy
+		for x := 0; x < width; x++ {
+			dx := float64(x) - cx
+			sx := cx + dx*cos - dy*sin
+			sy := cy + dx*sin + dy*cos
+			o := (y*width + x) * components
+
+			x0, y0 := int(math.Floor(sx)), int(math.Floor(sy))
+			if x0 < 0 || y0 < 0 || x0 >= width-1 || y0 >= height-1 {
+				for c := 0; c < components; c++ {
+					out[o+c] = 255
+				}
+				continue
+			}
+			fx, fy := sx-float64(x0), sy-float64(y0)
+			i00 := (y0*width + x0) * components
+			i10 := i00 + components
+			i01 := i00 + width*components
+			i11 := i01 + components
+			for c := 0; c < components; c++ {
+				top := float64(pxls[i00+c])*(1-fx) + float64(pxls[i10+c])*fx
+				bottom := float64(pxls[i01+c])*(1-fx) + float64(pxls[i11+c])*fx
+				out[o+c] = byte(top*(1-fy) + bottom*fy + 0.5)
+			}
+		}
+	}
+	return out
+}
+
+// deskewPixels estimates the skew of gray or RGB pixels on the Otsu
+// binarized luminance and straightens the page when the angle reaches
+// the minimum. Returns the pixels, the detected angle and whether they changed.
+func deskewPixels(pxls []byte, width, height, components int, convParams ConversionParameters) ([]byte, float64, bool) {
+	n := width * height
+	gray := luminance(pxls, components)
+	// Otsu puts the threshold value itself into the dark class,
+	// for a bilevel page it is 0
+	thresh := OtsuThreshold(gray)
+	bin := make([]uint8, n)
+	for i := 0; i < n; i++ {
+		if gray[i] <= thresh {
+			bin[i] = 1
+		}
+	}
+
+	angle := estimateSkew(bin, width, height, convParams.DeskewMaxAngle)
+	if angle == 0 || math.Abs(angle) < convParams.DeskewMinAngle {
+		return pxls, angle, false
+	}
+	return rotateBilinear(pxls, width, height, components, angle), angle, true
+}
+
+// luminance returns gray pixels as they are and converts RGB pixels
+func luminance(pxls []byte, components int) []byte {
+	if components == 1 {
+		return pxls
+	}
+	n := len(pxls) / 3
+	gray := make([]byte, n)
+	for i := 0; i < n; i++ {
+		r, g, b := int(pxls[i*3]), int(pxls[i*3+1]), int(pxls[i*3+2])
+		gray[i] = byte((r*77 + g*150 + b*29) >> 8)
+	}
+	return gray
+}
@@ -0,0 +1,321 @@
+package converter
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// pagePlan is the predicted treatment of a page, from its header only
+type pagePlan struct {
+	treatment string
+	memory    int64 // bytes held while the page is converted
+	output    int64 // bytes of encoded page data
+}
+
+var compressionNames = map[int]string{
+	1: "none", 2: "CCITT RLE", 3: "CCITT G3", 4: "CCITT G4", 5: "LZW", 6: "old JPEG",
+	7: "JPEG", 8: "Deflate", 32773: "PackBits", 32946: "Deflate", 34712: "JPEG 2000",
+}
+
+var photometricNames = map[int]string{
+	photometricMinIsWhite: "min-is-white", photometricMinIsBlack: "min-is-black",
+	photometricRGB: "RGB", photometricPalette: "palette", photometricSeparated: "CMYK",
+	photometricYCbCr: "YCbCr", photometricCIELab: "CIELab",
+}
+
+func headerName(names map[int]string, value int) string {
+	if name, ok := names[value]; ok {
+		return name
+	}
+	return fmt.Sprintf("#%d", value)
+}
+
+// encodedSize is a rough size of a scanned page of pixels in compression,
+// good enough to plan disk space, not more
+func encodedSize(pixels int64, compression string, gray bool, quality, jpxRatio int) int64 {
+	components := 2.0 // RGB JPEGs are chroma subsampled
+	if gray {
+		components = 1
+	}
+	switch compression {
+	case "ccitt":
+		return pixels / 80
+	case "jbig2":
+		return pixels / 120
+	case "flate":
+		return int64(float64(pixels) * components * 0.6)
+	case "jpx":
+		if jpxRatio <= 0 {
+			jpxRatio = 2 // lossless
+		}
+		return int64(float64(pixels) * components * 1.5 / float64(jpxRatio))
+	}
+	if quality <= 0 {
+		quality = 75
+	}
+	return int64(float64(pixels) * components * (0.03 + 0.002*float64(quality)))
+}
+
+// bilevelEncoding is the encoding of pages made bilevel
+func bilevelEncoding(p ConversionParameters) string {
+	if p.Bilevel == "jbig2" && !p.Raw {
+		return "jbig2"
+	}
+	return "ccitt"
+}
+
+// predictPage guesses what ConvertTIFF does with a page from its header,
+// following the same order of checks. Classified pages are assumed to stay
+// in the class of their source.
+func predictPage(h TIFFHeader, fileSize int64, p ConversionParameters) pagePlan {
+	var plan pagePlan
+	pixels := int64(h.Width) * int64(h.Height)
+
+	switch {
+	case h.Compression == 2 || h.Compression == 3 || h.Compression == 4:
+		switch {
+		case pageEditsEnabled(p):
+			plan.treatment = "bilevel, page edits, re-encoded " + strings.ToUpper(bilevelEncoding(p))
+			plan.memory, plan.output = pixels+pixels/8, encodedSize(pixels, bilevelEncoding(p), true, 0, 0)
+		case bilevelEncoding(p) == "jbig2":
+			plan.treatment = "CCITT transcoded to JBIG2"
+			plan.memory, plan.output = pixels/4, encodedSize(pixels, "jbig2", true, 0, 0)
+		case p.Raw && (h.Compression != 4 || h.Photometric != photometricMinIsWhite):
+			plan.treatment = "CCITT transcoded to G4"
+			plan.memory, plan.output = pixels/4, encodedSize(pixels, "ccitt", true, 0, 0)
+		default:
+			plan.treatment = "CCITT passthrough"
+			plan.memory, plan.output = fileSize, fileSize
+		}
+		return plan
+	case h.Compression == CompressionJPEG && jpegPassthroughAllowed(p) && !h.Tiled:
+		gray := h.Samples == 1
+		compression, target := p.RGBCompression, p.TargetRGBdpi
+		if gray {
+			compression, target = p.GrayCompression, p.TargetGraydpi
+		}
+		if compression == "jpeg" && (h.DPI == 0 || h.DPI == outputDPI(p, target, h.DPI)) {
+			plan.treatment = "JPEG passthrough"
+			plan.memory, plan.output = fileSize, fileSize
+			return plan
+		}
+	case h.Photometric == photometricPalette && palettePageAllowed(p):
+		dpi := outputDPI(p, p.TargetRGBdpi, h.DPI)
+		out := scaledPixels(pixels, h.DPI, dpi)
+		plan.treatment = "palette, indexed" + resampleNote(h.DPI, dpi)
+		plan.memory = pixels + out
+		plan.output = out * int64(h.BitsPerSample) / 16
+		return plan
+	}
+
+	gray := h.Samples == 1 && h.Photometric != photometricPalette
+	target := p.TargetRGBdpi
+	if gray {
+		target = p.TargetGraydpi
+	}
+	dpi := outputDPI(p, target, h.DPI)
+	out := scaledPixels(pixels, h.DPI, dpi)
+	quality := p.TargetRGBjpegQuality
+	if gray {
+		quality = p.TargetGrayjpegQuality
+	}
+	mrc := p.MRC != "" && p.MRC != "off"
+	// banded pages are never bilevel
+	banded := pixels > bandedMinPixels && !decodesRaw(p)
+	ccitt := p.CCITT
+	if banded {
+		ccitt = "off"
+	}
+	rgb := fmt.Sprintf("RGB %s", p.RGBCompression)
+	bilevel := strings.ToUpper(bilevelEncoding(p))
+
+	switch {
+	case ccitt == "on":
+		plan.treatment = bilevel
+		plan.output = encodedSize(out, bilevelEncoding(p), true, 0, 0)
+	case h.Photometric == photometricSeparated && p.CMYK == "keep" && !decodesRaw(p):
+		plan.treatment = "CMYK JPEG"
+		plan.output = encodedSize(out, "jpeg", false, quality, 0) * 2
+	case gray && h.BitsPerSample == 1 && ccitt == "auto":
+		plan.treatment = bilevel
+		plan.output = encodedSize(out, bilevelEncoding(p), true, 0, 0)
+	case gray:
+		plan.treatment = "gray " + p.GrayCompression
+		if ccitt == "auto" {
+			plan.treatment += " or " + bilevel
+		}
+		plan.output = encodedSize(out, p.GrayCompression, true, quality, p.TargetGrayjpxRatio)
+	default:
+		if mrc && p.MRC == "on" {
+			rgb = "MRC"
+		} else if mrc {
+			rgb += " or MRC"
+		}
+		plan.treatment = fmt.Sprintf("%s or gray %s", rgb, p.GrayCompression)
+		if ccitt == "auto" {
+			plan.treatment = fmt.Sprintf("%s, gray %s or %s", rgb, p.GrayCompression, bilevel)
+		}
+		plan.output = encodedSize(out, p.RGBCompression, false, quality, p.TargetRGBjpxRatio)
+	}
+	plan.treatment += resampleNote(h.DPI, dpi)
+
+	if banded {
+		// banded pages hold two bands
+		plan.memory = int64(h.Width) * bandRows * 4 * 2
+	} else {
+		plan.memory = pixels*4 + out*4
+		if decodesRaw(p) {
+			plan.memory += out * 3
+		}
+	}
+	plan.memory += plan.output
+	return plan
+}
+
+// scaledPixels is the pixel count of a page resampled from dpi to target
+func scaledPixels(pixels int64, dpi, target int) int64 {
+	if dpi <= 0 || target <= 0 || dpi == target {
+		return pixels
+	}
+	scale := float64(target) / float64(dpi)
+	return int64(float64(pixels) * scale * scale)
+}
+
+func resampleNote(dpi, target int) string {
+	switch {
+	case dpi == 0:
+		return fmt.Sprintf(", no resolution, %d dpi assumed", target)
+	case dpi != target:
+		return fmt.Sprintf(", resampled %d -> %d dpi", dpi, target)
+	}
+	return ""
+}
+
+// existingOutput describes what the run does with an existing output file
+func existingOutput(path, keep string, policy outputPolicy) string {
+	if _, err := os.Lstat(path); err != nil || path == keep {
+		return ""
+	}
+	if !policy.keeps(path) {
+		return " (exists, replaced)"
+	}
+	switch policy.collision {
+	case CollisionSkip:
+		return " (exists, skipped)"
+	case CollisionSuffix:
+		return " (exists, written with a _2, _3, ... suffix)"
+	}
+	return " (exists, the run stops)"
+}
+
+func megabytes(n int64) string {
+	return fmt.Sprintf("%.1f MB", float64(n)/(1024*1024))
+}
+
+// DryRun prints what Convert would do with request: the treatment of every
+// page predicted from the TIFF headers, the output files, and estimates of
+// the output size and the memory used. Nothing is converted or written, the
+// error reports output plan errors.
+func DryRun(request ConversionRequest) error {
+	plan, errs := PlanOutputs(request)
+	outputs := make(map[string]PlannedOutput) // by folder for PDFs, by source for TIFFs
+	for _, out := range plan {
+		key := out.Folder
+		if out.Source != "" {
+			key = out.Source
+		}
+		outputs[key] = out
+	}
+
+	fmt.Println("DRY RUN: nothing is converted or written")
+	var totalPages int
+	var totalOutput, totalMemory int64
+	for _, folder := range request.Folders {
+		params := folderParams(request, folder)
+		p := pdfConversionParameters(params, nil)
+		if params.OutputFileType != "pdf" {
+			p = tiffConversionParameters(params, nil)
+		}
+
+		fmt.Printf("Folder %s: %d files, %s\n", folder.Name, len(folder.TiffFilesPaths), megabytes(folder.TiffFilesSize))
+		if folder.ConfigPath != "" {
+			fmt.Printf("  config %s\n", filepath.Base(folder.ConfigPath))
+		}
+		var folderOutput int64
+		var memories []int64
+		for _, path := range folder.TiffFilesPaths {
+			h, err := ReadTIFFHeader(path)
+			if err != nil {
+				fmt.Printf("  %s: %v\n", filepath.Base(path), err)
+				continue
+			}
+			var fileSize int64
+			if info, err := os.Stat(path); err == nil {
+				fileSize = info.Size()
+			}
+			page := predictPage(h, fileSize, p)
+			pages := ""
+			if h.Pages > 1 {
+				pages = fmt.Sprintf(", %d pages (the first is converted)", h.Pages)
+			}
+			fmt.Printf("  %s: %dx%d, %d dpi, %s, %s, %d bit%s -> %s\n",
+				filepath.Base(path), h.Width, h.Height, h.DPI,
+				headerName(compressionNames, h.Compression), headerName(photometricNames, h.Photometric),
+				h.BitsPerSample*h.Samples, pages, page.treatment)
+			if out, ok := outputs[path]; ok {
+				keep := ""
+				if p.TIFFMode == "replace" {
+					keep = path
+				}
+				policy := newOutputPolicy(params.Overwrite, params.Collision, path)
+				for _, outPath := range out.Paths {
+					fmt.Printf("    -> %s%s\n", outPath, existingOutput(outPath, keep, policy))
+				}
+			}
+			folderOutput += page.output
+			memories = append(memories, page.memory)
+		}
+
+		if out, ok := outputs[folder.Name]; ok && out.Source == "" {
+			if out.Paths == nil {
+				fmt.Printf("  output: named after the pages in %s\n", strings.Join(params.OutputDir, ", "))
+			}
+			policy := newOutputPolicy(params.Overwrite, params.Collision, folder.TiffFilesPaths...)
+			for _, outPath := range out.Paths {
+				fmt.Printf("  output: %s%s\n", outPath, existingOutput(outPath, "", policy))
+			}
+		}
+
+		// every folder runs at once, with up to one worker per CPU
+		sort.Slice(memories, func(i, j int) bool { return memories[i] > memories[j] })
+		var folderMemory int64
+		for _, memory := range memories[:min(runtime.NumCPU(), len(memories))] {
+			folderMemory += memory
+		}
+		fmt.Printf("  estimated output %s, memory %s\n", megabytes(folderOutput), megabytes(folderMemory))
+		totalPages += len(folder.TiffFilesPaths)
+		copies := len(params.OutputDir)
+		if params.OutputFileType != "pdf" && params.TIFFMode != "convert" {
+			copies = 1 // next to the sources
+		}
+		totalOutput += folderOutput * int64(copies)
+		totalMemory += folderMemory
+	}
+
+	if len(errs) > 0 {
+		fmt.Println("Output plan errors:")
+		for _, err := range errs {
+			fmt.Printf("- %v\n", err)
+		}
+	}
+	fmt.Printf("Total: %d folder(s), %d page(s), estimated output %s, peak memory %s\n",
+		len(request.Folders), totalPages, megabytes(totalOutput), megabytes(totalMemory))
+	if len(errs) > 0 {
+		return fmt.Errorf("%d output plan error(s)", len(errs))
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package converter
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+)
+
+// FlateImage is a lossless image prepared for a /FlateDecode XObject.
+// Rows are prefixed with a PNG filter type byte (PDF /Predictor 15).
+type FlateImage struct {
+	Data             []byte
+	Palette          []byte // nil unless the image is written as /Indexed
+	BitsPerComponent int
+	Colors           int // components per sample in Data (1 for indexed)
+}
+
+const maxPaletteColors = 256
+
+const (
+	pngFilterNone  = 0
+	pngFilterUp    = 2
+	pngFilterPaeth = 4
+)
+
+// encodeFlate compresses gray (components=1) or RGB (components=3) pixels
+// losslessly. Pages with no more than 256 distinct colors are stored as
+// palette indices with the smallest bit depth that fits.
+func encodeFlate(pxls []byte, width, height, components int) (FlateImage, error) {
+	if components != 1 && components != 3 {
+		return FlateImage{}, fmt.Errorf("unsupported components count %d", components)
+	}
+	if len(pxls) != width*height*components {
+		return FlateImage{}, fmt.Errorf("invalid pixel buffer length")
+	}
+
+	img := FlateImage{
+		BitsPerComponent: 8,
+		Colors:           components,
+	}
+	rows := pxls
+	rowBytes := width * components
+	bpp := components
+
+	palette, indices, ok := buildPalette(pxls, components)
+	bits := paletteBits(len(palette) / components)
+	// an 8-bit gray palette saves nothing over plain gray
+	if ok && !(components == 1 && bits == 8) {
+		img.Palette = palette
+		img.BitsPerComponent = bits
+		img.Colors = 1
+		rows, rowBytes = packIndices(indices, width, height, bits)
+		bpp = 1
+	}
+
+	data, err := deflateRows(rows, rowBytes, height, bpp)
+	if err != nil {
+		return FlateImage{}, err
+	}
+	img.Data = data
+	return img, nil
+}
+
+// encodeSMask compresses an alpha plane for a /SMask, which must be plain
+// DeviceGray, so it is never stored as palette indices
+func encodeSMask(alpha []byte, width, height int) ([]byte, error) {
+	if len(alpha) != width*height {
+		return nil, fmt.Errorf("invalid alpha buffer length")
+	}
+	return deflateRows(alpha, width, height, 1)
+}
+
+// deflateRows applies the PNG predictors and compresses the result
+func deflateRows(rows []byte, rowBytes, height, bpp int) ([]byte, error) {
+	filtered := applyPNGPredictors(rows, rowBytes, height, bpp)
+
+	var buf bytes.Buffer
+	zw, err := zlib.NewWriterLevel(&buf, zlib.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := zw.Write(filtered); err != nil {
+		return nil, fmt.Errorf("zlib write failed: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("zlib close failed: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// buildPalette returns the color table and per-pixel indices,
+// or ok=false if the image has more than maxPaletteColors colors.
+func buildPalette(pxls []byte, components int) (palette []byte, indices []byte, ok bool) {
+	npixels := len(pxls) / components
+	lookup := make(map[uint32]byte, maxPaletteColors)
+	indices = make([]byte, npixels)
+	for i := 0; i < npixels; i++ {
+		var key uint32
+		if components == 3 {
+			key = uint32(pxls[i*3])<<16 | uint32(pxls[i*3+1])<<8 | uint32(pxls[i*3+2])
+		} else {
+			key = uint32(pxls[i])
+		}
+		idx, found := lookup[key]
+		if !found {
+			if len(lookup) == maxPaletteColors {
+				return nil, nil, false
+			}
+			idx = byte(len(lookup))
+			lookup[key] = idx
+			palette = append(palette, pxls[i*components:i*components+components]...)
+		}
+		indices[i] = idx
+	}
+	return palette, indices, true
+}
+
+func paletteBits(colors int) int {
+	switch {
+	case colors <= 2:
+		return 1
+	case colors <= 4:
+		return 2
+	case colors <= 16:
+		return 4
+	}
+	return 8
+}
+
+// packIndices packs 8-bit indices into rows of bits-wide samples, MSB first.
+func packIndices(indices []byte, width, height, bits int) ([]byte, int) {
+	if bits == 8 {
+		return indices, width
+	}
+	perByte := 8 / bits
+	rowBytes := (width + perByte - 1) / perByte
+	out := make([]byte, rowBytes*height)
+	for y := 0; y < height; y++ {
+		src := indices[y*width : (y+1)*width]
+		dst := out[y*rowBytes : (y+1)*rowBytes]
+		for x, v := range src {
+			shift := 8 - bits*(x%perByte+1)
+			dst[x/perByte] |= v << shift
+		}
+	}
+	return out, rowBytes
+}
+
+// applyPNGPredictors filters every row with Up or Paeth, whichever gives
+// the smaller sum of absolute residuals, and prefixes the filter type.
+func applyPNGPredictors(rows []byte, rowBytes, height, bpp int) []byte {
+	out := make([]byte, 0, (rowBytes+1)*height)
+	prev := make([]byte, rowBytes)
+	up := make([]byte, rowBytes)
+	paeth := make([]byte, rowBytes)
+
+	for y := 0; y < height; y++ {
+		cur := rows[y*rowBytes : (y+1)*rowBytes]
+		var upSum, paethSum int
+		for x := 0; x < rowBytes; x++ {
+			var a, c byte
+			if x >= bpp {
+				a = cur[x-bpp]
+				c = prev[x-bpp]
+			}
+			b := prev[x]
+			up[x] = cur[x] - b
+			paeth[x] = cur[x] - paethPredictor(a, b, c)
+			upSum += absResidual(up[x])
+			paethSum += absResidual(paeth[x])
+		}
+		if y == 0 {
+			// Up against an all-zero row is the same as no filtering
+			out = append(out, pngFilterNone)
+			out = append(out, cur...)
+		} else if paethSum < upSum {
+			out = append(out, pngFilterPaeth)
+			out = append(out, paeth...)
+		} else {
+			out = append(out, pngFilterUp)
+			out = append(out, up...)
+		}
+		prev = cur
+	}
+	return out
+}
+
+func paethPredictor(a, b, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa := abs(p - int(a))
+	pb := abs(p - int(b))
+	pc := abs(p - int(c))
+	if pa <= pb && pa <= pc {
+		return a
+	}
+	if pb <= pc {
+		return b
+	}
+	return c
+}
+
+func absResidual(v byte) int {
+	return abs(int(int8(v)))
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
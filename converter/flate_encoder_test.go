@@ -0,0 +1,269 @@
+package converter
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+	"testing"
+)
+
+func TestPackIndices(t *testing.T) {
+	tests := []struct {
+		name          string
+		indices       []byte
+		width, height int
+		bits          int
+		want          []byte
+		rowBytes      int
+	}{
+		{"1 bit", []byte{1, 0, 1, 1, 0, 0, 0, 1}, 8, 1, 1, []byte{0xb1}, 1},
+		{"1 bit padded rows", []byte{1, 1, 1, 0, 0, 0, 0, 0, 0, 1, 0, 1, 0, 0, 0, 0, 0, 0, 1, 1}, 10, 2, 1, []byte{0xe0, 0x40, 0x40, 0xc0}, 2},
+		{"2 bits", []byte{3, 2, 1, 0, 1}, 5, 1, 2, []byte{0xe4, 0x40}, 2},
+		{"2 bits two rows", []byte{1, 2, 3, 3, 2, 1}, 3, 2, 2, []byte{0x6c, 0xe4}, 1},
+		{"4 bits", []byte{0xa, 0x5, 0xf}, 3, 1, 4, []byte{0xa5, 0xf0}, 2},
+		{"8 bits", []byte{7, 200, 3}, 3, 1, 8, []byte{7, 200, 3}, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, rowBytes := packIndices(tt.indices, tt.width, tt.height, tt.bits)
+			if !bytes.Equal(got, tt.want) || rowBytes != tt.rowBytes {
+				t.Errorf("packIndices = % x, %d, want % x, %d", got, rowBytes, tt.want, tt.rowBytes)
+			}
+		})
+	}
+}
+
+func TestApplyPNGPredictors(t *testing.T) {
+	tests := []struct {
+		name     string
+		rows     []byte
+		rowBytes int
+		bpp      int
+		want     []byte
+	}{
+		{
+			"first row is not filtered",
+			[]byte{10, 20, 30},
+			3, 1,
+			[]byte{pngFilterNone, 10, 20, 30},
+		},
+		{
+			"Up for a repeated row",
+			[]byte{10, 200, 30, 10, 200, 30},
+			3, 1,
+			[]byte{pngFilterNone, 10, 200, 30, pngFilterUp, 0, 0, 0},
+		},
+		{
+			"Up wraps around",
+			[]byte{250, 5, 4, 10},
+			2, 1,
+			[]byte{pngFilterNone, 250, 5, pngFilterUp, 10, 5},
+		},
+		{
+			// a flat row below another: Up leaves the difference in every
+			// byte, Paeth only in the first
+			"Paeth for a new flat row",
+			[]byte{0, 0, 0, 0, 50, 50, 50, 50},
+			4, 1,
+			[]byte{pngFilterNone, 0, 0, 0, 0, pngFilterPaeth, 50, 0, 0, 0},
+		},
+		{
+			// with three bytes per pixel Paeth compares each channel with
+			// the same channel of the pixel to the left
+			"Paeth per RGB channel",
+			[]byte{0, 0, 0, 0, 0, 0, 10, 20, 30, 10, 20, 30},
+			6, 3,
+			[]byte{pngFilterNone, 0, 0, 0, 0, 0, 0, pngFilterPaeth, 10, 20, 30, 0, 0, 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := applyPNGPredictors(tt.rows, tt.rowBytes, len(tt.rows)/tt.rowBytes, tt.bpp)
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("applyPNGPredictors = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPaethPredictor(t *testing.T) {
+	tests := []struct{ a, b, c, want byte }{
+		{0, 0, 0, 0},
+		{10, 20, 10, 20}, // vertical edge: the byte above
+		{20, 10, 10, 20}, // horizontal edge: the byte to the left
+		{10, 10, 20, 10}, // a ties b and wins
+		{100, 50, 80, 80},
+		{255, 0, 128, 128},
+	}
+	for _, tt := range tests {
+		if got := paethPredictor(tt.a, tt.b, tt.c); got != tt.want {
+			t.Errorf("paethPredictor(%d, %d, %d) = %d, want %d", tt.a, tt.b, tt.c, got, tt.want)
+		}
+	}
+}
+
+// decodeFlateImage inflates img, undoes the PNG predictors like a PDF reader
+// with /Predictor 15 and expands the samples back to pixels
+func decodeFlateImage(t *testing.T, img FlateImage, width, height, components int) []byte {
+	t.Helper()
+	zr, err := zlib.NewReader(bytes.NewReader(img.Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rowBytes := (width*img.Colors*img.BitsPerComponent + 7) / 8
+	bpp := (img.Colors*img.BitsPerComponent + 7) / 8
+	if len(data) != (rowBytes+1)*height {
+		t.Fatalf("inflated %d bytes, want %d rows of %d bytes and a filter byte", len(data), height, rowBytes)
+	}
+	prev := make([]byte, rowBytes)
+	samples := make([]byte, 0, rowBytes*height)
+	for y := 0; y < height; y++ {
+		filter, row := data[y*(rowBytes+1)], data[y*(rowBytes+1)+1:(y+1)*(rowBytes+1)]
+		cur := make([]byte, rowBytes)
+		for x := range row {
+			var a, c byte
+			if x >= bpp {
+				a, c = cur[x-bpp], prev[x-bpp]
+			}
+			switch filter {
+			case pngFilterNone:
+				cur[x] = row[x]
+			case pngFilterUp:
+				cur[x] = row[x] + prev[x]
+			case pngFilterPaeth:
+				cur[x] = row[x] + paethPredictor(a, prev[x], c)
+			default:
+				t.Fatalf("row %d has filter type %d", y, filter)
+			}
+		}
+		samples = append(samples, cur...)
+		prev = cur
+	}
+
+	if img.Palette == nil {
+		return samples
+	}
+	return expandIndices(samples, img.Palette, components, width, height, rowBytes, img.BitsPerComponent)
+}
+
+// expandIndices unpacks bits-wide indices from rows of rowBytes and looks
+// them up in the palette
+func expandIndices(samples, palette []byte, channels, width, height, rowBytes, bits int) []byte {
+	pxls := make([]byte, 0, width*height*channels)
+	mask := byte(1<<uint(bits) - 1)
+	for y := 0; y < height; y++ {
+		row := samples[y*rowBytes : (y+1)*rowBytes]
+		for x := 0; x < width; x++ {
+			bit := x * bits
+			idx := int(row[bit/8]>>uint(8-bits-bit%8)) & int(mask)
+			pxls = append(pxls, palette[idx*channels:(idx+1)*channels]...)
+		}
+	}
+	return pxls
+}
+
+// testPixels fills a width x height image of components with colors
+// distinct colors, as a gradient with some noise so both predictors get used
+func testPixels(width, height, components, colors int) []byte {
+	pxls := make([]byte, 0, width*height*components)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			v := (x + 2*y + (x*y)%3) % colors
+			for c := 0; c < components; c++ {
+				pxls = append(pxls, byte(v*255/(colors-1)+c*7))
+			}
+		}
+	}
+	return pxls
+}
+
+func TestEncodeFlateRoundTrip(t *testing.T) {
+	tests := []struct {
+		name       string
+		components int
+		colors     int
+		bits       int // expected BitsPerComponent
+		indexed    bool
+	}{
+		{"gray 2 colors", 1, 2, 1, true},
+		{"gray 4 colors", 1, 4, 2, true},
+		{"gray 16 colors", 1, 16, 4, true},
+		{"gray 200 colors", 1, 200, 8, false},
+		{"RGB 2 colors", 3, 2, 1, true},
+		{"RGB 3 colors", 3, 3, 2, true},
+		{"RGB 11 colors", 3, 11, 4, true},
+		{"RGB 256 colors", 3, 256, 8, true},
+	}
+	for _, tt := range tests {
+		// widths that leave a partial byte at the end of the packed rows
+		for _, width := range []int{2, 3, 5, 7, 8, 9, 13, 30} {
+			height := 6
+			if tt.colors > 16 {
+				height = 300 // enough rows for every color
+			}
+			pxls := testPixels(width, height, tt.components, tt.colors)
+			img, err := encodeFlate(pxls, width, height, tt.components)
+			if err != nil {
+				t.Fatalf("%s, width %d: %v", tt.name, width, err)
+			}
+			if img.BitsPerComponent != tt.bits || (img.Palette != nil) != tt.indexed {
+				t.Errorf("%s, width %d: %d bits, palette %v, want %d bits, palette %v", tt.name, width, img.BitsPerComponent, img.Palette != nil, tt.bits, tt.indexed)
+				continue
+			}
+			if got := decodeFlateImage(t, img, width, height, tt.components); !bytes.Equal(got, pxls) {
+				t.Errorf("%s, width %d: decoded pixels differ from the source", tt.name, width)
+			}
+		}
+	}
+}
+
+func TestEncodeFlateManyColors(t *testing.T) {
+	width, height := 20, 20
+	pxls := make([]byte, 0, width*height*3)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			pxls = append(pxls, byte(x*12), byte(y*12), byte(x*y))
+		}
+	}
+	img, err := encodeFlate(pxls, width, height, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Palette != nil || img.BitsPerComponent != 8 || img.Colors != 3 {
+		t.Fatalf("got %d bits, %d colors, palette %v, want plain 8-bit RGB", img.BitsPerComponent, img.Colors, img.Palette != nil)
+	}
+	if got := decodeFlateImage(t, img, width, height, 3); !bytes.Equal(got, pxls) {
+		t.Error("decoded pixels differ from the source")
+	}
+}
+
+func TestEncodeSMaskRoundTrip(t *testing.T) {
+	for _, width := range []int{1, 7, 9} {
+		alpha := testPixels(width, 5, 1, 2) // two levels, still stored as 8 bits
+		data, err := encodeSMask(alpha, width, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img := FlateImage{Data: data, BitsPerComponent: 8, Colors: 1}
+		if got := decodeFlateImage(t, img, width, 5, 1); !bytes.Equal(got, alpha) {
+			t.Errorf("width %d: decoded alpha differs from the source", width)
+		}
+	}
+}
+
+func TestEncodeFlateBadInput(t *testing.T) {
+	if _, err := encodeFlate(make([]byte, 8), 2, 2, 2); err == nil {
+		t.Error("two components accepted")
+	}
+	if _, err := encodeFlate(make([]byte, 11), 2, 2, 3); err == nil {
+		t.Error("short buffer accepted")
+	}
+	if _, err := encodeSMask(make([]byte, 3), 2, 2); err == nil {
+		t.Error("short alpha accepted")
+	}
+}
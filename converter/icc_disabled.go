@@ -0,0 +1,7 @@
+//go:build !lcms
+// +build !lcms
+
+package converter
+
+// ICCAvailable reports whether this build converts CMYK with ICC profiles
+const ICCAvailable = false
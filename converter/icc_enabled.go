@@ -0,0 +1,10 @@
+//go:build cgo && lcms
+// +build cgo,lcms
+
+package converter
+
+// #cgo LDFLAGS: -llcms2
+import "C"
+
+// ICCAvailable reports whether this build converts CMYK with ICC profiles
+const ICCAvailable = true
@@ -0,0 +1,39 @@
+//go:build lcms
+
+#include <stdlib.h>
+#include <lcms2.h>
+
+#include "converter.h"
+
+
+void* cmyk_icc_open(const unsigned char* profile, size_t size)
+{
+    cmsHPROFILE in = cmsOpenProfileFromMem(profile, (cmsUInt32Number)size);
+    if (!in) return NULL;
+    if (cmsGetColorSpace(in) != cmsSigCmykData) {
+        cmsCloseProfile(in);
+        return NULL;
+    }
+    cmsHPROFILE out = cmsCreate_sRGBProfile();
+    cmsHTRANSFORM t = NULL;
+    if (out) {
+        t = cmsCreateTransform(in, TYPE_CMYK_8, out, TYPE_RGBA_8, INTENT_PERCEPTUAL, 0);
+        cmsCloseProfile(out);
+    }
+    cmsCloseProfile(in);
+    return t;
+}
+
+// in place: packed C, M, Y, K bytes in, R, G, B and opaque alpha out
+void cmyk_icc_apply(void* transform, uint32_t* pixels, size_t npixels)
+{
+    cmsDoTransform((cmsHTRANSFORM)transform, pixels, pixels, (cmsUInt32Number)npixels);
+    for (size_t i = 0; i < npixels; i++) {
+        pixels[i] |= 0xFF000000u;
+    }
+}
+
+void cmyk_icc_close(void* transform)
+{
+    cmsDeleteTransform((cmsHTRANSFORM)transform);
+}
@@ -0,0 +1,27 @@
+//go:build !lcms
+
+#include <stddef.h>
+
+#include "converter.h"
+
+
+// without LittleCMS CMYK pages are converted by the plain formula
+
+void* cmyk_icc_open(const unsigned char* profile, size_t size)
+{
+    (void)profile;
+    (void)size;
+    return NULL;
+}
+
+void cmyk_icc_apply(void* transform, uint32_t* pixels, size_t npixels)
+{
+    (void)transform;
+    (void)pixels;
+    (void)npixels;
+}
+
+void cmyk_icc_close(void* transform)
+{
+    (void)transform;
+}
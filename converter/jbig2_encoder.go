@@ -0,0 +1,251 @@
+package converter
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// JBIG2 (ITU T.88) lossless generic region encoder.
+// Produces the embedded stream expected by PDF /JBIG2Decode: a page information
+// segment followed by one immediate generic region segment, arithmetic coded
+// with template 0, the nominal AT pixels and no typical prediction.
+
+const (
+	jbig2SegPageInfo               = 48
+	jbig2SegImmediateGenericRegion = 38
+)
+
+// nominal adaptive template pixels for GBTEMPLATE 0
+var jbig2TemplateAT = [8]int8{3, -1, -3, -1, 2, -2, -2, -2}
+
+// encodeJBIG2Generic encodes a packed MSB-first bilevel image (1 = black).
+func encodeJBIG2Generic(bits []byte, width, height, dpi int) ([]byte, error) {
+	rowBytes := (width + 7) / 8
+	if width <= 0 || height <= 0 || len(bits) != rowBytes*height {
+		return nil, errors.New("invalid packed bits length")
+	}
+
+	coded := jbig2EncodeGenericRegion(bits, width, height)
+
+	ppm := uint32(0)
+	if dpi > 0 {
+		ppm = uint32(float64(dpi)/0.0254 + 0.5)
+	}
+
+	out := make([]byte, 0, len(coded)+64)
+
+	// page information segment
+	page := make([]byte, 19)
+	binary.BigEndian.PutUint32(page[0:], uint32(width))
+	binary.BigEndian.PutUint32(page[4:], uint32(height))
+	binary.BigEndian.PutUint32(page[8:], ppm)
+	binary.BigEndian.PutUint32(page[12:], ppm)
+	page[16] = 0x01 // page is eventually lossless, default pixel 0, OR operator
+	// page[17:19] striping info stays 0
+	out = appendJBIG2Segment(out, 0, jbig2SegPageInfo, page)
+
+	// region segment information + generic region flags + AT pixels
+	region := make([]byte, 0, 26+len(coded))
+	var info [17]byte
+	binary.BigEndian.PutUint32(info[0:], uint32(width))
+	binary.BigEndian.PutUint32(info[4:], uint32(height))
+	// x, y location 0, external combination operator OR
+	region = append(region, info[:]...)
+	region = append(region, 0x00) // MMR 0, GBTEMPLATE 0, TPGDON 0
+	for _, v := range jbig2TemplateAT {
+		region = append(region, byte(v))
+	}
+	region = append(region, coded...)
+	out = appendJBIG2Segment(out, 1, jbig2SegImmediateGenericRegion, region)
+
+	return out, nil
+}
+
+func appendJBIG2Segment(out []byte, number uint32, segType byte, data []byte) []byte {
+	var hdr [11]byte
+	binary.BigEndian.PutUint32(hdr[0:], number)
+	hdr[4] = segType // 1-byte page association
+	hdr[5] = 0x00    // no referred-to segments
+	hdr[6] = 1       // page 1
+	binary.BigEndian.PutUint32(hdr[7:], uint32(len(data)))
+	out = append(out, hdr[:]...)
+	return append(out, data...)
+}
+
+// jbig2EncodeGenericRegion arithmetic codes every pixel in its template 0 context.
+func jbig2EncodeGenericRegion(bits []byte, width, height int) []byte {
+	// unpack into a bordered one-byte-per-pixel plane so the template
+	// never needs bounds checks: 2 rows on top, 4 columns on each side
+	const padX, padY = 4, 2
+	stride := width + 2*padX
+	plane := make([]byte, stride*(height+padY))
+	rowBytes := (width + 7) / 8
+	for y := 0; y < height; y++ {
+		src := bits[y*rowBytes : (y+1)*rowBytes]
+		dst := plane[(y+padY)*stride+padX:]
+		for x := 0; x < width; x++ {
+			dst[x] = (src[x>>3] >> (7 - uint(x&7))) & 1
+		}
+	}
+
+	at := jbig2TemplateAT
+	a1 := int(at[1])*stride + int(at[0])
+	a2 := int(at[3])*stride + int(at[2])
+	a3 := int(at[5])*stride + int(at[4])
+	a4 := int(at[7])*stride + int(at[6])
+
+	enc := newMQEncoder(1 << 16)
+	for y := 0; y < height; y++ {
+		row := (y + padY) * stride
+		for x := 0; x < width; x++ {
+			i := row + x + padX
+			up := i - stride
+			up2 := i - 2*stride
+			cx := uint32(plane[i-1]) |
+				uint32(plane[i-2])<<1 |
+				uint32(plane[i-3])<<2 |
+				uint32(plane[i-4])<<3 |
+				uint32(plane[i+a1])<<4 |
+				uint32(plane[up+2])<<5 |
+				uint32(plane[up+1])<<6 |
+				uint32(plane[up])<<7 |
+				uint32(plane[up-1])<<8 |
+				uint32(plane[up-2])<<9 |
+				uint32(plane[i+a2])<<10 |
+				uint32(plane[i+a3])<<11 |
+				uint32(plane[up2+1])<<12 |
+				uint32(plane[up2])<<13 |
+				uint32(plane[up2-1])<<14 |
+				uint32(plane[i+a4])<<15
+			enc.encode(cx, plane[i])
+		}
+	}
+	return enc.flush()
+}
+
+// MQ arithmetic coder probability estimation table (T.88 Table E.1)
+var mqQe = [47]struct {
+	qe         uint32
+	nmps, nlps uint8
+	swtch      bool
+}{
+	{0x5601, 1, 1, true}, {0x3401, 2, 6, false}, {0x1801, 3, 9, false}, {0x0AC1, 4, 12, false},
+	{0x0521, 5, 29, false}, {0x0221, 38, 33, false}, {0x5601, 7, 6, true}, {0x5401, 8, 14, false},
+	{0x4801, 9, 14, false}, {0x3801, 10, 14, false}, {0x3001, 11, 17, false}, {0x2401, 12, 18, false},
+	{0x1C01, 13, 20, false}, {0x1601, 29, 21, false}, {0x5601, 15, 14, true}, {0x5401, 16, 14, false},
+	{0x5101, 17, 15, false}, {0x4801, 18, 16, false}, {0x3801, 19, 17, false}, {0x3401, 20, 18, false},
+	{0x3001, 21, 19, false}, {0x2801, 22, 19, false}, {0x2401, 23, 20, false}, {0x2201, 24, 21, false},
+	{0x1C01, 25, 22, false}, {0x1801, 26, 23, false}, {0x1601, 27, 24, false}, {0x1401, 28, 25, false},
+	{0x1201, 29, 26, false}, {0x1101, 30, 27, false}, {0x0AC1, 31, 28, false}, {0x09C1, 32, 29, false},
+	{0x08A1, 33, 30, false}, {0x0521, 34, 31, false}, {0x0441, 35, 32, false}, {0x02A1, 36, 33, false},
+	{0x0221, 37, 34, false}, {0x0141, 38, 35, false}, {0x0111, 39, 36, false}, {0x0085, 40, 37, false},
+	{0x0049, 41, 38, false}, {0x0025, 42, 39, false}, {0x0015, 43, 40, false}, {0x0009, 44, 41, false},
+	{0x0005, 45, 42, false}, {0x0001, 45, 43, false}, {0x5601, 46, 46, false},
+}
+
+type mqEncoder struct {
+	a, c  uint32
+	ct    int
+	out   []byte // out[0] is the byte before the first code byte
+	index []uint8
+	mps   []uint8
+}
+
+func newMQEncoder(contexts int) *mqEncoder {
+	return &mqEncoder{
+		a:     0x8000,
+		ct:    12,
+		out:   []byte{0},
+		index: make([]uint8, contexts),
+		mps:   make([]uint8, contexts),
+	}
+}
+
+func (e *mqEncoder) encode(cx uint32, d byte) {
+	state := &mqQe[e.index[cx]]
+	qe := state.qe
+	e.a -= qe
+	if d == e.mps[cx] {
+		if e.a&0x8000 != 0 {
+			e.c += qe
+			return
+		}
+		if e.a < qe {
+			e.a = qe
+		} else {
+			e.c += qe
+		}
+		e.index[cx] = state.nmps
+	} else {
+		if e.a < qe {
+			e.c += qe
+		} else {
+			e.a = qe
+		}
+		if state.swtch {
+			e.mps[cx] ^= 1
+		}
+		e.index[cx] = state.nlps
+	}
+	e.renorm()
+}
+
+func (e *mqEncoder) renorm() {
+	for {
+		e.a <<= 1
+		e.c <<= 1
+		e.ct--
+		if e.ct == 0 {
+			e.byteOut()
+		}
+		if e.a&0x8000 != 0 {
+			return
+		}
+	}
+}
+
+func (e *mqEncoder) byteOut() {
+	last := len(e.out) - 1
+	if e.out[last] == 0xFF {
+		e.out = append(e.out, byte(e.c>>20))
+		e.c &= 0xFFFFF
+		e.ct = 7
+		return
+	}
+	if e.c < 0x8000000 {
+		e.out = append(e.out, byte(e.c>>19))
+		e.c &= 0x7FFFF
+		e.ct = 8
+		return
+	}
+	// propagate the carry into the previous byte
+	e.out[last]++
+	if e.out[last] == 0xFF {
+		e.c &= 0x7FFFFFF
+		e.out = append(e.out, byte(e.c>>20))
+		e.c &= 0xFFFFF
+		e.ct = 7
+		return
+	}
+	e.out = append(e.out, byte(e.c>>19))
+	e.c &= 0x7FFFF
+	e.ct = 8
+}
+
+// flush terminates the code stream and appends the 0xFFAC marker.
+func (e *mqEncoder) flush() []byte {
+	temp := e.c + e.a
+	e.c |= 0xFFFF
+	if e.c >= temp {
+		e.c -= 0x8000
+	}
+	e.c <<= uint(e.ct)
+	e.byteOut()
+	e.c <<= uint(e.ct)
+	e.byteOut()
+	if e.out[len(e.out)-1] != 0xFF {
+		e.out = append(e.out, 0xFF)
+	}
+	e.out = append(e.out, 0xAC)
+	return e.out[1:]
+}
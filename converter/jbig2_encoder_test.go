@@ -0,0 +1,249 @@
+package converter
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+// mqDecoder is the MQ decoder of T.88 Annex E.3, to check the encoder
+type mqDecoder struct {
+	data        []byte
+	bp          int
+	chigh, clow uint32
+	a           uint32
+	ct          int
+	index, mps  []uint8
+}
+
+func newMQDecoder(data []byte, contexts int) *mqDecoder {
+	d := &mqDecoder{data: data, index: make([]uint8, contexts), mps: make([]uint8, contexts)}
+	d.chigh = uint32(d.at(0))
+	d.byteIn()
+	d.chigh = (d.chigh<<7)&0xFFFF | (d.clow>>9)&0x7F
+	d.clow = (d.clow << 7) & 0xFFFF
+	d.ct -= 7
+	d.a = 0x8000
+	return d
+}
+
+// at reads past the end of the data as 0xFF, like the 0xFFAC marker
+func (d *mqDecoder) at(i int) byte {
+	if i < len(d.data) {
+		return d.data[i]
+	}
+	return 0xFF
+}
+
+func (d *mqDecoder) byteIn() {
+	if d.at(d.bp) == 0xFF {
+		if d.at(d.bp+1) > 0x8F {
+			d.clow += 0xFF00
+			d.ct = 8
+		} else {
+			d.bp++
+			d.clow += uint32(d.at(d.bp)) << 9
+			d.ct = 7
+		}
+	} else {
+		d.bp++
+		d.clow += uint32(d.at(d.bp)) << 8
+		d.ct = 8
+	}
+	if d.clow > 0xFFFF {
+		d.chigh += d.clow >> 16
+		d.clow &= 0xFFFF
+	}
+}
+
+func (d *mqDecoder) decode(cx uint32) byte {
+	state := &mqQe[d.index[cx]]
+	qe := state.qe
+	mps := d.mps[cx]
+	var bit byte
+	a := d.a - qe
+	if d.chigh < qe {
+		if a < qe {
+			bit = mps
+			d.index[cx] = state.nmps
+		} else {
+			bit = 1 ^ mps
+			if state.swtch {
+				d.mps[cx] = bit
+			}
+			d.index[cx] = state.nlps
+		}
+		a = qe
+	} else {
+		d.chigh -= qe
+		if a&0x8000 != 0 {
+			d.a = a
+			return mps
+		}
+		if a < qe {
+			bit = 1 ^ mps
+			if state.swtch {
+				d.mps[cx] = bit
+			}
+			d.index[cx] = state.nlps
+		} else {
+			bit = mps
+			d.index[cx] = state.nmps
+		}
+	}
+	for {
+		if d.ct == 0 {
+			d.byteIn()
+		}
+		a <<= 1
+		d.chigh = (d.chigh<<1)&0xFFFF | (d.clow>>15)&1
+		d.clow = (d.clow << 1) & 0xFFFF
+		d.ct--
+		if a&0x8000 != 0 {
+			break
+		}
+	}
+	d.a = a
+	return bit
+}
+
+func TestMQEncoderReference(t *testing.T) {
+	// test sequence of T.88 Annex H.2, every bit coded in context 0
+	input := []byte{
+		0x00, 0x02, 0x00, 0x51, 0x00, 0x00, 0x00, 0xC0, 0x03, 0x52, 0x87, 0x2A, 0xAA, 0xAA, 0xAA, 0xAA,
+		0x82, 0xC0, 0x20, 0x00, 0xFC, 0xD7, 0x9E, 0xF6, 0xBF, 0x7F, 0xED, 0x90, 0x4F, 0x46, 0xA3, 0xBF,
+	}
+	want := []byte{
+		0x84, 0xC7, 0x3B, 0xFC, 0xE1, 0xA1, 0x43, 0x04, 0x02, 0x20, 0x00, 0x00, 0x41, 0x0D, 0xBB, 0x86,
+		0xF4, 0x31, 0x7F, 0xFF, 0x88, 0xFF, 0x37, 0x47, 0x1A, 0xDB, 0x6A, 0xDF, 0xFF, 0xAC,
+	}
+	enc := newMQEncoder(1)
+	for _, b := range input {
+		for i := 7; i >= 0; i-- {
+			enc.encode(0, (b>>uint(i))&1)
+		}
+	}
+	if got := enc.flush(); !bytes.Equal(got, want) {
+		t.Errorf("encoded\n% X\nwant\n% X", got, want)
+	}
+}
+
+func TestMQEncoderRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	random := func(n, contexts int, ones float64) ([]uint32, []byte) {
+		cxs, bits := make([]uint32, n), make([]byte, n)
+		for i := range bits {
+			cxs[i] = uint32(rng.Intn(contexts))
+			if rng.Float64() < ones {
+				bits[i] = 1
+			}
+		}
+		return cxs, bits
+	}
+	constant := func(n int, bit byte) ([]uint32, []byte) {
+		return make([]uint32, n), bytes.Repeat([]byte{bit}, n)
+	}
+
+	zeroCxs, zeros := constant(100000, 0)
+	oneCxs, ones := constant(100000, 1)
+	evenCxs, even := random(50000, 1, 0.5)
+	sparseCxs, sparse := random(200000, 16, 0.01)
+	denseCxs, dense := random(200000, 16, 0.9)
+	manyCxs, many := random(200000, 1<<16, 0.2)
+
+	tests := []struct {
+		name     string
+		contexts int
+		cxs      []uint32
+		bits     []byte
+	}{
+		{"empty", 1, nil, nil},
+		{"single zero", 1, []uint32{0}, []byte{0}},
+		{"single one", 1, []uint32{0}, []byte{1}},
+		{"zeros", 1, zeroCxs, zeros},
+		{"ones", 1, oneCxs, ones},
+		{"even", 1, evenCxs, even},
+		{"sparse", 16, sparseCxs, sparse},
+		{"dense", 16, denseCxs, dense},
+		{"many contexts", 1 << 16, manyCxs, many},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			enc := newMQEncoder(tt.contexts)
+			for i, bit := range tt.bits {
+				enc.encode(tt.cxs[i], bit)
+			}
+			coded := enc.flush()
+			if n := len(coded); n < 2 || coded[n-2] != 0xFF || coded[n-1] != 0xAC {
+				t.Fatalf("code stream does not end with the 0xFFAC marker: % X", coded[max(0, n-4):])
+			}
+			dec := newMQDecoder(coded, tt.contexts)
+			for i, bit := range tt.bits {
+				if got := dec.decode(tt.cxs[i]); got != bit {
+					t.Fatalf("bit %d decoded as %d, want %d", i, got, bit)
+				}
+			}
+		})
+	}
+}
+
+// decodeGenericRegion decodes a template 0 generic region pixel by pixel
+func decodeGenericRegion(coded []byte, width, height int) []byte {
+	rowBytes := (width + 7) / 8
+	out := make([]byte, rowBytes*height)
+	pixel := func(x, y int) uint32 {
+		if x < 0 || x >= width || y < 0 {
+			return 0
+		}
+		return uint32(out[y*rowBytes+x/8]>>(7-uint(x%8))) & 1
+	}
+	at := jbig2TemplateAT
+	dec := newMQDecoder(coded, 1<<16)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			cx := pixel(x-1, y) | pixel(x-2, y)<<1 | pixel(x-3, y)<<2 | pixel(x-4, y)<<3 |
+				pixel(x+int(at[0]), y+int(at[1]))<<4 |
+				pixel(x+2, y-1)<<5 | pixel(x+1, y-1)<<6 | pixel(x, y-1)<<7 | pixel(x-1, y-1)<<8 | pixel(x-2, y-1)<<9 |
+				pixel(x+int(at[2]), y+int(at[3]))<<10 | pixel(x+int(at[4]), y+int(at[5]))<<11 |
+				pixel(x+1, y-2)<<12 | pixel(x, y-2)<<13 | pixel(x-1, y-2)<<14 |
+				pixel(x+int(at[6]), y+int(at[7]))<<15
+			if dec.decode(cx) == 1 {
+				out[y*rowBytes+x/8] |= 0x80 >> uint(x%8)
+			}
+		}
+	}
+	return out
+}
+
+func TestJBIG2GenericRegionRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	tests := []struct {
+		name          string
+		width, height int
+		fill          func(x, y int) bool
+	}{
+		{"white", 64, 16, func(x, y int) bool { return false }},
+		{"black", 33, 7, func(x, y int) bool { return true }},
+		{"one pixel", 1, 1, func(x, y int) bool { return true }},
+		{"stripes", 100, 40, func(x, y int) bool { return (x/3+y/5)%2 == 0 }},
+		{"text like", 203, 57, func(x, y int) bool { return (x%17 < 2 || y%11 == 0) && x%50 < 40 }},
+		{"noise", 77, 31, func(x, y int) bool { return rng.Intn(3) == 0 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rowBytes := (tt.width + 7) / 8
+			bits := make([]byte, rowBytes*tt.height)
+			for y := 0; y < tt.height; y++ {
+				for x := 0; x < tt.width; x++ {
+					if tt.fill(x, y) {
+						bits[y*rowBytes+x/8] |= 0x80 >> uint(x%8)
+					}
+				}
+			}
+			coded := jbig2EncodeGenericRegion(bits, tt.width, tt.height)
+			if got := decodeGenericRegion(coded, tt.width, tt.height); !bytes.Equal(got, bits) {
+				t.Errorf("decoded region differs from the encoded one")
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+#include <stdlib.h>
+#include <string.h>
+#include <tiffio.h>
+
+#include "converter.h"
+
+
+// Size in the first SOF marker of a JPEG stream; 0 if the coding process is
+// not one PDF DCTDecode reads (baseline, extended or progressive Huffman)
+static int jpeg_frame_size(const unsigned char* buf, size_t size, uint32_t* w, uint32_t* h)
+{
+    size_t pos = 2; // after SOI
+    while (pos + 4 <= size) {
+        if (buf[pos] != 0xFF) return 0;
+        unsigned char marker = buf[pos + 1];
+        if (marker == 0xFF) { // fill byte
+            pos++;
+            continue;
+        }
+        size_t len = ((size_t)buf[pos + 2] << 8) | buf[pos + 3];
+        if (marker >= 0xC0 && marker <= 0xCF && marker != 0xC4 && marker != 0xC8 && marker != 0xCC) {
+            if (marker > 0xC2 || pos + 9 > size) return 0;
+            *h = ((uint32_t)buf[pos + 5] << 8) | buf[pos + 6];
+            *w = ((uint32_t)buf[pos + 7] << 8) | buf[pos + 8];
+            return 1;
+        }
+        if (marker == 0xDA) return 0; // scan data before a frame header
+        pos += 2 + len;
+    }
+    return 0;
+}
+
+// Rebuild a standalone JPEG stream from a new-style JPEG TIFF with a single
+// strip or tile: the shared JPEGTables (quantization and Huffman tables) are
+// put in front of the strip data. Returns -2 for pages that cannot be passed
+// through as they are.
+int extract_jpeg_raw(const char*     path,
+                     unsigned char** outBuf,
+                     unsigned long*  outSize,
+                     size_t*         width,
+                     size_t*         height,
+                     jpeg_params*    params)
+{
+    TIFF* tif = TIFFOpen(path, "r");
+    if (!tif) return -1;
+
+    uint32_t w = 0, h = 0;
+    uint16_t comp = 0, bps = 8, spp = 1, photometric = 0, planar = PLANARCONFIG_CONTIG;
+    TIFFGetField(tif, TIFFTAG_IMAGEWIDTH,  &w);
+    TIFFGetField(tif, TIFFTAG_IMAGELENGTH, &h);
+    TIFFGetField(tif, TIFFTAG_COMPRESSION, &comp);
+    TIFFGetFieldDefaulted(tif, TIFFTAG_BITSPERSAMPLE,   &bps);
+    TIFFGetFieldDefaulted(tif, TIFFTAG_SAMPLESPERPIXEL, &spp);
+    TIFFGetFieldDefaulted(tif, TIFFTAG_PLANARCONFIG,    &planar);
+    TIFFGetField(tif, TIFFTAG_PHOTOMETRIC, &photometric);
+
+    // DCTDecode turns 3 components from YCbCr to RGB, 1 component is gray
+    int gray = (photometric == PHOTOMETRIC_MINISBLACK && spp == 1);
+    int ycbcr = (photometric == PHOTOMETRIC_YCBCR && spp == 3);
+    if (comp != COMPRESSION_JPEG || bps != 8 || planar != PLANARCONFIG_CONTIG || (!gray && !ycbcr)) {
+        TIFFClose(tif);
+        return -2;
+    }
+
+    int tiled = TIFFIsTiled(tif);
+    if (tiled) {
+        uint32_t tw = 0, th = 0;
+        TIFFGetField(tif, TIFFTAG_TILEWIDTH,  &tw);
+        TIFFGetField(tif, TIFFTAG_TILELENGTH, &th);
+        // a tile is padded to its full size, only an exact fit shows the page as is
+        if (TIFFNumberOfTiles(tif) != 1 || tw != w || th != h) {
+            TIFFClose(tif);
+            return -2;
+        }
+    } else if (TIFFNumberOfStrips(tif) != 1) {
+        TIFFClose(tif);
+        return -2;
+    }
+
+    uint64_t* byteCounts = NULL;
+    TIFFGetField(tif, tiled ? TIFFTAG_TILEBYTECOUNTS : TIFFTAG_STRIPBYTECOUNTS, &byteCounts);
+    tmsize_t rawSize = byteCounts ? (tmsize_t)byteCounts[0] : 0;
+    if (rawSize <= 4) {
+        TIFFClose(tif);
+        return -2;
+    }
+    unsigned char* raw = malloc(rawSize);
+    if (!raw) {
+        TIFFClose(tif);
+        return -3;
+    }
+    tmsize_t got = tiled ? TIFFReadRawTile(tif, 0, raw, rawSize) : TIFFReadRawStrip(tif, 0, raw, rawSize);
+    if (got <= 4 || raw[0] != 0xFF || raw[1] != 0xD8) {
+        free(raw);
+        TIFFClose(tif);
+        return got < 0 ? -4 : -2;
+    }
+
+    // tables-only stream: SOI, DQT/DHT segments, EOI
+    uint32_t tablesSize = 0;
+    unsigned char* tables = NULL;
+    TIFFGetField(tif, TIFFTAG_JPEGTABLES, &tablesSize, &tables);
+    if (tablesSize < 4 || tables[0] != 0xFF || tables[1] != 0xD8 ||
+        tables[tablesSize - 2] != 0xFF || tables[tablesSize - 1] != 0xD9) {
+        tablesSize = 0;
+    }
+
+    size_t tablesBody = tablesSize ? tablesSize - 4 : 0;
+    size_t total = 2 + tablesBody + (size_t)got - 2;
+    unsigned char* buf = malloc(total);
+    if (!buf) {
+        free(raw);
+        TIFFClose(tif);
+        return -3;
+    }
+    buf[0] = 0xFF;
+    buf[1] = 0xD8;
+    if (tablesBody) memcpy(buf + 2, tables + 2, tablesBody);
+    memcpy(buf + 2 + tablesBody, raw + 2, (size_t)got - 2);
+    free(raw);
+
+    uint16_t orientation = ORIENTATION_TOPLEFT;
+    TIFFGetFieldDefaulted(tif, TIFFTAG_ORIENTATION, &orientation);
+    TIFFClose(tif);
+
+    uint32_t fw = 0, fh = 0;
+    if (!jpeg_frame_size(buf, total, &fw, &fh) || fw != w || fh != h) {
+        free(buf);
+        return -2;
+    }
+
+    params->gray = gray;
+    params->orientation = orientation;
+    *outBuf  = buf;
+    *outSize = total;
+    *width   = w;
+    *height  = h;
+    return 0;
+}
@@ -5,48 +5,105 @@
 #include "converter.h"
 
 
+struct jpeg_stream {
+    struct jpeg_compress_struct cinfo;
+    struct jpeg_error_mgr jerr;
+    uint8_t* inverted;      // CMYK row in the Adobe convention
+};
+
+// JPEG encoder fed one row of gray, RGB or CMYK pixels at a time (1, 3 or 4
+// components); NULL if the page is larger than JPEG allows
+jpeg_stream* jpeg_stream_begin(uint32_t width, uint32_t height, int quality, int dpi, int components,
+                               unsigned char** out, unsigned long* outSize) {
+    if (width == 0 || height == 0 || width > JPEG_MAX_DIMENSION || height > JPEG_MAX_DIMENSION) {
+        return NULL;
+    }
+    jpeg_stream* s = malloc(sizeof(jpeg_stream));
+    if (!s) return NULL;
+    s->inverted = NULL;
+    if (components == 4) {
+        s->inverted = malloc((size_t)width * 4);
+        if (!s->inverted) {
+            free(s);
+            return NULL;
+        }
+    }
+
+    s->cinfo.err = jpeg_std_error(&s->jerr);
+    jpeg_create_compress(&s->cinfo);
+    jpeg_mem_dest(&s->cinfo, out, outSize);
+
+    s->cinfo.image_width = width;
+    s->cinfo.image_height = height;
+    s->cinfo.input_components = components;
+    s->cinfo.in_color_space = components == 1 ? JCS_GRAYSCALE : components == 4 ? JCS_CMYK : JCS_RGB;
+
+    jpeg_set_defaults(&s->cinfo);
+    jpeg_set_quality(&s->cinfo, quality, TRUE);
+    //jpeg_simple_progression(&s->cinfo);
+    s->cinfo.density_unit = 1;
+    s->cinfo.X_density = dpi;
+    s->cinfo.Y_density = dpi;
+
+    if (components == 3) {
+        s->cinfo.comp_info[0].h_samp_factor = 2;
+        s->cinfo.comp_info[0].v_samp_factor = 2;
+        s->cinfo.comp_info[1].h_samp_factor = 1;
+        s->cinfo.comp_info[1].v_samp_factor = 1;
+        s->cinfo.comp_info[2].h_samp_factor = 1;
+        s->cinfo.comp_info[2].v_samp_factor = 1;
+    }
+
+    jpeg_start_compress(&s->cinfo, TRUE);
+    return s;
+}
+
+void jpeg_stream_write(jpeg_stream* s, const uint8_t* row) {
+    JSAMPROW row_pointer[1] = { (JSAMPROW)row };
+    if (s->inverted) {
+        // libjpeg writes an Adobe marker for CMYK, readers take the samples as inverted
+        size_t n = (size_t)s->cinfo.image_width * 4;
+        for (size_t i = 0; i < n; i++) {
+            s->inverted[i] = 255 - row[i];
+        }
+        row_pointer[0] = s->inverted;
+    }
+    jpeg_write_scanlines(&s->cinfo, row_pointer, 1);
+}
+
+void jpeg_stream_end(jpeg_stream* s) {
+    jpeg_finish_compress(&s->cinfo);
+    jpeg_destroy_compress(&s->cinfo);
+    free(s->inverted);
+    free(s);
+}
+
 // JPEG encoder from RGBA → JPEG memory
 int write_jpeg_to_mem(uint32_t width, uint32_t height, uint8_t* buffer,
                       int quality, int dpi, int gray,
                       unsigned char** out, unsigned long* outSize) {
-    struct jpeg_compress_struct cinfo;
-    struct jpeg_error_mgr jerr;
-
-    JSAMPROW row_pointer[1];
     size_t row_stride = width * (gray ? 1 : 3);
 
-    cinfo.err = jpeg_std_error(&jerr);
-    jpeg_create_compress(&cinfo);
-    jpeg_mem_dest(&cinfo, out, outSize);
-
-    cinfo.image_width = width;
-    cinfo.image_height = height;
-    cinfo.input_components = gray ? 1 : 3;
-    cinfo.in_color_space = gray ? JCS_GRAYSCALE : JCS_RGB;
-
-    jpeg_set_defaults(&cinfo);
-    jpeg_set_quality(&cinfo, quality, TRUE);
-    //jpeg_simple_progression(&cinfo);
-    cinfo.density_unit = 1;
-    cinfo.X_density = dpi;
-    cinfo.Y_density = dpi;
-
-    if (!gray) {
-        cinfo.comp_info[0].h_samp_factor = 2;
-        cinfo.comp_info[0].v_samp_factor = 2;
-        cinfo.comp_info[1].h_samp_factor = 1;
-        cinfo.comp_info[1].v_samp_factor = 1;
-        cinfo.comp_info[2].h_samp_factor = 1;
-        cinfo.comp_info[2].v_samp_factor = 1;
+    jpeg_stream* s = jpeg_stream_begin(width, height, quality, dpi, gray ? 1 : 3, out, outSize);
+    if (!s) return -1;
+    for (uint32_t y = 0; y < height; y++) {
+        jpeg_stream_write(s, &buffer[y * row_stride]);
     }
+    jpeg_stream_end(s);
+
+    return 0;
+}
 
-    jpeg_start_compress(&cinfo, TRUE);
-    while (cinfo.next_scanline < cinfo.image_height) {
-        row_pointer[0] = &buffer[cinfo.next_scanline * row_stride];
-        jpeg_write_scanlines(&cinfo, row_pointer, 1);
+// CMYK JPEG from packed C, M, Y, K bytes
+int write_cmyk_jpeg_to_mem(uint32_t width, uint32_t height, const uint32_t* cmyk,
+                           int quality, int dpi,
+                           unsigned char** out, unsigned long* outSize) {
+    jpeg_stream* s = jpeg_stream_begin(width, height, quality, dpi, 4, out, outSize);
+    if (!s) return -1;
+    for (uint32_t y = 0; y < height; y++) {
+        jpeg_stream_write(s, (const uint8_t*)&cmyk[(size_t)y * width]);
     }
-    jpeg_finish_compress(&cinfo);
-    jpeg_destroy_compress(&cinfo);
+    jpeg_stream_end(s);
 
     return 0;
-}
\ No newline at end of file
+}
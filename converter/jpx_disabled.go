@@ -0,0 +1,13 @@
+//go:build !jpx
+// +build !jpx
+
+package converter
+
+import "errors"
+
+// JPXAvailable reports whether this build can encode JPEG 2000
+const JPXAvailable = false
+
+func encodeJPX(pxls []byte, width, height int, gray bool, ratio int) ([]byte, error) {
+	return nil, errors.New("JPEG 2000 support is not compiled in (build with -tags jpx)")
+}
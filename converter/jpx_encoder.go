@@ -0,0 +1,47 @@
+//go:build cgo && jpx
+// +build cgo,jpx
+
+package converter
+
+/*
+
+#cgo LDFLAGS: -lopenjp2
+
+#include <stdlib.h>
+
+#include "converter.h"
+
+*/
+import "C"
+import (
+	"errors"
+	"unsafe"
+)
+
+// JPXAvailable reports whether this build can encode JPEG 2000
+const JPXAvailable = true
+
+func encodeJPX(pxls []byte, width, height int, gray bool, ratio int) ([]byte, error) {
+	components := 3
+	grayInt := 0
+	if gray {
+		components = 1
+		grayInt = 1
+	}
+	if len(pxls) != width*height*components {
+		return nil, errors.New("invalid pixel buffer length")
+	}
+	var outPtr *C.uchar
+	var outSize C.ulong
+	ret := C.write_jpx_to_mem(
+		C.uint32_t(width), C.uint32_t(height),
+		(*C.uint8_t)(unsafe.Pointer(&pxls[0])),
+		C.int(grayInt), C.int(ratio),
+		&outPtr, &outSize,
+	)
+	if ret != 0 {
+		return nil, errors.New("openjpeg encode failed")
+	}
+	defer C.free(unsafe.Pointer(outPtr))
+	return goBytes(unsafe.Pointer(outPtr), int(outSize)), nil
+}
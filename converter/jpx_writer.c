@@ -0,0 +1,136 @@
+//go:build jpx
+
+#include <stdlib.h>
+#include <string.h>
+#include <openjpeg.h>
+
+#include "converter.h"
+
+
+typedef struct {
+    unsigned char *data;
+    size_t         size;
+    size_t         cap;
+    size_t         off;
+} jpx_mem_buf;
+
+static int jpx_reserve(jpx_mem_buf *m, size_t need) {
+    if (need <= m->cap) return 1;
+    size_t new_cap = need * 2 + 4096;
+    unsigned char *p = realloc(m->data, new_cap);
+    if (!p) return 0;
+    memset(p + m->cap, 0, new_cap - m->cap);
+    m->data = p;
+    m->cap = new_cap;
+    return 1;
+}
+
+static OPJ_SIZE_T jpx_write_callback(void *buf, OPJ_SIZE_T sz, void *user) {
+    jpx_mem_buf *m = (jpx_mem_buf*)user;
+    if (!jpx_reserve(m, m->off + sz)) return (OPJ_SIZE_T)-1;
+    memcpy(m->data + m->off, buf, sz);
+    m->off += sz;
+    if (m->off > m->size) m->size = m->off;
+    return sz;
+}
+
+static OPJ_OFF_T jpx_skip_callback(OPJ_OFF_T n, void *user) {
+    jpx_mem_buf *m = (jpx_mem_buf*)user;
+    if (n < 0 || !jpx_reserve(m, m->off + (size_t)n)) return -1;
+    m->off += (size_t)n;
+    if (m->off > m->size) m->size = m->off;
+    return n;
+}
+
+static OPJ_BOOL jpx_seek_callback(OPJ_OFF_T n, void *user) {
+    jpx_mem_buf *m = (jpx_mem_buf*)user;
+    if (n < 0 || !jpx_reserve(m, (size_t)n)) return OPJ_FALSE;
+    m->off = (size_t)n;
+    if (m->off > m->size) m->size = m->off;
+    return OPJ_TRUE;
+}
+
+// JPEG 2000 (JP2) encoder from RGB/gray pixels → memory.
+// ratio is the target compression ratio, 0 means lossless.
+int write_jpx_to_mem(uint32_t width, uint32_t height, const uint8_t* buffer,
+                     int gray, int ratio,
+                     unsigned char** out, unsigned long* outSize)
+{
+    int numcomps = gray ? 1 : 3;
+
+    opj_cparameters_t params;
+    opj_set_default_encoder_parameters(&params);
+    params.tcp_numlayers = 1;
+    params.cp_disto_alloc = 1;
+    params.tcp_rates[0] = ratio > 0 ? (float)ratio : 0.0f;
+    params.irreversible = ratio > 0 ? 1 : 0;
+    params.tcp_mct = gray ? 0 : 1;
+    // small pages cannot have the default 6 resolution levels
+    while (params.numresolution > 1 &&
+           ((width >> (params.numresolution - 1)) == 0 ||
+            (height >> (params.numresolution - 1)) == 0)) {
+        params.numresolution--;
+    }
+
+    opj_image_cmptparm_t cmpt[3];
+    memset(cmpt, 0, sizeof(cmpt));
+    for (int c = 0; c < numcomps; c++) {
+        cmpt[c].dx = 1;
+        cmpt[c].dy = 1;
+        cmpt[c].w = width;
+        cmpt[c].h = height;
+        cmpt[c].prec = 8;
+        cmpt[c].sgnd = 0;
+    }
+
+    opj_image_t* image = opj_image_create(numcomps, cmpt, gray ? OPJ_CLRSPC_GRAY : OPJ_CLRSPC_SRGB);
+    if (!image) return -1;
+    image->x0 = 0;
+    image->y0 = 0;
+    image->x1 = width;
+    image->y1 = height;
+
+    size_t npixels = (size_t)width * height;
+    for (int c = 0; c < numcomps; c++) {
+        OPJ_INT32* dst = image->comps[c].data;
+        for (size_t i = 0; i < npixels; i++) {
+            dst[i] = buffer[i * numcomps + c];
+        }
+    }
+
+    opj_codec_t* codec = opj_create_compress(OPJ_CODEC_JP2);
+    if (!codec || !opj_setup_encoder(codec, &params, image)) {
+        if (codec) opj_destroy_codec(codec);
+        opj_image_destroy(image);
+        return -2;
+    }
+
+    jpx_mem_buf mb = { .data = NULL, .size = 0, .cap = 0, .off = 0 };
+    opj_stream_t* stream = opj_stream_create(OPJ_J2K_STREAM_CHUNK_SIZE, OPJ_FALSE);
+    if (!stream) {
+        opj_destroy_codec(codec);
+        opj_image_destroy(image);
+        return -3;
+    }
+    opj_stream_set_user_data(stream, &mb, NULL);
+    opj_stream_set_write_function(stream, jpx_write_callback);
+    opj_stream_set_skip_function(stream, jpx_skip_callback);
+    opj_stream_set_seek_function(stream, jpx_seek_callback);
+
+    OPJ_BOOL ok = opj_start_compress(codec, image, stream) &&
+                  opj_encode(codec, stream) &&
+                  opj_end_compress(codec, stream);
+
+    opj_stream_destroy(stream);
+    opj_destroy_codec(codec);
+    opj_image_destroy(image);
+
+    if (!ok) {
+        free(mb.data);
+        return -4;
+    }
+
+    *out = mb.data;
+    *outSize = (unsigned long)mb.size;
+    return 0;
+}
@@ -0,0 +1,162 @@
+package converter
+
+import (
+	"fmt"
+	"tiff2pdf/contracts"
+)
+
+type MRCLayers = contracts.MRCLayers
+
+const (
+	mrcBackgroundScale = 3 // background is stored at 1/3 of the page resolution
+	mrcForegroundScale = 6 // foreground colors change slowly, 1/6 is enough
+
+	// auto mode: text mask coverage range of a page that benefits from MRC
+	mrcMinCoverage = 0.002
+	mrcMaxCoverage = 0.30
+)
+
+// segmentTextMask binarizes the luminance of an RGB page with Otsu + closing.
+// Returns the mask (1 = text) and the share of text pixels.
+func segmentTextMask(rgb []byte, width, height int) ([]uint8, float64) {
+	n := width * height
+	gray := make([]byte, n)
+	for i := 0; i < n; i++ {
+		r, g, b := int(rgb[i*3]), int(rgb[i*3+1]), int(rgb[i*3+2])
+		gray[i] = byte((r*77 + g*150 + b*29) >> 8)
+	}
+	thresh := OtsuThreshold(gray)
+	bin := make([]uint8, n)
+	for i := 0; i < n; i++ {
+		if gray[i] < thresh {
+			bin[i] = 1
+		}
+	}
+	mask := MorphologyClose(bin, width, height)
+	count := 0
+	for _, v := range mask {
+		count += int(v)
+	}
+	return mask, float64(count) / float64(n)
+}
+
+// buildMRCLayers splits an RGB page of dpi resolution into a text mask, a
+// background without text and a foreground carrying the text colors.
+// Returns ok=false in auto mode when the page does not look like a text page.
+func buildMRCLayers(rgb []byte, width, height, dpi int, convParams ConversionParameters) (*MRCLayers, []byte, bool, error) {
+	mask, coverage := segmentTextMask(rgb, width, height)
+	if convParams.MRC == "auto" && (coverage < mrcMinCoverage || coverage > mrcMaxCoverage) {
+		return nil, nil, false, nil
+	}
+
+	packed := packBinary(mask, width, height)
+	layers := &MRCLayers{}
+	if convParams.Bilevel == "jbig2" {
+		data, err := encodeJBIG2Generic(packed, width, height, dpi)
+		if err == nil {
+			layers.Mask = data
+			layers.MaskFormat = string(jbig2Format)
+		}
+	}
+	if layers.Mask == nil {
+		data, err := encodeRawCCITTG4(packed, width, height)
+		if err != nil {
+			return nil, nil, false, fmt.Errorf("mask encode failed: %v", err)
+		}
+		layers.Mask = data
+		layers.MaskFormat = string(ccittFormat)
+	}
+
+	bg, bgW, bgH := reduceLayer(rgb, mask, width, height, mrcBackgroundScale, 0)
+	bgData, err := encodeJPEG(bg, bgW, bgH, false, convParams.TargetRGBjpegQuality, dpi/mrcBackgroundScale)
+	if err != nil {
+		return nil, nil, false, fmt.Errorf("background encode failed: %v", err)
+	}
+	layers.BgWidth, layers.BgHeight = bgW, bgH
+
+	fg, fgW, fgH := reduceLayer(rgb, mask, width, height, mrcForegroundScale, 1)
+	fgData, err := encodeJPEG(fg, fgW, fgH, false, convParams.TargetRGBjpegQuality, dpi/mrcForegroundScale)
+	if err != nil {
+		return nil, nil, false, fmt.Errorf("foreground encode failed: %v", err)
+	}
+	layers.Foreground = fgData
+	layers.FgWidth, layers.FgHeight = fgW, fgH
+
+	return layers, bgData, true, nil
+}
+
+// reduceLayer downsamples an RGB page by scale, averaging only the pixels
+// whose mask value equals keep. Blocks without such pixels take the color
+// of the previous block in the row (or the block above) so that JPEG sees
+// smooth areas instead of holes.
+func reduceLayer(rgb []byte, mask []uint8, width, height, scale int, keep uint8) ([]byte, int, int) {
+	w2 := (width + scale - 1) / scale
+	h2 := (height + scale - 1) / scale
+	out := make([]byte, w2*h2*3)
+	filled := make([]bool, w2*h2)
+
+	for by := 0; by < h2; by++ {
+		for bx := 0; bx < w2; bx++ {
+			var sr, sg, sb, cnt int
+			for y := by * scale; y < min((by+1)*scale, height); y++ {
+				for x := bx * scale; x < min((bx+1)*scale, width); x++ {
+					i := y*width + x
+					if mask[i] != keep {
+						continue
+					}
+					sr += int(rgb[i*3])
+					sg += int(rgb[i*3+1])
+					sb += int(rgb[i*3+2])
+					cnt++
+				}
+			}
+			o := by*w2 + bx
+			if cnt > 0 {
+				out[o*3] = byte(sr / cnt)
+				out[o*3+1] = byte(sg / cnt)
+				out[o*3+2] = byte(sb / cnt)
+				filled[o] = true
+			}
+		}
+	}
+
+	for o := range filled {
+		if filled[o] {
+			continue
+		}
+		src := -1
+		if o%w2 > 0 && filled[o-1] {
+			src = o - 1
+		} else if o >= w2 && filled[o-w2] {
+			src = o - w2
+		}
+		if src < 0 {
+			// nothing to copy from yet: white background, black text
+			v := byte(255)
+			if keep == 1 {
+				v = 0
+			}
+			out[o*3], out[o*3+1], out[o*3+2] = v, v, v
+		} else {
+			copy(out[o*3:o*3+3], out[src*3:src*3+3])
+		}
+		filled[o] = true
+	}
+	return out, w2, h2
+}
+
+// packBinary packs a 0/1 mask into a 1-bit MSB2LSB buffer
+func packBinary(bin []uint8, width, height int) []byte {
+	rowBytes := (width + 7) / 8
+	out := make([]byte, rowBytes*height)
+	for y := 0; y < height; y++ {
+		src := bin[y*width : (y+1)*width]
+		dst := out[y*rowBytes : (y+1)*rowBytes]
+		for x, v := range src {
+			if v == 1 {
+				dst[x>>3] |= 0x80 >> uint(x&7)
+			}
+		}
+	}
+	return out
+}
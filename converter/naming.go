@@ -0,0 +1,308 @@
+package converter
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Output name templates: placeholders in braces are replaced, the
+// extension is added when the template has none
+const (
+	DefaultNameTemplate     = "{1}"
+	DefaultNamePattern      = `^(.+?)(-2)?$` // {1} is the folder name without the "-2" of a rescan
+	DefaultTIFFNameTemplate = "{file}"
+	AppendTIFFNameTemplate  = "_{file}"
+)
+
+// overwrite policies for output files that already exist
+const (
+	OverwriteAlways  = "always"
+	OverwriteNever   = "never"
+	OverwriteIfNewer = "if-newer" // replace files older than their newest source
+)
+
+// collision policies for existing output files that are not overwritten
+const (
+	CollisionSkip   = "skip"
+	CollisionSuffix = "suffix"
+	CollisionFail   = "fail"
+
+	// CollisionOverwrite is the overwrite collision policy from before
+	// -overwrite, kept as an alias of -overwrite always
+	CollisionOverwrite = "overwrite"
+)
+
+var placeholderRe = regexp.MustCompile(`\{([^{}]*)\}`)
+
+// nameFields are the values of the template placeholders
+type nameFields struct {
+	folder  string // folder name
+	parent  string // name of the folder's parent directory
+	file    string // source file name without extension, TIFF output
+	barcode string // separator sheet barcode, PDF output
+	date    time.Time
+	pages   int
+	index   int // document number in the folder for PDFs, page number for TIFFs
+	groups  map[string]string
+}
+
+// folderFields fills the folder placeholders and the capture groups of
+// pattern matched against the folder name
+func folderFields(folder TIFFfolder, pattern string, date time.Time) nameFields {
+	f := nameFields{
+		folder: folder.Name,
+		parent: filepath.Base(filepath.Dir(filepath.Clean(folder.Path))),
+		date:   date,
+		groups: make(map[string]string),
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return f // checked by ValidateNameTemplate
+	}
+	match := re.FindStringSubmatch(folder.Name)
+	for i, name := range re.SubexpNames() {
+		if i == 0 {
+			continue
+		}
+		value := ""
+		if match != nil {
+			value = match[i]
+		}
+		f.groups[strconv.Itoa(i)] = value
+		if name != "" {
+			f.groups[name] = value
+		}
+	}
+	return f
+}
+
+func (f nameFields) value(key string) (string, bool) {
+	switch key {
+	case "folder":
+		return f.folder, true
+	case "parent":
+		return f.parent, true
+	case "file":
+		return f.file, true
+	case "barcode":
+		return safeFileName(f.barcode), true
+	case "date":
+		return f.date.Format("2006-01-02"), true
+	case "pages":
+		return strconv.Itoa(f.pages), true
+	case "index":
+		return fmt.Sprintf("%03d", f.index), true
+	}
+	value, ok := f.groups[key]
+	return value, ok
+}
+
+// expandName fills a template and adds ext if the name has no extension
+// of the output type. Path separators become underscores.
+func expandName(template string, f nameFields, exts ...string) string {
+	name := placeholderRe.ReplaceAllStringFunc(template, func(placeholder string) string {
+		value, _ := f.value(placeholder[1 : len(placeholder)-1])
+		return value
+	})
+	name = strings.NewReplacer("/", "_", `\`, "_").Replace(strings.TrimSpace(name))
+	for _, ext := range exts {
+		if strings.EqualFold(filepath.Ext(name), ext) {
+			return name
+		}
+	}
+	if strings.Trim(name, ".") == "" {
+		// nothing left of the template, e.g. an unmatched pattern
+		name = f.folder
+		if f.file != "" {
+			name = f.file
+		}
+	}
+	return name + exts[0]
+}
+
+// tiffOutputName expands the TIFF name template for the page of source;
+// replace mode keeps the extension of the source
+func tiffOutputName(template string, f nameFields, source, tiffMode string) string {
+	exts := []string{".tif", ".tiff"}
+	if tiffMode == "replace" {
+		exts = append([]string{filepath.Ext(source)}, exts...)
+	}
+	return expandName(template, f, exts...)
+}
+
+// usesPlaceholder reports whether a template contains {key}
+func usesPlaceholder(template, key string) bool {
+	return strings.Contains(template, "{"+key+"}")
+}
+
+// ValidateNameTemplate checks the placeholders of a PDF (pdf true) or TIFF
+// name template against the folder name pattern
+func ValidateNameTemplate(template, pattern string, pdf bool) error {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid name pattern: %v", err)
+	}
+	if strings.ContainsAny(template, `/\`) {
+		return fmt.Errorf("name template %q must be a file name without a path", template)
+	}
+	groups := make(map[string]bool)
+	for i, name := range re.SubexpNames() {
+		groups[strconv.Itoa(i)] = i > 0
+		if name != "" {
+			groups[name] = true
+		}
+	}
+	for _, match := range placeholderRe.FindAllStringSubmatch(template, -1) {
+		key := match[1]
+		switch key {
+		case "folder", "parent", "date", "index":
+			continue
+		case "pages", "barcode":
+			if pdf {
+				continue
+			}
+		case "file":
+			if !pdf {
+				continue
+			}
+		default:
+			if groups[key] {
+				continue
+			}
+		}
+		return fmt.Errorf("unknown placeholder {%s} in name template %q", key, template)
+	}
+	return nil
+}
+
+// runOutputs are the output files claimed in a run, so that two folders
+// (or two pages) never write the same file
+type runOutputs struct {
+	mu     sync.Mutex
+	owners map[string]string // lower case path -> folder or source file
+}
+
+func newRunOutputs() *runOutputs {
+	return &runOutputs{owners: make(map[string]string)}
+}
+
+// outputPolicy decides about the output files of one folder or page
+type outputPolicy struct {
+	overwrite string    // always, never or if-newer
+	collision string    // existing files that are not overwritten: skip, suffix or fail
+	newest    time.Time // modification time of the newest source
+	owner     string
+	run       *runOutputs
+}
+
+// newOutputPolicy makes the policy of the outputs of sources. The sources
+// are only read for if-newer, the other policies need no modification times.
+func newOutputPolicy(overwrite, collision string, sources ...string) outputPolicy {
+	if collision == CollisionOverwrite {
+		overwrite, collision = OverwriteAlways, CollisionSkip
+	}
+	p := outputPolicy{overwrite: overwrite, collision: collision}
+	if overwrite == OverwriteIfNewer {
+		p.newest = newestModTime(sources...)
+	}
+	return p
+}
+
+// outputKey compares paths case-insensitively, names that differ only in
+// case are the same file on Windows and macOS
+func outputKey(path string) string {
+	return strings.ToLower(filepath.Clean(path))
+}
+
+// newestModTime returns the latest modification time of the files
+func newestModTime(paths ...string) time.Time {
+	var newest time.Time
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil && info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+	}
+	return newest
+}
+
+// keeps reports whether the policy keeps the existing file at path
+func (p outputPolicy) keeps(path string) bool {
+	if p.overwrite != OverwriteNever && p.overwrite != OverwriteIfNewer {
+		return false
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		return false
+	}
+	switch p.overwrite {
+	case OverwriteNever:
+		return true
+	case OverwriteIfNewer:
+		return !p.newest.After(info.ModTime())
+	}
+	return false
+}
+
+// outputName applies the overwrite and collision policies to name in every
+// output folder and claims the result for the run. A file at keep (the
+// source of replace mode) is not a collision. It returns an empty name when
+// the output is skipped.
+func (p outputPolicy) outputName(dirs []string, name, keep string) (string, error) {
+	p.run.mu.Lock()
+	defer p.run.mu.Unlock()
+
+	for _, dir := range dirs {
+		path := filepath.Join(dir, name)
+		if owner, ok := p.run.owners[outputKey(path)]; ok {
+			return "", fmt.Errorf("output file %s is also written by %s", path, owner)
+		}
+	}
+	kept := false
+	for _, dir := range dirs {
+		path := filepath.Join(dir, name)
+		if path != keep && p.keeps(path) {
+			kept = true
+		}
+	}
+	if kept {
+		switch p.collision {
+		case CollisionSkip:
+			return "", nil
+		case CollisionSuffix:
+			name = p.freeName(dirs, name)
+		default:
+			return "", fmt.Errorf("output file %s already exists", name)
+		}
+	}
+	for _, dir := range dirs {
+		p.run.owners[outputKey(filepath.Join(dir, name))] = p.owner
+	}
+	return name, nil
+}
+
+// freeName numbers name (_2, _3, ...) until no output folder has the file
+// and the run has not claimed it
+func (p outputPolicy) freeName(dirs []string, name string) string {
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	for n := 2; ; n++ {
+		candidate := fmt.Sprintf("%s_%d%s", stem, n, ext)
+		free := true
+		for _, dir := range dirs {
+			path := filepath.Join(dir, candidate)
+			_, claimed := p.run.owners[outputKey(path)]
+			if _, err := os.Lstat(path); err == nil || claimed {
+				free = false
+			}
+		}
+		if free {
+			return candidate
+		}
+	}
+}
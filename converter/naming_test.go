@@ -0,0 +1,179 @@
+package converter
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpandName(t *testing.T) {
+	date := time.Date(2024, 3, 9, 12, 0, 0, 0, time.UTC)
+	folder := func(name, pattern string) nameFields {
+		return folderFields(TIFFfolder{Name: name, Path: filepath.Join("scans", "Box7", name)}, pattern, date)
+	}
+	smith := folder("Smith_1999-2", DefaultNamePattern)
+	named := folder("Jones_2001", `^(?P<name>[A-Za-z]+)_(?P<year>\d{4})$`)
+	unmatched := folder("misc", `^(?P<name>[A-Za-z]+)_(?P<year>\d{4})$`)
+	page := smith
+	page.file, page.index = "0007", 7
+	doc := smith
+	doc.index, doc.pages, doc.barcode = 2, 12, "INV 42/7"
+
+	tests := []struct {
+		name     string
+		template string
+		fields   nameFields
+		exts     []string
+		want     string
+	}{
+		{"default template drops the rescan suffix", DefaultNameTemplate, smith, []string{".pdf"}, "Smith_1999.pdf"},
+		{"folder and parent", "{parent}-{folder}", smith, []string{".pdf"}, "Box7-Smith_1999-2.pdf"},
+		{"named groups", "{year} {name}", named, []string{".pdf"}, "2001 Jones.pdf"},
+		{"numbered groups", "{2}_{1}", named, []string{".pdf"}, "2001_Jones.pdf"},
+		{"date", "{folder}_{date}", named, []string{".pdf"}, "Jones_2001_2024-03-09.pdf"},
+		{"index is padded", "{1}_{index}", doc, []string{".pdf"}, "Smith_1999_002.pdf"},
+		{"pages", "{1} ({pages} pages)", doc, []string{".pdf"}, "Smith_1999 (12 pages).pdf"},
+		{"barcode is made safe", "{barcode}", doc, []string{".pdf"}, "INV_42_7.pdf"},
+		{"extension is kept", "{folder}.PDF", smith, []string{".pdf"}, "Smith_1999-2.PDF"},
+		{"other extension is kept as text", "{folder}.v2", smith, []string{".pdf"}, "Smith_1999-2.v2.pdf"},
+		{"path separators", "{folder}/{date}", named, []string{".pdf"}, "Jones_2001_2024-03-09.pdf"},
+		{"unknown placeholder is empty", "{folder}{nope}", smith, []string{".pdf"}, "Smith_1999-2.pdf"},
+		{"unmatched pattern falls back to the folder", "{name}", unmatched, []string{".pdf"}, "misc.pdf"},
+		{"empty name falls back to the file", "{name}", func() nameFields { f := unmatched; f.file = "0001"; return f }(), []string{".tif"}, "0001.tif"},
+		{"tiff file", DefaultTIFFNameTemplate, page, []string{".tif", ".tiff"}, "0007.tif"},
+		{"tiff keeps .tiff", "{file}.tiff", page, []string{".tif", ".tiff"}, "0007.tiff"},
+		{"spaces are trimmed", "  {folder} ", smith, []string{".pdf"}, "Smith_1999-2.pdf"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := expandName(tt.template, tt.fields, tt.exts...); got != tt.want {
+				t.Errorf("expandName(%q) = %q, want %q", tt.template, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTIFFOutputName(t *testing.T) {
+	f := nameFields{folder: "in", file: "scan"}
+	tests := []struct {
+		template, source, mode string
+		want                   string
+	}{
+		{DefaultTIFFNameTemplate, "in/scan.tif", "convert", "scan.tif"},
+		{DefaultTIFFNameTemplate, "in/scan.TIFF", "replace", "scan.TIFF"},
+		{AppendTIFFNameTemplate, "in/scan.tiff", "append", "_scan.tif"},
+		{"{file}.tiff", "in/scan.tif", "convert", "scan.tiff"},
+		{"new_{file}", "in/scan.btf", "replace", "new_scan.btf"},
+	}
+	for _, tt := range tests {
+		if got := tiffOutputName(tt.template, f, tt.source, tt.mode); got != tt.want {
+			t.Errorf("tiffOutputName(%q, %q, %s) = %q, want %q", tt.template, tt.source, tt.mode, got, tt.want)
+		}
+	}
+}
+
+func TestValidateNameTemplate(t *testing.T) {
+	const named = `^(?P<name>[A-Za-z]+)_(?P<year>\d{4})$`
+	tests := []struct {
+		template, pattern string
+		pdf               bool
+		err               string // part of the error, empty if valid
+	}{
+		{DefaultNameTemplate, DefaultNamePattern, true, ""},
+		{"{folder}_{parent}_{date}_{index}", DefaultNamePattern, true, ""},
+		{"{barcode} {pages}", DefaultNamePattern, true, ""},
+		{"{name}-{year}-{1}-{2}", named, true, ""},
+		{DefaultTIFFNameTemplate, DefaultNamePattern, false, ""},
+		{"{folder}_{file}_{index}", DefaultNamePattern, false, ""},
+		{"{0}", DefaultNamePattern, true, "unknown placeholder {0}"},
+		{"{2}", DefaultNamePattern, true, ""},
+		{"{3}", DefaultNamePattern, true, "unknown placeholder {3}"},
+		{"{name}", DefaultNamePattern, true, "unknown placeholder {name}"},
+		{"{file}", DefaultNamePattern, true, "unknown placeholder {file}"},
+		{"{barcode}", DefaultNamePattern, false, "unknown placeholder {barcode}"},
+		{"{pages}", DefaultNamePattern, false, "unknown placeholder {pages}"},
+		{"out/{folder}", DefaultNamePattern, true, "without a path"},
+		{`out\{folder}`, DefaultNamePattern, true, "without a path"},
+		{"{folder}", "([a-z", true, "invalid name pattern"},
+	}
+	for _, tt := range tests {
+		err := ValidateNameTemplate(tt.template, tt.pattern, tt.pdf)
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("ValidateNameTemplate(%q, %q, %v) = %v, want no error", tt.template, tt.pattern, tt.pdf, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("ValidateNameTemplate(%q, %q, %v) = %v, want an error with %q", tt.template, tt.pattern, tt.pdf, err, tt.err)
+		}
+	}
+}
+
+func TestOutputPolicyOutputName(t *testing.T) {
+	dir := t.TempDir()
+	other := t.TempDir()
+	old := time.Now().Add(-time.Hour)
+	for _, name := range []string{"old.pdf", "new.pdf", "taken.pdf", "taken_2.pdf", "source.tif"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the source changed after old.pdf and before new.pdf
+	source := filepath.Join(dir, "source.tif")
+	for path, mtime := range map[string]time.Time{filepath.Join(dir, "old.pdf"): old, source: old.Add(time.Minute)} {
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name                 string
+		overwrite, collision string
+		dirs                 []string
+		file, keep           string
+		claimed              string // claimed earlier in the run by another owner
+		want                 string
+		err                  string
+	}{
+		{"new file", OverwriteNever, CollisionFail, []string{dir}, "free.pdf", "", "", "free.pdf", ""},
+		{"always overwrites", OverwriteAlways, CollisionFail, []string{dir}, "taken.pdf", "", "", "taken.pdf", ""},
+		{"alias overwrites", OverwriteNever, CollisionOverwrite, []string{dir}, "taken.pdf", "", "", "taken.pdf", ""},
+		{"never skips", OverwriteNever, CollisionSkip, []string{dir}, "taken.pdf", "", "", "", ""},
+		{"never fails", OverwriteNever, CollisionFail, []string{dir}, "taken.pdf", "", "", "", "already exists"},
+		{"suffix skips used numbers", OverwriteNever, CollisionSuffix, []string{dir}, "taken.pdf", "", "", "taken_3.pdf", ""},
+		{"if-newer replaces old files", OverwriteIfNewer, CollisionFail, []string{dir}, "old.pdf", "", "", "old.pdf", ""},
+		{"if-newer keeps new files", OverwriteIfNewer, CollisionSkip, []string{dir}, "new.pdf", "", "", "", ""},
+		{"replace mode source", OverwriteNever, CollisionFail, []string{dir}, "source.tif", source, "", "source.tif", ""},
+		{"existing in one of two folders", OverwriteNever, CollisionSkip, []string{other, dir}, "taken.pdf", "", "", "", ""},
+		{"claimed by another folder", OverwriteAlways, CollisionSkip, []string{dir}, "free.pdf", "", "free.pdf", "", "also written by folder A"},
+		{"claimed in another case", OverwriteAlways, CollisionSkip, []string{dir}, "FREE.pdf", "", "free.pdf", "", "also written by folder A"},
+		{"suffix avoids claimed names", OverwriteNever, CollisionSuffix, []string{dir}, "new.pdf", "", "new_2.pdf", "new_3.pdf", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			run := newRunOutputs()
+			if tt.claimed != "" {
+				run.owners[outputKey(filepath.Join(dir, tt.claimed))] = "folder A"
+			}
+			p := newOutputPolicy(tt.overwrite, tt.collision, source)
+			p.owner, p.run = "folder B", run
+			got, err := p.outputName(tt.dirs, tt.file, tt.keep)
+			switch {
+			case tt.err == "" && err != nil:
+				t.Fatalf("outputName(%q) error: %v", tt.file, err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Fatalf("outputName(%q) = %q, %v, want an error with %q", tt.file, got, err, tt.err)
+			}
+			if got != tt.want {
+				t.Errorf("outputName(%q) = %q, want %q", tt.file, got, tt.want)
+			}
+			if got != "" {
+				for _, d := range tt.dirs {
+					if owner := run.owners[outputKey(filepath.Join(d, got))]; owner != "folder B" {
+						t.Errorf("%s is claimed by %q, want folder B", filepath.Join(d, got), owner)
+					}
+				}
+			}
+		})
+	}
+}
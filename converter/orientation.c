@@ -0,0 +1,61 @@
+#include <stdlib.h>
+#include <tiffio.h>
+
+#include "converter.h"
+
+
+// Mirror (left-right, applied first) and clockwise rotation that bring a
+// TIFF Orientation upright, plus an extra clockwise rotation on top
+void orientation_transform(int orientation, int extra_rotate, int* mirror, int* rotate)
+{
+    int m = 0, r = 0;
+    switch (orientation) {
+    case ORIENTATION_TOPRIGHT: m = 1; r = 0;   break;
+    case ORIENTATION_BOTRIGHT: m = 0; r = 180; break;
+    case ORIENTATION_BOTLEFT:  m = 1; r = 180; break;
+    case ORIENTATION_LEFTTOP:  m = 1; r = 270; break;
+    case ORIENTATION_RIGHTTOP: m = 0; r = 90;  break;
+    case ORIENTATION_RIGHTBOT: m = 1; r = 90;  break;
+    case ORIENTATION_LEFTBOT:  m = 0; r = 270; break;
+    default: break; // TOPLEFT or invalid
+    }
+    *mirror = m;
+    *rotate = (r + extra_rotate) % 360;
+}
+
+// Turn a raster read in stored order upright; width and height are swapped
+// for quarter turns
+int orient_raster(uint32_t** raster, size_t* width, size_t* height, int orientation, int extra_rotate)
+{
+    int mirror = 0, rotate = 0;
+    orientation_transform(orientation, extra_rotate, &mirror, &rotate);
+    if (!mirror && rotate == 0) return 0;
+
+    size_t w = *width, h = *height;
+    uint32_t* src = *raster;
+    uint32_t* dst = malloc(w * h * sizeof(uint32_t));
+    if (!dst) return -1;
+
+    size_t nw = (rotate == 90 || rotate == 270) ? h : w;
+    for (size_t y = 0; y < h; y++) {
+        const uint32_t* row = src + y * w;
+        for (size_t x = 0; x < w; x++) {
+            uint32_t v = row[mirror ? w - 1 - x : x];
+            size_t dx = x, dy = y;
+            switch (rotate) {
+            case 90:  dx = h - 1 - y; dy = x;         break;
+            case 180: dx = w - 1 - x; dy = h - 1 - y; break;
+            case 270: dx = y;         dy = w - 1 - x; break;
+            }
+            dst[dy * nw + dx] = v;
+        }
+    }
+
+    free(src);
+    *raster = dst;
+    if (rotate == 90 || rotate == 270) {
+        *width = h;
+        *height = w;
+    }
+    return 0;
+}
@@ -0,0 +1,236 @@
+package converter
+
+import (
+	"image"
+)
+
+// Optional edits of a decoded page before it is encoded. Pages are edited as
+// gray or RGB pixels; bilevel pages are unpacked to gray and packed again.
+
+const (
+	edgeSearchShare = 0.25 // dark edges are searched in the outer quarter of the page
+	edgeDarkShare   = 0.5  // a row or column is part of a dark edge when half of it is dark
+)
+
+// pageEditsEnabled reports whether pages are edited as raw pixels before encoding
+func pageEditsEnabled(convParams ConversionParameters) bool {
+	return convParams.Deskew ||
+		(convParams.AutoCrop != "" && convParams.AutoCrop != "off") ||
+		convParams.FixedCropMM != [4]float64{}
+}
+
+// rawPixelsNeeded reports whether editPage has to see the decoded page
+func rawPixelsNeeded(convParams ConversionParameters) bool {
+	return pageEditsEnabled(convParams) || blankDetectionEnabled(convParams)
+}
+
+// editPage runs the enabled edits on gray (components=1) or RGB pixels at dpi:
+// fixed crop, dark edge removal, deskew and content crop, in that order.
+// The blank check runs before the content crop, which would take away the
+// margins it ignores.
+// Returns the pixels and their new size.
+func editPage(pxls []byte, width, height, components, dpi int, convParams ConversionParameters, report *PageReport) ([]byte, int, int) {
+	page := image.Rect(0, 0, width, height)
+	kept := page // area of the original page that is still there
+	area := page // part of the buffer that still holds the page, whitening shrinks it
+	pad := mmToPixels(convParams.CropPaddingMM, dpi)
+
+	apply := func(r image.Rectangle) {
+		r = r.Intersect(area)
+		if r.Empty() || r == area {
+			return
+		}
+		if convParams.CropAction == "whiten" {
+			whitenOutside(pxls, width, height, components, r)
+			area = r
+			kept = r
+		} else {
+			pxls = cropPixels(pxls, width, height, components, r)
+			width, height = r.Dx(), r.Dy()
+			area = image.Rect(0, 0, width, height)
+			kept = r.Add(kept.Min)
+		}
+	}
+	// detect runs a bounds detector on the part of the page that is left,
+	// whitened margins would hide dark borders behind them
+	detect := func(find func(gray []byte, width, height, pad int) image.Rectangle) image.Rectangle {
+		gray := luminance(pxls, components)
+		if area != image.Rect(0, 0, width, height) {
+			gray = cropPixels(gray, width, height, 1, area)
+		}
+		return find(gray, area.Dx(), area.Dy(), pad).Add(area.Min)
+	}
+
+	if convParams.FixedCropMM != [4]float64{} {
+		apply(fixedCropRect(width, height, dpi, convParams.FixedCropMM))
+	}
+	if convParams.AutoCrop == "edges" || convParams.AutoCrop == "content" {
+		apply(detect(darkEdgeRect))
+	}
+	if convParams.Deskew {
+		pxls, report.SkewAngle, report.Deskewed = deskewPixels(pxls, width, height, components, convParams)
+	}
+	if blankDetectionEnabled(convParams) {
+		gray := luminance(pxls, components)
+		if area != image.Rect(0, 0, width, height) {
+			gray = cropPixels(gray, width, height, 1, area)
+		}
+		report.InkCoverage, report.Blank = detectBlank(gray, area.Dx(), area.Dy(), dpi, convParams)
+	}
+	if convParams.AutoCrop == "content" {
+		apply(detect(contentRect))
+	}
+
+	if kept != page {
+		report.CropBox = []int{kept.Min.X, kept.Min.Y, kept.Max.X, kept.Max.Y}
+	}
+	return pxls, width, height
+}
+
+// editPacked runs editPage on a packed MSB2LSB bilevel page (1 = black)
+func editPacked(bits []byte, width, height, dpi int, convParams ConversionParameters, report *PageReport) ([]byte, int, int) {
+	gray := unpackBits(bits, width, height)
+	gray, width, height = editPage(gray, width, height, 1, dpi, convParams, report)
+	return packGrayTo1Bit(gray, width, height), width, height
+}
+
+// unpackBits turns a packed MSB2LSB bilevel page (1 = black) into gray pixels
+func unpackBits(bits []byte, width, height int) []byte {
+	rowBytes := (width + 7) / 8
+	gray := make([]byte, width*height)
+	for y := 0; y < height; y++ {
+		row := bits[y*rowBytes : (y+1)*rowBytes]
+		for x := 0; x < width; x++ {
+			if row[x>>3]&(0x80>>uint(x&7)) == 0 {
+				gray[y*width+x] = 255
+			}
+		}
+	}
+	return gray
+}
+
+func mmToPixels(mm float64, dpi int) int {
+	return int(mm*float64(dpi)/25.4 + 0.5)
+}
+
+// fixedCropRect keeps the page without the given top, right, bottom and left
+// margins in mm; empty if nothing would be left
+func fixedCropRect(width, height, dpi int, mm [4]float64) image.Rectangle {
+	r := image.Rect(
+		mmToPixels(mm[3], dpi),
+		mmToPixels(mm[0], dpi),
+		width-mmToPixels(mm[1], dpi),
+		height-mmToPixels(mm[2], dpi),
+	)
+	return r.Intersect(image.Rect(0, 0, width, height))
+}
+
+// darkEdgeRect finds dark scanner bed borders: runs of mostly dark rows and
+// columns starting at the page edges. Found borders are trimmed by pad more.
+func darkEdgeRect(gray []byte, width, height, pad int) image.Rectangle {
+	thresh := OtsuThreshold(gray)
+	rowDark := make([]int, height)
+	colDark := make([]int, width)
+	for y := 0; y < height; y++ {
+		row := gray[y*width : (y+1)*width]
+		for x, v := range row {
+			if v <= thresh {
+				rowDark[y]++
+				colDark[x]++
+			}
+		}
+	}
+
+	scan := func(counts []int, total int, from, step int) int {
+		edge, limit := 0, int(float64(len(counts))*edgeSearchShare)
+		for i := from; edge < limit; i += step {
+			if float64(counts[i]) < edgeDarkShare*float64(total) {
+				break
+			}
+			edge++
+		}
+		if edge > 0 {
+			edge += pad
+		}
+		return edge
+	}
+
+	top := scan(rowDark, width, 0, 1)
+	bottom := scan(rowDark, width, height-1, -1)
+	left := scan(colDark, height, 0, 1)
+	right := scan(colDark, height, width-1, -1)
+	return image.Rect(left, top, width-right, height-bottom).Intersect(image.Rect(0, 0, width, height))
+}
+
+// contentRect finds the bounds of dark content, ignoring rows and columns
+// with only a few specks, and widens them by pad. The whole page is returned
+// when it has no content.
+func contentRect(gray []byte, width, height, pad int) image.Rectangle {
+	thresh := OtsuThreshold(gray)
+	rowDark := make([]int, height)
+	colDark := make([]int, width)
+	for y := 0; y < height; y++ {
+		row := gray[y*width : (y+1)*width]
+		for x, v := range row {
+			if v <= thresh {
+				rowDark[y]++
+				colDark[x]++
+			}
+		}
+	}
+
+	first := func(counts []int, minCount int) int {
+		for i, c := range counts {
+			if c >= minCount {
+				return i
+			}
+		}
+		return -1
+	}
+	last := func(counts []int, minCount int) int {
+		for i := len(counts) - 1; i >= 0; i-- {
+			if counts[i] >= minCount {
+				return i
+			}
+		}
+		return -1
+	}
+
+	minRow := max(2, width/400)
+	minCol := max(2, height/400)
+	top, bottom := first(rowDark, minRow), last(rowDark, minRow)
+	left, right := first(colDark, minCol), last(colDark, minCol)
+	if top < 0 || left < 0 {
+		return image.Rect(0, 0, width, height)
+	}
+	r := image.Rect(left-pad, top-pad, right+1+pad, bottom+1+pad)
+	return r.Intersect(image.Rect(0, 0, width, height))
+}
+
+func cropPixels(pxls []byte, width, height, components int, r image.Rectangle) []byte {
+	rowBytes := r.Dx() * components
+	out := make([]byte, rowBytes*r.Dy())
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		src := (y*width + r.Min.X) * components
+		copy(out[(y-r.Min.Y)*rowBytes:], pxls[src:src+rowBytes])
+	}
+	return out
+}
+
+func whitenOutside(pxls []byte, width, height, components int, r image.Rectangle) {
+	for y := 0; y < height; y++ {
+		row := pxls[y*width*components : (y+1)*width*components]
+		if y < r.Min.Y || y >= r.Max.Y {
+			for i := range row {
+				row[i] = 255
+			}
+			continue
+		}
+		for i := 0; i < r.Min.X*components; i++ {
+			row[i] = 255
+		}
+		for i := r.Max.X * components; i < len(row); i++ {
+			row[i] = 255
+		}
+	}
+}
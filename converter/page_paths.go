@@ -0,0 +1,35 @@
+package converter
+
+// the checks that pick the conversion path of a page, shared by ConvertTIFF
+// and the dry run
+
+// decodesRaw reports whether pages are decoded to raw pixels instead of JPEG:
+// flate, jpx, MRC, page edits and blank detection are handled on the Go
+// side, so they need raw pixels too
+func decodesRaw(convParams ConversionParameters) bool {
+	return convParams.Raw || convParams.RGBCompression != "jpeg" || convParams.GrayCompression != "jpeg" ||
+		(convParams.MRC != "" && convParams.MRC != "off") || rawPixelsNeeded(convParams)
+}
+
+// jpegPassthroughAllowed reports whether a JPEG page may skip decoding:
+// nothing has to look at its pixels and JPEG is the output compression
+func jpegPassthroughAllowed(convParams ConversionParameters) bool {
+	return convParams.JPEGPassthrough && !convParams.Raw && convParams.CCITT == "off" &&
+		(convParams.MRC == "" || convParams.MRC == "off") && !rawPixelsNeeded(convParams)
+}
+
+// palettePageAllowed reports whether palette pages may keep their colormap:
+// nothing has to look at their pixels and pages are not made bilevel anyway
+func palettePageAllowed(convParams ConversionParameters) bool {
+	return convParams.CCITT != "on" && (convParams.MRC == "" || convParams.MRC == "off") &&
+		!rawPixelsNeeded(convParams)
+}
+
+// outputDPI is the resolution a page of dpi is converted to, like output_dpi
+// on the C side
+func outputDPI(convParams ConversionParameters, targetDPI, dpi int) int {
+	if convParams.DownsampleOnly && dpi > 0 && dpi < targetDPI {
+		return dpi
+	}
+	return targetDPI
+}
@@ -0,0 +1,125 @@
+#include <stdlib.h>
+#include <tiffio.h>
+
+#include "converter.h"
+
+
+// Old writers store 8-bit colormap values; libtiff takes a colormap without
+// any value above 255 for one of those
+static int colormap_shift(const uint16_t* r, const uint16_t* g, const uint16_t* b, int n)
+{
+    for (int i = 0; i < n; i++) {
+        if (r[i] >= 256 || g[i] >= 256 || b[i] >= 256) return 8;
+    }
+    return 0;
+}
+
+// Decode a palette TIFF (Photometric 3) with 1, 2, 4 or 8 bits per sample
+// into one 8-bit index per pixel in stored order, with the colormap scaled
+// to 8-bit RGB entries. Returns -2 for pages that are not such palette images.
+int read_palette_indices(const char*     path,
+                         unsigned char** outBuf,
+                         unsigned long*  outSize,
+                         size_t*         width,
+                         size_t*         height,
+                         unsigned char*  colormap,
+                         int*            colors,
+                         int*            orientation)
+{
+    TIFF* tif = TIFFOpen(path, "r");
+    if (!tif) return -1;
+
+    uint32_t w = 0, h = 0;
+    uint16_t bps = 1, spp = 1, photometric = 0;
+    TIFFGetField(tif, TIFFTAG_IMAGEWIDTH,  &w);
+    TIFFGetField(tif, TIFFTAG_IMAGELENGTH, &h);
+    TIFFGetFieldDefaulted(tif, TIFFTAG_BITSPERSAMPLE,   &bps);
+    TIFFGetFieldDefaulted(tif, TIFFTAG_SAMPLESPERPIXEL, &spp);
+    TIFFGetField(tif, TIFFTAG_PHOTOMETRIC, &photometric);
+
+    uint16_t *red = NULL, *green = NULL, *blue = NULL;
+    if (photometric != PHOTOMETRIC_PALETTE || w == 0 || h == 0 || spp != 1 ||
+        (bps != 1 && bps != 2 && bps != 4 && bps != 8) ||
+        !TIFFGetField(tif, TIFFTAG_COLORMAP, &red, &green, &blue)) {
+        TIFFClose(tif);
+        return -2;
+    }
+
+    int n = 1 << bps;
+    int shift = colormap_shift(red, green, blue, n);
+    for (int i = 0; i < n; i++) {
+        colormap[i * 3]     = (unsigned char)(red[i]   >> shift);
+        colormap[i * 3 + 1] = (unsigned char)(green[i] >> shift);
+        colormap[i * 3 + 2] = (unsigned char)(blue[i]  >> shift);
+    }
+
+    uint16_t orient = ORIENTATION_TOPLEFT;
+    TIFFGetFieldDefaulted(tif, TIFFTAG_ORIENTATION, &orient);
+
+    size_t packedRow = ((size_t)w * bps + 7) / 8;
+    unsigned char* buf = malloc((size_t)w * h);
+    unsigned char* row = malloc(packedRow);
+    if (!buf || !row) {
+        free(buf);
+        free(row);
+        TIFFClose(tif);
+        return -4;
+    }
+
+    int rc = 0;
+    if (TIFFIsTiled(tif)) {
+        uint32_t tw = 0, th = 0;
+        TIFFGetField(tif, TIFFTAG_TILEWIDTH,  &tw);
+        TIFFGetField(tif, TIFFTAG_TILELENGTH, &th);
+        size_t tileRow = ((size_t)tw * bps + 7) / 8;
+        unsigned char* tile = malloc(TIFFTileSize(tif));
+        if (!tile || tw == 0 || th == 0) {
+            rc = -4;
+        }
+        for (uint32_t ty = 0; rc == 0 && ty < h; ty += th) {
+            for (uint32_t tx = 0; tx < w; tx += tw) {
+                if (TIFFReadTile(tif, tile, tx, ty, 0, 0) < 0) {
+                    rc = -5;
+                    break;
+                }
+                uint32_t rows = h - ty < th ? h - ty : th;
+                uint32_t cols = w - tx < tw ? w - tx : tw;
+                for (uint32_t r = 0; r < rows; r++) {
+                    const unsigned char* src = tile + r * tileRow;
+                    unsigned char* dst = buf + (size_t)(ty + r) * w + tx;
+                    for (uint32_t x = 0; x < cols; x++) {
+                        size_t bit = (size_t)x * bps;
+                        dst[x] = (src[bit >> 3] >> (8 - bps - (bit & 7))) & (n - 1);
+                    }
+                }
+            }
+        }
+        free(tile);
+    } else {
+        for (uint32_t y = 0; y < h; y++) {
+            if (TIFFReadScanline(tif, row, y, 0) < 0) {
+                rc = -5;
+                break;
+            }
+            unsigned char* dst = buf + (size_t)y * w;
+            for (uint32_t x = 0; x < w; x++) {
+                size_t bit = (size_t)x * bps;
+                dst[x] = (row[bit >> 3] >> (8 - bps - (bit & 7))) & (n - 1);
+            }
+        }
+    }
+    free(row);
+    TIFFClose(tif);
+    if (rc != 0) {
+        free(buf);
+        return rc;
+    }
+
+    *outBuf  = buf;
+    *outSize = (unsigned long)((size_t)w * h);
+    *width   = w;
+    *height  = h;
+    *colors  = n;
+    *orientation = orient;
+    return 0;
+}
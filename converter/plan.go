@@ -0,0 +1,125 @@
+package converter
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"tiff2pdf/contracts"
+	"time"
+)
+
+// PlannedOutput is a file a folder (PDF) or a source page (TIFF) is going
+// to write
+type PlannedOutput struct {
+	Folder string
+	Source string   // source TIFF of a TIFF output, empty for PDFs
+	Paths  []string // one per output folder, nil when the name depends on the page contents
+}
+
+// PlanError stops a run before anything is converted, Errors are the
+// errors of PlanOutputs
+type PlanError struct {
+	Errors []error
+}
+
+func (e *PlanError) Error() string {
+	return fmt.Sprintf("output collisions: %v (%d in total)", e.Errors[0], len(e.Errors))
+}
+
+// folderParams are the run flags with the folder config applied
+func folderParams(request ConversionRequest, folder TIFFfolder) contracts.InputFlags {
+	if folder.Flags != nil {
+		return *folder.Flags
+	}
+	return request.Parameters
+}
+
+// pdfNameKnown reports whether the PDF name of a folder is known before
+// its pages are converted: separator sheets, blank page splits and the
+// {barcode} placeholder depend on the pages
+func pdfNameKnown(params contracts.InputFlags) bool {
+	if len(params.Separators) > 0 || params.BlankMode == "split" {
+		return false
+	}
+	if usesPlaceholder(params.OutputName, "barcode") {
+		return false
+	}
+	return params.BlankMode != "drop" || !usesPlaceholder(params.OutputName, "pages")
+}
+
+// PlanOutputs expands the output names of every folder before anything is
+// converted. The errors are the outputs written twice in the run, outputs
+// that would replace another source TIFF before it is converted and, with
+// the fail collision policy, the existing files that would stop a folder.
+func PlanOutputs(request ConversionRequest) ([]PlannedOutput, []error) {
+	var plan []PlannedOutput
+	var errs []error
+	started := time.Now()
+	owners := make(map[string]string)
+	sources := make(map[string]string)
+	for _, folder := range request.Folders {
+		for _, source := range folder.TiffFilesPaths {
+			sources[outputKey(source)] = source
+		}
+	}
+
+	add := func(out PlannedOutput, owner string, policy outputPolicy, keep string) {
+		plan = append(plan, out)
+		for _, path := range out.Paths {
+			key := outputKey(path)
+			if first, ok := owners[key]; ok {
+				errs = append(errs, fmt.Errorf("%s and %s both write %s", first, owner, path))
+				continue
+			}
+			owners[key] = owner
+			if source, ok := sources[key]; ok && path != keep {
+				errs = append(errs, fmt.Errorf("%s: output %s would replace the source %s", owner, path, filepath.Base(source)))
+				continue
+			}
+			if path != keep && policy.collision == CollisionFail && policy.keeps(path) {
+				errs = append(errs, fmt.Errorf("%s: output file %s already exists", owner, path))
+			}
+		}
+	}
+
+	for _, folder := range request.Folders {
+		params := folderParams(request, folder)
+		fields := folderFields(folder, params.NamePattern, started)
+
+		if params.OutputFileType == "pdf" {
+			out := PlannedOutput{Folder: folder.Name}
+			if pdfNameKnown(params) {
+				fields.index, fields.pages = 1, len(folder.TiffFilesPaths)
+				name := expandName(params.OutputName, fields, ".pdf")
+				for _, dir := range params.OutputDir {
+					out.Paths = append(out.Paths, filepath.Join(dir, name))
+				}
+			}
+			policy := newOutputPolicy(params.Overwrite, params.Collision, folder.TiffFilesPaths...)
+			add(out, "folder "+folder.Name, policy, "")
+			continue
+		}
+
+		template := tiffNameTemplate(params)
+		for i, source := range folder.TiffFilesPaths {
+			base := filepath.Base(source)
+			fields.file, fields.index = strings.TrimSuffix(base, filepath.Ext(base)), i+1
+			name := tiffOutputName(template, fields, source, params.TIFFMode)
+			dirs := params.OutputDir
+			keep := ""
+			if params.TIFFMode != "convert" {
+				dirs = []string{filepath.Dir(source)}
+			}
+			if params.TIFFMode == "replace" {
+				keep = source
+			}
+			out := PlannedOutput{Folder: folder.Name, Source: source}
+			for _, dir := range dirs {
+				out.Paths = append(out.Paths, filepath.Join(dir, name))
+			}
+			policy := newOutputPolicy(params.Overwrite, params.Collision, source)
+			add(out, "file "+base, policy, keep)
+		}
+	}
+	return plan, errs
+}
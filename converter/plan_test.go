@@ -0,0 +1,130 @@
+package converter
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"tiff2pdf/contracts"
+)
+
+func TestPlanOutputs(t *testing.T) {
+	in, out := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(out, "Jones_2001.pdf"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	folder := func(name string, files ...string) contracts.TIFFfolder {
+		f := contracts.TIFFfolder{Name: name, Path: filepath.Join(in, name)}
+		for _, file := range files {
+			f.TiffFilesPaths = append(f.TiffFilesPaths, filepath.Join(in, name, file))
+		}
+		return f
+	}
+	pdf := func(collision string) contracts.InputFlags {
+		return contracts.InputFlags{
+			OutputFileType: "pdf",
+			OutputDir:      []string{out},
+			OutputName:     DefaultNameTemplate,
+			NamePattern:    DefaultNamePattern,
+			Overwrite:      OverwriteNever,
+			Collision:      collision,
+		}
+	}
+	tiff := func(mode, template string) contracts.InputFlags {
+		return contracts.InputFlags{
+			OutputFileType: "tiff",
+			OutputDir:      []string{out},
+			TIFFMode:       mode,
+			TIFFName:       template,
+			NamePattern:    DefaultNamePattern,
+			Overwrite:      OverwriteNever,
+			Collision:      CollisionSkip,
+		}
+	}
+
+	tests := []struct {
+		name    string
+		params  contracts.InputFlags
+		folders []contracts.TIFFfolder
+		paths   [][]string // planned paths per output
+		errs    []string   // parts of the errors, in order
+	}{
+		{
+			"one PDF per folder",
+			pdf(CollisionSkip),
+			[]contracts.TIFFfolder{folder("Smith_1999", "1.tif"), folder("Jones_2001", "1.tif")},
+			[][]string{{filepath.Join(out, "Smith_1999.pdf")}, {filepath.Join(out, "Jones_2001.pdf")}},
+			nil,
+		},
+		{
+			"rescan maps to the same PDF",
+			pdf(CollisionSkip),
+			[]contracts.TIFFfolder{folder("Smith_1999", "1.tif"), folder("Smith_1999-2", "1.tif")},
+			[][]string{{filepath.Join(out, "Smith_1999.pdf")}, {filepath.Join(out, "Smith_1999.pdf")}},
+			[]string{"folder Smith_1999 and folder Smith_1999-2 both write " + filepath.Join(out, "Smith_1999.pdf")},
+		},
+		{
+			"fail with an existing file",
+			pdf(CollisionFail),
+			[]contracts.TIFFfolder{folder("Smith_1999", "1.tif"), folder("Jones_2001", "1.tif")},
+			[][]string{{filepath.Join(out, "Smith_1999.pdf")}, {filepath.Join(out, "Jones_2001.pdf")}},
+			[]string{"folder Jones_2001: output file " + filepath.Join(out, "Jones_2001.pdf") + " already exists"},
+		},
+		{
+			"names from the pages are not planned",
+			func() contracts.InputFlags { p := pdf(CollisionFail); p.Separators = []string{"patch"}; return p }(),
+			[]contracts.TIFFfolder{folder("Jones_2001", "1.tif")},
+			[][]string{nil},
+			nil,
+		},
+		{
+			"TIFF convert mode",
+			tiff("convert", ""),
+			[]contracts.TIFFfolder{folder("in", "a.tif", "b.TIFF")},
+			[][]string{{filepath.Join(out, "a.tif")}, {filepath.Join(out, "b.tif")}},
+			nil,
+		},
+		{
+			"replace mode keeps the source name",
+			tiff("replace", ""),
+			[]contracts.TIFFfolder{folder("in", "a.tif")},
+			[][]string{{filepath.Join(in, "in", "a.tif")}},
+			nil,
+		},
+		{
+			"renamed output replaces another source",
+			tiff("replace", "{index}"),
+			[]contracts.TIFFfolder{folder("in", "z.tif", "001.tif")},
+			[][]string{{filepath.Join(in, "in", "001.tif")}, {filepath.Join(in, "in", "002.tif")}},
+			[]string{"file z.tif: output " + filepath.Join(in, "in", "001.tif") + " would replace the source 001.tif"},
+		},
+		{
+			"append mode writes next to the sources",
+			tiff("append", ""),
+			[]contracts.TIFFfolder{folder("in", "a.tif")},
+			[][]string{{filepath.Join(in, "in", "_a.tif")}},
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan, errs := PlanOutputs(ConversionRequest{Parameters: tt.params, Folders: tt.folders})
+			if len(plan) != len(tt.paths) {
+				t.Fatalf("planned %d outputs, want %d: %+v", len(plan), len(tt.paths), plan)
+			}
+			for i, p := range plan {
+				if strings.Join(p.Paths, "|") != strings.Join(tt.paths[i], "|") {
+					t.Errorf("output %d paths %q, want %q", i, p.Paths, tt.paths[i])
+				}
+			}
+			if len(errs) != len(tt.errs) {
+				t.Fatalf("errors %v, want %d", errs, len(tt.errs))
+			}
+			for i, err := range errs {
+				if !strings.Contains(err.Error(), tt.errs[i]) {
+					t.Errorf("error %q, want it to contain %q", err, tt.errs[i])
+				}
+			}
+		})
+	}
+}
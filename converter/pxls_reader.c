@@ -4,11 +4,115 @@
 #include <tiffio.h>
 
 #include "converter.h"
-#include "settings.h"
+
+#define COLOR_CELL_MIN (COLOR_CELL * COLOR_CELL / 2) // colored pixels of a colored cell
+
+// Count the colored pixels of rgb rows starting at row y0 into cells of
+// COLOR_CELL x COLOR_CELL pixels, cw cells per row
+void count_color_cells(const uint8_t* rgb, size_t width, size_t y0, size_t rows,
+                       int threshold, uint8_t* cells)
+{
+    size_t cw = (width + COLOR_CELL - 1) / COLOR_CELL;
+    for (size_t y = 0; y < rows; y++) {
+        uint8_t* cell_row = cells + ((y0 + y) / COLOR_CELL) * cw;
+        for (size_t x = 0; x < width; x++) {
+            const uint8_t* p = rgb + (y * width + x) * 3;
+            int mx = p[0], mn = p[0];
+            if (p[1] > mx) mx = p[1];
+            if (p[1] < mn) mn = p[1];
+            if (p[2] > mx) mx = p[2];
+            if (p[2] < mn) mn = p[2];
+            if (mx - mn > threshold) {
+                cell_row[x / COLOR_CELL]++;
+            }
+        }
+    }
+}
+
+// Largest 8-connected region of colored cells in pixels. A cell counts when
+// at least half of it is colored, so thin color fringes along black text do not.
+// The cells are cleared on the way.
+size_t largest_color_cell_region(uint8_t* cells, size_t cw, size_t ch)
+{
+    size_t cap = 1024;
+    size_t* stack = malloc(cap * sizeof(size_t));
+    if (!stack) return 0;
+
+    size_t largest = 0;
+    for (size_t i = 0; i < cw * ch; i++) {
+        if (cells[i] < COLOR_CELL_MIN) continue;
+        size_t count = 0, top = 0;
+        cells[i] = 0;
+        stack[top++] = i;
+        while (top > 0) {
+            size_t c = stack[--top];
+            count++;
+            size_t cx = c % cw, cy = c / cw;
+            for (int dy = -1; dy <= 1; dy++) {
+                for (int dx = -1; dx <= 1; dx++) {
+                    if ((dx < 0 && cx == 0) || (dy < 0 && cy == 0) ||
+                        (dx > 0 && cx + 1 >= cw) || (dy > 0 && cy + 1 >= ch)) continue;
+                    size_t n = (cy + dy) * cw + cx + dx;
+                    if (cells[n] < COLOR_CELL_MIN) continue;
+                    if (top == cap) {
+                        // the stack grows with the region, not with the page
+                        size_t* grown = realloc(stack, cap * 2 * sizeof(size_t));
+                        if (!grown) {
+                            free(stack);
+                            return largest * COLOR_CELL * COLOR_CELL;
+                        }
+                        stack = grown;
+                        cap *= 2;
+                    }
+                    cells[n] = 0;
+                    stack[top++] = n;
+                }
+            }
+        }
+        if (count > largest) largest = count;
+    }
+
+    free(stack);
+    return largest * COLOR_CELL * COLOR_CELL;
+}
+
+static size_t largest_color_region(const uint8_t* rgb, size_t width, size_t height, int threshold)
+{
+    size_t cw = (width + COLOR_CELL - 1) / COLOR_CELL;
+    size_t ch = (height + COLOR_CELL - 1) / COLOR_CELL;
+    uint8_t* cells = calloc(cw * ch, 1);
+    if (!cells) return 0;
+    count_color_cells(rgb, width, 0, height, threshold, cells);
+    size_t largest = largest_color_cell_region(cells, cw, ch);
+    free(cells);
+    return largest;
+}
+
+// A page is gray when enough of its pixels are gray, unless the color area
+// rule finds a large enough colored region (a stamp, a logo)
+static bool classify_gray(const uint8_t* rgb, size_t width, size_t height, size_t gr_count,
+                          const classify_params* params, int dpi, classify_stats* stats)
+{
+    stats->gray_ratio = (double)gr_count / (double)(width * height);
+    stats->bw_ratio = 0;
+    stats->color_area_mm2 = 0;
+    if (stats->gray_ratio <= params->gray_ratio) {
+        return false;
+    }
+    if (params->color_area_mm2 > 0 && dpi > 0) {
+        double mm = 25.4 / dpi;
+        stats->color_area_mm2 = largest_color_region(rgb, width, height, params->color_threshold) * mm * mm;
+        if (stats->color_area_mm2 >= params->color_area_mm2) {
+            return false;
+        }
+    }
+    return true;
+}
 
 // read pixels to rgb
 int read_pxls_from_raster(uint32_t* raster, size_t* width, size_t* height,
-                        uint8_t** pxls_buff, bool* gray, int* ccitt_ready)
+                        uint8_t** pxls_buff, bool* gray, int* ccitt_ready,
+                        const classify_params* params, int dpi, classify_stats* stats)
 {
 
     int ccitt_mode = *ccitt_ready;
@@ -52,21 +156,20 @@ int read_pxls_from_raster(uint32_t* raster, size_t* width, size_t* height,
             rgb[dst + 0] = r;
             rgb[dst + 1] = g;
             rgb[dst + 2] = b;
-            if (abs(r-g) < GRAY_THRESHOLD && abs(r-b) < GRAY_THRESHOLD && abs(g-b) < GRAY_THRESHOLD) {
+            if (abs(r-g) < params->gray_threshold && abs(r-b) < params->gray_threshold && abs(g-b) < params->gray_threshold) {
                 gr_count++;
             }
         }
     }
 
-    double gray_ratio = (double)gr_count / (double)(npixels);
-    if (gray_ratio > GRAY_RATIO || ccitt_mode == 1) {
+    if (classify_gray(rgb, *width, *height, gr_count, params, dpi, stats) || ccitt_mode == 1) {
         uint8_t* gray_buff =  malloc(npixels);
         if (!gray_buff) {
             free(rgb);
             return -6;
         }
         int ready_for_ccitt = 0;
-        rgb_to_gray_sse2(rgb, gray_buff, npixels, &ready_for_ccitt);
+        rgb_to_gray_sse2(rgb, gray_buff, npixels, params, &ready_for_ccitt, &stats->bw_ratio);
 
         if (ccitt_mode == -1) {
             ready_for_ccitt = 0;
@@ -93,7 +196,8 @@ int read_pxls_from_raster(uint32_t* raster, size_t* width, size_t* height,
 // read pixels to rgb_resampled
 int read_pxls_resampled_from_raster(uint32_t* raster, size_t* width, size_t* height,
                                     uint8_t** pxls_buff, bool* gray, int* ccitt_ready,
-                                    int target_dpi, int orig_dpi)
+                                    int target_dpi, int orig_dpi, int filter,
+                                    const classify_params* params, classify_stats* stats)
 {
     int ccitt_mode = *ccitt_ready;
 
@@ -112,9 +216,8 @@ int read_pxls_resampled_from_raster(uint32_t* raster, size_t* width, size_t* hei
         return -4;
     }
 
-    double resample_scale = (double)target_dpi / (double)orig_dpi;
-    size_t new_width  = (*width)  * resample_scale + 0.5;
-    size_t new_height = (*height) * resample_scale + 0.5;
+    size_t new_width, new_height;
+    resampled_size(*width, *height, target_dpi, orig_dpi, &new_width, &new_height);
 
     npixels = new_width * new_height;
     if (npixels > SIZE_MAX / 3) {
@@ -122,73 +225,37 @@ int read_pxls_resampled_from_raster(uint32_t* raster, size_t* width, size_t* hei
     }
 
     uint8_t* rgb_resampled = malloc(npixels * 3);
-    if (!rgb_resampled) {
+    float* tmp = malloc((*width) * 3 * sizeof(float));
+    resample_axis ax, ay;
+    int ax_rc = resample_axis_init(&ax, *width, new_width, filter);
+    int ay_rc = resample_axis_init(&ay, *height, new_height, filter);
+    if (!rgb_resampled || !tmp || ax_rc != 0 || ay_rc != 0) {
+        free(rgb_resampled);
+        free(tmp);
+        resample_axis_free(&ax);
+        resample_axis_free(&ay);
         return -6;
     }
 
-    uint32_t px;
-    uint8_t r, g, b;
     size_t gr_count = 0;
-    size_t px_index;
-
-    // bilinear resampling
     for (size_t y = 0; y < new_height; y++) {
-        double fy = y / resample_scale;
-        size_t    y0 = (size_t)floor(fy);
-        double wy = fy - y0;
-        if (y0 < 0)       { y0 = 0;    wy = 0; }
-        if (y0 >= (*height)-1) { y0 = (*height)-2; wy = 1; }
-        int y1 = y0 + 1;
-
+        uint8_t* row = rgb_resampled + y * new_width * 3;
+        resample_row(&ax, &ay, y, raster + ay.first[y] * (*width), *width, 3, tmp, row);
         for (size_t x = 0; x < new_width; x++) {
-            double fx = x / resample_scale;
-            size_t    x0 = (size_t)floor(fx);
-            double wx = fx - x0;
-            if (x0 < 0)      { x0 = 0;    wx = 0; }
-            if (x0 >= (*width)-1)  { x0 = (*width)-2;  wx = 1; }
-            int x1 = x0 + 1;
-
-            // 4 pixel neighbors
-            uint32_t p00 = raster[y0*(*width) + x0];
-            uint32_t p10 = raster[y0*(*width) + x1];
-            uint32_t p01 = raster[y1*(*width) + x0];
-            uint32_t p11 = raster[y1*(*width) + x1];
-
-            // get channels
-            uint8_t r00 = TIFFGetR(p00), g00 = TIFFGetG(p00), b00 = TIFFGetB(p00);
-            uint8_t r10 = TIFFGetR(p10), g10 = TIFFGetG(p10), b10 = TIFFGetB(p10);
-            uint8_t r01 = TIFFGetR(p01), g01 = TIFFGetG(p01), b01 = TIFFGetB(p01);
-            uint8_t r11 = TIFFGetR(p11), g11 = TIFFGetG(p11), b11 = TIFFGetB(p11);
-
-            // linear interpolation X
-            double r0 = r00*(1-wx) + r10*wx;
-            double g0 = g00*(1-wx) + g10*wx;
-            double b0 = b00*(1-wx) + b10*wx;
-            double r1 = r01*(1-wx) + r11*wx;
-            double g1 = g01*(1-wx) + g11*wx;
-            double b1 = b01*(1-wx) + b11*wx;
-
-            // linear interpolation Y
-            uint8_t rf = (uint8_t)(r0*(1-wy) + r1*wy + 0.5);
-            uint8_t gf = (uint8_t)(g0*(1-wy) + g1*wy + 0.5);
-            uint8_t bf = (uint8_t)(b0*(1-wy) + b1*wy + 0.5);
-
-            px_index = y * new_width + x;
-            rgb_resampled[px_index*3 + 0] = rf;
-            rgb_resampled[px_index*3 + 1] = gf;
-            rgb_resampled[px_index*3 + 2] = bf;
-            if (abs(rf-gf) < GRAY_THRESHOLD && abs(rf-bf) < GRAY_THRESHOLD && abs(gf-bf) < GRAY_THRESHOLD) {
+            int rf = row[x * 3], gf = row[x * 3 + 1], bf = row[x * 3 + 2];
+            if (abs(rf-gf) < params->gray_threshold && abs(rf-bf) < params->gray_threshold && abs(gf-bf) < params->gray_threshold) {
                 gr_count++;
             }
-
         }
     }
+    free(tmp);
+    resample_axis_free(&ax);
+    resample_axis_free(&ay);
 
     *width = new_width;
     *height = new_height;
 
-    double gray_ratio = (double)gr_count / (double)(npixels);
-    if (gray_ratio > GRAY_RATIO || ccitt_mode == 1) {
+    if (classify_gray(rgb_resampled, new_width, new_height, gr_count, params, target_dpi, stats) || ccitt_mode == 1) {
         uint8_t* gray_buff =  malloc(npixels);
 
         if (!gray_buff) {
@@ -196,7 +263,7 @@ int read_pxls_resampled_from_raster(uint32_t* raster, size_t* width, size_t* hei
             return -7;
         }
         int ready_for_ccitt = 0;
-        rgb_to_gray_sse2(rgb_resampled, gray_buff, npixels, &ready_for_ccitt);
+        rgb_to_gray_sse2(rgb_resampled, gray_buff, npixels, params, &ready_for_ccitt, &stats->bw_ratio);
 
         if (ccitt_mode == -1) {
             ready_for_ccitt = 0;
@@ -218,4 +285,99 @@ int read_pxls_resampled_from_raster(uint32_t* raster, size_t* width, size_t* hei
     *ccitt_ready = false;
 
     return 0;
-}
\ No newline at end of file
+}
+// Resampling of all four bytes of a raster, for packed CMYK and alpha
+// planes; the raster is replaced
+int resample_raster(uint32_t** raster, size_t* width, size_t* height, int target_dpi, int orig_dpi, int filter)
+{
+    size_t new_width, new_height;
+    resampled_size(*width, *height, target_dpi, orig_dpi, &new_width, &new_height);
+    if (new_width > SIZE_MAX / sizeof(uint32_t) / new_height) {
+        return -5;
+    }
+    uint32_t* out = malloc(new_width * new_height * sizeof(uint32_t));
+    uint8_t* row = malloc(new_width * 4);
+    float* tmp = malloc((*width) * 4 * sizeof(float));
+    resample_axis ax, ay;
+    int ax_rc = resample_axis_init(&ax, *width, new_width, filter);
+    int ay_rc = resample_axis_init(&ay, *height, new_height, filter);
+    if (!out || !row || !tmp || ax_rc != 0 || ay_rc != 0) {
+        free(out);
+        free(row);
+        free(tmp);
+        resample_axis_free(&ax);
+        resample_axis_free(&ay);
+        return -6;
+    }
+
+    for (size_t y = 0; y < new_height; y++) {
+        resample_row(&ax, &ay, y, *raster + ay.first[y] * (*width), *width, 4, tmp, row);
+        uint32_t* dst = out + y * new_width;
+        for (size_t x = 0; x < new_width; x++) {
+            const uint8_t* p = row + x * 4;
+            dst[x] = p[0] | (uint32_t)p[1] << 8 | (uint32_t)p[2] << 16 | (uint32_t)p[3] << 24;
+        }
+    }
+    free(row);
+    free(tmp);
+    resample_axis_free(&ax);
+    resample_axis_free(&ay);
+
+    free(*raster);
+    *raster = out;
+    *width = new_width;
+    *height = new_height;
+    return 0;
+}
+
+// One byte per pixel plane (an alpha channel) resampled to new_width x
+// new_height, with the same weights as resample_row
+int resample_plane(uint8_t** plane, size_t width, size_t height,
+                   size_t new_width, size_t new_height, int filter)
+{
+    if (new_width > SIZE_MAX / new_height) {
+        return -5;
+    }
+    uint8_t* out = malloc(new_width * new_height);
+    float* tmp = malloc(width * sizeof(float));
+    resample_axis ax, ay;
+    int ax_rc = resample_axis_init(&ax, width, new_width, filter);
+    int ay_rc = resample_axis_init(&ay, height, new_height, filter);
+    if (!out || !tmp || ax_rc != 0 || ay_rc != 0) {
+        free(out);
+        free(tmp);
+        resample_axis_free(&ax);
+        resample_axis_free(&ay);
+        return -6;
+    }
+
+    for (size_t y = 0; y < new_height; y++) {
+        const float* wy = ay.weights + y * ay.taps;
+        for (size_t x = 0; x < width; x++) {
+            tmp[x] = 0.0f;
+        }
+        for (int k = 0; k < ay.count[y]; k++) {
+            const uint8_t* row = *plane + (ay.first[y] + k) * width;
+            for (size_t x = 0; x < width; x++) {
+                tmp[x] += wy[k] * row[x];
+            }
+        }
+        uint8_t* dst = out + y * new_width;
+        for (size_t x = 0; x < new_width; x++) {
+            const float* wx = ax.weights + x * ax.taps;
+            const float* src = tmp + ax.first[x];
+            float v = 0.0f;
+            for (int k = 0; k < ax.count[x]; k++) {
+                v += wx[k] * src[k];
+            }
+            dst[x] = v <= 0.0f ? 0 : v >= 255.0f ? 255 : (uint8_t)(v + 0.5f);
+        }
+    }
+    free(tmp);
+    resample_axis_free(&ax);
+    resample_axis_free(&ay);
+
+    free(*plane);
+    *plane = out;
+    return 0;
+}
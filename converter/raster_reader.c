@@ -2,14 +2,16 @@
 #include <tiffio.h>
 
 #include "converter.h"
+#include "sample_reader.h"
 
 
 
 // Read TIFF raster
-int read_raster(const char* path,
-                uint32_t** raster, uint16_t* orig_dpi, size_t* orig_width, size_t* orig_height)
+int read_raster(const tiff_convert_options* options,
+                uint32_t** raster, uint16_t* orig_dpi, size_t* orig_width, size_t* orig_height,
+                sample_result* samples)
 {
-    TIFF* tif = TIFFOpen(path, "r");
+    TIFF* tif = TIFFOpen(options->path, "r");
     if (!tif) return -1;
 
     TIFFSetWarningHandler(NULL);
@@ -50,12 +52,35 @@ int read_raster(const char* path,
         return -4;
     }
 
-    if (!TIFFReadRGBAImageOriented(tif, width, height, *raster, ORIENTATION_TOPLEFT, 0)) {
+    // libtiff only flips for Orientation and ignores the transposed values,
+    // so the raster is read in stored order and turned by orient_raster
+    uint16_t orientation = ORIENTATION_TOPLEFT;
+    TIFFGetFieldDefaulted(tif, TIFFTAG_ORIENTATION, &orientation);
+    if (orientation < ORIENTATION_TOPLEFT || orientation > ORIENTATION_LEFTBOT) {
+        orientation = ORIENTATION_TOPLEFT;
+    }
+
+    sample_reader sr;
+    int rc = sample_reader_open(&sr, tif, options);
+    if (rc == 1) {
+        rc = sample_reader_rows(&sr, 0, (uint32_t)height, *raster);
+        samples->conversions = sample_reader_conversions(&sr);
+        samples->cmyk = samples->conversions & SAMPLES_CMYK_KEPT;
+        sample_reader_close(&sr);
+    } else if (rc == 0 && !TIFFReadRGBAImageOriented(tif, width, height, *raster, orientation, 0)) {
+        rc = -5;
+    }
+    if (rc != 0) {
         free(*raster);
         TIFFClose(tif);
-        return -5;
+        return rc;
     }
 
     TIFFClose(tif);
+
+    if (orient_raster(raster, orig_width, orig_height, orientation, options->rotate) != 0) {
+        free(*raster);
+        return -4;
+    }
     return 0;
 }
\ No newline at end of file
@@ -0,0 +1,33 @@
+package converter
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// writeReport saves the run report as JSON, folders by name and pages in order
+func writeReport(path string, report RunReport) error {
+	sort.Slice(report.Folders, func(i, j int) bool {
+		return report.Folders[i].Folder < report.Folders[j].Folder
+	})
+	for _, folder := range report.Folders {
+		sort.Slice(folder.Pages, func(i, j int) bool {
+			return folder.Pages[i].Page < folder.Pages[j].Page
+		})
+	}
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode report: %v", err)
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write report: %v", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to rename report: %v", err)
+	}
+	return nil
+}
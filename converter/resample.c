@@ -0,0 +1,191 @@
+#include <stdlib.h>
+#include <math.h>
+
+#include "converter.h"
+
+#ifndef M_PI
+#define M_PI 3.14159265358979323846
+#endif
+
+static double sinc(double x)
+{
+    if (x == 0.0) return 1.0;
+    x *= M_PI;
+    return sin(x) / x;
+}
+
+// filter kernels and their support in source pixels at scale 1
+static double kernel(int filter, double x)
+{
+    x = fabs(x);
+    switch (filter) {
+    case RESAMPLE_BICUBIC: // Catmull-Rom (a = -0.5)
+        if (x < 1.0) return (1.5 * x - 2.5) * x * x + 1.0;
+        if (x < 2.0) return ((-0.5 * x + 2.5) * x - 4.0) * x + 2.0;
+        return 0.0;
+    case RESAMPLE_LANCZOS3:
+        return x < 3.0 ? sinc(x) * sinc(x / 3.0) : 0.0;
+    default: // bilinear
+        return x < 1.0 ? 1.0 - x : 0.0;
+    }
+}
+
+static double kernel_support(int filter)
+{
+    switch (filter) {
+    case RESAMPLE_BICUBIC:  return 2.0;
+    case RESAMPLE_LANCZOS3: return 3.0;
+    default:                return 1.0;
+    }
+}
+
+// Source taps and weights of every output position along one axis of in
+// source and out output pixels. Downsampling widens the kernels by the
+// scale so every source pixel contributes (no aliasing); area adds up the
+// covered share of each source pixel and interpolates like bilinear when
+// upsampling.
+int resample_axis_init(resample_axis* a, size_t in, size_t out, int filter)
+{
+    a->out = out;
+    a->taps = 1;
+    a->first = NULL;
+    a->count = NULL;
+    a->weights = NULL;
+    if (in == 0 || out == 0) return -2;
+
+    double scale = (double)out / (double)in;
+    if (filter == RESAMPLE_AREA && scale >= 1.0) filter = RESAMPLE_BILINEAR;
+    double stretch = scale < 1.0 ? 1.0 / scale : 1.0;
+    double support = filter == RESAMPLE_AREA ? 0.5 * stretch + 1.0 : kernel_support(filter) * stretch;
+    if (filter != RESAMPLE_NEAREST) {
+        a->taps = (int)ceil(support) * 2 + 1;
+    }
+
+    a->first = malloc(out * sizeof(size_t));
+    a->count = malloc(out * sizeof(int));
+    a->weights = malloc(out * a->taps * sizeof(float));
+    if (!a->first || !a->count || !a->weights) {
+        resample_axis_free(a);
+        return -4;
+    }
+
+    for (size_t o = 0; o < out; o++) {
+        float* w = a->weights + o * a->taps;
+        double center = (o + 0.5) / scale; // in source pixel edges
+        if (filter == RESAMPLE_NEAREST) {
+            size_t i = (size_t)center;
+            a->first[o] = i < in ? i : in - 1;
+            a->count[o] = 1;
+            w[0] = 1.0f;
+            continue;
+        }
+
+        long lo = (long)floor(center - support);
+        long hi = (long)ceil(center + support);
+        if (lo < 0) lo = 0;
+        if (hi > (long)in) hi = (long)in;
+        if (hi - lo > a->taps) hi = lo + a->taps;
+
+        double sum = 0.0;
+        int n = 0;
+        for (long i = lo; i < hi; i++) {
+            double v;
+            if (filter == RESAMPLE_AREA) {
+                double x0 = o / scale, x1 = (o + 1) / scale;
+                double l = i > x0 ? i : x0, r = i + 1 < x1 ? i + 1 : x1;
+                v = r > l ? r - l : 0.0;
+            } else {
+                v = kernel(filter, (i + 0.5 - center) / stretch);
+            }
+            w[n++] = (float)v;
+            sum += v;
+        }
+        if (sum == 0.0) {
+            // nothing in reach, take the nearest pixel
+            long i = (long)center < (long)in ? (long)center : (long)in - 1;
+            lo = i;
+            n = 1;
+            w[0] = 1.0f;
+            sum = 1.0;
+        }
+        for (int k = 0; k < n; k++) {
+            w[k] = (float)(w[k] / sum);
+        }
+        a->first[o] = (size_t)lo;
+        a->count[o] = n;
+    }
+    return 0;
+}
+
+void resample_axis_free(resample_axis* a)
+{
+    free(a->first);
+    free(a->count);
+    free(a->weights);
+    a->first = NULL;
+    a->count = NULL;
+    a->weights = NULL;
+}
+
+static inline uint8_t clamp_byte(float v)
+{
+    if (v <= 0.0f) return 0;
+    if (v >= 255.0f) return 255;
+    return (uint8_t)(v + 0.5f);
+}
+
+// Output row y: rows holds the source rows of y (from ay->first[y] on),
+// width pixels apart. The first components bytes of every pixel are
+// resampled into out; tmp holds width * components floats.
+void resample_row(const resample_axis* ax, const resample_axis* ay, size_t y,
+                  const uint32_t* rows, size_t width, int components,
+                  float* tmp, uint8_t* out)
+{
+    const float* wy = ay->weights + y * ay->taps;
+    for (size_t i = 0; i < width * components; i++) {
+        tmp[i] = 0.0f;
+    }
+    for (int k = 0; k < ay->count[y]; k++) {
+        const uint32_t* row = rows + k * width;
+        float w = wy[k];
+        for (size_t x = 0; x < width; x++) {
+            uint32_t p = row[x];
+            for (int c = 0; c < components; c++) {
+                tmp[x * components + c] += w * ((p >> (c * 8)) & 0xFF);
+            }
+        }
+    }
+
+    for (size_t x = 0; x < ax->out; x++) {
+        const float* wx = ax->weights + x * ax->taps;
+        const float* src = tmp + ax->first[x] * components;
+        for (int c = 0; c < components; c++) {
+            float v = 0.0f;
+            for (int k = 0; k < ax->count[x]; k++) {
+                v += wx[k] * src[k * components + c];
+            }
+            out[x * components + c] = clamp_byte(v);
+        }
+    }
+}
+
+// Output size of a page resampled from orig_dpi to target_dpi
+void resampled_size(size_t width, size_t height, int target_dpi, int orig_dpi,
+                    size_t* new_width, size_t* new_height)
+{
+    double scale = (double)target_dpi / (double)orig_dpi;
+    *new_width  = (size_t)(width * scale + 0.5);
+    *new_height = (size_t)(height * scale + 0.5);
+    if (*new_width == 0) *new_width = 1;
+    if (*new_height == 0) *new_height = 1;
+}
+
+// Target resolution of a page: with downsample_only a page below the
+// target keeps its own resolution. An unknown resolution gets the target.
+int output_dpi(const tiff_convert_options* options, int target_dpi, int orig_dpi)
+{
+    if (options->downsample_only && orig_dpi > 0 && orig_dpi < target_dpi) {
+        return orig_dpi;
+    }
+    return target_dpi;
+}
@@ -5,10 +5,10 @@
 #include <emmintrin.h> // SSE2
 
 #include "converter.h"
-#include "settings.h"
 
 // Convert RGB to grayscale using SSE2
-void rgb_to_gray_sse2(const uint8_t* rgb, uint8_t* gray, size_t npixels, int* ccitt_ready) {
+void rgb_to_gray_sse2(const uint8_t* rgb, uint8_t* gray, size_t npixels,
+                      const classify_params* params, int* ccitt_ready, double* bw_ratio) {
 
     const __m128i coeff_r = _mm_set1_epi16(77);
     const __m128i coeff_g = _mm_set1_epi16(150);
@@ -42,7 +42,7 @@ void rgb_to_gray_sse2(const uint8_t* rgb, uint8_t* gray, size_t npixels, int* cc
         uint8_t tmp[8];
         _mm_storel_epi64((__m128i*)tmp, res8);
         for (size_t j = 0; j < 8; j++) {
-            if (tmp[j] > LOWER_THRESHOLD && tmp[j] < UPPER_THRESHOLD) {
+            if (tmp[j] > params->lower_threshold && tmp[j] < params->upper_threshold) {
                 bw_pixels--;
             }
         }
@@ -54,12 +54,13 @@ void rgb_to_gray_sse2(const uint8_t* rgb, uint8_t* gray, size_t npixels, int* cc
         uint8_t g = rgb[i * 3 + 1];
         uint8_t b = rgb[i * 3 + 2];
         gray[i] = (r * 77 + g * 150 + b * 29) >> 8;
-        if (gray[i] > LOWER_THRESHOLD && gray[i] < UPPER_THRESHOLD) {
+        if (gray[i] > params->lower_threshold && gray[i] < params->upper_threshold) {
             //bad_count++;
             bw_pixels--;
         }
     }
 
-    *ccitt_ready = (bw_pixels * 100 >= npixels * CCITT_THRESHOLD);
+    *bw_ratio = (double)bw_pixels / (double)npixels;
+    *ccitt_ready = (bw_pixels * 100 >= npixels * (size_t)params->ccitt_threshold);
 
 }
\ No newline at end of file
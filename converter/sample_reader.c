@@ -0,0 +1,382 @@
+#include <stdlib.h>
+#include <string.h>
+#include <math.h>
+#include <tiffio.h>
+
+#include "settings.h"
+#include "sample_reader.h"
+
+
+static inline uint32_t raw_sample(const sample_reader* s, const uint8_t* row, size_t i)
+{
+    return s->bps == 16 ? ((const uint16_t*)row)[i] : row[i];
+}
+
+// 16-bit samples are scaled to the nearest 8-bit value
+static inline uint8_t sample8(const sample_reader* s, const uint8_t* row, size_t i)
+{
+    if (s->bps == 16) {
+        return (uint8_t)((((const uint16_t*)row)[i] * 255u + 32767u) / 65535u);
+    }
+    return row[i];
+}
+
+static bool is_lab(uint16_t photometric)
+{
+    return photometric == PHOTOMETRIC_CIELAB || photometric == PHOTOMETRIC_ICCLAB;
+}
+
+static void mat_mul(const double* a, const double* b, double* out)
+{
+    for (int i = 0; i < 3; i++) {
+        for (int j = 0; j < 3; j++) {
+            out[i * 3 + j] = a[i * 3] * b[j] + a[i * 3 + 1] * b[3 + j] + a[i * 3 + 2] * b[6 + j];
+        }
+    }
+}
+
+static void mat_vec(const double* m, const double* v, double* out)
+{
+    for (int i = 0; i < 3; i++) {
+        out[i] = m[i * 3] * v[0] + m[i * 3 + 1] * v[1] + m[i * 3 + 2] * v[2];
+    }
+}
+
+// Lab to sRGB: XYZ relative to the white point of the file (WhitePoint tag,
+// D50 like ICC and Photoshop without it), Bradford adapted to D65
+static void setup_lab(sample_reader* s)
+{
+    static const double bradford[9] = {
+        0.8951,  0.2664, -0.1614,
+       -0.7502,  1.7135,  0.0367,
+        0.0389, -0.0685,  1.0296,
+    };
+    static const double bradford_inv[9] = {
+        0.9869929, -0.1470543, 0.1599627,
+        0.4323053,  0.5183603, 0.0492912,
+       -0.0085287,  0.0400428, 0.9684867,
+    };
+    static const double xyz_to_srgb[9] = {
+        3.2404542, -1.5371385, -0.4985314,
+       -0.9692660,  1.8760108,  0.0415560,
+        0.0556434, -0.2040259,  1.0572252,
+    };
+    static const double d65[3] = { 0.95047, 1.0, 1.08883 };
+
+    double x = 0.3457, y = 0.3585; // D50
+    float* wp = NULL;
+    if (s->photometric == PHOTOMETRIC_CIELAB && TIFFGetField(s->tif, TIFFTAG_WHITEPOINT, &wp) && wp && wp[1] > 0) {
+        x = wp[0];
+        y = wp[1];
+    }
+    s->white[0] = x / y;
+    s->white[1] = 1.0;
+    s->white[2] = (1.0 - x - y) / y;
+
+    double src[3], dst[3];
+    mat_vec(bradford, s->white, src);
+    mat_vec(bradford, d65, dst);
+    double cone[9] = {
+        dst[0] / src[0], 0, 0,
+        0, dst[1] / src[1], 0,
+        0, 0, dst[2] / src[2],
+    };
+    double t1[9], t2[9];
+    mat_mul(cone, bradford, t1);
+    mat_mul(bradford_inv, t1, t2);
+    mat_mul(xyz_to_srgb, t2, s->lab);
+
+    for (int i = 0; i < 4096; i++) {
+        double v = i / 4095.0;
+        v = v <= 0.0031308 ? 12.92 * v : 1.055 * pow(v, 1 / 2.4) - 0.055;
+        s->srgb[i] = (uint8_t)(v * 255 + 0.5);
+    }
+}
+
+static double lab_f_inv(double t)
+{
+    const double d = 6.0 / 29.0;
+    return t > d ? t * t * t : 3 * d * d * (t - 4.0 / 29.0);
+}
+
+static void lab_pixel(const sample_reader* s, const uint8_t* row, size_t i, uint8_t* rgb)
+{
+    double L, a = 0, b = 0;
+    uint32_t v0 = raw_sample(s, row, i);
+    bool icc = s->photometric == PHOTOMETRIC_ICCLAB;
+    if (s->bps == 16) {
+        // ICCLab uses the ICC v2 16-bit encoding, 0xFF00 is L* 100
+        L = v0 * 100.0 / (icc ? 65280.0 : 65535.0);
+        if (s->color == 3) {
+            uint32_t v1 = raw_sample(s, row, i + 1), v2 = raw_sample(s, row, i + 2);
+            a = icc ? v1 / 256.0 - 128 : (int16_t)v1 / 256.0;
+            b = icc ? v2 / 256.0 - 128 : (int16_t)v2 / 256.0;
+        }
+    } else {
+        L = v0 * 100.0 / 255.0;
+        if (s->color == 3) {
+            uint32_t v1 = raw_sample(s, row, i + 1), v2 = raw_sample(s, row, i + 2);
+            a = icc ? (double)v1 - 128 : (int8_t)v1;
+            b = icc ? (double)v2 - 128 : (int8_t)v2;
+        }
+    }
+
+    double fy = (L + 16) / 116;
+    double xyz[3] = {
+        s->white[0] * lab_f_inv(fy + a / 500),
+        s->white[1] * lab_f_inv(fy),
+        s->white[2] * lab_f_inv(fy - b / 200),
+    };
+    double lin[3];
+    mat_vec(s->lab, xyz, lin);
+    for (int k = 0; k < 3; k++) {
+        double v = lin[k] < 0 ? 0 : lin[k] > 1 ? 1 : lin[k];
+        rgb[k] = s->srgb[(int)(v * 4095 + 0.5)];
+    }
+}
+
+static void convert_row(sample_reader* s, const uint8_t* src, uint32_t* dst)
+{
+    bool cmyk = s->photometric == PHOTOMETRIC_SEPARATED;
+    for (uint32_t x = 0; x < s->width; x++) {
+        size_t i = (size_t)x * s->spp;
+        uint8_t c[4] = { 0, 0, 0, 0 };
+        int a = s->alpha >= 0 ? sample8(s, src, i + s->alpha) : 255;
+
+        if (is_lab(s->photometric)) {
+            lab_pixel(s, src, i, c);
+        } else {
+            for (int k = 0; k < s->color; k++) {
+                c[k] = sample8(s, src, i + k);
+            }
+            if (s->photometric == PHOTOMETRIC_MINISWHITE) {
+                c[0] = 255 - c[0];
+            }
+            if (s->color == 1) {
+                c[1] = c[2] = c[0];
+            }
+        }
+
+        if (cmyk) {
+            // no ink is white, so unassociated alpha flattens by scaling the
+            // inks; associated inks are flat already
+            if (a < 255 && !s->associated) {
+                for (int k = 0; k < 4; k++) {
+                    c[k] = (uint8_t)((c[k] * a + 127) / 255);
+                }
+            }
+            dst[x] = c[0] | (uint32_t)c[1] << 8 | (uint32_t)c[2] << 16 | (uint32_t)c[3] << 24;
+            continue;
+        }
+
+        if (a < 255) {
+            if (s->alpha_mode == ALPHA_KEEP) {
+                s->translucent = true;
+                if (s->associated) {
+                    for (int k = 0; k < 3; k++) {
+                        int v = a ? (c[k] * 255 + a / 2) / a : 255;
+                        c[k] = (uint8_t)(v > 255 ? 255 : v);
+                    }
+                }
+            } else {
+                for (int k = 0; k < 3; k++) {
+                    int v = s->associated ? c[k] + 255 - a : (c[k] * a + 255 * (255 - a) + 127) / 255;
+                    c[k] = (uint8_t)(v > 255 ? 255 : v);
+                }
+                a = 255;
+            }
+        }
+        dst[x] = c[0] | (uint32_t)c[1] << 8 | (uint32_t)c[2] << 16 | (uint32_t)a << 24;
+    }
+
+    if (cmyk && s->cmyk_mode != CMYK_KEEP) {
+        if (s->icc) {
+            cmyk_icc_apply(s->icc, dst, s->width);
+            return;
+        }
+        for (uint32_t x = 0; x < s->width; x++) {
+            uint32_t v = dst[x];
+            uint32_t k = 255 - (v >> 24);
+            uint32_t r = k * (255 - (v & 0xFF)) / 255;
+            uint32_t g = k * (255 - ((v >> 8) & 0xFF)) / 255;
+            uint32_t b = k * (255 - ((v >> 16) & 0xFF)) / 255;
+            dst[x] = r | g << 8 | b << 16 | 0xFF000000u;
+        }
+    }
+}
+
+// Decode the strip or the row of tiles that holds row y, or the next
+// rows of a large strip
+static int load_rows(sample_reader* s, uint32_t y)
+{
+    uint32_t first = y - y % s->step;
+    uint32_t count = s->height - first < s->step ? s->height - first : s->step;
+    if (s->scanlines) {
+        for (uint32_t r = 0; r < count; r++) {
+            if (TIFFReadScanline(s->tif, s->rows + r * s->row_bytes, first + r, 0) < 0) {
+                return -5;
+            }
+        }
+    } else if (!s->tiled) {
+        if (TIFFReadEncodedStrip(s->tif, TIFFComputeStrip(s->tif, first, 0), s->rows, (tmsize_t)-1) < 0) {
+            return -5;
+        }
+    } else {
+        size_t pixel = (size_t)s->spp * s->bps / 8;
+        for (uint32_t x = 0; x < s->width; x += s->tile_width) {
+            if (TIFFReadEncodedTile(s->tif, TIFFComputeTile(s->tif, x, first, 0, 0), s->tile, (tmsize_t)-1) < 0) {
+                return -5;
+            }
+            uint32_t cols = s->width - x < s->tile_width ? s->width - x : s->tile_width;
+            for (uint32_t r = 0; r < count; r++) {
+                memcpy(s->rows + r * s->row_bytes + x * pixel, s->tile + (size_t)r * s->tile_width * pixel, cols * pixel);
+            }
+        }
+    }
+    s->first = first;
+    s->count = count;
+    return 0;
+}
+
+// Returns 1 when the page is decoded here, 0 when TIFFReadRGBAImage reads it
+// right, negative on errors
+int sample_reader_open(sample_reader* s, TIFF* tif, const tiff_convert_options* options)
+{
+    memset(s, 0, sizeof(*s));
+    s->tif = tif;
+    s->alpha = -1;
+
+    uint16_t planar = PLANARCONFIG_CONTIG, format = SAMPLEFORMAT_UINT, inkset = INKSET_CMYK;
+    uint16_t extra_count = 0;
+    uint16_t* extra = NULL;
+    TIFFGetField(tif, TIFFTAG_IMAGEWIDTH, &s->width);
+    TIFFGetField(tif, TIFFTAG_IMAGELENGTH, &s->height);
+    TIFFGetFieldDefaulted(tif, TIFFTAG_BITSPERSAMPLE, &s->bps);
+    TIFFGetFieldDefaulted(tif, TIFFTAG_SAMPLESPERPIXEL, &s->spp);
+    TIFFGetFieldDefaulted(tif, TIFFTAG_PLANARCONFIG, &planar);
+    TIFFGetFieldDefaulted(tif, TIFFTAG_SAMPLEFORMAT, &format);
+    TIFFGetFieldDefaulted(tif, TIFFTAG_INKSET, &inkset);
+    TIFFGetFieldDefaulted(tif, TIFFTAG_EXTRASAMPLES, &extra_count, &extra);
+    if (!TIFFGetField(tif, TIFFTAG_PHOTOMETRIC, &s->photometric)) return 0;
+
+    switch (s->photometric) {
+    case PHOTOMETRIC_MINISWHITE:
+    case PHOTOMETRIC_MINISBLACK:
+        s->color = 1;
+        break;
+    case PHOTOMETRIC_RGB:
+        s->color = 3;
+        break;
+    case PHOTOMETRIC_SEPARATED:
+        s->color = inkset == INKSET_CMYK ? 4 : 0;
+        break;
+    case PHOTOMETRIC_CIELAB:
+    case PHOTOMETRIC_ICCLAB:
+        s->color = s->spp - extra_count >= 3 ? 3 : 1; // L* alone is a gray page
+        break;
+    }
+    if (s->color == 0 || (s->bps != 8 && s->bps != 16) || planar != PLANARCONFIG_CONTIG ||
+        format != SAMPLEFORMAT_UINT || s->width == 0 || s->height == 0 || s->spp < s->color + extra_count) {
+        return 0;
+    }
+    if (extra_count > 0 && (extra[0] == EXTRASAMPLE_ASSOCALPHA || extra[0] == EXTRASAMPLE_UNASSALPHA)) {
+        s->alpha = s->spp - extra_count;
+        s->associated = extra[0] == EXTRASAMPLE_ASSOCALPHA;
+    }
+    if (s->bps == 8 && s->alpha < 0 && !is_lab(s->photometric) && s->photometric != PHOTOMETRIC_SEPARATED) {
+        return 0;
+    }
+
+    s->alpha_mode = options->alpha;
+    s->cmyk_mode = options->cmyk;
+    if (s->photometric == PHOTOMETRIC_SEPARATED && s->cmyk_mode == CMYK_ICC) {
+        uint32_t size = 0;
+        void* profile = NULL;
+        if (TIFFGetField(tif, TIFFTAG_ICCPROFILE, &size, &profile) && size > 0) {
+            s->icc = cmyk_icc_open(profile, size);
+        }
+        if (!s->icc && options->cmyk_profile) {
+            s->icc = cmyk_icc_open(options->cmyk_profile, options->cmyk_profile_size);
+        }
+        // without a usable profile the plain conversion is used
+        if (!s->icc) {
+            s->cmyk_mode = CMYK_SIMPLE;
+        }
+    }
+    if (is_lab(s->photometric)) {
+        setup_lab(s);
+    }
+
+    s->tiled = TIFFIsTiled(tif);
+    uint32_t step = 0;
+    if (s->tiled) {
+        TIFFGetField(tif, TIFFTAG_TILEWIDTH, &s->tile_width);
+        TIFFGetField(tif, TIFFTAG_TILELENGTH, &step);
+        s->tile = malloc(TIFFTileSize(tif));
+    } else {
+        TIFFGetFieldDefaulted(tif, TIFFTAG_ROWSPERSTRIP, &step);
+        if (step > s->height) step = s->height;
+        // a large strip is not held as a whole, libtiff decodes it in order
+        if (step > BAND_ROWS) {
+            s->scanlines = true;
+            step = BAND_ROWS;
+        }
+    }
+    if (step == 0 || (s->tiled && (s->tile_width == 0 || !s->tile))) {
+        sample_reader_close(s);
+        return -5;
+    }
+    s->step = step;
+    s->row_bytes = (tmsize_t)s->width * s->spp * s->bps / 8;
+    s->rows = malloc((size_t)step * s->row_bytes);
+    if (!s->rows) {
+        sample_reader_close(s);
+        return -4;
+    }
+    return 1;
+}
+
+// Rows y to y+rows-1 as RGBA, or packed CMYK with CMYK_KEEP
+int sample_reader_rows(sample_reader* s, uint32_t y, uint32_t rows, uint32_t* out)
+{
+    for (uint32_t r = y; r < y + rows; r++) {
+        if (r < s->first || r >= s->first + s->count) {
+            int rc = load_rows(s, r);
+            if (rc != 0) return rc;
+        }
+        convert_row(s, s->rows + (size_t)(r - s->first) * s->row_bytes, out + (size_t)(r - y) * s->width);
+    }
+    return 0;
+}
+
+// SAMPLES_* flags of the conversions made so far
+int sample_reader_conversions(const sample_reader* s)
+{
+    int conversions = 0;
+    if (s->bps == 16) conversions |= SAMPLES_16BIT;
+    if (is_lab(s->photometric)) conversions |= SAMPLES_LAB;
+    if (s->photometric == PHOTOMETRIC_SEPARATED) {
+        conversions |= s->cmyk_mode == CMYK_KEEP ? SAMPLES_CMYK_KEPT :
+                       s->icc ? SAMPLES_CMYK_ICC : SAMPLES_CMYK_SIMPLE;
+    }
+    if (s->alpha >= 0) {
+        if (s->photometric == PHOTOMETRIC_SEPARATED || s->alpha_mode == ALPHA_FLATTEN) {
+            conversions |= SAMPLES_ALPHA_FLAT;
+        } else if (s->translucent) {
+            conversions |= SAMPLES_ALPHA_KEPT;
+        }
+    }
+    return conversions;
+}
+
+void sample_reader_close(sample_reader* s)
+{
+    free(s->rows);
+    free(s->tile);
+    if (s->icc) {
+        cmyk_icc_close(s->icc);
+    }
+    s->rows = NULL;
+    s->tile = NULL;
+    s->icc = NULL;
+}
@@ -0,0 +1,49 @@
+#ifndef SAMPLE_READER_H
+#define SAMPLE_READER_H
+
+#include <tiffio.h>
+
+#include "converter.h"
+
+// Explicit decoding of the samples libtiff's RGBA reader gets wrong or
+// loses: 16-bit samples, CMYK, CIELab and alpha channels. Rows come out as
+// RGBA rasters in stored order like TIFFReadRGBAImageOriented, or as packed
+// CMYK when CMYK is kept.
+typedef struct {
+    TIFF*     tif;
+    uint32_t  width;
+    uint32_t  height;
+    uint16_t  bps;
+    uint16_t  spp;
+    uint16_t  photometric;
+    int       color;        // color samples per pixel
+    int       alpha;        // index of the alpha sample, -1 if none
+    bool      associated;   // alpha is premultiplied
+    int       alpha_mode;   // ALPHA_FLATTEN or ALPHA_KEEP
+    int       cmyk_mode;    // CMYK_SIMPLE, CMYK_KEEP or CMYK_ICC
+    void*     icc;          // CMYK to sRGB transform with CMYK_ICC
+    bool      translucent;  // a kept alpha sample below 255 was seen
+    double    lab[9];       // XYZ relative to the Lab white point to linear sRGB
+    double    white[3];     // Lab white point XYZ
+    uint8_t   srgb[4096];   // linear to sRGB encoded
+
+    bool      tiled;
+    bool      scanlines;    // rows of a large strip are read one by one
+    uint32_t  step;         // rows of a strip or a tile
+    uint32_t  tile_width;
+    tmsize_t  row_bytes;
+    uint8_t*  rows;         // decoded strip or tile row
+    uint8_t*  tile;
+    uint32_t  first;        // first row in rows
+    uint32_t  count;        // rows in rows
+} sample_reader;
+
+int sample_reader_open(sample_reader* s, TIFF* tif, const tiff_convert_options* options);
+
+int sample_reader_rows(sample_reader* s, uint32_t y, uint32_t rows, uint32_t* out);
+
+int sample_reader_conversions(const sample_reader* s);
+
+void sample_reader_close(sample_reader* s);
+
+#endif // SAMPLE_READER_H
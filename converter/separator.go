@@ -0,0 +1,386 @@
+package converter
+
+import (
+	"slices"
+	"strings"
+)
+
+// Separator sheets between documents: Kodak patch codes and Code 39 / Code 128
+// barcodes on bilevel pages. Lines across the page are read as runs of white
+// and black pixels, a code counts when it is read on several lines.
+
+// separator kinds as reported for a page
+const (
+	separatorPatchT  = "patch-t"
+	separatorPatch2  = "patch-2"
+	separatorCode39  = "code39"
+	separatorCode128 = "code128"
+)
+
+const (
+	separatorLineStepMM = 1.0 // distance between read lines
+
+	// patch code bars are 0.08" (narrow) or 0.2" (wide) with 0.08" spaces
+	patchNarrowMinMM = 1.2
+	patchNarrowMaxMM = 3.2
+	patchWideMinMM   = 3.8
+	patchWideMaxMM   = 6.8
+	patchQuietMM     = 4.0
+	patchMinLines    = 8 // patch bars are long, short look-alikes in text are not
+
+	barcodeQuietModules = 5 // white before and after a barcode, in narrow modules
+	barcodeMinLines     = 3 // the same value has to be read on this many lines
+)
+
+// patch code bar patterns, N narrow and W wide, in reading order
+var patchPatterns = map[string]string{
+	"NNWW": separatorPatchT,
+	"WNWN": separatorPatch2,
+}
+
+// Code 39 characters with their wide elements as bits, first bar is the highest bit
+const code39Alphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ-. $/+%*"
+
+var code39Patterns = []uint16{
+	0x034, 0x121, 0x061, 0x160, 0x031, 0x130, 0x070, 0x025, 0x124, 0x064,
+	0x109, 0x049, 0x148, 0x019, 0x118, 0x058, 0x00D, 0x10C, 0x04C, 0x01C,
+	0x103, 0x043, 0x142, 0x013, 0x112, 0x052, 0x007, 0x106, 0x046, 0x016,
+	0x181, 0x0C1, 0x1C0, 0x091, 0x190, 0x0D0, 0x085, 0x184, 0x0C4, 0x0A8,
+	0x0A2, 0x08A, 0x02A, 0x094,
+}
+
+// Code 128 symbols 0-105 as bar and space widths in modules
+var code128Patterns = []string{
+	"212222", "222122", "222221", "121223", "121322", "131222", "122213", "122312", "132212", "221213",
+	"221312", "231212", "112232", "122132", "122231", "113222", "123122", "123221", "223211", "221132",
+	"221231", "213212", "223112", "312131", "311222", "321122", "321221", "312212", "322112", "322211",
+	"212123", "212321", "232121", "111323", "131123", "131321", "112313", "132113", "132311", "211313",
+	"231113", "231311", "112133", "112331", "132131", "113123", "113321", "133121", "313121", "211331",
+	"231131", "213113", "213311", "213131", "311123", "311321", "331121", "312113", "312311", "332111",
+	"314111", "221411", "431111", "111224", "111422", "121124", "121421", "141122", "141221", "112214",
+	"112412", "122114", "122411", "142112", "142211", "241211", "221114", "413111", "241112", "134111",
+	"111242", "121142", "121241", "114212", "124112", "124211", "411212", "421112", "421211", "212141",
+	"214121", "412121", "111143", "111341", "131141", "114113", "114311", "411113", "411311", "113141",
+	"114131", "311141", "411131", "211412", "211214", "211232",
+}
+
+const code128Stop = "2331112"
+
+const (
+	code128CodeC  = 99
+	code128CodeB  = 100
+	code128CodeA  = 101
+	code128Shift  = 98
+	code128StartA = 103
+	code128StartC = 105
+)
+
+var code128Values = func() map[string]int {
+	values := make(map[string]int, len(code128Patterns))
+	for i, p := range code128Patterns {
+		values[p] = i
+	}
+	return values
+}()
+
+// separatorsEnabled reports whether pages are checked for separator sheets
+func separatorsEnabled(convParams ConversionParameters) bool {
+	return len(convParams.Separators) > 0
+}
+
+// detectSeparator looks for the enabled separator codes on an upright packed
+// MSB2LSB bilevel page (1 = black). Returns the kind and, for barcodes, the
+// value; kind is empty for a regular page.
+func detectSeparator(bits []byte, width, height, dpi int, kinds []string) (string, string) {
+	rowBytes := (width + 7) / 8
+	black := func(x, y int) bool {
+		return bits[y*rowBytes+x>>3]&(0x80>>uint(x&7)) != 0
+	}
+	step := max(1, mmToPixels(separatorLineStepMM, dpi))
+
+	// rows are read left to right, columns top to bottom
+	var lines [][]int
+	for y := 0; y < height; y += step {
+		lines = append(lines, lineRuns(width, func(i int) bool { return black(i, y) }))
+	}
+	for x := 0; x < width; x += step {
+		lines = append(lines, lineRuns(height, func(i int) bool { return black(x, i) }))
+	}
+
+	if slices.Contains(kinds, "patch") {
+		votes := make(map[string]int)
+		// patch codes are not read backwards: Patch T and Patch 2 turned
+		// upside down are Patch 1 and Patch 6, which are no separators
+		for _, runs := range lines {
+			if kind := readPatch(runs, dpi); kind != "" {
+				votes[kind]++
+			}
+		}
+		if kind := bestVote(votes, patchMinLines); kind != "" {
+			return kind, ""
+		}
+	}
+
+	code39 := slices.Contains(kinds, separatorCode39)
+	code128 := slices.Contains(kinds, separatorCode128)
+	if !code39 && !code128 {
+		return "", ""
+	}
+	votes := make(map[string]int)
+	for _, runs := range lines {
+		// barcodes may be upside down, so every line is read both ways
+		for _, r := range [][]int{runs, reversedRuns(runs)} {
+			if code39 {
+				if value, ok := readCode39(r); ok {
+					votes[separatorCode39+":"+value]++
+					break
+				}
+			}
+			if code128 {
+				if value, ok := readCode128(r); ok {
+					votes[separatorCode128+":"+value]++
+					break
+				}
+			}
+		}
+	}
+	if best := bestVote(votes, barcodeMinLines); best != "" {
+		kind, value, _ := strings.Cut(best, ":")
+		return kind, value
+	}
+	return "", ""
+}
+
+// lineRuns returns the run lengths of a line, alternating white and black.
+// The first and the last run are white, possibly empty.
+func lineRuns(n int, black func(i int) bool) []int {
+	runs := []int{0}
+	dark := false
+	for i := 0; i < n; i++ {
+		if black(i) != dark {
+			dark = !dark
+			runs = append(runs, 0)
+		}
+		runs[len(runs)-1]++
+	}
+	if dark {
+		runs = append(runs, 0)
+	}
+	return runs
+}
+
+func reversedRuns(runs []int) []int {
+	r := slices.Clone(runs)
+	slices.Reverse(r)
+	return r
+}
+
+// bestVote returns the key with the most votes if it has at least minVotes
+func bestVote(votes map[string]int, minVotes int) string {
+	best, bestCount := "", 0
+	for key, count := range votes {
+		if count > bestCount || (count == bestCount && key < best) {
+			best, bestCount = key, count
+		}
+	}
+	if bestCount < minVotes {
+		return ""
+	}
+	return best
+}
+
+// readPatch finds four patch code bars with their spaces and quiet zones
+func readPatch(runs []int, dpi int) string {
+	px := func(mm float64) float64 { return mm * float64(dpi) / 25.4 }
+	narrowMin, narrowMax := px(patchNarrowMinMM), px(patchNarrowMaxMM)
+	wideMin, wideMax := px(patchWideMinMM), px(patchWideMaxMM)
+	quiet := px(patchQuietMM)
+
+	for i := 1; i+7 < len(runs); i += 2 {
+		if float64(runs[i-1]) < quiet || float64(runs[i+7]) < quiet {
+			continue
+		}
+		var pattern [4]byte
+		ok := true
+		for b := 0; b < 4 && ok; b++ {
+			bar := float64(runs[i+2*b])
+			switch {
+			case bar >= narrowMin && bar <= narrowMax:
+				pattern[b] = 'N'
+			case bar >= wideMin && bar <= wideMax:
+				pattern[b] = 'W'
+			default:
+				ok = false
+			}
+			if b < 3 {
+				space := float64(runs[i+2*b+1])
+				ok = ok && space >= narrowMin && space <= narrowMax
+			}
+		}
+		if !ok {
+			continue
+		}
+		if kind, found := patchPatterns[string(pattern[:])]; found {
+			return kind
+		}
+	}
+	return ""
+}
+
+// readCode39 decodes the first Code 39 barcode on a line, without the start
+// and stop characters
+func readCode39(runs []int) (string, bool) {
+	for i := 1; i+9 < len(runs); i += 2 {
+		c, width, ok := code39Char(runs[i : i+9])
+		if !ok || c != '*' || float64(runs[i-1]) < barcodeQuietModules*float64(width)/12 {
+			continue
+		}
+		var text []byte
+		for pos := i + 10; pos+9 < len(runs); pos += 10 {
+			c, w, ok := code39Char(runs[pos : pos+9])
+			if !ok || w < width*3/4 || w > width*5/4 {
+				break
+			}
+			if c == '*' {
+				if len(text) > 0 && float64(runs[pos+9]) >= barcodeQuietModules*float64(width)/12 {
+					return string(text), true
+				}
+				break
+			}
+			text = append(text, c)
+		}
+	}
+	return "", false
+}
+
+// code39Char decodes nine elements starting with a bar; the three widest
+// have to stand out from the narrow ones
+func code39Char(elements []int) (byte, int, bool) {
+	sorted := slices.Clone(elements)
+	slices.Sort(sorted)
+	narrow, wide := sorted[5], sorted[6]
+	if wide*2 < narrow*3 {
+		return 0, 0, false
+	}
+	threshold := (narrow + wide) / 2
+	var pattern uint16
+	width := 0
+	for _, e := range elements {
+		pattern <<= 1
+		if e > threshold {
+			pattern |= 1
+		}
+		width += e
+	}
+	i := slices.Index(code39Patterns, pattern)
+	if i < 0 {
+		return 0, 0, false
+	}
+	return code39Alphabet[i], width, true
+}
+
+// readCode128 decodes the first Code 128 barcode on a line with a valid check symbol
+func readCode128(runs []int) (string, bool) {
+	for i := 1; i+6 < len(runs); i += 2 {
+		start, width, ok := code128Symbol(runs[i : i+6])
+		if !ok || start < code128StartA || float64(runs[i-1]) < barcodeQuietModules*float64(width)/11 {
+			continue
+		}
+		values := []int{start}
+		for pos := i + 6; pos+7 < len(runs); pos += 6 {
+			if modules(runs[pos:pos+7], 13) == code128Stop {
+				if len(values) >= 3 && float64(runs[pos+7]) >= barcodeQuietModules*float64(width)/11 {
+					if text, ok := code128Text(values); ok {
+						return text, true
+					}
+				}
+				break
+			}
+			v, w, ok := code128Symbol(runs[pos : pos+6])
+			if !ok || w < width*4/5 || w > width*6/5 {
+				break
+			}
+			values = append(values, v)
+		}
+	}
+	return "", false
+}
+
+// code128Symbol decodes six elements of an 11 module symbol
+func code128Symbol(elements []int) (int, int, bool) {
+	width := 0
+	for _, e := range elements {
+		width += e
+	}
+	v, ok := code128Values[modules(elements, 11)]
+	return v, width, ok
+}
+
+// modules rounds element widths to whole modules of a symbol with the given
+// module count; empty if they do not add up
+func modules(elements []int, count int) string {
+	width := 0
+	for _, e := range elements {
+		width += e
+	}
+	if width < count {
+		return ""
+	}
+	var b strings.Builder
+	sum := 0
+	for _, e := range elements {
+		m := (e*count + width/2) / width
+		if m < 1 || m > 4 {
+			return ""
+		}
+		sum += m
+		b.WriteByte(byte('0' + m))
+	}
+	if sum != count {
+		return ""
+	}
+	return b.String()
+}
+
+// code128Text checks the check symbol (the last value) and decodes the data
+// symbols in code sets A, B and C; function codes are left out
+func code128Text(values []int) (string, bool) {
+	n := len(values) - 1
+	sum := values[0]
+	for i := 1; i < n; i++ {
+		sum += i * values[i]
+	}
+	if sum%103 != values[n] {
+		return "", false
+	}
+
+	set := values[0] - code128StartA // 0 A, 1 B, 2 C
+	shift := false
+	var text []byte
+	for _, v := range values[1:n] {
+		current := set
+		if shift {
+			current = 1 - set // shift swaps A and B for one symbol
+			shift = false
+		}
+		switch {
+		case current == 2 && v < 100:
+			text = append(text, byte('0'+v/10), byte('0'+v%10))
+		case current != 2 && v < 64:
+			text = append(text, byte(' '+v))
+		case current == 0 && v < 96:
+			text = append(text, byte(v-64)) // control characters
+		case current == 1 && v < 96:
+			text = append(text, byte(' '+v))
+		case current != 2 && v == code128Shift:
+			shift = true
+		case v == code128CodeC && current != 2:
+			set = 2
+		case v == code128CodeB && current != 1:
+			set = 1
+		case v == code128CodeA && current != 0:
+			set = 0
+		}
+	}
+	return string(text), len(text) > 0
+}
@@ -0,0 +1,252 @@
+package converter
+
+import (
+	"strings"
+	"testing"
+)
+
+const separatorTestDPI = 200
+
+// patchRuns builds the runs of a line across patch code bars, N narrow and
+// W wide, at separatorTestDPI: 0.08" narrow bars and spaces, 0.2" wide bars
+func patchRuns(pattern string) []int {
+	const narrow, wide, quiet = 16, 40, 60
+	runs := []int{quiet}
+	for i, c := range pattern {
+		if i > 0 {
+			runs = append(runs, narrow)
+		}
+		if c == 'W' {
+			runs = append(runs, wide)
+		} else {
+			runs = append(runs, narrow)
+		}
+	}
+	return append(runs, quiet)
+}
+
+// code39Runs builds the runs of a line across *text* with a narrow gap
+// between the characters
+func code39Runs(text string, narrow, wide int) []int {
+	runs := []int{10 * narrow}
+	for i, c := range "*" + text + "*" {
+		if i > 0 {
+			runs = append(runs, narrow)
+		}
+		pattern := code39Patterns[strings.IndexRune(code39Alphabet, c)]
+		for b := 8; b >= 0; b-- {
+			if pattern>>uint(b)&1 != 0 {
+				runs = append(runs, wide)
+			} else {
+				runs = append(runs, narrow)
+			}
+		}
+	}
+	return append(runs, 10*narrow)
+}
+
+// code128Runs builds the runs of a line across a start symbol, data symbols,
+// the check symbol plus delta and the stop pattern
+func code128Runs(values []int, delta, module int) []int {
+	sum := values[0]
+	for i, v := range values[1:] {
+		sum += (i + 1) * v
+	}
+	symbols := make([]string, 0, len(values)+2)
+	for _, v := range values {
+		symbols = append(symbols, code128Patterns[v])
+	}
+	symbols = append(symbols, code128Patterns[(sum+delta)%103], code128Stop)
+	runs := []int{10 * module}
+	for _, s := range symbols {
+		for _, m := range s {
+			runs = append(runs, int(m-'0')*module)
+		}
+	}
+	return append(runs, 10*module)
+}
+
+// code128B returns the code set B values of text after a start B symbol
+func code128B(text string) []int {
+	values := []int{code128StartA + 1}
+	for _, c := range text {
+		values = append(values, int(c)-' ')
+	}
+	return values
+}
+
+func TestReadPatch(t *testing.T) {
+	tests := []struct {
+		name string
+		runs []int
+		want string
+	}{
+		{"patch T", patchRuns("NNWW"), separatorPatchT},
+		{"patch 2", patchRuns("WNWN"), separatorPatch2},
+		{"patch T backwards is patch 1", reversedRuns(patchRuns("NNWW")), ""},
+		{"patch 2 backwards is patch 6", reversedRuns(patchRuns("WNWN")), ""},
+		{"patch 3", patchRuns("WNNW"), ""},
+		{"patch 4", patchRuns("NWWN"), ""},
+		{"no quiet zone", append([]int{10, 30}, patchRuns("NNWW")[1:]...), ""},
+		{"text strokes", []int{60, 4, 4, 4, 4, 10, 4, 10, 60}, ""},
+		{"bars too wide", []int{60, 16, 16, 16, 16, 80, 16, 80, 60}, ""},
+		{"white line", []int{800}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := readPatch(tt.runs, separatorTestDPI); got != tt.want {
+				t.Errorf("readPatch(%v) = %q, want %q", tt.runs, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadCode39(t *testing.T) {
+	wrongStop := code39Runs("SEP-1", 3, 8)
+	copy(wrongStop[len(wrongStop)-10:], code39Runs("A", 3, 8)[11:20]) // A instead of the stop *
+	noQuiet := code39Runs("SEP-1", 3, 8)
+	noQuiet[0] = 3
+
+	tests := []struct {
+		name string
+		runs []int
+		want string
+		ok   bool
+	}{
+		{"text", code39Runs("SEP-1", 3, 8), "SEP-1", true},
+		{"all characters", code39Runs("0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ-. $/+%", 2, 6), "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ-. $/+%", true},
+		{"wide ratio 2.5", code39Runs("BOX7", 4, 10), "BOX7", true},
+		{"backwards", reversedRuns(code39Runs("SEP-1", 3, 8)), "", false},
+		{"wrong stop", wrongStop, "", false},
+		{"no quiet zone", noQuiet, "", false},
+		{"start and stop only", code39Runs("", 3, 8), "", false},
+		{"wide too narrow", code39Runs("SEP-1", 4, 5), "", false},
+		{"wider characters later", append(code39Runs("AB", 3, 8)[:21], code39Runs("C", 6, 16)[11:]...), "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := readCode39(tt.runs)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("readCode39 = %q, %v, want %q, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestReadCode128(t *testing.T) {
+	brokenStop := code128Runs(code128B("Box 7"), 0, 3)
+	brokenStop[len(brokenStop)-3] += 6 // last bar of the stop pattern two modules wider
+	noQuiet := code128Runs(code128B("Box 7"), 0, 3)
+	noQuiet[len(noQuiet)-1] = 6
+
+	tests := []struct {
+		name string
+		runs []int
+		want string
+		ok   bool
+	}{
+		{"set B", code128Runs(code128B("Box 7"), 0, 3), "Box 7", true},
+		{"set C", code128Runs([]int{code128StartC, 12, 34, 5}, 0, 2), "123405", true},
+		{"set A control character", code128Runs([]int{code128StartA, 33, 65, 34}, 0, 2), "A\x01B", true},
+		{"C to B", code128Runs([]int{code128StartC, 20, 24, code128CodeB, 'X' - ' '}, 0, 2), "2024X", true},
+		{"shift in B", code128Runs([]int{code128StartA + 1, 'a' - ' ', code128Shift, 64 + 9, 'b' - ' '}, 0, 2), "a\tb", true},
+		{"wider module", code128Runs(code128B("INV-42"), 0, 5), "INV-42", true},
+		{"backwards", reversedRuns(code128Runs(code128B("Box 7"), 0, 3)), "", false},
+		{"wrong check symbol", code128Runs(code128B("Box 7"), 1, 3), "", false},
+		{"broken stop", brokenStop, "", false},
+		{"no quiet zone after the stop", noQuiet, "", false},
+		{"no data", code128Runs([]int{code128StartA + 1}, 0, 3), "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := readCode128(tt.runs)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("readCode128 = %q, %v, want %q, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+// separatorPage is a white packed bilevel page to draw codes on
+type separatorPage struct {
+	bits          []byte
+	width, height int
+}
+
+func newSeparatorPage(width, height int) *separatorPage {
+	return &separatorPage{bits: make([]byte, (width+7)/8*height), width: width, height: height}
+}
+
+// draw paints the black runs of a line starting at start, across rows with
+// across set (bars are vertical) or down columns (bars are horizontal), from
+// from to to on the other axis
+func (p *separatorPage) draw(runs []int, start int, across bool, from, to int) *separatorPage {
+	pos := start
+	for i, r := range runs {
+		if i%2 == 1 {
+			for a := pos; a < pos+r; a++ {
+				for b := from; b < to; b++ {
+					x, y := a, b
+					if !across {
+						x, y = b, a
+					}
+					p.bits[y*((p.width+7)/8)+x/8] |= 0x80 >> uint(x%8)
+				}
+			}
+		}
+		pos += r
+	}
+	return p
+}
+
+func TestDetectSeparator(t *testing.T) {
+	all := []string{"patch", separatorCode39, separatorCode128}
+	tests := []struct {
+		name        string
+		page        *separatorPage
+		kinds       []string
+		kind, value string
+	}{
+		{"blank page", newSeparatorPage(800, 800), all, "", ""},
+		{"patch T", newSeparatorPage(800, 800).draw(patchRuns("NNWW"), 200, false, 100, 700), all, separatorPatchT, ""},
+		{"patch 2 turned counterclockwise", newSeparatorPage(800, 800).draw(patchRuns("WNWN"), 200, true, 100, 700), all, separatorPatch2, ""},
+		{"patch T upside down", newSeparatorPage(800, 800).draw(reversedRuns(patchRuns("NNWW")), 200, false, 100, 700), all, "", ""},
+		{"patch 2 upside down", newSeparatorPage(800, 800).draw(reversedRuns(patchRuns("WNWN")), 200, false, 100, 700), all, "", ""},
+		{"patch 1", newSeparatorPage(800, 800).draw(patchRuns("WWNN"), 200, false, 100, 700), all, "", ""},
+		{"short patch look-alike", newSeparatorPage(800, 800).draw(patchRuns("NNWW"), 200, false, 100, 150), all, "", ""},
+		{"patch not enabled", newSeparatorPage(800, 800).draw(patchRuns("NNWW"), 200, false, 100, 700), []string{separatorCode39}, "", ""},
+		{"code 39", newSeparatorPage(800, 400).draw(code39Runs("SEP-1", 3, 8), 100, true, 100, 200), all, separatorCode39, "SEP-1"},
+		{"code 39 upside down", newSeparatorPage(800, 400).draw(reversedRuns(code39Runs("SEP-1", 3, 8)), 100, true, 100, 200), all, separatorCode39, "SEP-1"},
+		{"code 39 sideways", newSeparatorPage(400, 800).draw(code39Runs("SEP-1", 3, 8), 100, false, 100, 200), all, separatorCode39, "SEP-1"},
+		{"code 39 too short", newSeparatorPage(800, 400).draw(code39Runs("SEP-1", 3, 8), 100, true, 100, 110), all, "", ""},
+		{"code 128", newSeparatorPage(800, 400).draw(code128Runs(code128B("Box 7"), 0, 3), 100, true, 100, 200), all, separatorCode128, "Box 7"},
+		{"code 128 upside down", newSeparatorPage(800, 400).draw(reversedRuns(code128Runs(code128B("Box 7"), 0, 3)), 100, true, 100, 200), all, separatorCode128, "Box 7"},
+		{"code 128 not enabled", newSeparatorPage(800, 400).draw(code128Runs(code128B("Box 7"), 0, 3), 100, true, 100, 200), []string{"patch", separatorCode39}, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kind, value := detectSeparator(tt.page.bits, tt.page.width, tt.page.height, separatorTestDPI, tt.kinds)
+			if kind != tt.kind || value != tt.value {
+				t.Errorf("detectSeparator = %q, %q, want %q, %q", kind, value, tt.kind, tt.value)
+			}
+		})
+	}
+}
+
+func TestBestVote(t *testing.T) {
+	tests := []struct {
+		votes    map[string]int
+		minVotes int
+		want     string
+	}{
+		{map[string]int{}, 1, ""},
+		{map[string]int{"a": 2}, 3, ""},
+		{map[string]int{"a": 3, "b": 5}, 3, "b"},
+		{map[string]int{"b": 4, "a": 4}, 3, "a"},
+	}
+	for _, tt := range tests {
+		if got := bestVote(tt.votes, tt.minVotes); got != tt.want {
+			t.Errorf("bestVote(%v, %d) = %q, want %q", tt.votes, tt.minVotes, got, tt.want)
+		}
+	}
+}
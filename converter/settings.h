@@ -9,10 +9,18 @@
 #define JPEGCOLORMODE_RGB     1
 #endif
 
+// defaults of the page classification options
 #define GRAY_THRESHOLD 2
 #define GRAY_RATIO 0.9
 #define LOWER_THRESHOLD 5
 #define UPPER_THRESHOLD 250
 #define CCITT_THRESHOLD 98
+#define COLOR_THRESHOLD 40
+#define COLOR_AREA_MM2 0
+
+// pages with more pixels are decoded, resampled and encoded in bands of
+// at least BAND_ROWS rows instead of as a whole raster
+#define BANDED_MIN_PIXELS 50000000
+#define BAND_ROWS 256
 
 #endif
\ No newline at end of file
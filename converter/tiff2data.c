@@ -3,6 +3,40 @@
 #include "converter.h"
 
 
+// composite RGBA pixels onto white
+static void flatten_raster(uint32_t* raster, size_t npixels)
+{
+    for (size_t i = 0; i < npixels; i++) {
+        uint32_t p = raster[i];
+        uint32_t a = p >> 24;
+        uint32_t v = 0xFF000000u;
+        for (int shift = 0; shift < 24; shift += 8) {
+            v |= ((((p >> shift) & 0xFF) * a + 255 * (255 - a) + 127) / 255) << shift;
+        }
+        raster[i] = v;
+    }
+}
+
+// alpha bytes of the raster, resampled to the output size on their own
+static int alpha_plane(const uint32_t* raster, size_t width, size_t height, int target_dpi, int orig_dpi,
+                       int filter, size_t out_width, size_t out_height, unsigned char** alpha)
+{
+    *alpha = malloc(width * height);
+    if (!*alpha) return -4;
+    for (size_t i = 0; i < width * height; i++) {
+        (*alpha)[i] = raster[i] >> 24;
+    }
+    if (target_dpi != orig_dpi) {
+        int rc = resample_plane(alpha, width, height, out_width, out_height, filter);
+        if (rc != 0) {
+            free(*alpha);
+            *alpha = NULL;
+            return rc;
+        }
+    }
+    return 0;
+}
+
 int convert_tiff_to_data(const tiff_convert_options* options,
                          unsigned char** outBuf, 
                          unsigned long* outSize,
@@ -10,27 +44,77 @@ int convert_tiff_to_data(const tiff_convert_options* options,
                          bool* gray_filter,
                          size_t* outWidth, 
                          size_t* outHeight, 
-                         int* outDpi)
+                         int* outDpi,
+                         classify_stats* stats,
+                         int* outMirror,
+                         int* outRotate,
+                         sample_result* samples)
 {
 
     int rc = 0;
 
     int ccitt_mode = *ccitt_filter;
 
+    *outMirror = 0;
+    *outRotate = 0;
+    samples->conversions = 0;
+    samples->cmyk = false;
+    samples->alpha = NULL;
+    // raw pixels are edited as a whole page on the Go side
+    if (!options->raw && page_needs_bands(options->path)) {
+        return convert_tiff_banded(options, outBuf, outSize, ccitt_filter, gray_filter,
+                                   outWidth, outHeight, outDpi, stats, outMirror, outRotate, samples);
+    }
+
     uint16_t orig_dpi = 0;
     size_t orig_width = 0, orig_height = 0;
     uint32_t* raster;
 
     rc = read_raster(
-        options->path, 
+        options,
         &raster, 
         &orig_dpi, 
         &orig_width, 
-        &orig_height
+        &orig_height,
+        samples
     );
 
     if (rc != 0) { return rc; }
 
+    // kept CMYK skips the classification, the page is a CMYK JPEG
+    if (samples->cmyk) {
+        if (orig_dpi == 0) {
+            orig_dpi = options->rgb_target_dpi;
+        }
+        int dpi = output_dpi(options, options->rgb_target_dpi, orig_dpi);
+        if (dpi != orig_dpi) {
+            rc = resample_raster(&raster, &orig_width, &orig_height, dpi, orig_dpi, options->filter);
+        }
+        if (rc == 0) {
+            rc = write_cmyk_jpeg_to_mem((uint32_t)orig_width, (uint32_t)orig_height, raster,
+                                        options->rgb_quality, dpi, outBuf, outSize) == 0 ? 0 : -6;
+        }
+        free(raster);
+        if (rc != 0) { return rc; }
+        *ccitt_filter = 0;
+        *gray_filter = false;
+        *outWidth = orig_width;
+        *outHeight = orig_height;
+        *outDpi = dpi;
+        return 0;
+    }
+
+    // a kept alpha channel is not binarized: forced CCITT flattens it
+    bool keep_alpha = samples->conversions & SAMPLES_ALPHA_KEPT;
+    if (keep_alpha && ccitt_mode == 1) {
+        flatten_raster(raster, orig_width * orig_height);
+        samples->conversions = (samples->conversions & ~SAMPLES_ALPHA_KEPT) | SAMPLES_ALPHA_FLAT;
+        keep_alpha = false;
+    } else if (keep_alpha) {
+        ccitt_mode = -1;
+        *ccitt_filter = -1;
+    }
+
     size_t width = orig_width;
     size_t height = orig_height;
 
@@ -38,13 +122,18 @@ int convert_tiff_to_data(const tiff_convert_options* options,
     bool gray = false;
     int ccitt_ready = *ccitt_filter;
 
+    // the color area rule needs a resolution before the page class is known
+    int classify_dpi = orig_dpi ? orig_dpi : options->rgb_target_dpi;
     rc = read_pxls_from_raster(
         raster, 
         &width, 
         &height, 
         &pixel_buffer, 
         &gray, 
-        &ccitt_ready
+        &ccitt_ready,
+        &options->classify,
+        classify_dpi,
+        stats
     );
 
     if (rc != 0) {
@@ -57,15 +146,17 @@ int convert_tiff_to_data(const tiff_convert_options* options,
         orig_dpi = gray ? options->gray_target_dpi : options->rgb_target_dpi;
     }
 
-    bool rgb_need_resample = (options->rgb_target_dpi != orig_dpi);
-    bool gray_need_resample = (options->gray_target_dpi != orig_dpi);
+    int rgb_dpi = output_dpi(options, options->rgb_target_dpi, orig_dpi);
+    int gray_dpi = output_dpi(options, options->gray_target_dpi, orig_dpi);
+    bool rgb_need_resample = (rgb_dpi != orig_dpi);
+    bool gray_need_resample = (gray_dpi != orig_dpi);
 
 
     if (gray) {
         if (gray_need_resample) {
             uint8_t* gray_buff = NULL;
             rc = read_pxls_resampled_from_raster(raster, &width, &height, &gray_buff, &gray, &ccitt_ready,
-                options->gray_target_dpi, orig_dpi);
+                gray_dpi, orig_dpi, options->filter, &options->classify, stats);
             if (rc != 0) {
                 free(raster);
                 free(pixel_buffer);
@@ -84,8 +175,11 @@ int convert_tiff_to_data(const tiff_convert_options* options,
                 &rgb_buff, 
                 &gray, 
                 &ccitt_ready,
-                options->rgb_target_dpi, 
-                orig_dpi
+                rgb_dpi, 
+                orig_dpi,
+                options->filter,
+                &options->classify,
+                stats
             );
             if (rc != 0) {
                 free(raster);
@@ -97,6 +191,17 @@ int convert_tiff_to_data(const tiff_convert_options* options,
         }
     }
 
+    if (keep_alpha) {
+        int dpi = gray ? gray_dpi : rgb_dpi;
+        rc = alpha_plane(raster, orig_width, orig_height, dpi, orig_dpi, options->filter,
+                         width, height, &samples->alpha);
+        if (rc != 0) {
+            free(raster);
+            free(pixel_buffer);
+            return rc;
+        }
+    }
+
     if ((ccitt_ready && ccitt_mode == 0) || ccitt_mode == 1) {
         *ccitt_filter = 1;
         *gray_filter = false;
@@ -104,7 +209,7 @@ int convert_tiff_to_data(const tiff_convert_options* options,
         *outSize = (unsigned long)(width * height);
         *outWidth = width;
         *outHeight = height;
-        *outDpi = options->gray_target_dpi;
+        *outDpi = gray_dpi;
         free(raster);
         return 0;
     }
@@ -117,7 +222,7 @@ int convert_tiff_to_data(const tiff_convert_options* options,
             *outSize = (unsigned long)(width * height * 3);
             *outWidth = width;
             *outHeight = height;
-            *outDpi = options->rgb_target_dpi;
+            *outDpi = rgb_dpi;
             free(raster);
             return 0;
         } else {
@@ -125,11 +230,11 @@ int convert_tiff_to_data(const tiff_convert_options* options,
                                    (uint32_t)height, 
                                    pixel_buffer, 
                                    options->rgb_quality, 
-                                   options->rgb_target_dpi, 
+                                   rgb_dpi, 
                                    gray ? 1 : 0, 
                                    outBuf, outSize
             );
-            *outDpi = options->rgb_target_dpi;
+            *outDpi = rgb_dpi;
         }
 
     } else {
@@ -138,12 +243,12 @@ int convert_tiff_to_data(const tiff_convert_options* options,
             *outSize = (unsigned long)(width * height);
             *outWidth = width;
             *outHeight = height;
-            *outDpi = options->gray_target_dpi;
+            *outDpi = gray_dpi;
             free(raster);
             return 0;
         } else {
-            rc = write_jpeg_to_mem((uint32_t)width, (uint32_t)height, pixel_buffer, options->gray_quality, options->gray_target_dpi, gray ? 1 : 0, outBuf, outSize);
-            *outDpi = options->gray_target_dpi;
+            rc = write_jpeg_to_mem((uint32_t)width, (uint32_t)height, pixel_buffer, options->gray_quality, gray_dpi, gray ? 1 : 0, outBuf, outSize);
+            *outDpi = gray_dpi;
         }
     }
 
@@ -1,5 +1,6 @@
 
 #include <stdlib.h>
+#include <string.h>
 #include <tiffio.h>
 
 #include "converter.h"
@@ -11,4 +12,66 @@ int get_compression_type(const char* path) {
     TIFFGetField(tif, TIFFTAG_COMPRESSION, &compression);
     TIFFClose(tif);
     return (int)compression;
-}
\ No newline at end of file
+}
+// Horizontal resolution in dpi, 0 if the file does not have one
+int get_resolution_dpi(const char* path) {
+    TIFF* tif = TIFFOpen(path, "r");
+    if (!tif) return 0;
+    float xres = 0.0f;
+    uint16_t resUnit = RESUNIT_INCH;
+    int dpi = 0;
+    if (TIFFGetField(tif, TIFFTAG_XRESOLUTION, &xres)) {
+        TIFFGetFieldDefaulted(tif, TIFFTAG_RESOLUTIONUNIT, &resUnit);
+        if (resUnit == RESUNIT_INCH) {
+            dpi = (int)(xres + 0.5f);
+        } else if (resUnit == RESUNIT_CENTIMETER) {
+            dpi = (int)(xres * 2.54f + 0.5f);
+        }
+    }
+    TIFFClose(tif);
+    return dpi;
+}
+
+// Header fields for planning a run, the image data is not read
+int read_tiff_header(const char* path, tiff_header* h) {
+    memset(h, 0, sizeof(*h));
+    TIFF* tif = TIFFOpen(path, "r");
+    if (!tif) return -1;
+    uint16_t compression = COMPRESSION_NONE, photometric = 0, bits = 1, samples = 1;
+    TIFFGetField(tif, TIFFTAG_IMAGEWIDTH, &h->width);
+    TIFFGetField(tif, TIFFTAG_IMAGELENGTH, &h->height);
+    TIFFGetFieldDefaulted(tif, TIFFTAG_COMPRESSION, &compression);
+    TIFFGetField(tif, TIFFTAG_PHOTOMETRIC, &photometric);
+    TIFFGetFieldDefaulted(tif, TIFFTAG_BITSPERSAMPLE, &bits);
+    TIFFGetFieldDefaulted(tif, TIFFTAG_SAMPLESPERPIXEL, &samples);
+    h->compression = compression;
+    h->photometric = photometric;
+    h->bits = bits;
+    h->samples = samples;
+    h->tiled = TIFFIsTiled(tif);
+    h->pages = TIFFNumberOfDirectories(tif);
+    TIFFClose(tif);
+    h->dpi = get_resolution_dpi(path);
+    return 0;
+}
+
+// Copy of the embedded ICC profile (tag 34675), NULL if the file has none
+int get_icc_profile(const char* path, unsigned char** out, unsigned long* size) {
+    *out = NULL;
+    *size = 0;
+    TIFF* tif = TIFFOpen(path, "r");
+    if (!tif) return -1;
+    uint32_t count = 0;
+    void* profile = NULL;
+    if (TIFFGetField(tif, TIFFTAG_ICCPROFILE, &count, &profile) && count > 0) {
+        *out = malloc(count);
+        if (!*out) {
+            TIFFClose(tif);
+            return -4;
+        }
+        memcpy(*out, profile, count);
+        *size = count;
+    }
+    TIFFClose(tif);
+    return 0;
+}
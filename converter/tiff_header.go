@@ -0,0 +1,30 @@
+package converter
+
+const (
+	// TIFF photometric interpretations
+	photometricMinIsWhite = 0
+	photometricMinIsBlack = 1
+	photometricRGB        = 2
+	photometricPalette    = 3
+	photometricSeparated  = 5
+	photometricYCbCr      = 6
+	photometricCIELab     = 8
+
+	// pages above bandedMinPixels are decoded bandRows rows at a time, as
+	// BANDED_MIN_PIXELS and BAND_ROWS in settings.h
+	bandedMinPixels = 50000000
+	bandRows        = 256
+)
+
+// TIFFHeader are the first page fields of a TIFF, read without decoding it
+type TIFFHeader struct {
+	Width         int
+	Height        int
+	DPI           int // 0 if the file has no resolution
+	Compression   int
+	Photometric   int
+	BitsPerSample int
+	Samples       int
+	Pages         int
+	Tiled         bool
+}
@@ -0,0 +1,11 @@
+//go:build !cgo
+// +build !cgo
+
+package converter
+
+import "errors"
+
+// ReadTIFFHeader needs libtiff
+func ReadTIFFHeader(path string) (TIFFHeader, error) {
+	return TIFFHeader{}, errors.New("reading TIFF headers needs a cgo build with libtiff")
+}
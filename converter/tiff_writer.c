@@ -8,13 +8,16 @@
 #include "converter.h"
 
 
-void write_tiff(const char* filename,
+// 0 on success, negative if libtiff could not create or write the file
+int write_tiff(const char* filename,
                     uint32_t width, uint32_t height,
                     unsigned char* buf, size_t buf_size,
-                    int dpi, int compression, int gray)
+                    int dpi, int compression, int gray,
+                    const unsigned char* palette, int colors, int bits)
 {
     TIFF* out = TIFFOpen(filename, "w");
-    if (!out) return;
+    if (!out) return -1;
+    tmsize_t written = 0;
 
     TIFFSetField(out, TIFFTAG_IMAGEWIDTH, width);
     TIFFSetField(out, TIFFTAG_IMAGELENGTH, height);
@@ -24,7 +27,30 @@ void write_tiff(const char* filename,
     TIFFSetField(out, TIFFTAG_RESOLUTIONUNIT, RESUNIT_INCH);
 
 
-    if (compression == COMPRESSION_CCITTFAX4)
+    if (palette)
+    {
+        // TIFF colormaps have 1 << bits 16-bit entries per channel
+        int n = 1 << bits;
+        uint16_t* map = calloc((size_t)n * 3, sizeof(uint16_t));
+        if (!map) {
+            TIFFClose(out);
+            return -4;
+        }
+        for (int i = 0; i < colors && i < n; i++) {
+            map[i]         = palette[i * 3] * 257;
+            map[n + i]     = palette[i * 3 + 1] * 257;
+            map[2 * n + i] = palette[i * 3 + 2] * 257;
+        }
+        TIFFSetField(out, TIFFTAG_PHOTOMETRIC, PHOTOMETRIC_PALETTE);
+        TIFFSetField(out, TIFFTAG_BITSPERSAMPLE, bits);
+        TIFFSetField(out, TIFFTAG_SAMPLESPERPIXEL, 1);
+        TIFFSetField(out, TIFFTAG_PLANARCONFIG, PLANARCONFIG_CONTIG);
+        TIFFSetField(out, TIFFTAG_COLORMAP, map, map + n, map + 2 * n);
+        TIFFSetField(out, TIFFTAG_ROWSPERSTRIP, height);
+        written = TIFFWriteEncodedStrip(out, 0, (tdata_t)buf, (tmsize_t)buf_size);
+        free(map);
+    }
+    else if (compression == COMPRESSION_CCITTFAX4)
     {
         TIFFSetField(out, TIFFTAG_PHOTOMETRIC, PHOTOMETRIC_MINISWHITE);
         TIFFSetField(out, TIFFTAG_FILLORDER, FILLORDER_MSB2LSB);
@@ -32,7 +58,7 @@ void write_tiff(const char* filename,
         TIFFSetField(out, TIFFTAG_BITSPERSAMPLE, 1);
         TIFFSetField(out, TIFFTAG_SAMPLESPERPIXEL, 1);
 
-        TIFFWriteRawStrip(out, 0, buf, (tmsize_t)buf_size);
+        written = TIFFWriteRawStrip(out, 0, buf, (tmsize_t)buf_size);
     }
         else if (compression == COMPRESSION_JPEG)
     {
@@ -49,7 +75,7 @@ void write_tiff(const char* filename,
 
         TIFFSetField(out, TIFFTAG_JPEGQUALITY,  90);
         TIFFSetField(out, TIFFTAG_ROWSPERSTRIP, height);
-        TIFFWriteEncodedStrip(out, 0, (tdata_t)buf, (tmsize_t)(width * height * (gray ? 1 : 3)));
+        written = TIFFWriteEncodedStrip(out, 0, (tdata_t)buf, (tmsize_t)(width * height * (gray ? 1 : 3)));
 
     } else {
         if (gray) {
@@ -62,7 +88,34 @@ void write_tiff(const char* filename,
         TIFFSetField(out, TIFFTAG_BITSPERSAMPLE,   8);
         TIFFSetField(out, TIFFTAG_PLANARCONFIG,    PLANARCONFIG_CONTIG);
         TIFFSetField(out, TIFFTAG_ROWSPERSTRIP, height);
-        TIFFWriteEncodedStrip(out, 0, (tdata_t)buf, (tmsize_t)(width * height * (gray ? 1 : 3)));
+        written = TIFFWriteEncodedStrip(out, 0, (tdata_t)buf, (tmsize_t)(width * height * (gray ? 1 : 3)));
     }
+    // the directory is only written by the flush
+    int ok = written >= 0 && TIFFFlush(out);
     TIFFClose(out);
+    return ok ? 0 : -5;
+}
+
+// check_tiff reopens a written file and decodes all of its strips: 0 if it
+// reads back with the expected size
+int check_tiff(const char* filename, uint32_t width, uint32_t height)
+{
+    TIFF* in = TIFFOpen(filename, "r");
+    if (!in) return -1;
+    uint32_t w = 0, h = 0;
+    TIFFGetField(in, TIFFTAG_IMAGEWIDTH, &w);
+    TIFFGetField(in, TIFFTAG_IMAGELENGTH, &h);
+    if (w != width || h != height) {
+        TIFFClose(in);
+        return -2;
+    }
+    int rc = 0;
+    void* strip = _TIFFmalloc(TIFFStripSize(in));
+    if (!strip) rc = -4;
+    for (uint32_t s = 0; rc == 0 && s < TIFFNumberOfStrips(in); s++) {
+        if (TIFFReadEncodedStrip(in, s, strip, (tmsize_t)-1) < 0) rc = -3;
+    }
+    _TIFFfree(strip);
+    TIFFClose(in);
+    return rc;
 }
\ No newline at end of file
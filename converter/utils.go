@@ -181,38 +181,33 @@ func medianFilterLight(gray []byte, w, h int) []byte {
 }
 
 func packGrayTo1BitDither(gray []byte, width, height int) []byte {
+	return packBits(ditherFloydSteinberg(gray, width, height), width, height)
+}
+
+// ditherFloydSteinberg binarizes with Floyd–Steinberg error diffusion, 1 = black
+func ditherFloydSteinberg(gray []byte, width, height int) []uint8 {
 	// floating buffer for error diffusion
 	buf := make([]float64, len(gray))
 	for i, v := range gray {
 		buf[i] = float64(v)
 	}
 
-	rowBytes := (width + 7) / 8
-	out := make([]byte, rowBytes*height)
+	bin := make([]uint8, width*height)
 
 	for y := 0; y < height; y++ {
 		for x := 0; x < width; x++ {
 			idx := y*width + x
 			old := buf[idx]
 			var newVal float64
-			var bitVal uint8
 			// treshold 128: darker → black (1), lighter → white (0)
 			if old < 128 {
 				newVal = 0
-				bitVal = 1
+				bin[idx] = 1
 			} else {
 				newVal = 255
-				bitVal = 0
 			}
 			err := old - newVal
 
-			// packing bit
-			bytePos := y*rowBytes + x/8
-			bitPos := 7 - (x % 8)
-			if bitVal == 1 {
-				out[bytePos] |= 1 << bitPos
-			}
-
 			// error diffusion
 			// Right: 7/16
 			if x+1 < width {
@@ -233,7 +228,7 @@ func packGrayTo1BitDither(gray []byte, width, height int) []byte {
 		}
 	}
 
-	return out
+	return bin
 }
 
 // packGrayTo1BitClean performs:
@@ -305,3 +300,68 @@ func downsampleGray(src []byte, w, h, w2, h2 int) []byte {
 	}
 	return dst
 }
+
+// orientPacked mirrors (left-right, first) and rotates clockwise a packed
+// MSB2LSB bilevel image; quarter turns swap width and height
+func orientPacked(bits []byte, width, height int, mirror bool, rotate int) ([]byte, int, int) {
+	nw, nh := width, height
+	if rotate == 90 || rotate == 270 {
+		nw, nh = height, width
+	}
+	srcRow := (width + 7) / 8
+	dstRow := (nw + 7) / 8
+	out := make([]byte, dstRow*nh)
+	for y := 0; y < height; y++ {
+		row := bits[y*srcRow : (y+1)*srcRow]
+		for x := 0; x < width; x++ {
+			sx := x
+			if mirror {
+				sx = width - 1 - x
+			}
+			if row[sx>>3]&(0x80>>uint(sx&7)) == 0 {
+				continue
+			}
+			dx, dy := x, y
+			switch rotate {
+			case 90:
+				dx, dy = height-1-y, x
+			case 180:
+				dx, dy = width-1-x, height-1-y
+			case 270:
+				dx, dy = y, width-1-x
+			}
+			out[dy*dstRow+(dx>>3)] |= 0x80 >> uint(dx&7)
+		}
+	}
+	return out, nw, nh
+}
+
+// orientPlane mirrors (left-right, first) and rotates clockwise a plane of
+// 8-bit samples; quarter turns swap width and height
+func orientPlane(pxls []byte, width, height int, mirror bool, rotate int) ([]byte, int, int) {
+	nw, nh := width, height
+	if rotate == 90 || rotate == 270 {
+		nw, nh = height, width
+	}
+	out := make([]byte, len(pxls))
+	for y := 0; y < height; y++ {
+		row := pxls[y*width : (y+1)*width]
+		for x := 0; x < width; x++ {
+			sx := x
+			if mirror {
+				sx = width - 1 - x
+			}
+			dx, dy := x, y
+			switch rotate {
+			case 90:
+				dx, dy = height-1-y, x
+			case 180:
+				dx, dy = width-1-x, height-1-y
+			case 270:
+				dx, dy = y, width-1-x
+			}
+			out[dy*nw+dx] = row[sx]
+		}
+	}
+	return out, nw, nh
+}
@@ -0,0 +1,472 @@
+package files_manager
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"tiff2pdf/contracts"
+
+	"github.com/BurntSushi/toml"
+)
+
+type InputFlags = contracts.InputFlags
+
+// Settings are the flags a config file, preset or folder config sets by
+// their command line names, nil = not set
+type Settings struct {
+	Input           *string     `json:"input,omitempty"`
+	Output          []string    `json:"output,omitempty"`
+	Type            *string     `json:"type,omitempty"`
+	TIFFMode        *string     `json:"tiffmode,omitempty"`
+	CCITT           *string     `json:"ccitt,omitempty"`
+	Bilevel         *string     `json:"bilevel,omitempty"`
+	MRC             *string     `json:"mrc,omitempty"`
+	Compression     *string     `json:"compression,omitempty"`
+	RGBCompression  *string     `json:"rgbcomp,omitempty"`
+	GrayCompression *string     `json:"grcomp,omitempty"`
+	RGBdpi          *int        `json:"rgbdpi,omitempty"`
+	GrayDpi         *int        `json:"grdpi,omitempty"`
+	RGBJpegQuality  *int        `json:"rgbq,omitempty"`
+	GrayJpegQuality *int        `json:"grq,omitempty"`
+	RGBJpxRatio     *int        `json:"rgbjpxr,omitempty"`
+	GrayJpxRatio    *int        `json:"grjpxr,omitempty"`
+	Rotate          *int        `json:"rotate,omitempty"`
+	Deskew          *bool       `json:"deskew,omitempty"`
+	DeskewMaxAngle  *float64    `json:"deskewmax,omitempty"`
+	DeskewMinAngle  *float64    `json:"deskewmin,omitempty"`
+	AutoCrop        *string     `json:"autocrop,omitempty"`
+	CropAction      *string     `json:"cropaction,omitempty"`
+	CropPaddingMM   *float64    `json:"croppad,omitempty"`
+	FixedCropMM     margins     `json:"cropmm,omitempty"`
+	BlankMode       *string     `json:"blank,omitempty"`
+	BlankInkPercent *float64    `json:"blankink,omitempty"`
+	BlankMarginMM   *float64    `json:"blankmargin,omitempty"`
+	Separators      *stringList `json:"separator,omitempty"`
+	SeparatorNames  *bool       `json:"separatorname,omitempty"`
+	Binarization    *string     `json:"binarize,omitempty"`
+	BinThreshold    *int        `json:"binthreshold,omitempty"`
+	BinK            *float64    `json:"bink,omitempty"`
+	BinWindowMM     *float64    `json:"binwindow,omitempty"`
+	BinPreFilter    *string     `json:"binpre,omitempty"`
+	BinPostFilters  *stringList `json:"binpost,omitempty"`
+	GrayThreshold   *int        `json:"graydiff,omitempty"`
+	GrayRatio       *float64    `json:"grayratio,omitempty"`
+	LowerThreshold  *int        `json:"bwlow,omitempty"`
+	UpperThreshold  *int        `json:"bwhigh,omitempty"`
+	CCITTThreshold  *int        `json:"bwratio,omitempty"`
+	ColorThreshold  *int        `json:"colordiff,omitempty"`
+	ColorAreaMM2    *float64    `json:"colorarea,omitempty"`
+	JPEGPassthrough *bool       `json:"jpegpass,omitempty"`
+	Alpha           *string     `json:"alpha,omitempty"`
+	CMYK            *string     `json:"cmyk,omitempty"`
+	CMYKProfile     *string     `json:"cmykprofile,omitempty"` // relative to the config file
+	ResampleFilter  *string     `json:"resample,omitempty"`
+	ResamplePolicy  *string     `json:"resamplepolicy,omitempty"`
+	Report          *string     `json:"report,omitempty"`
+	OutputName      *string     `json:"name,omitempty"`
+	TIFFName        *string     `json:"tiffname,omitempty"`
+	NamePattern     *string     `json:"namepattern,omitempty"`
+	Overwrite       *string     `json:"overwrite,omitempty"`
+	Collision       *string     `json:"collision,omitempty"`
+	Backup          *string     `json:"backup,omitempty"` // relative to the config file
+	Metadata        *metadata   `json:"metadata,omitempty"`
+}
+
+type metadata struct {
+	Title    *string `json:"title,omitempty"`
+	Author   *string `json:"author,omitempty"`
+	Subject  *string `json:"subject,omitempty"`
+	Keywords *string `json:"keywords,omitempty"`
+}
+
+// Config is a run config file: settings over the defaults and presets
+// that add to or replace the built-in ones
+type Config struct {
+	Settings
+	Presets map[string]*Settings `json:"presets,omitempty"`
+}
+
+// stringList is a list given as an array or as a comma separated string
+// like on the command line
+type stringList []string
+
+func (l *stringList) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*l = stringList{}
+		for _, part := range strings.Split(text, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				*l = append(*l, part)
+			}
+		}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("expected a string or an array of strings")
+	}
+	*l = list
+	return nil
+}
+
+// margins are crop margins in mm given as one number for all edges, an
+// array or a "top,right,bottom,left" string
+type margins []float64
+
+func (m *margins) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*m = margins{}
+		for _, part := range strings.Split(text, ",") {
+			mm, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+			if err != nil {
+				return fmt.Errorf("invalid margin %q", part)
+			}
+			*m = append(*m, mm)
+		}
+		return nil
+	}
+	var mm float64
+	if err := json.Unmarshal(data, &mm); err == nil {
+		*m = margins{mm}
+		return nil
+	}
+	var list []float64
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("expected a number, an array of numbers or a string")
+	}
+	*m = list
+	return nil
+}
+
+// BuiltinPresets are the presets available without a config file
+var BuiltinPresets = map[string]*Settings{
+	// high quality, pages are never upsampled
+	"archive": {
+		CCITT:           ptr("auto"),
+		RGBdpi:          ptr(300),
+		GrayDpi:         ptr(300),
+		RGBJpegQuality:  ptr(95),
+		GrayJpegQuality: ptr(95),
+		ResamplePolicy:  ptr("downonly"),
+	},
+	// small files to send around
+	"email": {
+		CCITT:           ptr("auto"),
+		RGBdpi:          ptr(150),
+		GrayDpi:         ptr(150),
+		RGBJpegQuality:  ptr(70),
+		GrayJpegQuality: ptr(65),
+	},
+	// bilevel pages at fax resolution
+	"fax": {
+		CCITT:          ptr("on"),
+		RGBdpi:         ptr(200),
+		GrayDpi:        ptr(200),
+		ResamplePolicy: ptr("downonly"),
+	},
+}
+
+func ptr[T any](value T) *T {
+	return &value
+}
+
+// PresetNames lists the built-in presets and those of the config, sorted
+func PresetNames(cfg *Config) []string {
+	names := make([]string, 0, len(BuiltinPresets))
+	for name := range BuiltinPresets {
+		names = append(names, name)
+	}
+	if cfg != nil {
+		for name := range cfg.Presets {
+			if _, builtin := BuiltinPresets[name]; !builtin {
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Preset finds a preset of the config or a built-in one
+func Preset(cfg *Config, name string) (*Settings, error) {
+	if cfg != nil {
+		if preset, ok := cfg.Presets[name]; ok {
+			return preset, nil
+		}
+	}
+	if preset, ok := BuiltinPresets[name]; ok {
+		return preset, nil
+	}
+	return nil, fmt.Errorf("unknown preset %q, available: %s", name, strings.Join(PresetNames(cfg), ", "))
+}
+
+// ReadConfig reads a run config file, TOML if the extension is .toml and
+// JSON otherwise
+func ReadConfig(path string) (*Config, error) {
+	var cfg Config
+	if err := decodeSettingsFile(path, &cfg); err != nil {
+		return nil, err
+	}
+	dir := filepath.Dir(path)
+	all := []*Settings{&cfg.Settings}
+	for name, preset := range cfg.Presets {
+		if preset == nil {
+			return nil, fmt.Errorf("%s: preset %q is empty", filepath.Base(path), name)
+		}
+		all = append(all, preset)
+	}
+	for _, s := range all {
+		s.resolvePaths(dir)
+	}
+	return &cfg, nil
+}
+
+// ParseSettings decodes settings given as JSON, unknown keys are errors
+func ParseSettings(data []byte) (*Settings, error) {
+	var s Settings
+	if err := decodeStrict(data, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func decodeSettingsFile(path string, v any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if strings.ToLower(filepath.Ext(path)) == ".toml" {
+		if data, err = tomlToJSON(data); err != nil {
+			return fmt.Errorf("%s: %v", filepath.Base(path), err)
+		}
+	}
+	if err := decodeStrict(data, v); err != nil {
+		return fmt.Errorf("%s: %v", filepath.Base(path), err)
+	}
+	return nil
+}
+
+func decodeStrict(data []byte, v any) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
+
+// resolvePaths makes the file paths of the settings relative to dir
+func (s *Settings) resolvePaths(dir string) {
+	for _, path := range []*string{s.Input, s.CMYKProfile, s.Report, s.Backup} {
+		if path != nil && *path != "" && !filepath.IsAbs(*path) {
+			*path = filepath.Join(dir, *path)
+		}
+	}
+	for i, output := range s.Output {
+		if output != "" && !filepath.IsAbs(output) {
+			s.Output[i] = filepath.Join(dir, output)
+		}
+	}
+}
+
+func setString(dst *string, value *string) {
+	if value != nil {
+		*dst = strings.ToLower(strings.TrimSpace(*value))
+	}
+}
+
+func setValue[T any](dst *T, value *T) {
+	if value != nil {
+		*dst = *value
+	}
+}
+
+// Apply sets the configured fields on a copy of the flags
+func (s *Settings) Apply(flags InputFlags) (InputFlags, error) {
+	setValue(&flags.InputRootDir, s.Input)
+	if s.Output != nil {
+		flags.OutputDir = append([]string(nil), s.Output...)
+	}
+	setString(&flags.OutputFileType, s.Type)
+	setString(&flags.TIFFMode, s.TIFFMode)
+	setString(&flags.CCITT, s.CCITT)
+	setString(&flags.Bilevel, s.Bilevel)
+	setString(&flags.MRC, s.MRC)
+	setString(&flags.Compression, s.Compression)
+	setString(&flags.RGBCompression, s.RGBCompression)
+	setString(&flags.GrayCompression, s.GrayCompression)
+	setValue(&flags.RGBdpi, s.RGBdpi)
+	setValue(&flags.GrayDpi, s.GrayDpi)
+	setValue(&flags.RGBJpegQuality, s.RGBJpegQuality)
+	setValue(&flags.GrayJpegQuality, s.GrayJpegQuality)
+	setValue(&flags.RGBJpxRatio, s.RGBJpxRatio)
+	setValue(&flags.GrayJpxRatio, s.GrayJpxRatio)
+	setValue(&flags.Rotate, s.Rotate)
+	setValue(&flags.Deskew, s.Deskew)
+	setValue(&flags.DeskewMaxAngle, s.DeskewMaxAngle)
+	setValue(&flags.DeskewMinAngle, s.DeskewMinAngle)
+	setString(&flags.AutoCrop, s.AutoCrop)
+	setString(&flags.CropAction, s.CropAction)
+	setValue(&flags.CropPaddingMM, s.CropPaddingMM)
+	switch len(s.FixedCropMM) {
+	case 0:
+	case 1:
+		mm := s.FixedCropMM[0]
+		flags.FixedCropMM = [4]float64{mm, mm, mm, mm}
+	case 4:
+		copy(flags.FixedCropMM[:], s.FixedCropMM)
+	default:
+		return flags, fmt.Errorf("cropmm: expected one value or four values: top, right, bottom, left")
+	}
+	setString(&flags.BlankMode, s.BlankMode)
+	setValue(&flags.BlankInkPercent, s.BlankInkPercent)
+	setValue(&flags.BlankMarginMM, s.BlankMarginMM)
+	if s.Separators != nil {
+		flags.Separators = nil
+		for _, separator := range *s.Separators {
+			separator = strings.ToLower(strings.TrimSpace(separator))
+			if separator != "" && separator != "off" {
+				flags.Separators = append(flags.Separators, separator)
+			}
+		}
+	}
+	setValue(&flags.SeparatorNames, s.SeparatorNames)
+	setString(&flags.Binarization, s.Binarization)
+	setValue(&flags.BinarizeThreshold, s.BinThreshold)
+	setValue(&flags.BinarizeK, s.BinK)
+	setValue(&flags.BinarizeWindowMM, s.BinWindowMM)
+	setString(&flags.BinarizePreFilter, s.BinPreFilter)
+	if s.BinPostFilters != nil {
+		// empty keeps the method default, "none" turns the filters off
+		flags.BinarizePostFilters = nil
+		for _, filter := range *s.BinPostFilters {
+			filter = strings.ToLower(strings.TrimSpace(filter))
+			if flags.BinarizePostFilters == nil {
+				flags.BinarizePostFilters = []string{}
+			}
+			if filter != "" && filter != "none" {
+				flags.BinarizePostFilters = append(flags.BinarizePostFilters, filter)
+			}
+		}
+	}
+	setValue(&flags.Classification.GrayThreshold, s.GrayThreshold)
+	setValue(&flags.Classification.GrayRatio, s.GrayRatio)
+	setValue(&flags.Classification.LowerThreshold, s.LowerThreshold)
+	setValue(&flags.Classification.UpperThreshold, s.UpperThreshold)
+	setValue(&flags.Classification.CCITTThreshold, s.CCITTThreshold)
+	setValue(&flags.Classification.ColorThreshold, s.ColorThreshold)
+	setValue(&flags.Classification.ColorAreaMM2, s.ColorAreaMM2)
+	setValue(&flags.JPEGPassthrough, s.JPEGPassthrough)
+	setString(&flags.Alpha, s.Alpha)
+	setString(&flags.CMYK, s.CMYK)
+	setValue(&flags.CMYKProfile, s.CMYKProfile)
+	setString(&flags.ResampleFilter, s.ResampleFilter)
+	setString(&flags.ResamplePolicy, s.ResamplePolicy)
+	setValue(&flags.ReportPath, s.Report)
+	setValue(&flags.OutputName, s.OutputName)
+	setValue(&flags.TIFFName, s.TIFFName)
+	setValue(&flags.NamePattern, s.NamePattern)
+	setString(&flags.Overwrite, s.Overwrite)
+	setString(&flags.Collision, s.Collision)
+	setValue(&flags.BackupDir, s.Backup)
+	if m := s.Metadata; m != nil {
+		setValue(&flags.Metadata.Title, m.Title)
+		setValue(&flags.Metadata.Author, m.Author)
+		setValue(&flags.Metadata.Subject, m.Subject)
+		setValue(&flags.Metadata.Keywords, m.Keywords)
+	}
+	return flags, nil
+}
+
+// FlagSettings describes flags as settings, for printing them as a config
+func FlagSettings(flags InputFlags) Settings {
+	s := Settings{
+		Input:           ptr(flags.InputRootDir),
+		Output:          flags.OutputDir,
+		Type:            ptr(flags.OutputFileType),
+		TIFFMode:        ptr(flags.TIFFMode),
+		CCITT:           ptr(flags.CCITT),
+		Bilevel:         ptr(flags.Bilevel),
+		MRC:             ptr(flags.MRC),
+		Compression:     ptr(flags.Compression),
+		RGBCompression:  ptr(flags.RGBCompression),
+		GrayCompression: ptr(flags.GrayCompression),
+		RGBdpi:          ptr(flags.RGBdpi),
+		GrayDpi:         ptr(flags.GrayDpi),
+		RGBJpegQuality:  ptr(flags.RGBJpegQuality),
+		GrayJpegQuality: ptr(flags.GrayJpegQuality),
+		RGBJpxRatio:     ptr(flags.RGBJpxRatio),
+		GrayJpxRatio:    ptr(flags.GrayJpxRatio),
+		Rotate:          ptr(flags.Rotate),
+		Deskew:          ptr(flags.Deskew),
+		DeskewMaxAngle:  ptr(flags.DeskewMaxAngle),
+		DeskewMinAngle:  ptr(flags.DeskewMinAngle),
+		AutoCrop:        ptr(flags.AutoCrop),
+		CropAction:      ptr(flags.CropAction),
+		CropPaddingMM:   ptr(flags.CropPaddingMM),
+		FixedCropMM:     margins(flags.FixedCropMM[:]),
+		BlankMode:       ptr(flags.BlankMode),
+		BlankInkPercent: ptr(flags.BlankInkPercent),
+		BlankMarginMM:   ptr(flags.BlankMarginMM),
+		Separators:      ptr(stringList(flags.Separators)),
+		SeparatorNames:  ptr(flags.SeparatorNames),
+		Binarization:    ptr(flags.Binarization),
+		BinThreshold:    ptr(flags.BinarizeThreshold),
+		BinK:            ptr(flags.BinarizeK),
+		BinWindowMM:     ptr(flags.BinarizeWindowMM),
+		BinPreFilter:    ptr(flags.BinarizePreFilter),
+		GrayThreshold:   ptr(flags.Classification.GrayThreshold),
+		GrayRatio:       ptr(flags.Classification.GrayRatio),
+		LowerThreshold:  ptr(flags.Classification.LowerThreshold),
+		UpperThreshold:  ptr(flags.Classification.UpperThreshold),
+		CCITTThreshold:  ptr(flags.Classification.CCITTThreshold),
+		ColorThreshold:  ptr(flags.Classification.ColorThreshold),
+		ColorAreaMM2:    ptr(flags.Classification.ColorAreaMM2),
+		JPEGPassthrough: ptr(flags.JPEGPassthrough),
+		Alpha:           ptr(flags.Alpha),
+		CMYK:            ptr(flags.CMYK),
+		CMYKProfile:     ptr(flags.CMYKProfile),
+		ResampleFilter:  ptr(flags.ResampleFilter),
+		ResamplePolicy:  ptr(flags.ResamplePolicy),
+		Report:          ptr(flags.ReportPath),
+		OutputName:      ptr(flags.OutputName),
+		TIFFName:        ptr(flags.TIFFName),
+		NamePattern:     ptr(flags.NamePattern),
+		Overwrite:       ptr(flags.Overwrite),
+		Collision:       ptr(flags.Collision),
+		Backup:          ptr(flags.BackupDir),
+	}
+	if flags.Separators == nil {
+		s.Separators = ptr(stringList{"off"})
+	}
+	switch {
+	case flags.BinarizePostFilters == nil:
+		// method default
+	case len(flags.BinarizePostFilters) == 0:
+		s.BinPostFilters = ptr(stringList{"none"})
+	default:
+		s.BinPostFilters = ptr(stringList(flags.BinarizePostFilters))
+	}
+	if flags.Metadata != (contracts.PDFMetadata{}) {
+		s.Metadata = &metadata{
+			Title:    ptr(flags.Metadata.Title),
+			Author:   ptr(flags.Metadata.Author),
+			Subject:  ptr(flags.Metadata.Subject),
+			Keywords: ptr(flags.Metadata.Keywords),
+		}
+	}
+	return s
+}
+
+// tomlToJSON converts TOML to JSON, so both formats are decoded by the
+// same strict JSON decoding
+func tomlToJSON(data []byte) ([]byte, error) {
+	root := make(map[string]any)
+	if _, err := toml.Decode(string(data), &root); err != nil {
+		return nil, err
+	}
+	return json.Marshal(root)
+}
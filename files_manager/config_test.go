@@ -0,0 +1,226 @@
+package files_manager
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTOMLToJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		toml string
+		want string // JSON, empty if an error is expected
+		err  string
+	}{
+		{"empty", "", `{}`, ""},
+		{"types", "ccitt = \"auto\"\nrgbdpi = 300\nbink = 0.34\ndeskew = true\njpegpass = false", `{"bink":0.34,"ccitt":"auto","deskew":true,"jpegpass":false,"rgbdpi":300}`, ""},
+		{"underscores in numbers", "colorarea = 1_000", `{"colorarea":1000}`, ""},
+		{"literal string", `name = '{1}\{2}'`, `{"name":"{1}\\{2}"}`, ""},
+		{"escapes", `name = "a\tbé"`, `{"name":"a\tbé"}`, ""},
+		{"comments", "# run settings\n\nccitt = \"on\" # fax\n   # indented\n", `{"ccitt":"on"}`, ""},
+		{"hash in strings", `name = "#{1}" # comment` + "\n" + `tiffname = '#{file}'`, `{"name":"#{1}","tiffname":"#{file}"}`, ""},
+		{"escaped quote before a hash", `name = "a\"#b" # comment`, `{"name":"a\"#b"}`, ""},
+		{"quoted key", `"rgbq" = 90`, `{"rgbq":90}`, ""},
+		{"arrays", `output = ["a", "b,c", 'd']` + "\ncropmm = [1, 2.5, 3, 4,]\nbinpost = []", `{"binpost":[],"cropmm":[1,2.5,3,4],"output":["a","b,c","d"]}`, ""},
+		{"escaped quote in an array", `separator = ["a\",b", "c"]`, `{"separator":["a\",b","c"]}`, ""},
+		{"tables", "ccitt = \"auto\"\n[metadata]\ntitle = \"T\"\n[presets.scan]\nrgbdpi = 200\n[presets.\"fax line\"]\nccitt = \"on\"", `{"ccitt":"auto","metadata":{"title":"T"},"presets":{"fax line":{"ccitt":"on"},"scan":{"rgbdpi":200}}}`, ""},
+		{"table reopened", "[presets.a]\nrgbq = 1\n[presets.b]\nrgbq = 2", `{"presets":{"a":{"rgbq":1},"b":{"rgbq":2}}}`, ""},
+		{"multi-line string", "name = \"\"\"\n{1} \\\n  {index}\"\"\"", `{"name":"{1} {index}"}`, ""},
+		{"multi-line literal string", "name = '''\n{1}\\{2}'''", `{"name":"{1}\\{2}"}`, ""},
+		{"multi-line array", "output = [\n  \"a\", # first\n  \"b\",\n]", `{"output":["a","b"]}`, ""},
+		{"inline table", `metadata = { title = "T", author = "A" }`, `{"metadata":{"author":"A","title":"T"}}`, ""},
+		{"dotted key", "presets.scan.rgbdpi = 200", `{"presets":{"scan":{"rgbdpi":200}}}`, ""},
+		{"array of tables", "[[presets]]", `{"presets":[{}]}`, ""},
+		{"unclosed table", "[presets", "", "line 1:"},
+		{"empty table name", "[presets.]", "", "line 1:"},
+		{"key as table", "rgbq = 1\n[rgbq.x]", "", "line 2:"},
+		{"no value", "ccitt", "", "line 1:"},
+		{"repeated key", "rgbq = 1\nrgbq = 2", "", `line 2 (last key "rgbq")`},
+		{"bare word", "ccitt = auto", "", `line 1 (last key "ccitt")`},
+		{"unterminated string", `ccitt = "auto`, "", "line 1"},
+		{"string spanning lines", "ccitt = \"au\nto\"", "", "line 1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tomlToJSON([]byte(tt.toml))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("tomlToJSON(%q) = %s, %v, want an error with %q", tt.toml, got, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("tomlToJSON(%q) error: %v", tt.toml, err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("tomlToJSON(%q) = %s, want %s", tt.toml, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStringList(t *testing.T) {
+	tests := []struct {
+		json string
+		want stringList
+		err  bool
+	}{
+		{`"code39, patch2"`, stringList{"code39", "patch2"}, false},
+		{`"code39,,  ,patcht"`, stringList{"code39", "patcht"}, false},
+		{`""`, stringList{}, false},
+		{`["despeckle", "fill"]`, stringList{"despeckle", "fill"}, false},
+		{`[]`, stringList{}, false},
+		{`3`, nil, true},
+		{`[1, 2]`, nil, true},
+	}
+	for _, tt := range tests {
+		var got stringList
+		err := json.Unmarshal([]byte(tt.json), &got)
+		if (err != nil) != tt.err {
+			t.Errorf("stringList from %s: error %v, want error %v", tt.json, err, tt.err)
+			continue
+		}
+		if !tt.err && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("stringList from %s = %q, want %q", tt.json, got, tt.want)
+		}
+	}
+}
+
+func TestMargins(t *testing.T) {
+	tests := []struct {
+		json string
+		want margins
+		err  string
+	}{
+		{`5`, margins{5}, ""},
+		{`2.5`, margins{2.5}, ""},
+		{`"1, 2,3,4"`, margins{1, 2, 3, 4}, ""},
+		{`"7"`, margins{7}, ""},
+		{`[1, 2, 3, 4]`, margins{1, 2, 3, 4}, ""},
+		{`"1,x"`, nil, `invalid margin "x"`},
+		{`"1,,2"`, nil, `invalid margin ""`},
+		{`true`, nil, "expected a number"},
+		{`["1"]`, nil, "expected a number"},
+	}
+	for _, tt := range tests {
+		var got margins
+		err := json.Unmarshal([]byte(tt.json), &got)
+		switch {
+		case tt.err != "":
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("margins from %s: error %v, want an error with %q", tt.json, err, tt.err)
+			}
+		case err != nil:
+			t.Errorf("margins from %s: error %v", tt.json, err)
+		case !reflect.DeepEqual(got, tt.want):
+			t.Errorf("margins from %s = %v, want %v", tt.json, got, tt.want)
+		}
+	}
+}
+
+func TestApplyListsAndMargins(t *testing.T) {
+	tests := []struct {
+		json       string
+		crop       [4]float64
+		separators []string
+		err        string
+	}{
+		{`{"cropmm": 3}`, [4]float64{3, 3, 3, 3}, nil, ""},
+		{`{"cropmm": "1,2,3,4"}`, [4]float64{1, 2, 3, 4}, nil, ""},
+		{`{"cropmm": [1, 2]}`, [4]float64{}, nil, "cropmm: expected one value or four values"},
+		{`{"separator": "Code39, PATCHT"}`, [4]float64{}, []string{"code39", "patcht"}, ""},
+		{`{"separator": ["off"]}`, [4]float64{}, nil, ""},
+	}
+	for _, tt := range tests {
+		s, err := ParseSettings([]byte(tt.json))
+		if err != nil {
+			t.Fatalf("ParseSettings(%s): %v", tt.json, err)
+		}
+		flags, err := s.Apply(InputFlags{Separators: []string{"patch2"}})
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Apply(%s): error %v, want an error with %q", tt.json, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Apply(%s): %v", tt.json, err)
+			continue
+		}
+		if flags.FixedCropMM != tt.crop {
+			t.Errorf("Apply(%s): cropmm %v, want %v", tt.json, flags.FixedCropMM, tt.crop)
+		}
+		if s.Separators != nil && !reflect.DeepEqual(flags.Separators, tt.separators) {
+			t.Errorf("Apply(%s): separators %q, want %q", tt.json, flags.Separators, tt.separators)
+		}
+	}
+}
+
+func TestReadConfigTOMLMatchesJSON(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"run.toml": `# scans of the archive
+output = ["pdf", "/srv/pdf"]
+cropmm = "2,2,2,2"
+binpost = "despeckle, fill"
+name = "{1} #{index}"
+
+[metadata]
+author = "Records office"
+
+[presets.maps]
+rgbdpi = 200
+resamplepolicy = "downonly"
+`,
+		"run.json": `{
+	"output": ["pdf", "/srv/pdf"],
+	"cropmm": [2, 2, 2, 2],
+	"binpost": ["despeckle", "fill"],
+	"name": "{1} #{index}",
+	"metadata": {"author": "Records office"},
+	"presets": {"maps": {"rgbdpi": 200, "resamplepolicy": "downonly"}}
+}`,
+	}
+	configs := make(map[string]*Config)
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := ReadConfig(path)
+		if err != nil {
+			t.Fatalf("ReadConfig(%s): %v", name, err)
+		}
+		configs[name] = cfg
+	}
+	if !reflect.DeepEqual(configs["run.toml"], configs["run.json"]) {
+		t.Errorf("TOML and JSON configs differ:\n%+v\n%+v", configs["run.toml"], configs["run.json"])
+	}
+	if got, want := configs["run.toml"].Output, []string{filepath.Join(dir, "pdf"), "/srv/pdf"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("output %q, want %q relative to the config file", got, want)
+	}
+}
+
+func TestReadConfigArrayOfTables(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run.toml")
+	if err := os.WriteFile(path, []byte("[[presets]]\nrgbdpi = 300\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadConfig(path); err == nil || !strings.Contains(err.Error(), "run.toml") {
+		t.Errorf("ReadConfig with an array of presets: error %v, want an error naming the file", err)
+	}
+}
+
+func TestReadConfigUnknownKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run.toml")
+	if err := os.WriteFile(path, []byte("rgbdpi = 300\nrgb_dpi = 300\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadConfig(path); err == nil || !strings.Contains(err.Error(), "rgb_dpi") {
+		t.Errorf("ReadConfig with an unknown key: error %v, want it to name rgb_dpi", err)
+	}
+}
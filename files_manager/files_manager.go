@@ -1,8 +1,11 @@
 package files_manager
 
 import (
+	"bufio"
+	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"tiff2pdf/contracts"
 )
@@ -11,6 +14,10 @@ type TIFFfolder = contracts.TIFFfolder
 type ConvertedFolder = contracts.ConvertedFolder
 type BoxFolder = contracts.BoxFolder
 
+// RotationListName is the optional per-folder list of pages to rotate:
+// one "<file name> <90|180|270>" entry per line, '#' starts a comment
+const RotationListName = "rotate.txt"
+
 // func CheckProvidedDirs(inputRootDir string, outputDir string) error {
 // 	if inputRootDir == "" || outputDir == "" {
 // 		return fmt.Errorf("input and output directories required")
@@ -63,7 +70,8 @@ func GetTIFFPaths(dir string) ([]string, int64, error) {
 			continue
 		}
 		ext := strings.ToLower(filepath.Ext(entry.Name()))
-		if ext == ".tiff" || ext == ".tif" {
+		// .btf and .tf8 are used for BigTIFF
+		if ext == ".tiff" || ext == ".tif" || ext == ".btf" || ext == ".tf8" {
 			tiffFiles = append(tiffFiles, filepath.Join(dir, entry.Name()))
 			info, _ := entry.Info()
 			size += info.Size()
@@ -72,7 +80,74 @@ func GetTIFFPaths(dir string) ([]string, int64, error) {
 	return tiffFiles, size, nil
 }
 
-func GetTIFFFolders(rootFolder string) ([]TIFFfolder, error) {
+// ReadRotationList reads the rotation list of a folder, nil if there is none.
+// Entries are keyed by their path relative to the folder, with slashes.
+func ReadRotationList(dir string) (map[string]int, error) {
+	f, err := os.Open(filepath.Join(dir, RotationListName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	rotations := make(map[string]int)
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s line %d: expected file name and angle", RotationListName, lineNum)
+		}
+		angle, err := strconv.Atoi(fields[1])
+		if err != nil || (angle != 0 && angle != 90 && angle != 180 && angle != 270) {
+			return nil, fmt.Errorf("%s line %d: angle must be 0, 90, 180 or 270", RotationListName, lineNum)
+		}
+		rotations[filepath.ToSlash(filepath.Clean(fields[0]))] = angle
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rotations, nil
+}
+
+// GetTIFFFolder reads the TIFF files of dir with the rotation list and the
+// folder config of dir
+func GetTIFFFolder(dir string, flags InputFlags, overrides *Settings) (TIFFfolder, error) {
+	tiffFiles, size, err := GetTIFFPaths(dir)
+	if err != nil {
+		return TIFFfolder{}, err
+	}
+	folder := TIFFfolder{
+		TiffFilesPaths: tiffFiles,
+		Name:           filepath.Base(dir),
+		Path:           dir,
+		TiffFilesSize:  size,
+	}
+	if len(tiffFiles) == 0 {
+		return folder, nil
+	}
+	if folder.Rotations, err = ReadRotationList(dir); err != nil {
+		return TIFFfolder{}, err
+	}
+	if folder.Flags, folder.ConfigPath, err = ReadFolderConfig(dir, flags, overrides); err != nil {
+		return TIFFfolder{}, err
+	}
+	return folder, nil
+}
+
+// GetTIFFFolders lists the folders with TIFF files under rootFolder, with
+// their folder config applied to the run flags and overrides over it
+func GetTIFFFolders(rootFolder string, flags InputFlags, overrides *Settings) ([]TIFFfolder, error) {
 
 	subDirs, _ := os.ReadDir(rootFolder)
 
@@ -86,17 +161,14 @@ func GetTIFFFolders(rootFolder string) ([]TIFFfolder, error) {
 		if !entry.IsDir() {
 			continue
 		}
-		subDirPath := filepath.Join(rootFolder, entry.Name())
-		tiffFiles, size, _ := GetTIFFPaths(subDirPath)
-		if len(tiffFiles) == 0 {
+		folder, err := GetTIFFFolder(filepath.Join(rootFolder, entry.Name()), flags, overrides)
+		if err != nil {
+			return nil, fmt.Errorf("folder %s: %v", entry.Name(), err)
+		}
+		if len(folder.TiffFilesPaths) == 0 {
 			continue
 		}
-		tiffFolders = append(tiffFolders, TIFFfolder{
-			TiffFilesPaths: tiffFiles,
-			Name:           entry.Name(),
-			Path:           subDirPath,
-			TiffFilesSize:  size,
-		})
+		tiffFolders = append(tiffFolders, folder)
 	}
 	return tiffFolders, nil
 }
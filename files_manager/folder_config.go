@@ -0,0 +1,43 @@
+package files_manager
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// FolderConfigNames are the optional per-folder config files, the first one
+// found is used. Keys are the command line flag names.
+var FolderConfigNames = []string{"tiff2pdf.json", "tiff2pdf.toml"}
+
+// ReadFolderConfig reads the config file of a folder and applies it to the
+// run flags, then applies overrides (the flags given on the command line)
+// again. It returns nil flags and an empty path if there is none.
+func ReadFolderConfig(dir string, flags InputFlags, overrides *Settings) (*InputFlags, string, error) {
+	for _, name := range FolderConfigNames {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, "", err
+		}
+		var cfg Settings
+		if err := decodeSettingsFile(path, &cfg); err != nil {
+			return nil, "", err
+		}
+		if cfg.Input != nil || cfg.Output != nil || cfg.Type != nil || cfg.TIFFMode != nil || cfg.Report != nil || cfg.Backup != nil {
+			return nil, "", fmt.Errorf("%s: input, output, type, tiffmode, report and backup are run settings", name)
+		}
+		cfg.resolvePaths(dir)
+		folderFlags, err := cfg.Apply(flags)
+		if err == nil && overrides != nil {
+			folderFlags, err = overrides.Apply(folderFlags)
+		}
+		if err != nil {
+			return nil, "", fmt.Errorf("%s: %v", name, err)
+		}
+		return &folderFlags, path, nil
+	}
+	return nil, "", nil
+}
@@ -1,3 +1,5 @@
 module tiff2pdf
 
 go 1.24
+
+require github.com/BurntSushi/toml v1.6.0
@@ -2,9 +2,12 @@ package pdf_writer
 
 import (
 	"bufio"
+	"crypto/sha256"
 	"fmt"
 	"io"
+	"strings"
 	"tiff2pdf/contracts"
+	"unicode/utf16"
 )
 
 // type PDFWriter = contracts.PDFWriter
@@ -21,12 +24,20 @@ type PDFWriter struct {
 	pagesObjID   int64
 	pageIDs      []int64
 	catalogObjID int64
+	infoObjID    int64 // document information dictionary, 0 if there is no metadata
+
+	metadata contracts.PDFMetadata
+
+	iccIDs map[[32]byte]int64 // ICCBased streams by profile hash, shared by the pages
 }
 
 type ImageInfo struct {
 	id     int64
+	fgID   int64 // MRC foreground painted over the image, 0 if none
 	width  float64
 	height float64
+	rotate int  // page /Rotate
+	mirror bool // draw the image mirrored left-right
 }
 
 type countingWriter struct {
@@ -39,8 +50,9 @@ func NewPDFWriter(dst io.Writer) (*PDFWriter, error) {
 		w: dst,
 	}
 	pw := &PDFWriter{
-		cw: cw,
-		bw: bufio.NewWriterSize(cw, 8*1024*1024), // 8MB buffer
+		cw:     cw,
+		bw:     bufio.NewWriterSize(cw, 8*1024*1024), // 8MB buffer
+		iccIDs: make(map[[32]byte]int64),
 	}
 
 	if _, err := pw.bw.WriteString("%PDF-1.7\n%\xFF\xFF\xFF\xFF\n"); err != nil {
@@ -68,24 +80,110 @@ func (pw *PDFWriter) newObject() int64 {
 	return int64(pw.objNum)
 }
 
+// SetMetadata sets the document information written by Finish
+func (pw *PDFWriter) SetMetadata(metadata contracts.PDFMetadata) {
+	pw.metadata = metadata
+}
+
+// textString encodes a PDF text string, UTF-16BE with a byte order mark
+// unless the text is printable ASCII
+func textString(text string) string {
+	ascii := true
+	for _, r := range text {
+		if r < 0x20 || r > 0x7E {
+			ascii = false
+			break
+		}
+	}
+	if ascii {
+		return "(" + strings.NewReplacer(`\`, `\\`, "(", `\(`, ")", `\)`).Replace(text) + ")"
+	}
+	var b strings.Builder
+	b.WriteString("<FEFF")
+	for _, u := range utf16.Encode([]rune(text)) {
+		fmt.Fprintf(&b, "%04X", u)
+	}
+	b.WriteString(">")
+	return b.String()
+}
+
+func (pw *PDFWriter) writeInfo() {
+	entries := []struct{ key, value string }{
+		{"Title", pw.metadata.Title},
+		{"Author", pw.metadata.Author},
+		{"Subject", pw.metadata.Subject},
+		{"Keywords", pw.metadata.Keywords},
+	}
+	var dict strings.Builder
+	for _, entry := range entries {
+		if entry.value != "" {
+			fmt.Fprintf(&dict, "/%s %s\n", entry.key, textString(entry.value))
+		}
+	}
+	if dict.Len() == 0 {
+		return
+	}
+	pw.infoObjID = pw.newObject()
+	pw.bw.WriteString("<<\n")
+	pw.bw.WriteString(dict.String())
+	pw.bw.WriteString(">>\nendobj\n")
+}
+
 func (pw *PDFWriter) WriteImage(image *ConvertResult) error {
-	if image.CCITT {
-		if err := pw.writeCCITTImage(image.PixelWidth, image.PixelHeight, image.ImgBuffer); err != nil {
+	var smaskID int64
+	if image.SMask != nil {
+		smaskID = pw.writeSMask(image.PixelWidth, image.PixelHeight, image.SMask)
+	}
+	device := "/DeviceRGB"
+	switch {
+	case image.CMYK:
+		device = "/DeviceCMYK"
+	case image.Gray:
+		device = "/DeviceGray"
+	}
+	colorSpace := pw.colorSpace(image.ICCProfile, device)
+
+	if image.MRC != nil {
+		if err := pw.writeMRCImage(image, colorSpace); err != nil {
+			return fmt.Errorf("error writing MRC image: %v", err)
+		}
+	} else if image.ImgFormat == "JBIG2" {
+		if err := pw.writeJBIG2Image(image.PixelWidth, image.PixelHeight, image.ImgBuffer); err != nil {
+			return fmt.Errorf("error writing JBIG2 image: %v", err)
+		}
+	} else if image.CCITT {
+		if err := pw.writeCCITTImage(image.PixelWidth, image.PixelHeight, image.CCITTParams, image.ImgBuffer); err != nil {
 			return fmt.Errorf("error writing CCITT image: %v", err)
 		}
+	} else if image.ImgFormat == "PNG" {
+		if err := pw.writeFlateImage(image, colorSpace, smaskID); err != nil {
+			return fmt.Errorf("error writing Flate image: %v", err)
+		}
+	} else if image.ImgFormat == "JPX" {
+		if err := pw.writeJPXImage(image.PixelWidth, image.PixelHeight, colorSpace, image.ImgBuffer, smaskID); err != nil {
+			return fmt.Errorf("error writing JPEG 2000 image: %v", err)
+		}
+	} else if image.CMYK {
+		if err := pw.writeCMYKJPEGImage(image.PixelWidth, image.PixelHeight, colorSpace, image.ImgBuffer); err != nil {
+			return fmt.Errorf("error writing CMYK JPEG image: %v", err)
+		}
 	} else if image.Gray {
-		if err := pw.writeGrayJPEGImage(image.PixelWidth, image.PixelHeight, image.ImgBuffer); err != nil {
+		if err := pw.writeGrayJPEGImage(image.PixelWidth, image.PixelHeight, colorSpace, image.ImgBuffer, smaskID); err != nil {
 			return fmt.Errorf("error writing grayscale JPEG image: %v", err)
 		}
 	} else {
-		if err := pw.writeRGBJPEGImage(image.PixelWidth, image.PixelHeight, image.ImgBuffer); err != nil {
+		if err := pw.writeRGBJPEGImage(image.PixelWidth, image.PixelHeight, colorSpace, image.ImgBuffer, smaskID); err != nil {
 			return fmt.Errorf("error writing RGB JPEG image: %v", err)
 		}
 	}
+	// passed through data keeps its stored order, the page turns it upright
+	info := &pw.imageInfos[len(pw.imageInfos)-1]
+	info.rotate = image.Rotate
+	info.mirror = image.Mirror
 	return nil
 }
 
-func (pw *PDFWriter) writeCCITTImage(width int, height int, data []byte) error {
+func (pw *PDFWriter) writeCCITTImage(width int, height int, params *contracts.CCITTParams, data []byte) error {
 	imgID := pw.newObject()
 	pw.imageInfos = append(pw.imageInfos, ImageInfo{
 		id:     imgID,
@@ -103,7 +201,19 @@ func (pw *PDFWriter) writeCCITTImage(width int, height int, data []byte) error {
 
 	// open dictionary DecodeParms
 	pw.bw.WriteString("/DecodeParms <<\n")
-	pw.bw.WriteString(fmt.Sprintf("/K -1\n/Columns %d\n/Rows %d\n/BlackIs1 false\n", width, height))
+	k := -1
+	blackIs1 := false
+	if params != nil {
+		k = params.K
+		blackIs1 = params.BlackIs1
+	}
+	pw.bw.WriteString(fmt.Sprintf("/K %d\n/Columns %d\n/Rows %d\n/BlackIs1 %t\n", k, width, height, blackIs1))
+	if params != nil && params.EncodedByteAlign {
+		pw.bw.WriteString("/EncodedByteAlign true\n")
+	}
+	if params != nil && params.EndOfLine {
+		pw.bw.WriteString("/EndOfLine true\n")
+	}
 	pw.bw.WriteString(">>\n") // <-- close only DecodeParms dictionary
 
 	// Line /Length should be in the main dictionary
@@ -117,7 +227,7 @@ func (pw *PDFWriter) writeCCITTImage(width int, height int, data []byte) error {
 	return nil
 }
 
-func (pw *PDFWriter) writeRGBJPEGImage(width int, height int, data []byte) error {
+func (pw *PDFWriter) writeJBIG2Image(width int, height int, data []byte) error {
 	imgID := pw.newObject()
 	pw.imageInfos = append(pw.imageInfos, ImageInfo{
 		id:     imgID,
@@ -126,7 +236,70 @@ func (pw *PDFWriter) writeRGBJPEGImage(width int, height int, data []byte) error
 	})
 	pw.bw.WriteString("<<\n/Type /XObject\n/Subtype /Image\n")
 	pw.bw.WriteString(fmt.Sprintf("/Width %d\n/Height %d\n", width, height))
-	pw.bw.WriteString("/ColorSpace /DeviceRGB\n/BitsPerComponent 8\n")
+	pw.bw.WriteString("/ColorSpace /DeviceGray\n/BitsPerComponent 1\n")
+	pw.bw.WriteString("/Filter /JBIG2Decode\n")
+
+	pw.bw.WriteString(fmt.Sprintf("/Length %d\n", len(data)))
+	pw.bw.WriteString(">>\nstream\n")
+	pw.bw.Write(data)
+	pw.bw.WriteString("\nendstream\nendobj\n")
+	return nil
+}
+
+// colorSpace returns the image color space: the ICCBased stream of the
+// profile, written on first use, or the device space without a profile
+func (pw *PDFWriter) colorSpace(profile []byte, device string) string {
+	if len(profile) == 0 {
+		return device
+	}
+	key := sha256.Sum256(profile)
+	if id, ok := pw.iccIDs[key]; ok {
+		return fmt.Sprintf("[/ICCBased %d 0 R]", id)
+	}
+	components := map[string]int{"/DeviceGray": 1, "/DeviceRGB": 3, "/DeviceCMYK": 4}[device]
+
+	id := pw.newObject()
+	pw.bw.WriteString(fmt.Sprintf("<<\n/N %d\n/Alternate %s\n", components, device))
+	pw.bw.WriteString(fmt.Sprintf("/Length %d\n", len(profile)))
+	pw.bw.WriteString(">>\nstream\n")
+	pw.bw.Write(profile)
+	pw.bw.WriteString("\nendstream\nendobj\n")
+	pw.iccIDs[key] = id
+	return fmt.Sprintf("[/ICCBased %d 0 R]", id)
+}
+
+// writeSMask writes an alpha plane as the soft mask of the image that follows
+func (pw *PDFWriter) writeSMask(width int, height int, data []byte) int64 {
+	objID := pw.newObject()
+	pw.bw.WriteString("<<\n/Type /XObject\n/Subtype /Image\n")
+	pw.bw.WriteString(fmt.Sprintf("/Width %d\n/Height %d\n", width, height))
+	pw.bw.WriteString("/ColorSpace /DeviceGray\n/BitsPerComponent 8\n")
+	pw.bw.WriteString("/Filter /FlateDecode\n")
+	pw.bw.WriteString(fmt.Sprintf("/DecodeParms << /Predictor 15 /Colors 1 /BitsPerComponent 8 /Columns %d >>\n", width))
+	pw.bw.WriteString(fmt.Sprintf("/Length %d\n", len(data)))
+	pw.bw.WriteString(">>\nstream\n")
+	pw.bw.Write(data)
+	pw.bw.WriteString("\nendstream\nendobj\n")
+	return objID
+}
+
+func (pw *PDFWriter) writeSMaskRef(smaskID int64) {
+	if smaskID != 0 {
+		pw.bw.WriteString(fmt.Sprintf("/SMask %d 0 R\n", smaskID))
+	}
+}
+
+func (pw *PDFWriter) writeRGBJPEGImage(width int, height int, colorSpace string, data []byte, smaskID int64) error {
+	imgID := pw.newObject()
+	pw.imageInfos = append(pw.imageInfos, ImageInfo{
+		id:     imgID,
+		width:  float64(width),
+		height: float64(height),
+	})
+	pw.bw.WriteString("<<\n/Type /XObject\n/Subtype /Image\n")
+	pw.bw.WriteString(fmt.Sprintf("/Width %d\n/Height %d\n", width, height))
+	pw.bw.WriteString(fmt.Sprintf("/ColorSpace %s\n/BitsPerComponent 8\n", colorSpace))
+	pw.writeSMaskRef(smaskID)
 	pw.bw.WriteString("/Filter /DCTDecode\n")
 
 	pw.bw.WriteString(fmt.Sprintf("/Length %d\n", len(data)))
@@ -136,7 +309,8 @@ func (pw *PDFWriter) writeRGBJPEGImage(width int, height int, data []byte) error
 	return nil
 }
 
-func (pw *PDFWriter) writeGrayJPEGImage(width int, height int, data []byte) error {
+// writeCMYKJPEGImage writes a JPEG with an Adobe marker, its samples are inverted
+func (pw *PDFWriter) writeCMYKJPEGImage(width int, height int, colorSpace string, data []byte) error {
 	imgID := pw.newObject()
 	pw.imageInfos = append(pw.imageInfos, ImageInfo{
 		id:     imgID,
@@ -145,7 +319,28 @@ func (pw *PDFWriter) writeGrayJPEGImage(width int, height int, data []byte) erro
 	})
 	pw.bw.WriteString("<<\n/Type /XObject\n/Subtype /Image\n")
 	pw.bw.WriteString(fmt.Sprintf("/Width %d\n/Height %d\n", width, height))
-	pw.bw.WriteString("/ColorSpace /DeviceGray\n/BitsPerComponent 8\n")
+	pw.bw.WriteString(fmt.Sprintf("/ColorSpace %s\n/BitsPerComponent 8\n", colorSpace))
+	pw.bw.WriteString("/Decode [1 0 1 0 1 0 1 0]\n")
+	pw.bw.WriteString("/Filter /DCTDecode\n")
+
+	pw.bw.WriteString(fmt.Sprintf("/Length %d\n", len(data)))
+	pw.bw.WriteString(">>\nstream\n")
+	pw.bw.Write(data)
+	pw.bw.WriteString("\nendstream\nendobj\n")
+	return nil
+}
+
+func (pw *PDFWriter) writeGrayJPEGImage(width int, height int, colorSpace string, data []byte, smaskID int64) error {
+	imgID := pw.newObject()
+	pw.imageInfos = append(pw.imageInfos, ImageInfo{
+		id:     imgID,
+		width:  float64(width),
+		height: float64(height),
+	})
+	pw.bw.WriteString("<<\n/Type /XObject\n/Subtype /Image\n")
+	pw.bw.WriteString(fmt.Sprintf("/Width %d\n/Height %d\n", width, height))
+	pw.bw.WriteString(fmt.Sprintf("/ColorSpace %s\n/BitsPerComponent 8\n", colorSpace))
+	pw.writeSMaskRef(smaskID)
 	pw.bw.WriteString("/Filter /DCTDecode\n")
 
 	pw.bw.WriteString(fmt.Sprintf("/Length %d\n", len(data)))
@@ -155,11 +350,134 @@ func (pw *PDFWriter) writeGrayJPEGImage(width int, height int, data []byte) erro
 	return nil
 }
 
-func (pw *PDFWriter) writeContent(imgName string, imgObjID int64, width, height float64) int64 {
+func (pw *PDFWriter) writeFlateImage(image *ConvertResult, colorSpace string, smaskID int64) error {
+	imgID := pw.newObject()
+	pw.imageInfos = append(pw.imageInfos, ImageInfo{
+		id:     imgID,
+		width:  float64(image.PixelWidth),
+		height: float64(image.PixelHeight),
+	})
+
+	components := 3
+	if image.Gray {
+		components = 1
+	}
+	bpc := image.BitsPerComponent
+	if bpc == 0 {
+		bpc = 8
+	}
+
+	pw.bw.WriteString("<<\n/Type /XObject\n/Subtype /Image\n")
+	pw.bw.WriteString(fmt.Sprintf("/Width %d\n/Height %d\n", image.PixelWidth, image.PixelHeight))
+	colors := components
+	if len(image.Palette) > 0 {
+		// indexed image: one palette index per sample
+		colors = 1
+		pw.bw.WriteString(fmt.Sprintf("/ColorSpace [/Indexed %s %d <%X>]\n",
+			colorSpace, len(image.Palette)/components-1, image.Palette))
+	} else {
+		pw.bw.WriteString(fmt.Sprintf("/ColorSpace %s\n", colorSpace))
+	}
+	pw.bw.WriteString(fmt.Sprintf("/BitsPerComponent %d\n", bpc))
+	pw.writeSMaskRef(smaskID)
+	pw.bw.WriteString("/Filter /FlateDecode\n")
+	pw.bw.WriteString(fmt.Sprintf("/DecodeParms << /Predictor 15 /Colors %d /BitsPerComponent %d /Columns %d >>\n",
+		colors, bpc, image.PixelWidth))
+
+	pw.bw.WriteString(fmt.Sprintf("/Length %d\n", len(image.ImgBuffer)))
+	pw.bw.WriteString(">>\nstream\n")
+	pw.bw.Write(image.ImgBuffer)
+	pw.bw.WriteString("\nendstream\nendobj\n")
+	return nil
+}
+
+func (pw *PDFWriter) writeJPXImage(width int, height int, colorSpace string, data []byte, smaskID int64) error {
+	imgID := pw.newObject()
+	pw.imageInfos = append(pw.imageInfos, ImageInfo{
+		id:     imgID,
+		width:  float64(width),
+		height: float64(height),
+	})
+	pw.bw.WriteString("<<\n/Type /XObject\n/Subtype /Image\n")
+	pw.bw.WriteString(fmt.Sprintf("/Width %d\n/Height %d\n", width, height))
+	pw.bw.WriteString(fmt.Sprintf("/ColorSpace %s\n/BitsPerComponent 8\n", colorSpace))
+	pw.writeSMaskRef(smaskID)
+	pw.bw.WriteString("/Filter /JPXDecode\n")
+
+	pw.bw.WriteString(fmt.Sprintf("/Length %d\n", len(data)))
+	pw.bw.WriteString(">>\nstream\n")
+	pw.bw.Write(data)
+	pw.bw.WriteString("\nendstream\nendobj\n")
+	return nil
+}
+
+// writeMRCImage writes the background, the stencil text mask and the
+// foreground masked by it; the page paints the foreground over the background.
+func (pw *PDFWriter) writeMRCImage(image *ConvertResult, colorSpace string) error {
+	layers := image.MRC
+
+	bgID := pw.newObject()
+	pw.bw.WriteString("<<\n/Type /XObject\n/Subtype /Image\n")
+	pw.bw.WriteString(fmt.Sprintf("/Width %d\n/Height %d\n", layers.BgWidth, layers.BgHeight))
+	pw.bw.WriteString(fmt.Sprintf("/ColorSpace %s\n/BitsPerComponent 8\n", colorSpace))
+	pw.bw.WriteString("/Filter /DCTDecode\n")
+	pw.bw.WriteString(fmt.Sprintf("/Length %d\n", len(image.ImgBuffer)))
+	pw.bw.WriteString(">>\nstream\n")
+	pw.bw.Write(image.ImgBuffer)
+	pw.bw.WriteString("\nendstream\nendobj\n")
+
+	// decoded mask samples are 0 for text, which is the painted value of a stencil
+	maskID := pw.newObject()
+	pw.bw.WriteString("<<\n/Type /XObject\n/Subtype /Image\n")
+	pw.bw.WriteString(fmt.Sprintf("/Width %d\n/Height %d\n", image.PixelWidth, image.PixelHeight))
+	pw.bw.WriteString("/ImageMask true\n/BitsPerComponent 1\n")
+	if layers.MaskFormat == "JBIG2" {
+		pw.bw.WriteString("/Filter /JBIG2Decode\n")
+	} else {
+		pw.bw.WriteString("/Filter /CCITTFaxDecode\n")
+		pw.bw.WriteString(fmt.Sprintf("/DecodeParms << /K -1 /Columns %d /Rows %d /BlackIs1 false >>\n",
+			image.PixelWidth, image.PixelHeight))
+	}
+	pw.bw.WriteString(fmt.Sprintf("/Length %d\n", len(layers.Mask)))
+	pw.bw.WriteString(">>\nstream\n")
+	pw.bw.Write(layers.Mask)
+	pw.bw.WriteString("\nendstream\nendobj\n")
+
+	fgID := pw.newObject()
+	pw.bw.WriteString("<<\n/Type /XObject\n/Subtype /Image\n")
+	pw.bw.WriteString(fmt.Sprintf("/Width %d\n/Height %d\n", layers.FgWidth, layers.FgHeight))
+	pw.bw.WriteString(fmt.Sprintf("/ColorSpace %s\n/BitsPerComponent 8\n", colorSpace))
+	pw.bw.WriteString(fmt.Sprintf("/Mask %d 0 R\n", maskID))
+	pw.bw.WriteString("/Filter /DCTDecode\n")
+	pw.bw.WriteString(fmt.Sprintf("/Length %d\n", len(layers.Foreground)))
+	pw.bw.WriteString(">>\nstream\n")
+	pw.bw.Write(layers.Foreground)
+	pw.bw.WriteString("\nendstream\nendobj\n")
+
+	pw.imageInfos = append(pw.imageInfos, ImageInfo{
+		id:     bgID,
+		fgID:   fgID,
+		width:  float64(image.PixelWidth),
+		height: float64(image.PixelHeight),
+	})
+	return nil
+}
+
+func (pw *PDFWriter) writeContent(imgName string, imgObjID int64, fgObjID int64, width, height float64, mirror bool) int64 {
+	matrix := fmt.Sprintf("%.2f 0 0 %.2f 0 0 cm", width, height)
+	if mirror {
+		matrix = fmt.Sprintf("%.2f 0 0 %.2f %.2f 0 cm", -width, height, width)
+	}
 	content := fmt.Sprintf(
-		"q\n%.2f 0 0 %.2f 0 0 cm\n/%s Do\nQ\n",
-		width, height, imgName,
+		"q\n%s\n/%s Do\nQ\n",
+		matrix, imgName,
 	)
+	if fgObjID != 0 {
+		content += fmt.Sprintf(
+			"q\n%s\n/%s_fg Do\nQ\n",
+			matrix, imgName,
+		)
+	}
 	objID := pw.newObject()
 	pw.bw.WriteString("<<\n")
 	contentBytes := []byte(content)
@@ -173,15 +491,25 @@ func (pw *PDFWriter) writeContent(imgName string, imgObjID int64, width, height
 
 func (pw *PDFWriter) writePage(imgName string,
 	imgObjID int64,
+	fgObjID int64,
 	contentID int64,
-	width, height float64) int64 {
+	width, height float64,
+	rotate int) int64 {
 	objID := pw.newObject()
 	pw.bw.WriteString("<<\n")
 	pw.bw.WriteString("/Type /Page\n")
 	pw.bw.WriteString(fmt.Sprintf("/Parent %d 0 R\n", pw.pagesObjID))
 	pw.bw.WriteString(fmt.Sprintf("/MediaBox [0 0 %.2f %.2f]\n", width, height))
+	if rotate != 0 {
+		pw.bw.WriteString(fmt.Sprintf("/Rotate %d\n", rotate))
+	}
 	//
-	pw.bw.WriteString(fmt.Sprintf("/Resources << /XObject << /%s %d 0 R >> >>\n", imgName, imgObjID))
+	if fgObjID != 0 {
+		pw.bw.WriteString(fmt.Sprintf("/Resources << /XObject << /%s %d 0 R /%s_fg %d 0 R >> >>\n",
+			imgName, imgObjID, imgName, fgObjID))
+	} else {
+		pw.bw.WriteString(fmt.Sprintf("/Resources << /XObject << /%s %d 0 R >> >>\n", imgName, imgObjID))
+	}
 
 	pw.bw.WriteString(fmt.Sprintf("/Contents %d 0 R\n", contentID))
 	pw.bw.WriteString(">>\nendobj\n")
@@ -229,10 +557,10 @@ func (pw *PDFWriter) createDocumentStructure() error {
 		imgName := fmt.Sprintf("img_%d", i)
 
 		// first Content
-		contentID := pw.writeContent(imgName, imgID, info.width, info.height)
+		contentID := pw.writeContent(imgName, imgID, info.fgID, info.width, info.height, info.mirror)
 
 		// second - Page
-		pageID := pw.writePage(imgName, imgID, contentID, info.width, info.height)
+		pageID := pw.writePage(imgName, imgID, info.fgID, contentID, info.width, info.height, info.rotate)
 		pw.pageIDs = append(pw.pageIDs, pageID)
 	}
 
@@ -256,6 +584,8 @@ func (pw *PDFWriter) createDocumentStructure() error {
 	pw.bw.WriteString(fmt.Sprintf("/Type /Catalog\n/Pages %d 0 R\n", pw.pagesObjID))
 	pw.bw.WriteString(">>\nendobj\n")
 
+	pw.writeInfo()
+
 	// buffer flush
 	if err := pw.bw.Flush(); err != nil {
 		return fmt.Errorf("error flushing buffer after creating structure: %v", err)
@@ -285,9 +615,13 @@ func (pw *PDFWriter) Finish() error {
 		}
 	}
 
+	info := ""
+	if pw.infoObjID != 0 {
+		info = fmt.Sprintf(" /Info %d 0 R", pw.infoObjID)
+	}
 	if _, err := fmt.Fprintf(pw.cw.w,
-		"trailer\n<< /Size %d /Root %d 0 R >>\nstartxref\n%d\n%%%%EOF",
-		total, pw.catalogObjID, startXref,
+		"trailer\n<< /Size %d /Root %d 0 R%s >>\nstartxref\n%d\n%%%%EOF",
+		total, pw.catalogObjID, info, startXref,
 	); err != nil {
 		return fmt.Errorf("error writing trailer and startxref: %v", err)
 	}